@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/mrmushfiq/plinth/internal/datanode"
 	"google.golang.org/grpc"
 )
 
@@ -25,8 +26,11 @@ func main() {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
-	// TODO: Initialize storage service
-	// TODO: Register gRPC services
+	// Initialize storage service
+	store, err := datanode.NewStore(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
 
 	// Setup gRPC server
 	lis, err := net.Listen("tcp", ":"+grpcPort)
@@ -36,8 +40,8 @@ func main() {
 
 	grpcServer := grpc.NewServer()
 
-	// TODO: Register storage service
-	// pb.RegisterStorageServiceServer(grpcServer, storageService)
+	// Register storage service
+	datanode.NewServer(nodeID, store).Register(grpcServer)
 
 	// Graceful shutdown
 	go func() {
@@ -2,14 +2,26 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	_ "github.com/lib/pq"
 	"github.com/mrmushfiq/plinth/internal/api"
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+	"github.com/mrmushfiq/plinth/internal/quorum"
+	"github.com/mrmushfiq/plinth/internal/ratelimit"
+	"github.com/mrmushfiq/plinth/internal/sse"
 )
 
 func main() {
@@ -21,18 +33,144 @@ func main() {
 	dbUser := getEnv("DB_USER", "plinth")
 	dbPassword := getEnv("DB_PASSWORD", "plinth_dev_password")
 	environment := getEnv("ENVIRONMENT", "development")
+	dataNodes := getEnv("DATA_NODES", "localhost:50051,localhost:50052,localhost:50053")
+	quorumCfg := quorum.Config{
+		ReplicationFactor: getEnvInt("REPLICATION_FACTOR", 3),
+		WriteQuorum:       getEnvInt("WRITE_QUORUM", 2),
+		ReadQuorum:        getEnvInt("READ_QUORUM", 2),
+	}
+	authEnabled := getEnv("ENABLE_AUTH", "false") == "true"
+	blockPublicAccess := getEnv("BLOCK_PUBLIC_ACCESS", "false") == "true"
+	rateLimitMode := api.RateLimitMode(getEnv("RATE_LIMIT_MODE", string(api.RateLimitLocal)))
+	rateLimitSyncInterval := getEnvDuration("RATE_LIMIT_SYNC_INTERVAL", time.Second)
+	gatewayID := getEnv("GATEWAY_ID", defaultGatewayID())
 
 	log.Printf("Starting Plinth Gateway on port %s", port)
 	log.Printf("Database: %s@%s:%s/%s", dbUser, dbHost, dbPort, dbName)
 	log.Printf("Environment: %s", environment)
 
-	// TODO: Initialize metadata service (use dbPassword)
-	// TODO: Initialize placement service
-	// TODO: Initialize data node clients
-	_ = dbPassword // Will be used when metadata service is implemented
+	if err := quorum.ValidateConfig(quorumCfg); err != nil {
+		log.Fatalf("Invalid quorum configuration: %v", err)
+	}
+
+	// Initialize metadata service
+	db, err := sql.Open("postgres", metadata.DSN(dbHost, dbPort, dbUser, dbPassword, dbName))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Initialize placement service and data node clients
+	nodes, err := placement.ParseNodeList(dataNodes)
+	if err != nil {
+		log.Fatalf("Invalid DATA_NODES: %v", err)
+	}
+	ring := placement.NewRing(placement.DefaultVirtualNodes)
+	pool := datanode.NewPool()
+	defer pool.Close()
+	for _, node := range nodes {
+		if err := ring.AddNode(context.Background(), node); err != nil {
+			log.Fatalf("Failed to add node %s: %v", node.ID, err)
+		}
+		pool.Add(node.ID, node.Address)
+		log.Printf("Data node %s at %s", node.ID, node.Address)
+	}
+
+	meta := metadata.NewPostgresService(db)
+
+	// SECRETS_KEY encrypts the secret access keys stored in the metadata
+	// database; without it there is no access key store to check signatures
+	var secrets *auth.SecretBox
+	if encoded := os.Getenv("SECRETS_KEY"); encoded != "" {
+		key, err := auth.ParseSecretsKey(encoded)
+		if err == nil {
+			secrets, err = auth.NewSecretBox(key)
+		}
+		if err != nil {
+			log.Fatalf("Invalid SECRETS_KEY: %v", err)
+		}
+	} else if authEnabled {
+		log.Fatal("ENABLE_AUTH requires SECRETS_KEY (generate one with `openssl rand -base64 32`)")
+	}
+
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY seed a root access key, so
+	// a fresh cluster has a key to sign requests and create users with
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); secrets != nil && id != "" && secret != "" {
+		sealed, err := secrets.Seal(id, secret)
+		if err == nil {
+			err = meta.PutAccessKey(context.Background(), &metadata.AccessKey{AccessKeyID: id, SealedSecret: sealed})
+		}
+		if err != nil {
+			log.Fatalf("Failed to store access key %s: %v", id, err)
+		}
+		log.Printf("Root access key %s stored", id)
+	}
+	if authEnabled {
+		log.Println("SigV4 authentication enabled")
+	}
+	if blockPublicAccess {
+		log.Println("Public access blocked for all buckets")
+	}
+
+	// SSE_KEYFILE holds the master keys that wrap the data keys of encrypted
+	// objects, the current one first; without it objects cannot be
+	// encrypted, nor encrypted objects read
+	var keyring *sse.Keyring
+	if path := os.Getenv("SSE_KEYFILE"); path != "" {
+		var err error
+		if keyring, err = sse.LoadKeyring(path); err != nil {
+			log.Fatalf("Invalid SSE_KEYFILE: %v", err)
+		}
+		log.Printf("Server-side encryption enabled with master key %s", keyring.CurrentKeyID())
+	}
+
+	// RATE_LIMITS holds the limits in force until they are set through the
+	// admin API, as JSON in the same form
+	var rateLimits ratelimit.Config
+	if encoded := os.Getenv("RATE_LIMITS"); encoded != "" {
+		err := json.Unmarshal([]byte(encoded), &rateLimits)
+		if err == nil {
+			err = rateLimits.Validate()
+		}
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMITS: %v", err)
+		}
+	}
+	switch rateLimitMode {
+	case api.RateLimitLocal, api.RateLimitSplit, api.RateLimitShared:
+	default:
+		log.Fatalf("Invalid RATE_LIMIT_MODE %q (want local, split or shared)", rateLimitMode)
+	}
+	if rateLimitSyncInterval <= 0 {
+		log.Fatal("RATE_LIMIT_SYNC_INTERVAL must be positive")
+	}
+	log.Printf("Rate limits enforced %s as gateway %s", rateLimitMode, gatewayID)
 
 	// Create gateway with dependencies
-	gateway := api.NewGateway()
+	gateway := api.NewGateway(api.Config{
+		Metadata:    meta,
+		Placement:   ring,
+		Nodes:       pool,
+		Quorum:      quorumCfg,
+		AuthEnabled: authEnabled,
+		Secrets:     secrets,
+
+		BlockPublicAccess: blockPublicAccess,
+		Keyring:           keyring,
+
+		RateLimits:    rateLimits,
+		RateLimitMode: rateLimitMode,
+		GatewayID:     gatewayID,
+	})
+
+	// Pick up limits set through other gateways and keep the gateways'
+	// counters in step
+	ctx, cancel := context.WithCancel(context.Background())
+	limiterDone := make(chan struct{})
+	go func() {
+		defer close(limiterDone)
+		gateway.RunRateLimiter(ctx, rateLimitSyncInterval)
+	}()
 
 	// Setup Gin router
 	router := api.SetupRouter(gateway, environment)
@@ -61,10 +199,33 @@ func main() {
 		}
 	}()
 
-	log.Printf("Gateway listening on :%s", port)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	// TLS_CERT_FILE and TLS_KEY_FILE serve HTTPS, which customer-provided
+	// encryption keys (SSE-C) and aws:SecureTransport require
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		log.Printf("Gateway listening on :%s (TLS)", port)
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Printf("Gateway listening on :%s", port)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	cancel()
+	<-limiterDone
+}
+
+// defaultGatewayID names this gateway by host and pid
+func defaultGatewayID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gateway"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
 
 func getEnv(key, defaultValue string) string {
@@ -73,3 +234,21 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
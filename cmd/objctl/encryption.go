@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// rotation is the response to a POST /admin/encryption/rotate
+type rotation struct {
+	CurrentKeyID string `json:"current_key_id"`
+	Rewrapped    int    `json:"rewrapped"`
+	Failed       []struct {
+		KeyID    string `json:"key_id"`
+		ObjectID string `json:"object_id"`
+		UploadID string `json:"upload_id"`
+		Error    string `json:"error"`
+	} `json:"failed"`
+	More bool `json:"more"`
+}
+
+func handleEncryptionCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl encryption <show|rotate>")
+		return
+	}
+	subcmd := os.Args[2]
+	var err error
+	switch subcmd {
+	case "show":
+		err = showEncryption()
+	case "rotate":
+		err = rotateEncryption()
+	default:
+		fmt.Printf("Unknown encryption command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encryption %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func showEncryption() error {
+	var resp struct {
+		Enabled      bool     `json:"enabled"`
+		CurrentKeyID string   `json:"current_key_id"`
+		KeyIDs       []string `json:"key_ids"`
+	}
+	if err := getJSON("/admin/encryption", &resp); err != nil {
+		return err
+	}
+	if !resp.Enabled {
+		fmt.Println("Server-side encryption is not configured")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Current key:\t%s\n", resp.CurrentKeyID)
+	fmt.Fprintf(w, "Keys:\t%s\n", strings.Join(resp.KeyIDs, ", "))
+	return w.Flush()
+}
+
+// rotateEncryption rewraps data keys with the current master key a batch at
+// a time until none are left, or a batch rewraps none because every key
+// left failed. Keys that fail are listed again with every batch, so each is
+// reported once.
+func rotateEncryption() error {
+	total := 0
+	failed := make(map[string]bool)
+	for {
+		var resp rotation
+		if err := adminRequest(http.MethodPost, "/admin/encryption/rotate", nil, &resp); err != nil {
+			return err
+		}
+		total += resp.Rewrapped
+		for _, f := range resp.Failed {
+			id := "object " + f.ObjectID
+			if f.UploadID != "" {
+				id = "upload " + f.UploadID
+			}
+			if !failed[id] {
+				failed[id] = true
+				fmt.Fprintf(os.Stderr, "%s (key %s): %s\n", id, f.KeyID, f.Error)
+			}
+		}
+		if !resp.More || resp.Rewrapped == 0 {
+			fmt.Printf("Rewrapped %d data keys with master key %s\n", total, resp.CurrentKeyID)
+			break
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d data keys could not be rewrapped", len(failed))
+	}
+	return nil
+}
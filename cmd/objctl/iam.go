@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// user is a user as the admin API returns it
+type user struct {
+	Name       string      `json:"name"`
+	Groups     []string    `json:"groups"`
+	CreatedAt  string      `json:"created_at"`
+	AccessKeys []accessKey `json:"access_keys"`
+}
+
+// accessKey is an access key as the admin API returns it. The secret is
+// only present when the key is created.
+type accessKey struct {
+	AccessKeyID     string     `json:"access_key_id"`
+	SecretAccessKey string     `json:"secret_access_key"`
+	User            string     `json:"user"`
+	Status          string     `json:"status"`
+	ExpiresAt       string     `json:"expires_at"`
+	CreatedAt       string     `json:"created_at"`
+	Replaces        *accessKey `json:"replaces"`
+}
+
+// group is a group as the admin API returns it
+type group struct {
+	Name      string   `json:"name"`
+	Members   []string `json:"members"`
+	CreatedAt string   `json:"created_at"`
+}
+
+func handleUserCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl user <create|list|show|delete> [name]")
+		return
+	}
+	subcmd := os.Args[2]
+	var err error
+	switch subcmd {
+	case "list":
+		err = listUsers()
+	case "create", "show", "delete":
+		if len(os.Args) < 4 {
+			fmt.Printf("Usage: objctl user %s <name>\n", subcmd)
+			return
+		}
+		name := os.Args[3]
+		switch subcmd {
+		case "create":
+			var u user
+			if err = adminRequest(http.MethodPost, "/admin/users", map[string]string{"name": name}, &u); err == nil {
+				fmt.Printf("Created user %s\n", u.Name)
+			}
+		case "show":
+			err = showUser(name)
+		case "delete":
+			if err = adminRequest(http.MethodDelete, "/admin/users/"+url.PathEscape(name), nil, nil); err == nil {
+				fmt.Printf("Deleted user %s and its access keys\n", name)
+			}
+		}
+	default:
+		fmt.Printf("Unknown user command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func listUsers() error {
+	var resp struct {
+		Users []user `json:"users"`
+	}
+	if err := getJSON("/admin/users", &resp); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tGROUPS\tCREATED\t")
+	for _, u := range resp.Users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", u.Name, strings.Join(u.Groups, ","), u.CreatedAt)
+	}
+	return w.Flush()
+}
+
+func showUser(name string) error {
+	var u user
+	if err := getJSON("/admin/users/"+url.PathEscape(name), &u); err != nil {
+		return err
+	}
+	fmt.Printf("User:    %s\n", u.Name)
+	fmt.Printf("Groups:  %s\n", strings.Join(u.Groups, ", "))
+	fmt.Printf("Created: %s\n\n", u.CreatedAt)
+	return printAccessKeys(u.AccessKeys)
+}
+
+func printAccessKeys(keys []accessKey) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCESS KEY\tSTATUS\tEXPIRES\tCREATED\t")
+	for _, k := range keys {
+		expires := k.ExpiresAt
+		if expires == "" {
+			expires = "never"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", k.AccessKeyID, k.Status, expires, k.CreatedAt)
+	}
+	return w.Flush()
+}
+
+func handleKeyCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl key <create|list|rotate|disable|enable|expire|delete> <user|access-key-id> [flags]")
+		return
+	}
+	subcmd := os.Args[2]
+	fs := flag.NewFlagSet("key "+subcmd, flag.ExitOnError)
+	var expires, grace, in *time.Duration
+	var at *string
+	usage := "objctl key " + subcmd + " <access-key-id>"
+	switch subcmd {
+	case "create":
+		expires = fs.Duration("expires", 0, "how long the key is valid (default: no expiry)")
+		usage = "objctl key create <user> [--expires 720h]"
+	case "list":
+		usage = "objctl key list <user>"
+	case "rotate":
+		grace = fs.Duration("grace", 0, "how long the old key keeps working (default: disabled at once)")
+		usage = "objctl key rotate <access-key-id> [--grace 24h]"
+	case "expire":
+		in = fs.Duration("in", 0, "expire the key after this long (default: now)")
+		at = fs.String("at", "", "expire the key at this RFC 3339 time")
+		usage = "objctl key expire <access-key-id> [--in 24h | --at 2026-12-31T00:00:00Z]"
+	case "disable", "enable", "delete":
+	default:
+		fmt.Printf("Unknown key command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	fs.Usage = func() { fmt.Println("Usage: " + usage) }
+	args := parseArgs(fs, os.Args[3:])
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	name := url.PathEscape(args[0])
+
+	var err error
+	switch subcmd {
+	case "create":
+		body := map[string]string{}
+		if *expires > 0 {
+			body["expires_in"] = expires.String()
+		}
+		var k accessKey
+		if err = adminRequest(http.MethodPost, "/admin/users/"+name+"/keys", body, &k); err == nil {
+			printNewAccessKey(k)
+		}
+	case "list":
+		var resp struct {
+			AccessKeys []accessKey `json:"access_keys"`
+		}
+		if err = getJSON("/admin/users/"+name+"/keys", &resp); err == nil {
+			err = printAccessKeys(resp.AccessKeys)
+		}
+	case "rotate":
+		body := map[string]string{}
+		if *grace > 0 {
+			body["grace"] = grace.String()
+		}
+		var k accessKey
+		if err = adminRequest(http.MethodPost, "/admin/keys/"+name+"/rotate", body, &k); err == nil {
+			printNewAccessKey(k)
+			if old := k.Replaces; old != nil && old.ExpiresAt != "" && old.Status != "inactive" {
+				fmt.Printf("\n%s keeps working until %s\n", old.AccessKeyID, old.ExpiresAt)
+			} else if old != nil {
+				fmt.Printf("\n%s is disabled\n", old.AccessKeyID)
+			}
+		}
+	case "disable", "enable":
+		status := map[string]string{"disable": "inactive", "enable": "active"}[subcmd]
+		err = updateAccessKey(name, map[string]string{"status": status})
+	case "expire":
+		when := time.Now().Add(*in).UTC().Format(time.RFC3339)
+		if *at != "" {
+			if _, perr := time.Parse(time.RFC3339, *at); perr != nil {
+				fmt.Fprintf(os.Stderr, "key expire: --at must be an RFC 3339 time\n")
+				os.Exit(1)
+			}
+			when = *at
+		}
+		err = updateAccessKey(name, map[string]string{"expires_at": when})
+	case "delete":
+		if err = adminRequest(http.MethodDelete, "/admin/keys/"+name, nil, nil); err == nil {
+			fmt.Printf("Deleted access key %s\n", args[0])
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "key %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func updateAccessKey(name string, body map[string]string) error {
+	var k accessKey
+	if err := adminRequest(http.MethodPatch, "/admin/keys/"+name, body, &k); err != nil {
+		return err
+	}
+	return printAccessKeys([]accessKey{k})
+}
+
+// printNewAccessKey shows a created key with its secret, which the gateway
+// will not return again
+func printNewAccessKey(k accessKey) {
+	fmt.Printf("AWS_ACCESS_KEY_ID=%s\n", k.AccessKeyID)
+	fmt.Printf("AWS_SECRET_ACCESS_KEY=%s\n", k.SecretAccessKey)
+	if k.ExpiresAt != "" {
+		fmt.Printf("# expires %s\n", k.ExpiresAt)
+	}
+	fmt.Println("# Store the secret now: it cannot be retrieved later.")
+}
+
+func handleGroupCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl group <create|list|show|delete|add|remove> [group] [user]")
+		return
+	}
+	subcmd := os.Args[2]
+	var err error
+	switch subcmd {
+	case "list":
+		err = listGroups()
+	case "create", "show", "delete":
+		if len(os.Args) < 4 {
+			fmt.Printf("Usage: objctl group %s <group>\n", subcmd)
+			return
+		}
+		name := os.Args[3]
+		var grp group
+		switch subcmd {
+		case "create":
+			if err = adminRequest(http.MethodPost, "/admin/groups", map[string]string{"name": name}, &grp); err == nil {
+				fmt.Printf("Created group %s\n", grp.Name)
+			}
+		case "show":
+			if err = getJSON("/admin/groups/"+url.PathEscape(name), &grp); err == nil {
+				fmt.Printf("Group:   %s\n", grp.Name)
+				fmt.Printf("Members: %s\n", strings.Join(grp.Members, ", "))
+				fmt.Printf("Created: %s\n", grp.CreatedAt)
+			}
+		case "delete":
+			if err = adminRequest(http.MethodDelete, "/admin/groups/"+url.PathEscape(name), nil, nil); err == nil {
+				fmt.Printf("Deleted group %s\n", name)
+			}
+		}
+	case "add", "remove":
+		if len(os.Args) < 5 {
+			fmt.Printf("Usage: objctl group %s <group> <user>\n", subcmd)
+			return
+		}
+		path := "/admin/groups/" + url.PathEscape(os.Args[3]) + "/members/" + url.PathEscape(os.Args[4])
+		if subcmd == "add" {
+			if err = adminRequest(http.MethodPut, path, nil, nil); err == nil {
+				fmt.Printf("Added %s to %s\n", os.Args[4], os.Args[3])
+			}
+		} else if err = adminRequest(http.MethodDelete, path, nil, nil); err == nil {
+			fmt.Printf("Removed %s from %s\n", os.Args[4], os.Args[3])
+		}
+	default:
+		fmt.Printf("Unknown group command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "group %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func listGroups() error {
+	var resp struct {
+		Groups []group `json:"groups"`
+	}
+	if err := getJSON("/admin/groups", &resp); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tMEMBERS\tCREATED\t")
+	for _, grp := range resp.Groups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", grp.Name, strings.Join(grp.Members, ","), grp.CreatedAt)
+	}
+	return w.Flush()
+}
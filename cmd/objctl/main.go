@@ -1,8 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/auth"
 )
 
 func main() {
@@ -24,6 +38,20 @@ func main() {
 		handleObjectCommand()
 	case "costs":
 		handleCostsCommand()
+	case "presign":
+		handlePresignCommand()
+	case "user":
+		handleUserCommand()
+	case "key":
+		handleKeyCommand()
+	case "group":
+		handleGroupCommand()
+	case "quota":
+		handleQuotaCommand()
+	case "ratelimit":
+		handleRateLimitCommand()
+	case "encryption":
+		handleEncryptionCommand()
 	case "version":
 		fmt.Println("objctl version 0.1.0-alpha")
 	case "help", "--help", "-h":
@@ -61,15 +89,69 @@ Commands:
     bucket     Show costs for a bucket
     top        Show top objects by cost
   
+  user       User management (root access key)
+    create     Create a user
+    list       List users
+    show       Show a user's groups and access keys
+    delete     Delete a user and its access keys
+  
+  key        Access key management (root access key)
+    create     Create an access key for a user (--expires 720h)
+    list       List a user's access keys
+    rotate     Replace a key, retiring the old one (--grace 24h)
+    disable    Stop a key from signing requests
+    enable     Let a disabled key sign requests again
+    expire     Expire a key (--in 24h or --at <RFC 3339 time>)
+    delete     Delete a key
+  
+  group      Group management (root access key)
+    create     Create a group
+    list       List groups
+    show       Show a group's members
+    delete     Delete a group
+    add        Add a user to a group
+    remove     Remove a user from a group
+  
+  quota      Bucket and user quotas (root access key)
+    show       Show a bucket's or user's quota and usage
+    set        Set hard and soft limits (--max-bytes 10T, --max-objects,
+               --soft-max-bytes, --soft-max-objects)
+    delete     Remove a quota
+    events     List soft quota breaches
+  
+  ratelimit  Rate limits (root access key)
+    show       Show the rate limits in force
+    set        Replace the rate limits with a JSON file (- for stdin)
+  
+  encryption Server-side encryption master keys (root access key)
+    show       Show the gateway's master keys
+    rotate     Rewrap data keys with the current master key
+  
+  presign    Print a pre-signed URL for an object
+    --expires  How long the URL is valid (default 1h, at most 168h)
+    --method   GET, HEAD or PUT (default GET)
+  
   version    Show version
   help       Show this help message
 
+Environment:
+  PLINTH_ENDPOINT   Gateway URL (default http://localhost:9000)
+  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+                    Access key that signs admin requests and pre-signed URLs
+  AWS_REGION        Region to sign with (default us-east-1)
+
 Examples:
   objctl cluster status
   objctl nodes list
   objctl repair status
   objctl object stat bucket/key
   objctl costs bucket ml-datasets
+  objctl user create vision-team
+  objctl key create vision-team --expires 2160h
+  objctl quota set user vision-team --max-bytes 10T --soft-max-bytes 8T
+  objctl ratelimit set limits.json
+  objctl encryption rotate
+  objctl presign ml-datasets/train/000.tar --expires 1h --method PUT
 
 For more information, visit: https://github.com/mrmushfiq/plinth`)
 }
@@ -110,8 +192,10 @@ func handleRepairCommand() {
 	subcmd := os.Args[2]
 	switch subcmd {
 	case "status":
-		// TODO: Implement repair status
-		fmt.Println("Repair status... (TODO: implement)")
+		if err := repairStatus(); err != nil {
+			fmt.Fprintf(os.Stderr, "repair status: %v\n", err)
+			os.Exit(1)
+		}
 	case "run":
 		// TODO: Trigger repair cycle
 		fmt.Println("Triggering repair cycle... (TODO: implement)")
@@ -161,3 +245,221 @@ func handleCostsCommand() {
 		fmt.Println("Top objects by cost... (TODO: implement)")
 	}
 }
+
+func handlePresignCommand() {
+	fs := flag.NewFlagSet("presign", flag.ExitOnError)
+	expires := fs.Duration("expires", time.Hour, "how long the URL is valid")
+	method := fs.String("method", http.MethodGet, "GET, HEAD or PUT")
+	fs.Usage = func() {
+		fmt.Println("Usage: objctl presign <bucket/key> [--expires 1h] [--method GET|HEAD|PUT]")
+	}
+
+	args := parseArgs(fs, os.Args[2:])
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	presigned, err := presignURL(args[0], strings.ToUpper(*method), *expires)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "presign: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(presigned)
+}
+
+// parseArgs parses flags that may come before, between or after the
+// positional arguments, and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, arguments []string) []string {
+	var args []string
+	for {
+		fs.Parse(arguments)
+		if fs.NArg() == 0 {
+			return args
+		}
+		args = append(args, fs.Arg(0))
+		arguments = fs.Args()[1:]
+	}
+}
+
+// presignURL signs a URL for a method request on bucket/key with the
+// access key in the environment
+func presignURL(object, method string, expires time.Duration) (string, error) {
+	bucket, key, _ := strings.Cut(object, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("%q is not <bucket>/<key>", object)
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+	default:
+		return "", fmt.Errorf("method %s cannot be pre-signed; use GET, HEAD or PUT", method)
+	}
+	accessKeyID, secret, region, ok := credentials()
+	if !ok {
+		return "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	path := (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	return auth.Presign(method, gatewayEndpoint()+path, accessKeyID, secret, region, time.Now(), expires)
+}
+
+// repairStatus prints the repair queue depth per priority, the scrub
+// progress of every data node and the repair workers' leases
+func repairStatus() error {
+	var status struct {
+		Leases []struct {
+			Name      string `json:"name"`
+			Holder    string `json:"holder"`
+			ExpiresAt string `json:"expires_at"`
+		} `json:"leases"`
+		Queue struct {
+			ByPriority []struct {
+				RemainingReplicas int   `json:"remaining_replicas"`
+				AtRisk            bool  `json:"at_risk"`
+				Pending           int64 `json:"pending"`
+				InProgress        int64 `json:"in_progress"`
+			} `json:"by_priority"`
+			Pending    int64 `json:"pending"`
+			InProgress int64 `json:"in_progress"`
+		} `json:"queue"`
+		Scrub struct {
+			Nodes []struct {
+				NodeID              string  `json:"node_id"`
+				State               string  `json:"state"`
+				Progress            float64 `json:"progress"`
+				BytesScrubbed       int64   `json:"bytes_scrubbed"`
+				CorruptFound        int64   `json:"corrupt_found"`
+				LastPassCompletedAt string  `json:"last_pass_completed_at"`
+			} `json:"nodes"`
+		} `json:"scrub"`
+	}
+	if err := getJSON("/admin/repair/status", &status); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Repair queue: %d pending, %d in progress\n\n", status.Queue.Pending, status.Queue.InProgress)
+	fmt.Fprintln(w, "REPLICAS LEFT\tPENDING\tIN PROGRESS\t")
+	for _, d := range status.Queue.ByPriority {
+		left := fmt.Sprint(d.RemainingReplicas)
+		if d.AtRisk {
+			left += " (at risk)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", left, d.Pending, d.InProgress)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "NODE\tSCRUB\tPROGRESS\tBYTES\tCORRUPT\tLAST PASS\t")
+	for _, n := range status.Scrub.Nodes {
+		progress := "-"
+		if n.State == "scrubbing" {
+			progress = fmt.Sprintf("%.1f%%", n.Progress*100)
+		}
+		last := n.LastPassCompletedAt
+		if last == "" {
+			last = "never"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t\n",
+			n.NodeID, n.State, progress, n.BytesScrubbed, n.CorruptFound, last)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "LEASE\tHOLDER\tEXPIRES\t")
+	for _, l := range status.Leases {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", l.Name, l.Holder, l.ExpiresAt)
+	}
+	return w.Flush()
+}
+
+// getJSON fetches an admin endpoint from the gateway and decodes its body
+func getJSON(path string, v interface{}) error {
+	return adminRequest(http.MethodGet, path, nil, v)
+}
+
+// adminRequest sends a JSON request to an admin endpoint and decodes the
+// response into v, unless v is nil. With an access key in the environment
+// the request is signed, as the user and key endpoints require.
+func adminRequest(method, path string, body, v interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, gatewayEndpoint()+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if accessKeyID, secret, region, ok := credentials(); ok {
+		sum := sha256.Sum256(payload)
+		if err := auth.SignRequest(req, accessKeyID, secret, region, hex.EncodeToString(sum[:]), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s %s", path, resp.Status, responseError(resp))
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError extracts the message of an error response: JSON from the
+// admin API, or S3 XML when authentication failed
+func responseError(resp *http.Response) string {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var jsonErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &jsonErr) == nil && jsonErr.Error != "" {
+		return jsonErr.Error
+	}
+	// The S3 error is the root element, or nested one level down
+	type s3Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	var xmlErr struct {
+		s3Error
+		Error s3Error `xml:"Error"`
+	}
+	if xml.Unmarshal(b, &xmlErr) != nil {
+		return ""
+	}
+	if xmlErr.Code == "" {
+		xmlErr.s3Error = xmlErr.Error
+	}
+	if xmlErr.Code == "" {
+		return ""
+	}
+	return xmlErr.Code + ": " + xmlErr.Message
+}
+
+// gatewayEndpoint returns the gateway URL from PLINTH_ENDPOINT
+func gatewayEndpoint() string {
+	endpoint := os.Getenv("PLINTH_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:9000"
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
+
+// credentials returns the access key in the environment and the region to
+// sign with
+func credentials() (accessKeyID, secret, region string, ok bool) {
+	accessKeyID, secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	region = os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return accessKeyID, secret, region, accessKeyID != "" && secret != ""
+}
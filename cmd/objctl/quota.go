@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// quota is a quota as the admin API takes and returns it
+type quota struct {
+	MaxBytes       int64 `json:"max_bytes,omitempty"`
+	MaxObjects     int64 `json:"max_objects,omitempty"`
+	SoftMaxBytes   int64 `json:"soft_max_bytes,omitempty"`
+	SoftMaxObjects int64 `json:"soft_max_objects,omitempty"`
+}
+
+// quotaStatus is a bucket's or user's quota and usage
+type quotaStatus struct {
+	Bucket string `json:"bucket"`
+	User   string `json:"user"`
+	Quota  *quota `json:"quota"`
+	Usage  struct {
+		Bytes   int64 `json:"bytes"`
+		Objects int64 `json:"objects"`
+	} `json:"usage"`
+}
+
+// byteSize is a flag holding a number of bytes, with an optional K, M, G,
+// T or P suffix for powers of 1024
+type byteSize int64
+
+func (s *byteSize) String() string { return strconv.FormatInt(int64(*s), 10) }
+
+func (s *byteSize) Set(v string) error {
+	shift := 0
+	if i := strings.IndexAny(strings.ToUpper(v), "KMGTP"); i > 0 {
+		shift = 10 * (1 + strings.IndexByte("KMGTP", strings.ToUpper(v)[i]))
+		if rest := strings.ToUpper(v[i+1:]); rest != "" && rest != "B" && rest != "IB" {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		v = v[:i]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = byteSize(n << shift)
+	return nil
+}
+
+func handleQuotaCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl quota <show|set|delete> <bucket|user> <name> [flags], or objctl quota events")
+		return
+	}
+	subcmd := os.Args[2]
+	if subcmd == "events" {
+		if err := listQuotaEvents(); err != nil {
+			fmt.Fprintf(os.Stderr, "quota events: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("quota "+subcmd, flag.ExitOnError)
+	var q struct{ maxBytes, softMaxBytes byteSize }
+	var maxObjects, softMaxObjects *int64
+	usage := "objctl quota " + subcmd + " <bucket|user> <name>"
+	switch subcmd {
+	case "set":
+		fs.Var(&q.maxBytes, "max-bytes", "hard limit on bytes stored, e.g. 10T")
+		fs.Var(&q.softMaxBytes, "soft-max-bytes", "bytes stored above which events are raised")
+		maxObjects = fs.Int64("max-objects", 0, "hard limit on objects stored")
+		softMaxObjects = fs.Int64("soft-max-objects", 0, "objects stored above which events are raised")
+		usage += " [--max-bytes 10T] [--max-objects N] [--soft-max-bytes 8T] [--soft-max-objects N]"
+	case "show", "delete":
+	default:
+		fmt.Printf("Unknown quota command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	fs.Usage = func() { fmt.Println("Usage: " + usage) }
+	args := parseArgs(fs, os.Args[3:])
+	if len(args) != 2 || args[0] != "bucket" && args[0] != "user" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := "/admin/" + args[0] + "s/" + url.PathEscape(args[1]) + "/quota"
+
+	var err error
+	switch subcmd {
+	case "show":
+		var status quotaStatus
+		if err = getJSON(path, &status); err == nil {
+			err = printQuota(status)
+		}
+	case "set":
+		body := quota{
+			MaxBytes:       int64(q.maxBytes),
+			MaxObjects:     *maxObjects,
+			SoftMaxBytes:   int64(q.softMaxBytes),
+			SoftMaxObjects: *softMaxObjects,
+		}
+		var status quotaStatus
+		if err = adminRequest(http.MethodPut, path, body, &status); err == nil {
+			err = printQuota(status)
+		}
+	case "delete":
+		if err = adminRequest(http.MethodDelete, path, nil, nil); err == nil {
+			fmt.Printf("Deleted the quota of %s %s\n", args[0], args[1])
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quota %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func printQuota(status quotaStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if status.Bucket != "" {
+		fmt.Fprintf(w, "Bucket:\t%s\n", status.Bucket)
+	} else {
+		fmt.Fprintf(w, "User:\t%s\n", status.User)
+	}
+	q := status.Quota
+	if q == nil {
+		q = &quota{}
+	}
+	limit := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	fmt.Fprintln(w, "\tUSED\tSOFT\tHARD\t")
+	fmt.Fprintf(w, "Bytes\t%d\t%s\t%s\t\n", status.Usage.Bytes, limit(q.SoftMaxBytes), limit(q.MaxBytes))
+	fmt.Fprintf(w, "Objects\t%d\t%s\t%s\t\n", status.Usage.Objects, limit(q.SoftMaxObjects), limit(q.MaxObjects))
+	return w.Flush()
+}
+
+func listQuotaEvents() error {
+	var resp struct {
+		Events []struct {
+			Scope     string `json:"scope"`
+			Name      string `json:"name"`
+			Resource  string `json:"resource"`
+			Usage     int64  `json:"usage"`
+			Limit     int64  `json:"limit"`
+			CreatedAt string `json:"created_at"`
+		} `json:"events"`
+	}
+	if err := getJSON("/admin/quota-events", &resp); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSCOPE\tNAME\tRESOURCE\tUSAGE\tSOFT LIMIT\t")
+	for _, e := range resp.Events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t\n", e.CreatedAt, e.Scope, e.Name, e.Resource, e.Usage, e.Limit)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+func handleRateLimitCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: objctl ratelimit <show|set> [file]")
+		return
+	}
+	subcmd := os.Args[2]
+	var err error
+	switch subcmd {
+	case "show":
+		err = showRateLimits()
+	case "set":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: objctl ratelimit set <file|->")
+			return
+		}
+		err = setRateLimits(os.Args[3])
+	default:
+		fmt.Printf("Unknown ratelimit command: %s\n", subcmd)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ratelimit %s: %v\n", subcmd, err)
+		os.Exit(1)
+	}
+}
+
+func showRateLimits() error {
+	var limits json.RawMessage
+	if err := getJSON("/admin/rate-limits", &limits); err != nil {
+		return err
+	}
+	return printJSON(limits)
+}
+
+// setRateLimits replaces the rate limits with the JSON in file, or on
+// standard input for -
+func setRateLimits(file string) error {
+	var (
+		data []byte
+		err  error
+	)
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%s is not JSON", file)
+	}
+	var limits json.RawMessage
+	if err := adminRequest(http.MethodPut, "/admin/rate-limits", json.RawMessage(data), &limits); err != nil {
+		return err
+	}
+	return printJSON(limits)
+}
+
+func printJSON(data json.RawMessage) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
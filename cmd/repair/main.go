@@ -2,11 +2,21 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+	"github.com/mrmushfiq/plinth/internal/repair"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -16,17 +26,125 @@ func main() {
 	dbName := getEnv("DB_NAME", "plinth")
 	dbUser := getEnv("DB_USER", "plinth")
 	dbPassword := getEnv("DB_PASSWORD", "plinth_dev_password")
-	_ = dbPassword // Will be used when metadata service is implemented
 	repairInterval := getEnvDuration("REPAIR_INTERVAL", 60*time.Second)
 	scrubInterval := getEnvDuration("SCRUB_INTERVAL", 300*time.Second)
+	antiEntropyInterval := getEnvDuration("ANTI_ENTROPY_INTERVAL", 10*time.Minute)
+	dataNodes := getEnv("DATA_NODES", "localhost:50051,localhost:50052,localhost:50053")
+	replicationFactor := getEnvInt("REPLICATION_FACTOR", 3)
+	writeQuorum := getEnvInt("WRITE_QUORUM", 2)
+	batchSize := getEnvInt("REPAIR_BATCH_SIZE", repair.DefaultBatchSize)
+	concurrency := getEnvInt("REPAIR_CONCURRENCY", repair.DefaultConcurrency)
+	scrubBytesPerSec := getEnvInt("SCRUB_BYTES_PER_SEC", repair.DefaultScrubBytesPerSecond)
+	metricsPort := getEnv("METRICS_PORT", "9090")
+	workerID := getEnv("WORKER_ID", repair.DefaultHolder())
+	leaseTTL := getEnvDuration("LEASE_TTL", repair.DefaultLeaseTTL)
+	orphanInterval := getEnvDuration("ORPHAN_GC_INTERVAL", time.Hour)
+	orphanGrace := getEnvDuration("ORPHAN_GC_GRACE", repair.DefaultOrphanGracePeriod)
+	orphanMaxDeletes := getEnvInt("ORPHAN_GC_MAX_DELETES", repair.DefaultOrphanMaxDeletes)
+	orphanDryRun := getEnvBool("ORPHAN_GC_DRY_RUN", false)
+	tombstoneInterval := getEnvDuration("TOMBSTONE_GC_INTERVAL", 5*time.Minute)
+	tombstoneGrace := getEnvDuration("TOMBSTONE_GC_GRACE", repair.DefaultTombstoneGracePeriod)
+	noncurrentRetention := getEnvDuration("NONCURRENT_VERSION_RETENTION", 0)
+	pendingInterval := getEnvDuration("PENDING_REAPER_INTERVAL", 10*time.Minute)
+	pendingTimeout := getEnvDuration("PENDING_OBJECT_TIMEOUT", repair.DefaultPendingTimeout)
+	multipartInterval := getEnvDuration("MULTIPART_SWEEP_INTERVAL", time.Hour)
 
-	log.Printf("Starting Plinth Repair Worker")
+	log.Printf("Starting Plinth Repair Worker %s", workerID)
 	log.Printf("Database: %s@%s:%s/%s", dbUser, dbHost, dbPort, dbName)
 	log.Printf("Repair interval: %s", repairInterval)
-	log.Printf("Scrub interval: %s", scrubInterval)
+	log.Printf("Scrub interval: %s, budget %d bytes/s per node", scrubInterval, scrubBytesPerSec)
+	log.Printf("Anti-entropy interval: %s", antiEntropyInterval)
+	log.Printf("Orphan GC interval: %s, grace %s, at most %d deletes, dry run %t",
+		orphanInterval, orphanGrace, orphanMaxDeletes, orphanDryRun)
+	log.Printf("Tombstone GC interval: %s, grace %s, noncurrent version retention %s",
+		tombstoneInterval, tombstoneGrace, noncurrentRetention)
+	log.Printf("Pending reaper interval: %s, timeout %s, write quorum %d", pendingInterval, pendingTimeout, writeQuorum)
+	log.Printf("Multipart upload sweep interval: %s", multipartInterval)
+
+	// Initialize metadata service
+	db, err := sql.Open("postgres", metadata.DSN(dbHost, dbPort, dbUser, dbPassword, dbName))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Initialize placement service and data node clients
+	nodes, err := placement.ParseNodeList(dataNodes)
+	if err != nil {
+		log.Fatalf("Invalid DATA_NODES: %v", err)
+	}
+	ring := placement.NewRing(placement.DefaultVirtualNodes)
+	pool := datanode.NewPool()
+	defer pool.Close()
+	for _, node := range nodes {
+		if err := ring.AddNode(context.Background(), node); err != nil {
+			log.Fatalf("Failed to add node %s: %v", node.ID, err)
+		}
+		pool.Add(node.ID, node.Address)
+	}
+	meta := metadata.NewPostgresService(db)
+	// Repair processes sharing the database split the work through leases
+	coord := repair.NewCoordinator(meta, workerID)
+	// Repairs of at-risk objects pause the scrubber while they run
+	preemption := repair.NewPreemption()
+	antiEntropy := repair.NewAntiEntropy(ring, pool, replicationFactor)
+	worker := repair.NewWorker(repair.Config{
+		Metadata:          meta,
+		Placement:         ring,
+		Nodes:             pool,
+		ReplicationFactor: replicationFactor,
+		BatchSize:         batchSize,
+		Concurrency:       concurrency,
+		Preemption:        preemption,
+		Coordinator:       coord,
+		ScanLeaseTTL:      2 * repairInterval,
+	})
+	scrubber := repair.NewScrubber(repair.ScrubConfig{
+		Metadata:       meta,
+		Placement:      ring,
+		Nodes:          pool,
+		BytesPerSecond: int64(scrubBytesPerSec),
+		Interval:       scrubInterval,
+		Preemption:     preemption,
+		Coordinator:    coord,
+		LeaseTTL:       leaseTTL,
+	})
+	orphans := repair.NewOrphanCollector(repair.OrphanConfig{
+		Metadata:    meta,
+		Placement:   ring,
+		Nodes:       pool,
+		GracePeriod: orphanGrace,
+		MaxDeletes:  orphanMaxDeletes,
+		DryRun:      orphanDryRun,
+		Preemption:  preemption,
+	})
+	tombstones := repair.NewTombstoneCollector(repair.TombstoneConfig{
+		Metadata:            meta,
+		Placement:           ring,
+		Nodes:               pool,
+		GracePeriod:         tombstoneGrace,
+		NoncurrentRetention: noncurrentRetention,
+	})
+	pending := repair.NewPendingReaper(repair.PendingConfig{
+		Metadata:    meta,
+		Nodes:       pool,
+		WriteQuorum: writeQuorum,
+		Timeout:     pendingTimeout,
+	})
+	uploads := repair.NewUploadSweeper(repair.UploadConfig{
+		Metadata: meta,
+		Nodes:    pool,
+	})
 
-	// TODO: Initialize metadata service
-	// TODO: Initialize data node clients
+	// Prometheus metrics
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		log.Printf("Metrics listening on :%s", metricsPort)
+		if err := http.ListenAndServe(":"+metricsPort, mux); err != nil {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -41,13 +159,38 @@ func main() {
 		cancel()
 	}()
 
+	go coord.Heartbeat(ctx, leaseTTL)
+
 	// Repair loop
 	repairTicker := time.NewTicker(repairInterval)
 	defer repairTicker.Stop()
 
-	// Scrub loop
-	scrubTicker := time.NewTicker(scrubInterval)
-	defer scrubTicker.Stop()
+	// Scrubber runs continuously at its own pace, pausing between passes
+	go func() {
+		if err := scrubber.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Scrubber stopped: %v", err)
+		}
+	}()
+
+	// Anti-entropy loop
+	antiEntropyTicker := time.NewTicker(antiEntropyInterval)
+	defer antiEntropyTicker.Stop()
+
+	// Orphan GC loop
+	orphanTicker := time.NewTicker(orphanInterval)
+	defer orphanTicker.Stop()
+
+	// Tombstone GC loop
+	tombstoneTicker := time.NewTicker(tombstoneInterval)
+	defer tombstoneTicker.Stop()
+
+	// Pending reaper loop
+	pendingTicker := time.NewTicker(pendingInterval)
+	defer pendingTicker.Stop()
+
+	// Multipart upload expiry loop
+	multipartTicker := time.NewTicker(multipartInterval)
+	defer multipartTicker.Stop()
 
 	log.Println("Repair worker started")
 
@@ -58,18 +201,129 @@ func main() {
 			return
 		case <-repairTicker.C:
 			log.Println("Running repair cycle...")
-			// TODO: Implement repair logic
-			// - Find under-replicated objects
-			// - Rebuild from healthy replicas
-		case <-scrubTicker.C:
-			log.Println("Running scrub cycle...")
-			// TODO: Implement scrub logic
-			// - Verify checksums
-			// - Detect corruption
+			runRepair(ctx, worker)
+		case <-antiEntropyTicker.C:
+			log.Println("Running anti-entropy cycle...")
+			runAntiEntropy(ctx, coord, 2*antiEntropyInterval, antiEntropy, worker)
+		case <-orphanTicker.C:
+			runOrphanGC(ctx, coord, 2*orphanInterval, orphans)
+		case <-tombstoneTicker.C:
+			runTombstoneGC(ctx, coord, 2*tombstoneInterval, tombstones)
+		case <-pendingTicker.C:
+			runPendingReaper(ctx, coord, 2*pendingInterval, pending)
+		case <-multipartTicker.C:
+			runUploadSweeper(ctx, coord, 2*multipartInterval, uploads)
 		}
 	}
 }
 
+// runRepair rebuilds replicas of under-replicated objects
+func runRepair(ctx context.Context, worker *repair.Worker) {
+	start := time.Now()
+	stats, err := worker.RunCycle(ctx)
+	if err != nil {
+		log.Printf("Repair cycle failed: %v", err)
+	}
+	if stats == nil {
+		return
+	}
+	log.Printf("Repair cycle finished in %s: %d offline nodes, scanned %t, %d repairs run, %d repaired, %d failed",
+		time.Since(start).Round(time.Millisecond), len(stats.Offline), stats.Scanned, stats.Found, stats.Repaired, stats.Failed)
+}
+
+// runAntiEntropy compares replica inventories between nodes and repairs the
+// replicas they disagree on
+func runAntiEntropy(ctx context.Context, coord *repair.Coordinator, leaseTTL time.Duration, ae *repair.AntiEntropy, worker *repair.Worker) {
+	if !lead(ctx, coord, "anti-entropy", leaseTTL) {
+		return
+	}
+
+	start := time.Now()
+	divergent, err := ae.Run(ctx)
+	if err != nil {
+		log.Printf("Anti-entropy failed: %v", err)
+		return
+	}
+	stats, err := worker.RepairDivergent(ctx, divergent)
+	if err != nil {
+		log.Printf("Anti-entropy repair failed: %v", err)
+	}
+	log.Printf("Anti-entropy finished in %s: %d divergent replicas, %d repairs run, %d repaired, %d failed",
+		time.Since(start).Round(time.Millisecond), len(divergent), stats.Found, stats.Repaired, stats.Failed)
+}
+
+// runOrphanGC deletes replicas that no metadata accounts for
+func runOrphanGC(ctx context.Context, coord *repair.Coordinator, leaseTTL time.Duration, orphans *repair.OrphanCollector) {
+	if !lead(ctx, coord, "gc/orphans", leaseTTL) {
+		return
+	}
+	report, err := orphans.Run(ctx)
+	if err != nil {
+		log.Printf("Orphan GC failed: %v", err)
+	}
+	if report != nil {
+		report.Log()
+	}
+}
+
+// runTombstoneGC deletes the replicas of deleted and expired versions and
+// purges their records
+func runTombstoneGC(ctx context.Context, coord *repair.Coordinator, leaseTTL time.Duration, tombstones *repair.TombstoneCollector) {
+	if !lead(ctx, coord, "gc/tombstones", leaseTTL) {
+		return
+	}
+	report, err := tombstones.Run(ctx)
+	if err != nil {
+		log.Printf("Tombstone GC failed: %v", err)
+	}
+	report.Log()
+}
+
+// runPendingReaper commits or deletes objects left pending by interrupted
+// writes
+func runPendingReaper(ctx context.Context, coord *repair.Coordinator, leaseTTL time.Duration, pending *repair.PendingReaper) {
+	if !lead(ctx, coord, "gc/pending", leaseTTL) {
+		return
+	}
+	report, err := pending.Run(ctx)
+	if err != nil {
+		log.Printf("Pending reaper failed: %v", err)
+	}
+	if report.Examined > 0 {
+		report.Log()
+	}
+}
+
+// runUploadSweeper aborts multipart uploads past their bucket's
+// AbortIncompleteMultipartUpload lifecycle rule
+func runUploadSweeper(ctx context.Context, coord *repair.Coordinator, leaseTTL time.Duration, uploads *repair.UploadSweeper) {
+	if !lead(ctx, coord, "gc/multipart", leaseTTL) {
+		return
+	}
+	report, err := uploads.Run(ctx)
+	if err != nil {
+		log.Printf("Upload sweeper failed: %v", err)
+	}
+	if report.Buckets > 0 {
+		report.Log()
+	}
+}
+
+// lead reports whether this worker holds the named lease and so runs the
+// cycle. The lease outlives the cycle interval, so the same worker keeps
+// it until it stops.
+func lead(ctx context.Context, coord *repair.Coordinator, name string, ttl time.Duration) bool {
+	leader, err := coord.Acquire(ctx, name, ttl)
+	if err != nil {
+		log.Printf("Lease %s: %v", name, err)
+		return false
+	}
+	if !leader {
+		log.Printf("Skipping %s: run by another worker", name)
+	}
+	return leader
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -77,6 +331,24 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if d, err := time.ParseDuration(value); err == nil {
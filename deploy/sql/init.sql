@@ -3,6 +3,27 @@
 -- Enable UUID extension
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Users own access keys; requests are attributed to the signing key's user
+CREATE TABLE IF NOT EXISTS users (
+    name VARCHAR(64) PRIMARY KEY,
+    -- Quota on all the buckets the user owns (metadata.Quota); NULL if none
+    quota JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+    name VARCHAR(64) PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_name VARCHAR(64) NOT NULL REFERENCES user_groups(name) ON DELETE CASCADE,
+    user_name VARCHAR(64) NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+    PRIMARY KEY (group_name, user_name)
+);
+
+CREATE INDEX idx_group_members_user ON group_members(user_name);
+
 -- Buckets table
 CREATE TABLE IF NOT EXISTS buckets (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -10,12 +31,36 @@ CREATE TABLE IF NOT EXISTS buckets (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     
-    -- Versioning
-    versioning_enabled BOOLEAN DEFAULT FALSE,
+    -- Versioning: NULL until first enabled, then 'Enabled' or 'Suspended'
+    versioning_status VARCHAR(20) CHECK (versioning_status IN ('Enabled', 'Suspended')),
     
     -- Metadata
     region VARCHAR(50) DEFAULT 'us-east-1',
     
+    -- Repair ordering: higher is repaired first among equally at-risk objects
+    repair_priority INTEGER NOT NULL DEFAULT 0,
+    
+    -- Lifecycle rules (AbortIncompleteMultipartUpload); NULL if none
+    lifecycle JSONB,
+    
+    -- Access control: the creating user (NULL for root) and the bucket
+    -- policy document; NULL if none
+    owner VARCHAR(64) REFERENCES users(name) ON DELETE SET NULL,
+    policy TEXT,
+    
+    -- Public access: the canned ACL and the PublicAccessBlock
+    -- configuration; NULL if none
+    acl VARCHAR(20) NOT NULL DEFAULT 'private' CHECK (acl IN ('private', 'public-read')),
+    public_access_block JSONB,
+    
+    -- Hard and soft limits on bytes and objects (metadata.Quota), checked
+    -- against the cost_tracking counters; NULL if none
+    quota JSONB,
+    
+    -- Server-side encryption applied to objects written without one
+    -- (AES256); NULL if none
+    default_encryption VARCHAR(20),
+    
     CONSTRAINT bucket_name_valid CHECK (name ~ '^[a-z0-9][a-z0-9-]*[a-z0-9]$')
 );
 
@@ -30,6 +75,7 @@ CREATE TABLE IF NOT EXISTS objects (
     
     -- Version tracking
     version_id UUID NOT NULL DEFAULT uuid_generate_v4(),
+    null_version BOOLEAN DEFAULT FALSE,  -- the "null" version, written while versioning was off or suspended
     is_latest BOOLEAN DEFAULT TRUE,
     is_delete_marker BOOLEAN DEFAULT FALSE,
     
@@ -38,11 +84,18 @@ CREATE TABLE IF NOT EXISTS objects (
     etag VARCHAR(255) NOT NULL,
     content_type VARCHAR(255) DEFAULT 'application/octet-stream',
     
+    -- Checksums, encoded as "<algorithm>:<hex>"
+    checksum VARCHAR(255),          -- internal integrity checksum (xxhash)
+    s3_checksum VARCHAR(255),       -- S3 flexible checksum requested by the client
+    s3_checksum_type VARCHAR(20),   -- FULL_OBJECT or COMPOSITE for multipart objects
+    parts_count INTEGER DEFAULT 0,  -- number of parts of a multipart object
+    
     -- Placement info (stores node IDs where replicas exist)
     placement JSONB NOT NULL,
     
     -- State management
     state object_state DEFAULT 'committed',
+    noncurrent_at TIMESTAMP WITH TIME ZONE,  -- when the version stopped being the latest
     
     -- User metadata
     metadata JSONB,
@@ -50,6 +103,10 @@ CREATE TABLE IF NOT EXISTS objects (
     -- Tags
     tags JSONB,
     
+    -- Encryption at rest (metadata.Encryption): algorithm, wrapped data
+    -- key and sealed size; NULL if the data is stored in the clear
+    encryption JSONB,
+    
     -- Timestamps
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
@@ -64,6 +121,12 @@ CREATE INDEX idx_objects_bucket_key_latest ON objects(bucket_name, object_key) W
 CREATE INDEX idx_objects_state ON objects(state);
 CREATE INDEX idx_objects_created_at ON objects(created_at);
 
+-- Garbage collection: tombstones and noncurrent versions by age
+CREATE INDEX idx_objects_noncurrent ON objects(noncurrent_at) WHERE NOT is_latest AND state <> 'pending';
+
+-- Master key rotation: data keys by the master key they are wrapped with
+CREATE INDEX idx_objects_encryption_key ON objects((encryption->>'key_id')) WHERE encryption IS NOT NULL;
+
 -- Multipart uploads table
 CREATE TABLE IF NOT EXISTS multipart_uploads (
     upload_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -75,12 +138,22 @@ CREATE TABLE IF NOT EXISTS multipart_uploads (
     content_type VARCHAR(255),
     metadata JSONB,
     
+    -- S3 checksum carried by every part and how part checksums combine
+    checksum_algorithm VARCHAR(20),
+    checksum_type VARCHAR(20) CHECK (checksum_type IN ('FULL_OBJECT', 'COMPOSITE')),
+    
+    -- Encryption at rest of every part, sealed with the upload's data key
+    encryption JSONB,
+    
     -- State
     state VARCHAR(20) DEFAULT 'active' CHECK (state IN ('active', 'completed', 'aborted')),
     
     UNIQUE (bucket_name, object_key, upload_id)
 );
 
+CREATE INDEX idx_multipart_uploads_active ON multipart_uploads(bucket_name, object_key) WHERE state = 'active';
+CREATE INDEX idx_multipart_uploads_initiated ON multipart_uploads(bucket_name, initiated_at) WHERE state = 'active';
+
 -- Multipart upload parts
 CREATE TABLE IF NOT EXISTS multipart_parts (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -91,7 +164,11 @@ CREATE TABLE IF NOT EXISTS multipart_parts (
     size_bytes BIGINT NOT NULL,
     etag VARCHAR(255) NOT NULL,
     
-    -- Placement
+    -- Checksums, encoded as "<algorithm>:<hex>"
+    checksum VARCHAR(255),     -- internal integrity checksum (xxhash)
+    s3_checksum VARCHAR(255),  -- part checksum in the upload's S3 algorithm
+    
+    -- Placement (the part's data is stored as a replica keyed by id)
     placement JSONB NOT NULL,
     
     uploaded_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
@@ -111,6 +188,11 @@ CREATE TABLE IF NOT EXISTS cost_tracking (
     -- Egress tracking
     bytes_read_last_month BIGINT DEFAULT 0,
     bytes_read_current_month BIGINT DEFAULT 0,
+    anonymous_bytes_read_current_month BIGINT DEFAULT 0,  -- share read without credentials
+    
+    -- Parts of multipart uploads aborted by lifecycle rules
+    reclaimed_multipart_bytes BIGINT DEFAULT 0,
+    expired_multipart_uploads INTEGER DEFAULT 0,
     
     -- Cost configuration (dollars per GB)
     storage_cost_per_gb DECIMAL(10, 6) DEFAULT 0.023,
@@ -126,6 +208,17 @@ CREATE TABLE IF NOT EXISTS cost_tracking (
     UNIQUE (bucket_name)
 );
 
+-- Writes that took a bucket's or a user's usage over a soft quota
+CREATE TABLE IF NOT EXISTS quota_events (
+    id BIGSERIAL PRIMARY KEY,
+    scope VARCHAR(20) NOT NULL CHECK (scope IN ('bucket', 'user')),
+    name VARCHAR(255) NOT NULL,
+    resource VARCHAR(20) NOT NULL CHECK (resource IN ('bytes', 'objects')),
+    usage BIGINT NOT NULL,
+    quota_limit BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Access patterns table (for tiering decisions)
 CREATE TABLE IF NOT EXISTS access_patterns (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -161,12 +254,90 @@ CREATE TABLE IF NOT EXISTS repair_log (
     -- Details
     source_node VARCHAR(100),
     target_nodes TEXT[],
-    error_message TEXT
+    error_message TEXT,
+    
+    -- Queue ordering: fewest remaining replicas, then bucket priority, then age
+    remaining_replicas INTEGER NOT NULL DEFAULT 0,
+    bucket_priority INTEGER NOT NULL DEFAULT 0,
+    
+    -- Worker running the repair; the claim can be taken over once it expires
+    claimed_by VARCHAR(255),
+    claim_expires_at TIMESTAMP WITH TIME ZONE
 );
 
 CREATE INDEX idx_repair_log_status ON repair_log(repair_status);
 CREATE INDEX idx_repair_log_detected_at ON repair_log(detected_at);
 
+-- Repair queue: at most one pending repair per issue per object
+CREATE UNIQUE INDEX idx_repair_log_pending ON repair_log(object_id, issue_type) WHERE repair_status = 'pending';
+CREATE INDEX idx_repair_log_queue ON repair_log(remaining_replicas, bucket_priority DESC, detected_at) WHERE repair_status = 'pending';
+CREATE INDEX idx_repair_log_claims ON repair_log(claim_expires_at) WHERE repair_status = 'in_progress';
+
+-- Leases coordinating repair workers: scrub/<node> shards scrubbing by data
+-- node, repair/scan and anti-entropy elect the worker that runs those cycles
+CREATE TABLE IF NOT EXISTS leases (
+    name VARCHAR(255) PRIMARY KEY,
+    holder VARCHAR(255) NOT NULL,
+    acquired_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Scrubber position per data node, so a restarted worker resumes its pass
+CREATE TABLE IF NOT EXISTS scrub_progress (
+    node_id VARCHAR(100) PRIMARY KEY,
+    
+    -- Next ring token to scrub (the uint64 token stored bit for bit)
+    cursor_token BIGINT NOT NULL DEFAULT 0,
+    pass_started_at TIMESTAMP WITH TIME ZONE,
+    last_pass_completed_at TIMESTAMP WITH TIME ZONE,
+    
+    -- Totals for the current pass
+    bytes_scrubbed BIGINT DEFAULT 0,
+    replicas_scrubbed BIGINT DEFAULT 0,
+    corrupt_found BIGINT DEFAULT 0,
+    
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Access keys that sign S3 requests with AWS Signature V4. Verifying a
+-- signature needs the secret itself, not a hash of it, so it is stored
+-- encrypted with the gateway's SECRETS_KEY (AES-256-GCM). Keys without a
+-- user are root keys.
+CREATE TABLE IF NOT EXISTS access_keys (
+    access_key_id VARCHAR(128) PRIMARY KEY,
+    user_name VARCHAR(64) REFERENCES users(name) ON DELETE CASCADE,
+    sealed_secret BYTEA NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'inactive')),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_access_keys_user ON access_keys(user_name);
+
+-- Rate limits the gateways enforce, set with PUT /admin/rate-limits. A
+-- single row holds the JSON configuration.
+CREATE TABLE IF NOT EXISTS rate_limit_config (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    config JSONB NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Requests and bytes each gateway has charged to each rate limit key
+-- (access_key:<id>, source_ip:<ip> or bucket:<name>), when gateways share
+-- their limits (RATE_LIMIT_MODE=shared). Every gateway debits what the
+-- others charged from its own token buckets. Rows not updated for ten
+-- minutes are dropped.
+CREATE TABLE IF NOT EXISTS rate_limit_usage (
+    gateway_id VARCHAR(255) NOT NULL,
+    limit_key VARCHAR(512) NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (gateway_id, limit_key)
+);
+
+CREATE INDEX idx_rate_limit_usage_key ON rate_limit_usage(limit_key);
+
 -- Node health table
 CREATE TABLE IF NOT EXISTS node_health (
     node_id VARCHAR(100) PRIMARY KEY,
@@ -0,0 +1,32 @@
+-- Upgrade a database created before object versioning: replace
+-- buckets.versioning_enabled with versioning_status and add
+-- objects.null_version. Safe to run more than once.
+
+BEGIN;
+
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS
+    versioning_status VARCHAR(20) CHECK (versioning_status IN ('Enabled', 'Suspended'));
+
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS null_version BOOLEAN DEFAULT FALSE;
+
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'buckets'
+            AND column_name = 'versioning_enabled'
+    ) THEN
+        UPDATE buckets SET versioning_status = 'Enabled'
+        WHERE versioning_enabled AND versioning_status IS NULL;
+
+        -- Objects written while versioning was off are their key's null
+        -- version
+        UPDATE objects SET null_version = TRUE
+        FROM buckets
+        WHERE objects.bucket_name = buckets.name AND NOT COALESCE(buckets.versioning_enabled, FALSE);
+
+        ALTER TABLE buckets DROP COLUMN versioning_enabled;
+    END IF;
+END $$;
+
+COMMIT;
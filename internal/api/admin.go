@@ -0,0 +1,120 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// RepairStatus handles GET /admin/repair/status. It reports the depth of
+// the repair queue per number of remaining replicas, how far the scrubber
+// has got through each data node and which repair worker holds each lease,
+// from the state the repair workers persist.
+func (g *Gateway) RepairStatus(c *gin.Context) {
+	ctx := c.Request.Context()
+	depths, err := g.metadata.RepairQueueDepth(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	progress, err := g.metadata.ListScrubProgress(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	leases, err := g.metadata.ListLeases(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	queue := make([]gin.H, 0, len(depths))
+	var pending, inProgress int64
+	for _, d := range depths {
+		queue = append(queue, gin.H{
+			"remaining_replicas": d.RemainingReplicas,
+			"at_risk":            d.RemainingReplicas <= metadata.AtRiskReplicas,
+			"pending":            d.Pending,
+			"in_progress":        d.InProgress,
+		})
+		pending += d.Pending
+		inProgress += d.InProgress
+	}
+
+	nodes := make([]gin.H, 0, len(progress))
+	var bytesScrubbed, corrupt int64
+	for _, p := range progress {
+		node := gin.H{
+			"node_id":           p.NodeID,
+			"state":             "idle",
+			"progress":          0.0,
+			"bytes_scrubbed":    p.BytesScrubbed,
+			"replicas_scrubbed": p.ReplicasScrubbed,
+			"corrupt_found":     p.CorruptFound,
+			"updated_at":        p.UpdatedAt.Format(time.RFC3339),
+		}
+		if !p.PassStartedAt.IsZero() {
+			node["state"] = "scrubbing"
+			node["progress"] = float64(p.Cursor) / math.MaxUint64
+			node["pass_started_at"] = p.PassStartedAt.Format(time.RFC3339)
+		}
+		if !p.LastPassCompletedAt.IsZero() {
+			node["last_pass_completed_at"] = p.LastPassCompletedAt.Format(time.RFC3339)
+		}
+		nodes = append(nodes, node)
+		bytesScrubbed += p.BytesScrubbed
+		corrupt += p.CorruptFound
+	}
+
+	held := make([]gin.H, 0, len(leases))
+	for _, l := range leases {
+		held = append(held, gin.H{
+			"name":        l.Name,
+			"holder":      l.Holder,
+			"acquired_at": l.AcquiredAt.Format(time.RFC3339),
+			"expires_at":  l.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"leases": held,
+		"queue": gin.H{
+			"by_priority": queue,
+			"pending":     pending,
+			"in_progress": inProgress,
+		},
+		"scrub": gin.H{
+			"nodes":          nodes,
+			"bytes_scrubbed": bytesScrubbed,
+			"corrupt_found":  corrupt,
+		},
+	})
+}
+
+// SetBucketRepairPriority handles PUT /admin/buckets/:bucket/repair-priority
+// with a JSON body {"priority": n}. Among objects with the same number of
+// remaining replicas, those in higher-priority buckets are repaired first.
+func (g *Gateway) SetBucketRepairPriority(c *gin.Context) {
+	var req struct {
+		Priority *int `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Priority == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be {\"priority\": <integer>}"})
+		return
+	}
+	bucket := c.Param("bucket")
+	err := g.metadata.SetBucketRepairPriority(c.Request.Context(), bucket, *req.Priority)
+	if errors.Is(err, metadata.ErrBucketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bucket": bucket, "repair_priority": *req.Priority})
+}
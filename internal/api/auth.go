@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// Gin context keys set by AuthMiddleware: the access key ID a request was
+// signed with, the user owning it (empty for root keys), whether it was made
+// without credentials, and the signer that checks the chunks of a signed
+// aws-chunked payload
+const (
+	contextAccessKey   = "access_key"
+	contextUser        = "user"
+	contextAnonymous   = "anonymous"
+	contextChunkSigner = "chunk_signer"
+)
+
+// AuthMiddleware verifies the AWS Signature V4 of S3 requests against the
+// access keys in the metadata store. Requests must carry an Authorization
+// header and X-Amz-Content-Sha256, or be made with a pre-signed URL; a
+// payload signed with its hash is checked as the handler reads it, as are
+// the chunks of a streaming payload. GET and HEAD requests without
+// credentials go through as anonymous requests, which only a public bucket
+// ACL or policy lets read anything.
+func (g *Gateway) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !g.authEnabled {
+			c.Next()
+			countRequest(c, accessOpen)
+			return
+		}
+		if isAnonymous(c.Request) {
+			c.Set(contextAnonymous, true)
+			c.Next()
+			countRequest(c, accessAnonymous)
+			return
+		}
+		key, ok := g.authenticate(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		c.Set(contextAccessKey, key.AccessKeyID)
+		c.Set(contextUser, key.UserName)
+		c.Next()
+		countRequest(c, accessSigned)
+	}
+}
+
+// isAnonymous reports whether r is a read made without credentials. Other
+// requests without credentials are refused by authenticate.
+func isAnonymous(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && !auth.IsPresigned(r.URL.Query())
+}
+
+// authenticate verifies the request's signature and returns the access key
+// that signed it. On failure the error response has been written.
+func (g *Gateway) authenticate(c *gin.Context) (*metadata.AccessKey, bool) {
+	r := c.Request
+	header := r.Header.Get("Authorization")
+	if auth.IsPresigned(r.URL.Query()) {
+		if header != "" {
+			g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "Only one auth mechanism allowed")
+			return nil, false
+		}
+		return g.authenticatePresigned(c)
+	}
+	if header == "" {
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Access Denied")
+		return nil, false
+	}
+	parsed, err := auth.ParseAuthorization(header)
+	switch {
+	case errors.Is(err, auth.ErrUnsupported):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"The authorization mechanism you have provided is not supported. Please use "+auth.Algorithm+".")
+		return nil, false
+	case err != nil:
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationHeaderMalformed, err.Error())
+		return nil, false
+	}
+	if parsed.Scope.Service != auth.Service {
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationHeaderMalformed,
+			"The authorization header is malformed; incorrect service \""+parsed.Scope.Service+"\". This endpoint belongs to \""+auth.Service+"\".")
+		return nil, false
+	}
+
+	payloadHash := r.Header.Get(auth.HeaderContentSHA256)
+	switch {
+	case payloadHash == "":
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"Missing required header for this request: x-amz-content-sha256")
+		return nil, false
+	case payloadHash != auth.UnsignedPayload && !auth.IsStreaming(payloadHash) && !isSHA256Hex(payloadHash):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			"x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-AWS4-HMAC-SHA256-PAYLOAD, "+
+				"STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER, STREAMING-UNSIGNED-PAYLOAD-TRAILER or a valid sha256 value")
+		return nil, false
+	}
+
+	signedAt, err := auth.RequestTime(r.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied,
+			"AWS authentication requires a valid Date or x-amz-date header")
+		return nil, false
+	}
+	if err := auth.CheckSkew(signedAt, time.Now()); err != nil {
+		g.errorResponse(c, http.StatusForbidden, ErrRequestTimeTooSkewed,
+			"The difference between the request time and the current time is too large")
+		return nil, false
+	}
+
+	key, secret, ok := g.accessKey(c, parsed.AccessKeyID)
+	if !ok {
+		return nil, false
+	}
+
+	err = auth.Verify(r, parsed, secret, signedAt)
+	switch {
+	case errors.Is(err, auth.ErrSignatureMismatch):
+		g.errorResponse(c, http.StatusForbidden, ErrSignatureDoesNotMatch,
+			"The request signature we calculated does not match the signature you provided. Check your key and signing method.")
+		return nil, false
+	case err != nil:
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationHeaderMalformed, err.Error())
+		return nil, false
+	}
+	switch {
+	case payloadHash == auth.StreamingPayload, payloadHash == auth.StreamingPayloadTrailer:
+		// objectBody decodes the chunks, chaining their signatures from
+		// the one just verified
+		c.Set(contextChunkSigner, auth.NewChunkSigner(secret, parsed.Scope, signedAt, parsed.Signature))
+	case !auth.IsStreaming(payloadHash):
+		r.Body = auth.NewPayloadReader(r.Body, payloadHash)
+	}
+	return key, true
+}
+
+// authenticatePresigned verifies the query-string signature of a request
+// made with a pre-signed URL. Only object reads and uploads may be
+// pre-signed; the payload of an upload is unsigned.
+func (g *Gateway) authenticatePresigned(c *gin.Context) (*metadata.AccessKey, bool) {
+	r := c.Request
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+	default:
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied,
+			"Pre-signed URLs may only be used for GET, HEAD and PUT requests")
+		return nil, false
+	}
+	parsed, err := auth.ParsePresigned(r.URL.Query())
+	switch {
+	case errors.Is(err, auth.ErrUnsupported):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"The authorization mechanism you have provided is not supported. Please use "+auth.Algorithm+".")
+		return nil, false
+	case err != nil:
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationQueryParametersError, err.Error())
+		return nil, false
+	}
+	if parsed.Scope.Service != auth.Service {
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationQueryParametersError,
+			"Error parsing the X-Amz-Credential parameter; incorrect service \""+parsed.Scope.Service+"\". This endpoint belongs to \""+auth.Service+"\".")
+		return nil, false
+	}
+	err = parsed.CheckExpiry(time.Now())
+	switch {
+	case errors.Is(err, auth.ErrExpired):
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Request has expired")
+		return nil, false
+	case err != nil:
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Request is not valid yet")
+		return nil, false
+	}
+
+	key, secret, ok := g.accessKey(c, parsed.AccessKeyID)
+	if !ok {
+		return nil, false
+	}
+
+	err = auth.VerifyPresigned(r, parsed, secret)
+	switch {
+	case errors.Is(err, auth.ErrSignatureMismatch):
+		g.errorResponse(c, http.StatusForbidden, ErrSignatureDoesNotMatch,
+			"The request signature we calculated does not match the signature you provided. Check your key and signing method.")
+		return nil, false
+	case err != nil:
+		g.errorResponse(c, http.StatusBadRequest, ErrAuthorizationQueryParametersError, err.Error())
+		return nil, false
+	}
+	return key, true
+}
+
+// accessKey looks up the access key a request claims to be signed with and
+// unseals its secret. Unknown, inactive and expired keys are refused alike.
+// On failure the error response has been written.
+func (g *Gateway) accessKey(c *gin.Context, accessKeyID string) (*metadata.AccessKey, string, bool) {
+	if g.secrets == nil {
+		g.errorResponse(c, http.StatusServiceUnavailable, ErrServiceUnavailable,
+			"The access key store is not configured")
+		return nil, "", false
+	}
+	key, err := g.metadata.GetAccessKey(c.Request.Context(), accessKeyID)
+	switch {
+	case errors.Is(err, metadata.ErrAccessKeyNotFound),
+		err == nil && (key.Status != metadata.AccessKeyActive || key.Expired(time.Now())):
+		g.errorResponse(c, http.StatusForbidden, ErrInvalidAccessKeyID,
+			"The AWS Access Key Id you provided does not exist in our records.")
+		return nil, "", false
+	case err != nil:
+		g.lookupError(c, err)
+		return nil, "", false
+	}
+	secret, err := g.secrets.Open(key.AccessKeyID, key.SealedSecret)
+	if err != nil {
+		g.errorResponse(c, http.StatusInternalServerError, ErrInternalError,
+			"access key "+key.AccessKeyID+": "+err.Error())
+		return nil, "", false
+	}
+	return key, secret, true
+}
+
+// isSHA256Hex reports whether s is a hex-encoded SHA-256 digest
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
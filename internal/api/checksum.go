@@ -0,0 +1,179 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// S3 flexible checksum headers
+const (
+	headerSDKChecksumAlgorithm = "x-amz-sdk-checksum-algorithm"
+	headerChecksumAlgorithm    = "x-amz-checksum-algorithm"
+	headerChecksumType         = "x-amz-checksum-type"
+	headerChecksumMode         = "x-amz-checksum-mode"
+	headerTrailer              = "x-amz-trailer"
+)
+
+// checksumRequest describes the flexible checksum a client attached to an upload
+type checksumRequest struct {
+	// Algorithm is empty when the client did not ask for a flexible checksum
+	Algorithm checksum.Algorithm
+
+	// Expected is zero when the client named an algorithm but sent no value
+	Expected checksum.Value
+
+	// Trailing is set when the value follows the body in an aws-chunked
+	// trailer; Expected is filled in by readTrailer
+	Trailing bool
+}
+
+// parseChecksumRequest reads x-amz-sdk-checksum-algorithm and x-amz-checksum-*
+// from upload request headers
+func parseChecksumRequest(h http.Header) (checksumRequest, error) {
+	var req checksumRequest
+
+	for _, algo := range checksum.S3Algorithms {
+		encoded := h.Get(algo.S3Header())
+		if encoded == "" {
+			continue
+		}
+		if req.Algorithm != "" {
+			return checksumRequest{}, fmt.Errorf("expecting a single x-amz-checksum- header")
+		}
+		value, err := checksum.ParseBase64(algo, encoded)
+		if err != nil {
+			return checksumRequest{}, fmt.Errorf("value for %s header is invalid", algo.S3Header())
+		}
+		req.Algorithm = algo
+		req.Expected = value
+	}
+
+	if name := h.Get(headerTrailer); name != "" {
+		algo, ok := trailerChecksumAlgorithm(name)
+		if !ok {
+			return checksumRequest{}, fmt.Errorf("the %s header %q is not supported", headerTrailer, name)
+		}
+		if req.Algorithm != "" {
+			return checksumRequest{}, fmt.Errorf("expecting a single x-amz-checksum- header")
+		}
+		req.Algorithm = algo
+		req.Trailing = true
+	}
+
+	if name := h.Get(headerSDKChecksumAlgorithm); name != "" {
+		algo, err := checksum.ParseS3Algorithm(name)
+		if err != nil {
+			return checksumRequest{}, fmt.Errorf("checksum algorithm %q is not supported", name)
+		}
+		if req.Algorithm != "" && req.Algorithm != algo {
+			return checksumRequest{}, fmt.Errorf("value for %s header is invalid", headerSDKChecksumAlgorithm)
+		}
+		req.Algorithm = algo
+	}
+
+	return req, nil
+}
+
+// trailerChecksumAlgorithm returns the algorithm of the x-amz-checksum-*
+// header named in x-amz-trailer
+func trailerChecksumAlgorithm(name string) (checksum.Algorithm, bool) {
+	for _, algo := range checksum.S3Algorithms {
+		if strings.EqualFold(strings.TrimSpace(name), algo.S3Header()) {
+			return algo, true
+		}
+	}
+	return "", false
+}
+
+// readTrailer takes the expected checksum from the trailer of an aws-chunked
+// body, once the body has been read
+func (r *checksumRequest) readTrailer(trailer http.Header) error {
+	if !r.Trailing {
+		return nil
+	}
+	value, err := checksum.ParseBase64(r.Algorithm, trailer.Get(r.Algorithm.S3Header()))
+	if err != nil {
+		return fmt.Errorf("value for %s trailer is invalid", r.Algorithm.S3Header())
+	}
+	r.Expected = value
+	return nil
+}
+
+// parseMultipartChecksum reads the checksum algorithm and type a client
+// chose when creating a multipart upload. Without an explicit type the
+// algorithm's S3 default applies.
+func parseMultipartChecksum(h http.Header) (checksum.Algorithm, checksum.Type, error) {
+	name := h.Get(headerChecksumAlgorithm)
+	typeName := h.Get(headerChecksumType)
+	if name == "" {
+		if typeName != "" {
+			return "", "", fmt.Errorf("the %s header requires %s", headerChecksumType, headerChecksumAlgorithm)
+		}
+		return "", "", nil
+	}
+
+	algo, err := checksum.ParseS3Algorithm(name)
+	if err != nil {
+		return "", "", fmt.Errorf("checksum algorithm %q is not supported", name)
+	}
+	sumType := algo.DefaultType()
+	if typeName != "" {
+		if sumType, err = checksum.ParseType(strings.ToUpper(typeName)); err != nil {
+			return "", "", fmt.Errorf("value for %s header is invalid", headerChecksumType)
+		}
+	}
+	if !algo.SupportsType(sumType) {
+		return "", "", fmt.Errorf("the %s checksum type cannot be used with the %s algorithm", sumType, algo.S3Name())
+	}
+	return algo, sumType, nil
+}
+
+// parseContentMD5 decodes the optional Content-MD5 request header
+func parseContentMD5(h http.Header) (checksum.Value, error) {
+	encoded := h.Get("Content-MD5")
+	if encoded == "" {
+		return checksum.Value{}, nil
+	}
+	value, err := checksum.ParseBase64(checksum.MD5, encoded)
+	if err != nil {
+		return checksum.Value{}, fmt.Errorf("the Content-MD5 you specified is not valid")
+	}
+	return value, nil
+}
+
+// checksumModeEnabled reports whether the client asked for checksums on GET/HEAD
+func checksumModeEnabled(c *gin.Context) bool {
+	return strings.EqualFold(c.GetHeader(headerChecksumMode), "ENABLED")
+}
+
+// setChecksumHeaders returns the stored flexible checksum when the client opted in
+func setChecksumHeaders(c *gin.Context, obj *metadata.Object) {
+	if !checksumModeEnabled(c) || obj.S3Checksum.IsZero() {
+		return
+	}
+	c.Header(obj.S3Checksum.Algorithm.S3Header(), s3ChecksumValue(obj))
+	c.Header(headerChecksumType, string(s3ChecksumType(obj)))
+}
+
+// s3ChecksumType returns how an object's flexible checksum was derived.
+// Checksums of single uploads always cover the whole object.
+func s3ChecksumType(obj *metadata.Object) checksum.Type {
+	if obj.S3ChecksumType == "" {
+		return checksum.TypeFullObject
+	}
+	return obj.S3ChecksumType
+}
+
+// s3ChecksumValue formats an object's flexible checksum as S3 reports it:
+// base64, with a "-<parts>" suffix for composite checksums
+func s3ChecksumValue(obj *metadata.Object) string {
+	if s3ChecksumType(obj) == checksum.TypeComposite {
+		return fmt.Sprintf("%s-%d", obj.S3Checksum.Base64(), obj.PartsCount)
+	}
+	return obj.S3Checksum.Base64()
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// S3 CopyObject headers
+const (
+	headerCopySource          = "x-amz-copy-source"
+	headerCopySourceVersionID = "x-amz-copy-source-version-id"
+	headerMetadataDirective   = "x-amz-metadata-directive"
+)
+
+// copyObjectResult is the CopyObject response
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// parseCopySource parses x-amz-copy-source: the URL-encoded bucket and key
+// of the source, optionally led by a slash and followed by ?versionId=
+func parseCopySource(value string) (resource, error) {
+	var src resource
+	path, query, hasQuery := strings.Cut(value, "?")
+	if hasQuery {
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return resource{}, fmt.Errorf("invalid copy source query %q", query)
+		}
+		if _, ok := params["versionId"]; ok {
+			src.versionID, src.versioned = params.Get("versionId"), true
+		}
+	}
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		return resource{}, fmt.Errorf("invalid copy source encoding")
+	}
+	src.bucket, src.key, _ = strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if src.bucket == "" || src.key == "" {
+		return resource{}, errors.New("Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+	}
+	return src, nil
+}
+
+// CopyObject copies an object, or one version of it, to the request's key.
+// The data is read and written again, so the copy is encrypted as the
+// request and the destination bucket say, whatever the source's
+// encryption: a source encrypted with a customer-provided key needs that
+// key in the x-amz-copy-source-server-side-encryption-customer-* headers,
+// and the copy can be given another with the usual SSE-C headers.
+func (g *Gateway) CopyObject(c *gin.Context) {
+	if !g.authorize(c, actionPutObject) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	ctx := c.Request.Context()
+
+	src, err := parseCopySource(c.GetHeader(headerCopySource))
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	}
+	action := actionGetObject
+	if src.versioned {
+		action = actionGetObjectVersion
+	}
+	if !g.authorizeResource(c, action, src) {
+		return
+	}
+	directive := c.GetHeader(headerMetadataDirective)
+	if directive != "" && directive != "COPY" && directive != "REPLACE" {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "Unknown metadata directive.")
+		return
+	}
+	if src.bucket == bucket && src.key == key && directive != "REPLACE" &&
+		c.GetHeader(headerSSE) == "" && !sseCustomerHeaders.present(c) {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.")
+		return
+	}
+
+	source, ok := g.lookupCopySource(c, src)
+	if !ok {
+		return
+	}
+	sourceKey, ok := g.readKey(c, copySourceCustomerHeaders, source.Encryption, objectKeyOwner(source.ID))
+	if !ok {
+		return
+	}
+	b, err := g.metadata.GetBucket(ctx, bucket)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	id := metadata.NewID()
+	encryption, dataKey, ok := g.writeEncryption(c, b, objectKeyOwner(id))
+	if !ok {
+		return
+	}
+	quotas, ok := g.checkQuota(c, b, source.SizeBytes)
+	if !ok {
+		return
+	}
+
+	// The copy gets the source's flexible checksum algorithm, over the
+	// whole object
+	algo := source.S3Checksum.Algorithm
+	hasher, err := checksum.NewMultiHasher(checksum.XXHash, checksum.MD5, algo)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	obj := &metadata.Object{
+		ID:          id,
+		BucketName:  bucket,
+		ObjectKey:   key,
+		ContentType: source.ContentType,
+		Metadata:    source.Metadata,
+		Tags:        source.Tags,
+		Encryption:  encryption,
+	}
+	if directive == "REPLACE" {
+		obj.ContentType = c.GetHeader("Content-Type")
+		obj.Metadata = nil
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = "application/octet-stream"
+	}
+	r := g.readObject(ctx, source, sourceKey, 0, source.SizeBytes)
+	defer r.Close()
+	if err := g.writeObject(ctx, obj, r, hasher, dataKey); err != nil {
+		g.writeError(c, err)
+		return
+	}
+
+	// Encrypted sources are authenticated segment by segment as they are
+	// decrypted; plaintext ones are checked against their checksum
+	if hasher.Size() != source.SizeBytes {
+		err = fmt.Errorf("read %d of %d bytes", hasher.Size(), source.SizeBytes)
+	} else if source.Encryption == nil {
+		err = hasher.Verify(source.Checksum)
+	}
+	if err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.errorResponse(c, http.StatusInternalServerError, ErrInternalError,
+			fmt.Sprintf("copy source %s/%s (%s): %v", src.bucket, src.key, source.ID, err))
+		return
+	}
+
+	md5sum, _ := hasher.Sum(checksum.MD5)
+	obj.ETag = md5sum.Hex()
+	if algo != "" {
+		obj.S3Checksum, _ = hasher.Sum(algo)
+		obj.S3ChecksumType = checksum.TypeFullObject
+	}
+	if err := g.metadata.CommitObject(ctx, obj); err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.writeError(c, err)
+		return
+	}
+	g.quotaWritten(ctx, quotas, obj.SizeBytes)
+
+	if src.versioned || !source.NullVersion {
+		c.Header(headerCopySourceVersionID, versionID(source))
+	}
+	if b.Versioning != "" {
+		c.Header(headerVersionID, versionID(obj))
+	}
+	setEncryptionHeaders(c, obj.Encryption)
+	if !obj.S3Checksum.IsZero() {
+		c.Header(obj.S3Checksum.Algorithm.S3Header(), obj.S3Checksum.Base64())
+		c.Header(headerChecksumType, string(obj.S3ChecksumType))
+	}
+	c.XML(http.StatusOK, copyObjectResult{
+		ETag:         "\"" + obj.ETag + "\"",
+		LastModified: obj.CreatedAt.UTC().Format(timeFormatISO8601),
+	})
+}
+
+// lookupCopySource returns the object, or the version of it, that a copy
+// reads. On failure the error response has been written: like S3, a
+// version that is a delete marker cannot be copied.
+func (g *Gateway) lookupCopySource(c *gin.Context, src resource) (*metadata.Object, bool) {
+	ctx := c.Request.Context()
+	if !src.versioned {
+		obj, err := g.metadata.GetObject(ctx, src.bucket, src.key)
+		if err != nil {
+			g.lookupError(c, err)
+			return nil, false
+		}
+		return obj, true
+	}
+
+	obj, err := g.metadata.GetObjectVersion(ctx, src.bucket, src.key, src.versionID)
+	if errors.Is(err, metadata.ErrObjectNotFound) {
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchVersion, "The specified version does not exist")
+		return nil, false
+	}
+	if err != nil {
+		g.lookupError(c, err)
+		return nil, false
+	}
+	if obj.IsDeleteMarker {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"The source of a copy request may not specifically refer to a delete marker by version id.")
+		return nil, false
+	}
+	return obj, true
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+	"github.com/mrmushfiq/plinth/internal/quorum"
+	"github.com/mrmushfiq/plinth/internal/sse"
+)
+
+// objectStore keeps the latest version of each key of one bucket in memory
+type objectStore struct {
+	metadata.Service
+	bucket *metadata.Bucket
+
+	mu      sync.Mutex
+	objects map[string]*metadata.Object
+}
+
+func (s *objectStore) GetBucket(ctx context.Context, name string) (*metadata.Bucket, error) {
+	if name != s.bucket.Name {
+		return nil, metadata.ErrBucketNotFound
+	}
+	return s.bucket, nil
+}
+
+func (s *objectStore) CreateObject(ctx context.Context, obj *metadata.Object) error {
+	if obj.ID == "" {
+		obj.ID = metadata.NewID()
+	}
+	obj.VersionID, obj.CreatedAt = metadata.NewID(), time.Now()
+	return nil
+}
+
+func (s *objectStore) RecordEgress(ctx context.Context, bucketName string, bytes int64, anonymous bool) error {
+	return nil
+}
+
+func (s *objectStore) AbortObject(ctx context.Context, id string) error {
+	return nil
+}
+
+func (s *objectStore) CommitObject(ctx context.Context, obj *metadata.Object) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj.State, obj.IsLatest, obj.NullVersion = metadata.ObjectStateCommitted, true, true
+	committed := *obj
+	s.objects[obj.ObjectKey] = &committed
+	return nil
+}
+
+func (s *objectStore) GetObject(ctx context.Context, bucketName, objectKey string) (*metadata.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[objectKey]
+	if !ok || bucketName != s.bucket.Name {
+		return nil, metadata.ErrObjectNotFound
+	}
+	return obj, nil
+}
+
+// oneNode places every object on the data node "node-1"
+type oneNode struct {
+	placement.Controller
+}
+
+func (oneNode) GetNodes(ctx context.Context, objectKey string, replicationFactor int) ([]placement.Node, error) {
+	return []placement.Node{{ID: "node-1"}}, nil
+}
+
+// dataGateway serves a gateway over TLS, storing objects in objectStore
+// and on one data node, with one master key
+func dataGateway(t *testing.T) (*httptest.Server, *objectStore) {
+	t.Helper()
+	store, err := datanode.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	datanode.NewServer("node-1", store).Register(grpcServer)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	nodes := datanode.NewPool()
+	nodes.Add("node-1", lis.Addr().String())
+	t.Cleanup(func() { nodes.Close() })
+
+	keyring, err := sse.ParseKeyring([]byte("k1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, sse.MasterKeySize))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := &objectStore{bucket: &metadata.Bucket{Name: "bkt"}, objects: make(map[string]*metadata.Object)}
+	g := NewGateway(Config{
+		Metadata:  objects,
+		Placement: oneNode{},
+		Nodes:     nodes,
+		Quorum:    quorum.Config{ReplicationFactor: 1, WriteQuorum: 1, ReadQuorum: 1},
+		Keyring:   keyring,
+	})
+	srv := httptest.NewTLSServer(SetupRouter(g, "test"))
+	t.Cleanup(srv.Close)
+	return srv, objects
+}
+
+// customerHeaders returns the headers giving key as a customer-provided
+// key in h
+func customerHeaders(h customerKeyHeaders, key []byte) map[string]string {
+	sum := md5.Sum(key)
+	return map[string]string{
+		h.algorithm: "AES256",
+		h.key:       base64.StdEncoding.EncodeToString(key),
+		h.keyMD5:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func send(t *testing.T, srv *httptest.Server, method, path string, body []byte, headers ...map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		for name, value := range h {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readBody(t, resp)
+}
+
+// TestCopyObjectCustomerKeys copies an object encrypted with a
+// customer-provided key to a copy under another customer-provided key and to
+// a plaintext copy
+func TestCopyObjectCustomerKeys(t *testing.T) {
+	srv, objects := dataGateway(t)
+	data := bytes.Repeat([]byte("plinth "), 20000)
+	sourceKey := bytes.Repeat([]byte{1}, 32)
+	destKey := bytes.Repeat([]byte{2}, 32)
+	source := customerHeaders(sseCustomerHeaders, sourceKey)
+	copySource := map[string]string{headerCopySource: "/bkt/src%20key"}
+
+	if resp, body := send(t, srv, http.MethodPut, "/bkt/src key", data, source); resp.StatusCode != http.StatusOK {
+		t.Fatalf("put: status %d: %s", resp.StatusCode, body)
+	}
+
+	t.Run("to another customer key", func(t *testing.T) {
+		resp, body := send(t, srv, http.MethodPut, "/bkt/dst", nil, copySource,
+			customerHeaders(copySourceCustomerHeaders, sourceKey), customerHeaders(sseCustomerHeaders, destKey))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("copy: status %d: %s", resp.StatusCode, body)
+		}
+		if got := resp.Header.Get(headerSSECustomerAlgorithm); got != "AES256" {
+			t.Errorf("%s %q, want AES256", headerSSECustomerAlgorithm, got)
+		}
+
+		resp, body = send(t, srv, http.MethodGet, "/bkt/dst", nil, customerHeaders(sseCustomerHeaders, destKey))
+		if resp.StatusCode != http.StatusOK || body != string(data) {
+			t.Fatalf("get with the new key: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+		resp, body = send(t, srv, http.MethodGet, "/bkt/dst", nil, source)
+		if resp.StatusCode != http.StatusForbidden || s3ErrorCode(t, body) != ErrAccessDenied {
+			t.Fatalf("get with the source key: status %d: %s", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("to plaintext", func(t *testing.T) {
+		resp, body := send(t, srv, http.MethodPut, "/bkt/plain", nil, copySource,
+			customerHeaders(copySourceCustomerHeaders, sourceKey))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("copy: status %d: %s", resp.StatusCode, body)
+		}
+		if obj := objects.objects["plain"]; obj.Encryption != nil || obj.ETag != objects.objects["src key"].ETag {
+			t.Fatalf("copy encrypted as %+v with ETag %s", obj.Encryption, obj.ETag)
+		}
+		resp, body = send(t, srv, http.MethodGet, "/bkt/plain", nil)
+		if resp.StatusCode != http.StatusOK || body != string(data) {
+			t.Fatalf("get: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+	})
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{"without the source key", nil, http.StatusBadRequest, ErrInvalidRequest},
+		{"with the wrong source key", customerHeaders(copySourceCustomerHeaders, destKey), http.StatusForbidden, ErrAccessDenied},
+		{"with the source key as the destination key", source, http.StatusBadRequest, ErrInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodPut, "/bkt/other", nil, copySource, tt.headers)
+			if resp.StatusCode != tt.status || s3ErrorCode(t, body) != tt.code {
+				t.Fatalf("status %d: %s", resp.StatusCode, body)
+			}
+		})
+	}
+	if _, ok := objects.objects["other"]; ok {
+		t.Error("a refused copy was stored")
+	}
+
+	// A source key for a source not encrypted with one is refused
+	resp, body := send(t, srv, http.MethodPut, "/bkt/other", nil, map[string]string{headerCopySource: "bkt/plain"},
+		customerHeaders(copySourceCustomerHeaders, sourceKey))
+	if resp.StatusCode != http.StatusBadRequest || s3ErrorCode(t, body) != ErrInvalidRequest {
+		t.Fatalf("copy of plaintext with a source key: status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestParseCopySource(t *testing.T) {
+	tests := []struct {
+		value string
+		want  resource
+		ok    bool
+	}{
+		{"bkt/key", resource{bucket: "bkt", key: "key"}, true},
+		{"/bkt/dir/a%20b%3F", resource{bucket: "bkt", key: "dir/a b?"}, true},
+		{"bkt/key?versionId=v1", resource{bucket: "bkt", key: "key", versionID: "v1", versioned: true}, true},
+		{"bkt", resource{}, false},
+		{"/bkt/", resource{}, false},
+		{"bkt/%zz", resource{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCopySource(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseCopySource(%q) = %+v, %v", tt.value, got, err)
+		}
+	}
+}
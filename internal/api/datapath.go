@@ -0,0 +1,553 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+	"github.com/mrmushfiq/plinth/internal/quorum"
+	"github.com/mrmushfiq/plinth/internal/sse"
+)
+
+// errIncompleteBody marks failures reading the client's request body
+var errIncompleteBody = errors.New("incomplete request body")
+
+// cleanupTimeout bounds best-effort cleanup after a failed write
+const cleanupTimeout = 30 * time.Second
+
+// writeObject creates a pending record for obj and streams body to the
+// replicas chosen by the placement controller. The body is read exactly once:
+// hasher sees every byte on its way to the data nodes. On success obj holds
+// the stored size, internal checksum and placement, and is still pending;
+// the caller verifies client digests and then commits or discards it.
+//
+// With a data key the body is sealed with it on the way, as for sealBody,
+// and obj.Encryption gets the sealed size.
+func (g *Gateway) writeObject(ctx context.Context, obj *metadata.Object, body io.Reader, hasher *checksum.MultiHasher, dataKey []byte) error {
+	nodeIDs, err := g.placeObject(ctx, obj.BucketName, obj.ObjectKey)
+	if err != nil {
+		return err
+	}
+	token := placement.KeyHash(placement.RingKey(obj.BucketName, obj.ObjectKey))
+	body, sent, err := sealBody(body, hasher, dataKey)
+	if err != nil {
+		return err
+	}
+
+	obj.State = metadata.ObjectStatePending
+	obj.IsLatest = false
+	obj.Placement = nodeIDs
+	if err := g.metadata.CreateObject(ctx, obj); err != nil {
+		return err
+	}
+
+	stored, err := g.writeReplicas(ctx, obj.ID, token, nodeIDs, body, sent)
+	if err != nil {
+		g.discardObject(obj, nil)
+		return err
+	}
+
+	obj.Placement = stored
+	obj.SizeBytes = hasher.Size()
+	obj.Checksum, _ = sent.Sum(checksum.XXHash)
+	if obj.Encryption != nil {
+		obj.Encryption.StoredSize = sent.Size()
+	}
+	return nil
+}
+
+// sealBody returns what to send the data nodes for body and the hasher to
+// check the replicas against. Without a data key that is the body and
+// hasher themselves. With one it is the body sealed with the key, and a
+// hasher of the sealed data: hasher still sees the plaintext, for the
+// client's digests.
+func sealBody(body io.Reader, hasher *checksum.MultiHasher, dataKey []byte) (io.Reader, *checksum.MultiHasher, error) {
+	if dataKey == nil {
+		return body, hasher, nil
+	}
+	sent, err := checksum.NewMultiHasher(checksum.XXHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := sse.NewSealer(dataKey, hasher.Reader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, sent, nil
+}
+
+// sealedSize returns the stored size of size bytes of data, encrypted as
+// encryption says if it is not nil
+func sealedSize(encryption *metadata.Encryption, size int64) int64 {
+	if encryption == nil {
+		return size
+	}
+	return sse.SealedSize(size)
+}
+
+// placeObject returns the nodes that should hold a new replica of the key
+func (g *Gateway) placeObject(ctx context.Context, bucket, key string) ([]string, error) {
+	nodes, err := g.placement.GetNodes(ctx, placement.RingKey(bucket, key), g.quorum.ReplicationFactor)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) < g.quorum.WriteQuorum {
+		return nil, quorum.ErrInsufficientNodes
+	}
+	nodeIDs := make([]string, len(nodes))
+	for i, node := range nodes {
+		nodeIDs[i] = node.ID
+	}
+	return nodeIDs, nil
+}
+
+// writeReplicas streams body to the nodes as replica key, placed at token on
+// the ring, and returns the nodes that stored exactly what the gateway sent.
+// On error every replica written so far has been deleted.
+func (g *Gateway) writeReplicas(ctx context.Context, key string, token uint64, nodeIDs []string, body io.Reader, hasher *checksum.MultiHasher) ([]string, error) {
+	targets := make([]quorum.Target, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		nodeID := nodeID
+		targets[i] = quorum.Target{
+			NodeID: nodeID,
+			Write: func(ctx context.Context, r io.Reader) (interface{}, error) {
+				client, err := g.nodes.Get(nodeID)
+				if err != nil {
+					return nil, err
+				}
+				return client.Put(ctx, key, token, r)
+			},
+		}
+	}
+
+	results, err := quorum.WriteStream(ctx, &bodyReader{r: hasher.Reader(body)}, targets, g.quorum.WriteQuorum)
+	if err != nil {
+		g.deleteReplicas(key, nodeIDs)
+		return nil, err
+	}
+
+	// Each node hashed what it stored; a replica only counts if it matches
+	// what the gateway sent.
+	sum, _ := hasher.Sum(checksum.XXHash)
+	var stored, bad []string
+	for _, res := range results {
+		if !res.Success {
+			log.Printf("write %s to %s failed: %v", key, res.NodeID, res.Error)
+			continue
+		}
+		info := res.Data.(*datanode.ReplicaInfo)
+		if info.Size != hasher.Size() || !info.Checksum.Equal(sum) {
+			log.Printf("replica %s on %s does not match gateway checksum", key, res.NodeID)
+			bad = append(bad, res.NodeID)
+			continue
+		}
+		stored = append(stored, res.NodeID)
+	}
+	if len(stored) < g.quorum.WriteQuorum {
+		g.deleteReplicas(key, nodeIDs)
+		return nil, quorum.ErrWriteQuorumNotMet
+	}
+	g.deleteReplicas(key, bad)
+	return stored, nil
+}
+
+// assembleObject creates a pending record for a multipart object and builds
+// its replicas from the parts. Nodes holding every part concatenate them
+// locally, verifying each block as they go; if too few nodes hold every part
+// the parts are streamed through the gateway instead. On success obj holds
+// the size, internal checksum and placement, and is still pending.
+//
+// Encrypted parts were sealed one by one with the upload's data key, so the
+// object's data is the sealed parts one after another; obj.Encryption gets
+// their sizes and need not be unwrapped.
+func (g *Gateway) assembleObject(ctx context.Context, obj *metadata.Object, parts []*metadata.Part) error {
+	var size, storedSize int64
+	sources := make([]string, len(parts))
+	for i, part := range parts {
+		sources[i] = part.ID
+		size += part.SizeBytes
+		storedSize += sealedSize(obj.Encryption, part.SizeBytes)
+	}
+	if obj.Encryption != nil {
+		obj.Encryption.Parts = make([]int64, len(parts))
+		for i, part := range parts {
+			obj.Encryption.Parts[i] = part.SizeBytes
+		}
+		obj.Encryption.StoredSize = storedSize
+	}
+
+	nodeIDs := nodesWithAllParts(parts)
+	if len(nodeIDs) < g.quorum.WriteQuorum {
+		log.Printf("assemble %s/%s: only %d nodes hold every part, copying through gateway",
+			obj.BucketName, obj.ObjectKey, len(nodeIDs))
+		hasher, err := checksum.NewMultiHasher(checksum.XXHash)
+		if err != nil {
+			return err
+		}
+		r := &partsReader{ctx: ctx, g: g, parts: parts, encryption: obj.Encryption}
+		defer r.Close()
+		if err := g.writeObject(ctx, obj, r, hasher, nil); err != nil {
+			return err
+		}
+		obj.SizeBytes = size
+		return nil
+	}
+
+	obj.State = metadata.ObjectStatePending
+	obj.IsLatest = false
+	obj.Placement = nodeIDs
+	if err := g.metadata.CreateObject(ctx, obj); err != nil {
+		return err
+	}
+
+	results := quorum.Do(ctx, nodeIDs, func(ctx context.Context, nodeID string) (interface{}, error) {
+		client, err := g.nodes.Get(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		return client.Compose(ctx, obj.ID, sources)
+	})
+
+	// Every node composed verified parts, so the replicas should agree;
+	// keep those matching the majority.
+	votes := make(map[string]int)
+	best := 0
+	var sum checksum.Value
+	for _, res := range results {
+		if !res.Success {
+			log.Printf("compose %s on %s failed: %v", obj.ID, res.NodeID, res.Error)
+			continue
+		}
+		info := res.Data.(*datanode.ReplicaInfo)
+		if info.Size != storedSize {
+			continue
+		}
+		key := info.Checksum.String()
+		votes[key]++
+		if votes[key] > best {
+			best = votes[key]
+			sum = info.Checksum
+		}
+	}
+	var stored, bad []string
+	for _, res := range results {
+		if !res.Success {
+			continue
+		}
+		info := res.Data.(*datanode.ReplicaInfo)
+		if info.Size != storedSize || !info.Checksum.Equal(sum) {
+			log.Printf("composed replica %s on %s does not match the other replicas", obj.ID, res.NodeID)
+			bad = append(bad, res.NodeID)
+			continue
+		}
+		stored = append(stored, res.NodeID)
+	}
+	if len(stored) < g.quorum.WriteQuorum {
+		g.discardObject(obj, nodeIDs)
+		return quorum.ErrWriteQuorumNotMet
+	}
+	g.deleteReplicas(obj.ID, bad)
+
+	obj.Placement = stored
+	obj.SizeBytes = size
+	obj.Checksum = sum
+	return nil
+}
+
+// nodesWithAllParts returns the nodes holding a replica of every part, in
+// the placement order of the first part
+func nodesWithAllParts(parts []*metadata.Part) []string {
+	count := make(map[string]int)
+	for _, part := range parts {
+		for _, nodeID := range part.Placement {
+			count[nodeID]++
+		}
+	}
+	var nodeIDs []string
+	for _, nodeID := range parts[0].Placement {
+		if count[nodeID] == len(parts) {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	return nodeIDs
+}
+
+// discardObject deletes the replicas and pending record of a failed write
+func (g *Gateway) discardObject(obj *metadata.Object, nodeIDs []string) {
+	g.deleteReplicas(obj.ID, nodeIDs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if err := g.metadata.AbortObject(ctx, obj.ID); err != nil {
+		log.Printf("abort pending object %s: %v", obj.ID, err)
+	}
+}
+
+// deleteReplicas removes a replica from each node, logging failures
+func (g *Gateway) deleteReplicas(key string, nodeIDs []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	for _, nodeID := range nodeIDs {
+		client, err := g.nodes.Get(nodeID)
+		if err == nil {
+			err = client.Delete(ctx, key)
+		}
+		if err != nil {
+			log.Printf("delete replica %s from %s: %v", key, nodeID, err)
+		}
+	}
+}
+
+// bodyReader tags read errors from the client so they can be reported as
+// IncompleteBody rather than as server failures
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errIncompleteBody, err)
+	}
+	return n, err
+}
+
+// replicaReader reads an object from its replicas. If a node fails
+// mid-stream the read resumes on the next replica at the current offset. If a
+// node reports a corrupt block, only that block is read from another replica
+// and the read then returns to the original node.
+type replicaReader struct {
+	ctx    context.Context
+	g      *Gateway
+	key    string
+	node   string   // node currently being read
+	nodes  []string // replicas not yet tried
+	offset int64
+	end    int64 // exclusive
+	cur    io.ReadCloser
+	detour *replicaReader // reads a corrupt block from the other replicas
+	errs   []error
+}
+
+// openReplicas returns a reader over bytes [offset, end) of the replica key
+// held by the nodes, tried in order
+func (g *Gateway) openReplicas(ctx context.Context, key string, nodeIDs []string, offset, end int64) *replicaReader {
+	return &replicaReader{ctx: ctx, g: g, key: key, nodes: nodeIDs, offset: offset, end: end}
+}
+
+func (r *replicaReader) Read(p []byte) (int, error) {
+	for {
+		if r.offset >= r.end {
+			return 0, io.EOF
+		}
+		if remaining := r.end - r.offset; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+
+		if r.detour != nil {
+			n, err := r.detour.Read(p)
+			r.offset += int64(n)
+			if err == io.EOF {
+				r.detour = nil
+				err = nil
+			}
+			if n == 0 && err == nil {
+				continue
+			}
+			return n, err
+		}
+
+		if r.cur == nil {
+			if r.node == "" {
+				if len(r.nodes) == 0 {
+					return 0, fmt.Errorf("no readable replica of %s: %w", r.key, errors.Join(r.errs...))
+				}
+				r.node = r.nodes[0]
+				r.nodes = r.nodes[1:]
+			}
+			client, err := r.g.nodes.Get(r.node)
+			if err == nil {
+				r.cur, err = client.Get(r.ctx, r.key, r.offset, r.end-r.offset)
+			}
+			if err != nil {
+				r.errs = append(r.errs, fmt.Errorf("%s: %w", r.node, err))
+				r.node = ""
+				continue
+			}
+		}
+
+		n, err := r.cur.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.offset < r.end {
+			err = io.ErrUnexpectedEOF
+		}
+
+		var corrupt *datanode.CorruptBlockError
+		if errors.As(err, &corrupt) && len(r.nodes) > 0 {
+			log.Printf("replica %s on %s: corrupt block at offset %d (%d bytes), reading it from another replica",
+				r.key, r.node, corrupt.Block.Offset, corrupt.Block.Length)
+			r.cur.Close()
+			r.cur = nil
+			end := corrupt.Block.Offset + corrupt.Block.Length
+			if end > r.end {
+				end = r.end
+			}
+			r.detour = &replicaReader{ctx: r.ctx, g: r.g, key: r.key, nodes: r.nodes, offset: r.offset, end: end}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			r.errs = append(r.errs, fmt.Errorf("%s: %w", r.node, err))
+			r.node = ""
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *replicaReader) Close() error {
+	if r.detour != nil {
+		r.detour.Close()
+	}
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// partsReader reads the replicas of a sequence of parts, one part at a time,
+// as stored: sealed if they are encrypted
+type partsReader struct {
+	ctx        context.Context
+	g          *Gateway
+	parts      []*metadata.Part
+	encryption *metadata.Encryption
+	cur        *replicaReader
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := r.parts[0]
+			r.parts = r.parts[1:]
+			r.cur = r.g.openReplicas(r.ctx, part.ID, part.Placement, 0, sealedSize(r.encryption, part.SizeBytes))
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// readObject returns a reader over bytes [start, end) of obj's data,
+// decrypting them with dataKey if it is encrypted. Each sealed part of an
+// encrypted multipart object is decrypted on its own.
+func (g *Gateway) readObject(ctx context.Context, obj *metadata.Object, dataKey []byte, start, end int64) io.ReadCloser {
+	if obj.Encryption == nil {
+		return g.openReplicas(ctx, obj.ID, obj.Placement, start, end)
+	}
+	sizes := obj.Encryption.Parts
+	if sizes == nil {
+		sizes = []int64{obj.SizeBytes}
+	}
+	var readers []io.ReadCloser
+	var offset, sealedOffset int64 // where the part starts, in plaintext and as stored
+	for _, size := range sizes {
+		if offset < end && start < offset+size {
+			base := sealedOffset
+			open := func(from, to int64) io.ReadCloser {
+				return g.openReplicas(ctx, obj.ID, obj.Placement, base+from, base+to)
+			}
+			readers = append(readers, sse.NewRangeReader(dataKey, size, max(start-offset, 0), min(end-offset, size), open))
+		}
+		offset += size
+		sealedOffset += sse.SealedSize(size)
+	}
+	return newMultiReadCloser(readers)
+}
+
+// multiReadCloser reads a sequence of readers one after another and closes
+// them all
+type multiReadCloser struct {
+	io.Reader
+	closers []io.ReadCloser
+}
+
+func newMultiReadCloser(readers []io.ReadCloser) *multiReadCloser {
+	r := make([]io.Reader, len(readers))
+	for i, rc := range readers {
+		r[i] = rc
+	}
+	return &multiReadCloser{Reader: io.MultiReader(r...), closers: readers}
+}
+
+func (m *multiReadCloser) Close() error {
+	var errs []error
+	for _, c := range m.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// copyVerified copies src to dst but holds back the final chunk until verify
+// succeeds. When verification fails the response ends short of its declared
+// Content-Length, so clients see a truncated body instead of bad data.
+func copyVerified(dst io.Writer, src io.Reader, verify func() error) (int64, error) {
+	var written int64
+	held := make([]byte, 0, 256<<10)
+	buf := make([]byte, 256<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if len(held) > 0 {
+				m, werr := dst.Write(held)
+				written += int64(m)
+				if werr != nil {
+					return written, werr
+				}
+			}
+			held = append(held[:0], buf[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if err := verify(); err != nil {
+		return written, err
+	}
+	m, err := dst.Write(held)
+	return written + int64(m), err
+}
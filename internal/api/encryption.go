@@ -0,0 +1,442 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/sse"
+)
+
+// headerSSE asks for server-side encryption on writes and reports it on
+// reads
+const headerSSE = "x-amz-server-side-encryption"
+
+// Headers carrying a customer-provided key (SSE-C)
+const (
+	headerSSECustomerAlgorithm = "x-amz-server-side-encryption-customer-algorithm"
+	headerSSECustomerKey       = "x-amz-server-side-encryption-customer-key"
+	headerSSECustomerKeyMD5    = "x-amz-server-side-encryption-customer-key-MD5"
+)
+
+// customerKeyHeaders names the headers carrying a customer-provided key
+type customerKeyHeaders struct {
+	algorithm, key, keyMD5 string
+}
+
+var (
+	// sseCustomerHeaders carry the key of the data a request reads or
+	// writes
+	sseCustomerHeaders = customerKeyHeaders{headerSSECustomerAlgorithm, headerSSECustomerKey, headerSSECustomerKeyMD5}
+	// copySourceCustomerHeaders carry the key of the source of a copy
+	copySourceCustomerHeaders = customerKeyHeaders{
+		"x-amz-copy-source-server-side-encryption-customer-algorithm",
+		"x-amz-copy-source-server-side-encryption-customer-key",
+		"x-amz-copy-source-server-side-encryption-customer-key-MD5",
+	}
+)
+
+// present reports whether the request carries any of the headers
+func (h customerKeyHeaders) present(c *gin.Context) bool {
+	return c.GetHeader(h.algorithm) != "" || c.GetHeader(h.key) != "" || c.GetHeader(h.keyMD5) != ""
+}
+
+// Data keys rewrapped per POST /admin/encryption/rotate
+const (
+	defaultRotateLimit = 1000
+	maxRotateLimit     = 10000
+)
+
+// errNoKeyring marks encrypted data on a gateway without master keys
+var errNoKeyring = errors.New("server-side encryption is not configured on this gateway")
+
+// serverSideEncryptionConfiguration is the PutBucketEncryption request body
+// and the GetBucketEncryption response
+type serverSideEncryptionConfiguration struct {
+	XMLName xml.Name         `xml:"ServerSideEncryptionConfiguration"`
+	Rules   []encryptionRule `xml:"Rule"`
+}
+
+type encryptionRule struct {
+	Default          *encryptionByDefault `xml:"ApplyServerSideEncryptionByDefault"`
+	BucketKeyEnabled bool                 `xml:"BucketKeyEnabled"`
+}
+
+type encryptionByDefault struct {
+	SSEAlgorithm   string `xml:"SSEAlgorithm"`
+	KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+}
+
+// checkAlgorithm writes the error response for a server-side encryption
+// algorithm this gateway cannot apply, if algorithm is one
+func (g *Gateway) checkAlgorithm(c *gin.Context, algorithm string) bool {
+	switch algorithm {
+	case sse.AlgorithmAES256:
+	case "aws:kms", "aws:kms:dsse":
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented,
+			"Server-side encryption with KMS keys is not supported")
+		return false
+	default:
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			fmt.Sprintf("The encryption method %q is not supported", algorithm))
+		return false
+	}
+	if g.keys == nil {
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "Server-side encryption is not configured on this gateway")
+		return false
+	}
+	return true
+}
+
+// requestedEncryption returns the server-side encryption a write to bucket
+// b asks for with the x-amz-server-side-encryption header, or else the
+// bucket's default, empty for none. On failure the error response has been
+// written.
+func (g *Gateway) requestedEncryption(c *gin.Context, b *metadata.Bucket) (string, bool) {
+	algorithm := c.GetHeader(headerSSE)
+	if algorithm == "" {
+		algorithm = b.Encryption
+	}
+	if algorithm == "" {
+		return "", true
+	}
+	return algorithm, g.checkAlgorithm(c, algorithm)
+}
+
+// writeEncryption returns the encryption of data a request writes to
+// bucket b and the key to seal it with: the customer-provided key given
+// with the request, else a new data key for owner, as keyOwner names it, if
+// the request or the bucket asks for server-side encryption, else none. On
+// failure the error response has been written.
+func (g *Gateway) writeEncryption(c *gin.Context, b *metadata.Bucket, owner string) (*metadata.Encryption, []byte, bool) {
+	customerKey, ok := g.customerKey(c, sseCustomerHeaders)
+	if !ok {
+		return nil, nil, false
+	}
+	if customerKey != nil {
+		if c.GetHeader(headerSSE) != "" {
+			g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+				"Server Side Encryption with Customer provided key is incompatible with the encryption method specified")
+			return nil, nil, false
+		}
+		salt, fingerprint, err := sse.NewKeyFingerprint(customerKey)
+		if err != nil {
+			g.lookupError(c, err)
+			return nil, nil, false
+		}
+		encryption := &metadata.Encryption{Algorithm: sse.AlgorithmAES256, KeySalt: salt, KeyFingerprint: fingerprint}
+		return encryption, customerKey, true
+	}
+
+	algorithm, ok := g.requestedEncryption(c, b)
+	if !ok || algorithm == "" {
+		return nil, nil, ok
+	}
+	encryption, dataKey, err := g.newEncryption(algorithm, owner)
+	if err != nil {
+		g.lookupError(c, err)
+		return nil, nil, false
+	}
+	return encryption, dataKey, true
+}
+
+// customerKey returns the customer-provided key given with the headers h,
+// the x-amz-server-side-encryption-customer-* headers or their
+// x-amz-copy-source- counterparts, nil without them. On failure the error
+// response has been written.
+func (g *Gateway) customerKey(c *gin.Context, h customerKeyHeaders) ([]byte, bool) {
+	if !h.present(c) {
+		return nil, true
+	}
+	algorithm := c.GetHeader(h.algorithm)
+	encoded := c.GetHeader(h.key)
+	keyMD5 := c.GetHeader(h.keyMD5)
+	// Over plain HTTP the key is in the clear for anyone on the path
+	if c.Request.TLS == nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"Requests specifying Server Side Encryption with Customer provided keys must be made over a secure connection.")
+		return nil, false
+	}
+	if algorithm == "" {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"Requests specifying Server Side Encryption with Customer provided keys must provide a valid encryption algorithm.")
+		return nil, false
+	}
+	if algorithm != sse.AlgorithmAES256 {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidEncryptionAlgorithm,
+			"The encryption request you specified is not valid. Supported value: AES256.")
+		return nil, false
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != sse.CustomerKeySize {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			"The secret key was invalid for the specified algorithm.")
+		return nil, false
+	}
+	if keyMD5 == "" {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			"Requests specifying Server Side Encryption with Customer provided keys must provide the client calculated MD5 of the secret key.")
+		return nil, false
+	}
+	if sum := md5.Sum(key); base64.StdEncoding.EncodeToString(sum[:]) != keyMD5 {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			"The calculated MD5 hash of the key did not match the hash that was provided.")
+		return nil, false
+	}
+	return key, true
+}
+
+// customerKeyFor checks the customer-provided key given with the headers h
+// of a request that reads or adds to data encrypted as encryption says, nil
+// if it is not. Data encrypted with a customer-provided key can only be
+// reached with that key; other data must not be given one. It returns the
+// key, nil if the data is not encrypted with one. On failure the error
+// response has been written.
+func (g *Gateway) customerKeyFor(c *gin.Context, h customerKeyHeaders, encryption *metadata.Encryption) ([]byte, bool) {
+	key, ok := g.customerKey(c, h)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case encryption == nil || !encryption.CustomerKey():
+		if key != nil {
+			g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+				"The encryption parameters are not applicable to this object.")
+			return nil, false
+		}
+	case key == nil:
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			"The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+		return nil, false
+	case !sse.MatchKeyFingerprint(key, encryption.KeySalt, encryption.KeyFingerprint):
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied,
+			"The provided customer encryption key does not match the key the object was encrypted with.")
+		return nil, false
+	}
+	return key, true
+}
+
+// readKey returns the key to read or add to data encrypted as encryption
+// says, nil for plaintext: the customer-provided key given with the headers
+// h, or else the data key of owner, unwrapped. On failure the error
+// response has been written.
+func (g *Gateway) readKey(c *gin.Context, h customerKeyHeaders, encryption *metadata.Encryption, owner string) ([]byte, bool) {
+	key, ok := g.customerKeyFor(c, h, encryption)
+	if !ok || key != nil || encryption == nil {
+		return key, ok
+	}
+	key, err := g.dataKey(encryption, owner)
+	if err != nil {
+		g.lookupError(c, err)
+		return nil, false
+	}
+	return key, true
+}
+
+// setEncryptionHeaders reports how the data a response concerns is
+// encrypted, if it is. The MD5 of a customer-provided key is echoed back
+// from the request, as it is not stored.
+func setEncryptionHeaders(c *gin.Context, encryption *metadata.Encryption) {
+	switch {
+	case encryption == nil:
+	case encryption.CustomerKey():
+		c.Header(headerSSECustomerAlgorithm, encryption.Algorithm)
+		if keyMD5 := c.GetHeader(headerSSECustomerKeyMD5); keyMD5 != "" {
+			c.Header(headerSSECustomerKeyMD5, keyMD5)
+		}
+	default:
+		c.Header(headerSSE, encryption.Algorithm)
+	}
+}
+
+// objectKeyOwner and uploadKeyOwner name the object or multipart upload a
+// data key is wrapped for, so a wrapped key copied to another row does not
+// unwrap there
+func objectKeyOwner(id string) string { return "object/" + id }
+
+func uploadKeyOwner(id string) string { return "upload/" + id }
+
+// newEncryption returns the encryption of new data encrypted with
+// algorithm under a new data key for owner, and that key
+func (g *Gateway) newEncryption(algorithm, owner string) (*metadata.Encryption, []byte, error) {
+	dataKey, err := sse.NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := g.keys.Wrap(dataKey, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &metadata.Encryption{Algorithm: algorithm, KeyID: keyID, DataKey: wrapped}, dataKey, nil
+}
+
+// dataKey unwraps the data key of owner's encrypted data
+func (g *Gateway) dataKey(encryption *metadata.Encryption, owner string) ([]byte, error) {
+	if g.keys == nil {
+		return nil, errNoKeyring
+	}
+	return g.keys.Unwrap(encryption.KeyID, encryption.DataKey, owner)
+}
+
+// rewrapDataKey wraps the data key of encryption, wrapped for from, for to
+// instead, as when a completed upload's key passes to its object. Data
+// encrypted with a customer-provided key has no data key.
+func (g *Gateway) rewrapDataKey(encryption *metadata.Encryption, from, to string) error {
+	if encryption.CustomerKey() {
+		return nil
+	}
+	dataKey, err := g.dataKey(encryption, from)
+	if err != nil {
+		return err
+	}
+	encryption.KeyID, encryption.DataKey, err = g.keys.Wrap(dataKey, to)
+	return err
+}
+
+func (g *Gateway) GetBucketEncryption(c *gin.Context) {
+	if !g.authorize(c, actionGetEncryptionConfiguration) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if b.Encryption == "" {
+		g.errorResponse(c, http.StatusNotFound, ErrServerSideEncryptionConfigurationNotFound,
+			"The server side encryption configuration was not found")
+		return
+	}
+	c.XML(http.StatusOK, serverSideEncryptionConfiguration{
+		Rules: []encryptionRule{{Default: &encryptionByDefault{SSEAlgorithm: b.Encryption}}},
+	})
+}
+
+// PutBucketEncryption sets the encryption applied to objects written to the
+// bucket without an x-amz-server-side-encryption header. Objects already
+// stored are left as they are.
+func (g *Gateway) PutBucketEncryption(c *gin.Context) {
+	if !g.authorize(c, actionPutEncryptionConfiguration) {
+		return
+	}
+	var config serverSideEncryptionConfiguration
+	data, ok := g.readConfig(c)
+	if !ok {
+		return
+	}
+	if err := xml.Unmarshal(data, &config); err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The XML you provided was not well-formed or did not validate against our published schema")
+		return
+	}
+	if len(config.Rules) != 1 || config.Rules[0].Default == nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The server side encryption configuration must have exactly one rule with ApplyServerSideEncryptionByDefault")
+		return
+	}
+	if !g.checkAlgorithm(c, config.Rules[0].Default.SSEAlgorithm) {
+		return
+	}
+	if err := g.metadata.SetBucketEncryption(c.Request.Context(), c.Param("bucket"), config.Rules[0].Default.SSEAlgorithm); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) DeleteBucketEncryption(c *gin.Context) {
+	if !g.authorize(c, actionPutEncryptionConfiguration) {
+		return
+	}
+	if err := g.metadata.SetBucketEncryption(c.Request.Context(), c.Param("bucket"), ""); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetEncryption handles GET /admin/encryption, the master keys this gateway
+// holds
+func (g *Gateway) GetEncryption(c *gin.Context) {
+	if g.keys == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":        true,
+		"current_key_id": g.keys.CurrentKeyID(),
+		"key_ids":        g.keys.KeyIDs(),
+	})
+}
+
+// RotateEncryption handles POST /admin/encryption/rotate?limit=n. It
+// rewraps up to n data keys wrapped with master keys other than the current
+// one with the current one; "more" in the response means there may be
+// others left. Data keys that cannot be unwrapped, because their master
+// key is not in the keyfile, are reported and left as they are.
+func (g *Gateway) RotateEncryption(c *gin.Context) {
+	if g.keys == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoKeyring.Error()})
+		return
+	}
+	limit := defaultRotateLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRotateLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxRotateLimit)})
+			return
+		}
+		limit = n
+	}
+	ctx := c.Request.Context()
+	current := g.keys.CurrentKeyID()
+	keys, err := g.metadata.ListDataKeys(ctx, current, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rewrapped := 0
+	failed := []gin.H{}
+	for _, key := range keys {
+		owner := objectKeyOwner(key.ObjectID)
+		if key.UploadID != "" {
+			owner = uploadKeyOwner(key.UploadID)
+		}
+		dataKey, err := g.keys.Unwrap(key.KeyID, key.DataKey, owner)
+		if err == nil {
+			var keyID string
+			var wrapped []byte
+			if keyID, wrapped, err = g.keys.Wrap(dataKey, owner); err == nil {
+				err = g.metadata.RewrapDataKey(ctx, key, keyID, wrapped)
+			}
+		}
+		switch {
+		case errors.Is(err, metadata.ErrObjectNotFound):
+			// Deleted, or rewrapped by another gateway, since listed
+		case err != nil:
+			failure := gin.H{"key_id": key.KeyID, "error": err.Error()}
+			if key.UploadID != "" {
+				failure["upload_id"] = key.UploadID
+			} else {
+				failure["object_id"] = key.ObjectID
+			}
+			failed = append(failed, failure)
+		default:
+			rewrapped++
+		}
+	}
+	encryptionKeysRewrapped.Add(float64(rewrapped))
+	c.JSON(http.StatusOK, gin.H{
+		"current_key_id": current,
+		"rewrapped":      rewrapped,
+		"failed":         failed,
+		"more":           len(keys) == limit,
+	})
+}
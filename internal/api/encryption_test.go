@@ -0,0 +1,38 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestDataKeyOwner reads objects encrypted with data keys, and checks that a
+// wrapped data key moved to another object's record does not unwrap there
+func TestDataKeyOwner(t *testing.T) {
+	srv, objects := dataGateway(t)
+	sseHeader := map[string]string{headerSSE: "AES256"}
+	data := map[string][]byte{
+		"a": bytes.Repeat([]byte("a"), 70000),
+		"b": bytes.Repeat([]byte("b"), 10),
+	}
+	for key, body := range data {
+		resp, respBody := send(t, srv, http.MethodPut, "/bkt/"+key, body, sseHeader)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(headerSSE) != "AES256" {
+			t.Fatalf("put %s: status %d, %s %q: %s", key, resp.StatusCode, headerSSE, resp.Header.Get(headerSSE), respBody)
+		}
+		resp, respBody = send(t, srv, http.MethodGet, "/bkt/"+key, nil)
+		if resp.StatusCode != http.StatusOK || respBody != string(body) {
+			t.Fatalf("get %s: status %d, %d bytes", key, resp.StatusCode, len(respBody))
+		}
+	}
+
+	objects.mu.Lock()
+	a, b := objects.objects["a"].Encryption, objects.objects["b"].Encryption
+	a.DataKey, b.DataKey = b.DataKey, a.DataKey
+	objects.mu.Unlock()
+	for key := range data {
+		if resp, body := send(t, srv, http.MethodGet, "/bkt/"+key, nil); resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("get %s with the other object's data key: status %d: %s", key, resp.StatusCode, body)
+		}
+	}
+}
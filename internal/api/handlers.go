@@ -1,22 +1,103 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+	"github.com/mrmushfiq/plinth/internal/quorum"
+	"github.com/mrmushfiq/plinth/internal/ratelimit"
+	"github.com/mrmushfiq/plinth/internal/sse"
 )
 
 // Gateway holds dependencies for API handlers
 type Gateway struct {
-	// TODO: Add dependencies
-	// MetadataService metadata.Service
-	// PlacementController placement.Controller
-	// DataNodeClients map[string]DataNodeClient
+	metadata    metadata.Service
+	placement   placement.Controller
+	nodes       *datanode.Pool
+	quorum      quorum.Config
+	authEnabled bool
+	secrets     *auth.SecretBox
+
+	blockPublicAccess bool
+
+	limiter       *ratelimit.Limiter
+	rateLimitMode RateLimitMode
+	gatewayID     string
+
+	keys *sse.Keyring
+}
+
+// Config holds the dependencies used to build a Gateway
+type Config struct {
+	Metadata  metadata.Service
+	Placement placement.Controller
+	Nodes     *datanode.Pool
+	Quorum    quorum.Config
+
+	// AuthEnabled requires S3 requests to be signed with AWS Signature V4
+	// by an active access key
+	AuthEnabled bool
+
+	// Secrets encrypts the secret access keys in the metadata store. The
+	// access key store is unavailable without it.
+	Secrets *auth.SecretBox
+
+	// BlockPublicAccess applies every PublicAccessBlock setting to all
+	// buckets, whatever their own configuration
+	BlockPublicAccess bool
+
+	// RateLimits are the limits in force until limits are set with PUT
+	// /admin/rate-limits, which the metadata store keeps. They must be
+	// valid.
+	RateLimits ratelimit.Config
+
+	// RateLimitMode is how this gateway enforces the rate limits with the
+	// others; empty means RateLimitLocal
+	RateLimitMode RateLimitMode
+
+	// GatewayID names this gateway to the others splitting or sharing the
+	// rate limits. It must be unique among them.
+	GatewayID string
+
+	// Keyring holds the master keys that wrap the data keys of objects
+	// encrypted at rest. Server-side encryption is unavailable without it.
+	Keyring *sse.Keyring
 }
 
 // NewGateway creates a new API gateway instance
-func NewGateway() *Gateway {
-	return &Gateway{}
+func NewGateway(cfg Config) *Gateway {
+	return &Gateway{
+		metadata:    cfg.Metadata,
+		placement:   cfg.Placement,
+		nodes:       cfg.Nodes,
+		quorum:      cfg.Quorum,
+		authEnabled: cfg.AuthEnabled,
+		secrets:     cfg.Secrets,
+
+		blockPublicAccess: cfg.BlockPublicAccess,
+
+		limiter:       ratelimit.New(cfg.RateLimits),
+		rateLimitMode: cfg.RateLimitMode,
+		gatewayID:     cfg.GatewayID,
+
+		keys: cfg.Keyring,
+	}
 }
 
 // S3 Error responses
@@ -42,13 +123,79 @@ func (g *Gateway) errorResponse(c *gin.Context, code int, s3Code, message string
 	})
 }
 
+// lookupError maps metadata lookup failures to S3 errors
+func (g *Gateway) lookupError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, metadata.ErrBucketNotFound):
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchBucket, "The specified bucket does not exist")
+	case errors.Is(err, metadata.ErrObjectNotFound):
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchKey, "The specified key does not exist")
+	case errors.Is(err, metadata.ErrUploadNotFound):
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchUpload, "The specified multipart upload does not exist")
+	default:
+		g.errorResponse(c, http.StatusInternalServerError, ErrInternalError, err.Error())
+	}
+}
+
+// writeError maps data path failures to S3 errors
+func (g *Gateway) writeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, auth.ErrContentSHA256Mismatch):
+		g.errorResponse(c, http.StatusBadRequest, ErrXAmzContentSHA256Mismatch,
+			"The provided 'x-amz-content-sha256' header does not match what was computed")
+	case errors.Is(err, auth.ErrChunkSignatureMismatch):
+		g.errorResponse(c, http.StatusForbidden, ErrSignatureDoesNotMatch,
+			"The chunk signature we calculated does not match the signature you provided")
+	case errors.Is(err, auth.ErrMalformedChunk):
+		g.errorResponse(c, http.StatusBadRequest, ErrIncompleteBody, err.Error())
+	case errors.Is(err, errIncompleteBody):
+		g.errorResponse(c, http.StatusBadRequest, ErrIncompleteBody, "You did not provide the number of bytes specified by the Content-Length HTTP header")
+	case errors.Is(err, checksum.ErrMismatch):
+		g.errorResponse(c, http.StatusBadRequest, ErrBadDigest, err.Error())
+	case errors.Is(err, errInvalidPart):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidPart, err.Error())
+	case errors.Is(err, errInvalidPartOrder):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidPartOrder, err.Error())
+	case errors.Is(err, errEntityTooSmall):
+		g.errorResponse(c, http.StatusBadRequest, ErrEntityTooSmall, err.Error())
+	case errors.Is(err, quorum.ErrInsufficientNodes), errors.Is(err, quorum.ErrWriteQuorumNotMet):
+		g.errorResponse(c, http.StatusServiceUnavailable, ErrServiceUnavailable, err.Error())
+	default:
+		g.lookupError(c, err)
+	}
+}
+
+// maxConfigSize bounds the XML body of a bucket configuration request or a
+// CompleteMultipartUpload, which can list 10,000 parts
+const maxConfigSize = 4 << 20
+
+// readConfig reads the whole XML body of a configuration request. Decoders
+// stop at the end of the document, so only reading to the end checks the
+// body against the x-amz-content-sha256 it was signed with. On failure the
+// error response has been written.
+func (g *Gateway) readConfig(c *gin.Context) ([]byte, bool) {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxConfigSize+1))
+	if err != nil {
+		g.writeError(c, err)
+		return nil, false
+	}
+	if len(data) > maxConfigSize {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			fmt.Sprintf("The XML you provided was larger than the maximum of %d bytes", maxConfigSize))
+		return nil, false
+	}
+	return data, true
+}
+
 // Common S3 error codes
 const (
 	ErrNoSuchBucket        = "NoSuchBucket"
 	ErrNoSuchKey           = "NoSuchKey"
 	ErrBucketAlreadyExists = "BucketAlreadyExists"
+	ErrBucketNotEmpty      = "BucketNotEmpty"
 	ErrInvalidBucketName   = "InvalidBucketName"
 	ErrInvalidArgument     = "InvalidArgument"
+	ErrInvalidRequest      = "InvalidRequest"
 	ErrMethodNotAllowed    = "MethodNotAllowed"
 	ErrInternalError       = "InternalError"
 	ErrAccessDenied        = "AccessDenied"
@@ -56,15 +203,70 @@ const (
 	ErrInvalidPart         = "InvalidPart"
 	ErrNoSuchUpload        = "NoSuchUpload"
 	ErrEntityTooLarge      = "EntityTooLarge"
+	ErrEntityTooSmall      = "EntityTooSmall"
+	ErrInvalidPartOrder    = "InvalidPartOrder"
 	ErrIncompleteBody      = "IncompleteBody"
 	ErrInvalidRange        = "InvalidRange"
 	ErrPreconditionFailed  = "PreconditionFailed"
+	ErrBadDigest           = "BadDigest"
+	ErrInvalidDigest       = "InvalidDigest"
+	ErrServiceUnavailable  = "ServiceUnavailable"
+	ErrNotImplemented      = "NotImplemented"
+	ErrSlowDown            = "SlowDown"
+	ErrQuotaExceeded       = "QuotaExceeded"
+
+	ErrInvalidEncryptionAlgorithm = "InvalidEncryptionAlgorithmError"
+
+	ErrNoSuchVersion                  = "NoSuchVersion"
+	ErrNoSuchLifecycleConfiguration   = "NoSuchLifecycleConfiguration"
+	ErrIllegalVersioningConfiguration = "IllegalVersioningConfigurationException"
+	ErrMalformedPolicy                = "MalformedPolicy"
+	ErrNoSuchBucketPolicy             = "NoSuchBucketPolicy"
+
+	ErrNoSuchPublicAccessBlockConfiguration      = "NoSuchPublicAccessBlockConfiguration"
+	ErrServerSideEncryptionConfigurationNotFound = "ServerSideEncryptionConfigurationNotFoundError"
+
+	ErrInvalidAccessKeyID                = "InvalidAccessKeyId"
+	ErrSignatureDoesNotMatch             = "SignatureDoesNotMatch"
+	ErrAuthorizationHeaderMalformed      = "AuthorizationHeaderMalformed"
+	ErrRequestTimeTooSkewed              = "RequestTimeTooSkewed"
+	ErrMissingContentLength              = "MissingContentLength"
+	ErrXAmzContentSHA256Mismatch         = "XAmzContentSHA256Mismatch"
+	ErrAuthorizationQueryParametersError = "AuthorizationQueryParametersError"
 )
 
+// timeFormatISO8601 is the timestamp format used in S3 XML responses
+const timeFormatISO8601 = "2006-01-02T15:04:05.000Z"
+
+// bucketNamePattern matches the bucket_name_valid constraint in init.sql
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
 // Bucket Operations
 
 func (g *Gateway) ListBuckets(c *gin.Context) {
-	// TODO: Implement
+	if c.GetBool(contextAnonymous) {
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Access Denied")
+		return
+	}
+	buckets, err := g.metadata.ListBuckets(c.Request.Context())
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	// Users see the buckets they own, root keys every bucket
+	user := c.GetString(contextUser)
+	entries := make([]gin.H, 0, len(buckets))
+	for _, b := range buckets {
+		if user != "" && b.Owner != user {
+			continue
+		}
+		entries = append(entries, gin.H{
+			"Name":         b.Name,
+			"CreationDate": b.CreatedAt.UTC().Format(timeFormatISO8601),
+		})
+	}
+
 	c.XML(http.StatusOK, gin.H{
 		"ListAllMyBucketsResult": gin.H{
 			"Owner": gin.H{
@@ -72,228 +274,527 @@ func (g *Gateway) ListBuckets(c *gin.Context) {
 				"DisplayName": "plinth",
 			},
 			"Buckets": gin.H{
-				"Bucket": []gin.H{},
+				"Bucket": entries,
 			},
 		},
 	})
 }
 
 func (g *Gateway) HeadBucket(c *gin.Context) {
+	if !g.authorize(c, actionListBucket) {
+		return
+	}
 	bucket := c.Param("bucket")
-	// TODO: Check if bucket exists in metadata
-	_ = bucket
+
+	if _, err := g.metadata.GetBucket(c.Request.Context(), bucket); err != nil {
+		g.lookupError(c, err)
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
 func (g *Gateway) CreateBucket(c *gin.Context) {
 	bucket := c.Param("bucket")
 
-	// TODO: Validate bucket name
-	// TODO: Create bucket in metadata service
-
-	_ = bucket
+	if !bucketNamePattern.MatchString(bucket) {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidBucketName, "The specified bucket is not valid")
+		return
+	}
+	acl, ok := g.cannedACL(c)
+	if !ok {
+		return
+	}
+	if acl == metadata.ACLPublicRead && g.blocksPublicACL(c, bucket) {
+		return
+	}
+
+	// The creating user owns the bucket; buckets created by root keys, or
+	// with auth disabled, have no owner
+	_, err := g.metadata.CreateBucket(c.Request.Context(), bucket, c.GetString(contextUser))
+	if errors.Is(err, metadata.ErrBucketExists) {
+		g.errorResponse(c, http.StatusConflict, ErrBucketAlreadyExists, "The requested bucket name is not available")
+		return
+	}
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if acl != metadata.ACLPrivate {
+		if err := g.metadata.SetBucketACL(c.Request.Context(), bucket, acl); err != nil {
+			g.lookupError(c, err)
+			return
+		}
+	}
+
+	c.Header("Location", "/"+bucket)
 	c.Status(http.StatusOK)
 }
 
 func (g *Gateway) DeleteBucket(c *gin.Context) {
+	if !g.authorize(c, actionDeleteBucket) {
+		return
+	}
 	bucket := c.Param("bucket")
 
-	// TODO: Check if bucket is empty
-	// TODO: Delete bucket from metadata service
-
-	_ = bucket
+	err := g.metadata.DeleteBucket(c.Request.Context(), bucket)
+	if errors.Is(err, metadata.ErrBucketNotEmpty) {
+		g.errorResponse(c, http.StatusConflict, ErrBucketNotEmpty, "The bucket you tried to delete is not empty")
+		return
+	}
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
 	c.Status(http.StatusNoContent)
 }
 
+// listBucketResult is the ListObjects response, in V1 (marker) or V2
+// (list-type=2, continuation-token) form
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	Marker                string         `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int           `xml:"KeyCount,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listEntry    `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
 func (g *Gateway) ListObjects(c *gin.Context) {
+	if !g.authorize(c, actionListBucket) {
+		return
+	}
 	bucket := c.Param("bucket")
 	prefix := c.Query("prefix")
 	delimiter := c.Query("delimiter")
-	maxKeys := c.DefaultQuery("max-keys", "1000")
+	v2 := c.Query("list-type") == "2"
+	ctx := c.Request.Context()
+
+	encode := func(s string) string { return s }
+	switch c.Query("encoding-type") {
+	case "":
+	case "url":
+		encode = url.QueryEscape
+	default:
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "Invalid Encoding Method specified in Request")
+		return
+	}
+	maxKeys, err := queryLimit(c, "max-keys")
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	}
 	marker := c.Query("marker")
+	if v2 {
+		marker = c.Query("start-after")
+		if token := c.Query("continuation-token"); token != "" {
+			key, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "The continuation token provided is incorrect")
+				return
+			}
+			marker = string(key)
+		}
+	}
+	if _, err := g.metadata.GetBucket(ctx, bucket); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	objs, prefixes, next, err := g.listKeys(ctx, bucket, prefix, delimiter, marker, maxKeys)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	result := listBucketResult{
+		Name:        bucket,
+		Prefix:      encode(prefix),
+		Delimiter:   encode(delimiter),
+		MaxKeys:     maxKeys,
+		IsTruncated: next != "",
+	}
+	if c.Query("encoding-type") != "" {
+		result.EncodingType = "url"
+	}
+	if v2 {
+		keyCount := len(objs) + len(prefixes)
+		result.KeyCount = &keyCount
+		result.StartAfter = encode(c.Query("start-after"))
+		result.ContinuationToken = c.Query("continuation-token")
+		if next != "" {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+	} else {
+		result.Marker = encode(marker)
+		result.NextMarker = encode(next)
+	}
+	for _, obj := range objs {
+		result.Contents = append(result.Contents, listEntry{
+			Key:          encode(obj.ObjectKey),
+			LastModified: obj.CreatedAt.UTC().Format(timeFormatISO8601),
+			ETag:         "\"" + obj.ETag + "\"",
+			Size:         obj.SizeBytes,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(p)})
+	}
+	c.XML(http.StatusOK, result)
+}
 
-	// TODO: Query metadata service for objects
+// listKeys lists up to maxKeys keys and common prefixes under prefix after
+// marker. Keys containing the delimiter after the prefix are rolled up into
+// one common prefix each, which counts as a single entry, and a marker naming
+// a common prefix skips all of its keys. If the listing is truncated, next is
+// the last entry returned, to continue from.
+func (g *Gateway) listKeys(ctx context.Context, bucket, prefix, delimiter, marker string, maxKeys int) (objs []*metadata.Object, prefixes []string, next string, err error) {
+	if maxKeys == 0 {
+		return nil, nil, "", nil
+	}
+	after, entry := marker, marker
+	for {
+		batch, err := g.metadata.ListObjects(ctx, bucket, prefix, after, maxKeys+1)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, obj := range batch {
+			after = obj.ObjectKey
+			rolled := ""
+			if i := strings.Index(obj.ObjectKey[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				rolled = obj.ObjectKey[:len(prefix)+i+len(delimiter)]
+				if rolled == entry {
+					continue
+				}
+			}
+			if len(objs)+len(prefixes) == maxKeys {
+				return objs, prefixes, entry, nil
+			}
+			if rolled != "" {
+				prefixes = append(prefixes, rolled)
+				entry = rolled
+			} else {
+				objs = append(objs, obj)
+				entry = obj.ObjectKey
+			}
+		}
+		if len(batch) <= maxKeys {
+			return objs, prefixes, "", nil
+		}
+	}
+}
 
-	_, _, _, _ = bucket, prefix, delimiter, marker
-	_ = maxKeys
+// Object Operations
 
-	c.XML(http.StatusOK, gin.H{
-		"ListBucketResult": gin.H{
-			"Name":        bucket,
-			"Prefix":      prefix,
-			"Marker":      marker,
-			"MaxKeys":     maxKeys,
-			"IsTruncated": false,
-			"Contents":    []gin.H{},
-		},
-	})
+// setObjectHeaders sets the standard headers shared by GET and HEAD
+func setObjectHeaders(c *gin.Context, obj *metadata.Object) {
+	c.Header("ETag", "\""+obj.ETag+"\"")
+	c.Header("Content-Length", strconv.FormatInt(obj.SizeBytes, 10))
+	c.Header("Content-Type", obj.ContentType)
+	c.Header("Last-Modified", obj.CreatedAt.UTC().Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "bytes")
+	if !obj.NullVersion {
+		c.Header(headerVersionID, obj.VersionID)
+	}
+	setEncryptionHeaders(c, obj.Encryption)
+	setChecksumHeaders(c, obj)
 }
 
-// Object Operations
+// lookupObject returns the version of the key named by the versionId query
+// parameter, or its latest version. On failure the error response has been
+// written: a delete marker cannot be read, so asking for one by version is
+// refused.
+func (g *Gateway) lookupObject(c *gin.Context, bucket, key string) (*metadata.Object, bool) {
+	id, versioned := c.GetQuery("versionId")
+	if !versioned {
+		obj, err := g.metadata.GetObject(c.Request.Context(), bucket, key)
+		if err != nil {
+			g.lookupError(c, err)
+			return nil, false
+		}
+		return obj, true
+	}
+
+	obj, err := g.metadata.GetObjectVersion(c.Request.Context(), bucket, key, id)
+	if errors.Is(err, metadata.ErrObjectNotFound) {
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchVersion, "The specified version does not exist")
+		return nil, false
+	}
+	if err != nil {
+		g.lookupError(c, err)
+		return nil, false
+	}
+	if obj.IsDeleteMarker {
+		c.Header(headerDeleteMarker, "true")
+		c.Header(headerVersionID, versionID(obj))
+		c.Header("Last-Modified", obj.CreatedAt.UTC().Format(http.TimeFormat))
+		g.errorResponse(c, http.StatusMethodNotAllowed, ErrMethodNotAllowed,
+			"The specified method is not allowed against this resource")
+		return nil, false
+	}
+	if obj.NullVersion {
+		c.Header(headerVersionID, metadata.NullVersionID)
+	}
+	return obj, true
+}
 
 func (g *Gateway) HeadObject(c *gin.Context) {
+	if !g.authorize(c, versioned(c, actionGetObject)) {
+		return
+	}
 	bucket := c.Param("bucket")
 	key := c.Param("key")[1:] // Remove leading slash
 
-	// TODO: Get object metadata from metadata service
-	// TODO: Set headers: ETag, Content-Length, Content-Type, Last-Modified
+	obj, ok := g.lookupObject(c, bucket, key)
+	if !ok {
+		return
+	}
+	if _, ok := g.customerKeyFor(c, sseCustomerHeaders, obj.Encryption); !ok {
+		return
+	}
 
-	_, _ = bucket, key
+	setObjectHeaders(c, obj)
 	c.Status(http.StatusOK)
 }
 
 func (g *Gateway) GetObject(c *gin.Context) {
+	if !g.authorize(c, versioned(c, actionGetObject)) {
+		return
+	}
 	bucket := c.Param("bucket")
 	key := c.Param("key")[1:]
 	rangeHeader := c.GetHeader("Range")
 
-	// TODO: Get object metadata from metadata service
-	// TODO: Get placement (which nodes have the object)
-	// TODO: Read from data node(s)
-	// TODO: Verify checksum
-	// TODO: Handle range requests
+	obj, ok := g.lookupObject(c, bucket, key)
+	if !ok {
+		return
+	}
+	dataKey, ok := g.readKey(c, sseCustomerHeaders, obj.Encryption, objectKeyOwner(obj.ID))
+	if !ok {
+		return
+	}
+
+	start, end, partial, err := parseRange(rangeHeader, obj.SizeBytes)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", obj.SizeBytes))
+		g.errorResponse(c, http.StatusRequestedRangeNotSatisfiable, ErrInvalidRange, err.Error())
+		return
+	}
+
+	if !partial {
+		start, end = 0, obj.SizeBytes
+	}
+	hasher, err := checksum.NewMultiHasher(checksum.XXHash)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	r := g.readObject(c.Request.Context(), obj, dataKey, start, end)
+	defer r.Close()
+
+	setObjectHeaders(c, obj)
+	if partial {
+		// Ranges are verified block by block on the data nodes, and
+		// encrypted ones segment by segment as they are decrypted; the
+		// whole-object checksum does not apply to a slice of the object.
+		if !obj.S3Checksum.IsZero() {
+			c.Writer.Header().Del(obj.S3Checksum.Algorithm.S3Header())
+			c.Writer.Header().Del(headerChecksumType)
+		}
+		c.Header("Content-Length", strconv.FormatInt(end-start, 10))
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, obj.SizeBytes))
+		c.Status(http.StatusPartialContent)
+		n, err := io.Copy(c.Writer, r)
+		if err != nil {
+			log.Printf("GET %s/%s (%s) bytes %d-%d: %v", bucket, key, obj.ID, start, end-1, err)
+		}
+		g.recordEgress(c, bucket, n)
+		return
+	}
 
-	_, _, _ = bucket, key, rangeHeader
-	c.Data(http.StatusOK, "application/octet-stream", []byte{})
+	c.Status(http.StatusOK)
+	var n int64
+	if obj.Encryption != nil {
+		// Every segment is authenticated as it is decrypted
+		n, err = io.Copy(c.Writer, r)
+	} else {
+		n, err = copyVerified(c.Writer, hasher.Reader(r), func() error {
+			return hasher.Verify(obj.Checksum)
+		})
+	}
+	if err != nil {
+		log.Printf("GET %s/%s (%s): %v", bucket, key, obj.ID, err)
+	}
+	g.recordEgress(c, bucket, n)
 }
 
 func (g *Gateway) PutObject(c *gin.Context) {
+	if !g.authorize(c, actionPutObject) {
+		return
+	}
 	bucket := c.Param("bucket")
 	key := c.Param("key")[1:]
 	contentType := c.GetHeader("Content-Type")
-	contentLength := c.Request.ContentLength
-
-	// TODO: Get placement from placement controller
-	// TODO: Write to data nodes (quorum write)
-	// TODO: Calculate checksum
-	// TODO: Store metadata
-	// TODO: Return ETag
-
-	_, _, _, _ = bucket, key, contentType, contentLength
-
-	etag := "\"todo-calculate-etag\""
-	c.Header("ETag", etag)
+	ctx := c.Request.Context()
+
+	checksumReq, err := parseChecksumRequest(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	contentMD5, err := parseContentMD5(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidDigest, err.Error())
+		return
+	}
+
+	body, contentLength, ok := g.objectBody(c)
+	if !ok {
+		return
+	}
+
+	b, err := g.metadata.GetBucket(ctx, bucket)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	// The ID is chosen here so a new data key can be wrapped for the object
+	id := metadata.NewID()
+	encryption, dataKey, ok := g.writeEncryption(c, b, objectKeyOwner(id))
+	if !ok {
+		return
+	}
+	// Without a length the quotas are checked once the body has been read
+	var quotas []quotaUsage
+	if contentLength >= 0 {
+		if quotas, ok = g.checkQuota(c, b, contentLength); !ok {
+			return
+		}
+	}
+
+	// One pass over the body computes the internal checksum, the MD5 for
+	// the ETag and whatever flexible checksum the client asked for.
+	hasher, err := checksum.NewMultiHasher(checksum.XXHash, checksum.MD5, checksumReq.Algorithm)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	obj := &metadata.Object{
+		ID:          id,
+		BucketName:  bucket,
+		ObjectKey:   key,
+		ContentType: contentType,
+		Encryption:  encryption,
+	}
+	if err := g.writeObject(ctx, obj, body, hasher, dataKey); err != nil {
+		g.writeError(c, err)
+		return
+	}
+
+	if contentLength >= 0 && hasher.Size() != contentLength {
+		g.discardObject(obj, obj.Placement)
+		g.writeError(c, errIncompleteBody)
+		return
+	}
+	if err := checksumReq.readTrailer(c.Request.Trailer); err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := hasher.Verify(contentMD5, checksumReq.Expected); err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.writeError(c, err)
+		return
+	}
+	if contentLength < 0 {
+		if quotas, ok = g.checkQuota(c, b, hasher.Size()); !ok {
+			g.discardObject(obj, obj.Placement)
+			return
+		}
+	}
+
+	md5sum, _ := hasher.Sum(checksum.MD5)
+	obj.ETag = md5sum.Hex()
+	if checksumReq.Algorithm != "" {
+		obj.S3Checksum, _ = hasher.Sum(checksumReq.Algorithm)
+		obj.S3ChecksumType = checksum.TypeFullObject
+	}
+	if err := g.metadata.CommitObject(ctx, obj); err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.writeError(c, err)
+		return
+	}
+	g.quotaWritten(ctx, quotas, obj.SizeBytes)
+
+	c.Header("ETag", "\""+obj.ETag+"\"")
+	if b.Versioning != "" {
+		c.Header(headerVersionID, versionID(obj))
+	}
+	setEncryptionHeaders(c, obj.Encryption)
+	if !obj.S3Checksum.IsZero() {
+		c.Header(obj.S3Checksum.Algorithm.S3Header(), obj.S3Checksum.Base64())
+		c.Header(headerChecksumType, string(obj.S3ChecksumType))
+	}
 	c.Status(http.StatusOK)
 }
 
 func (g *Gateway) DeleteObject(c *gin.Context) {
+	if !g.authorize(c, versioned(c, actionDeleteObject)) {
+		return
+	}
 	bucket := c.Param("bucket")
 	key := c.Param("key")[1:]
-
-	// TODO: Create delete marker in metadata service
-	// TODO: Schedule garbage collection on data nodes
-
-	_, _ = bucket, key
+	ctx := c.Request.Context()
+
+	// The repair worker's tombstone collector deletes the replicas once
+	// the version is tombstoned. Deleting a missing key or version
+	// succeeds.
+	if id, ok := c.GetQuery("versionId"); ok {
+		obj, err := g.metadata.DeleteObjectVersion(ctx, bucket, key, id)
+		if err != nil && !errors.Is(err, metadata.ErrObjectNotFound) {
+			g.lookupError(c, err)
+			return
+		}
+		c.Header(headerVersionID, id)
+		if obj != nil && obj.IsDeleteMarker {
+			c.Header(headerDeleteMarker, "true")
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	marker, err := g.metadata.DeleteObject(ctx, bucket, key)
+	if err != nil && !errors.Is(err, metadata.ErrObjectNotFound) {
+		g.lookupError(c, err)
+		return
+	}
+	if marker != nil {
+		c.Header(headerDeleteMarker, "true")
+		c.Header(headerVersionID, versionID(marker))
+	}
 	c.Status(http.StatusNoContent)
 }
-
-// Multipart Upload Operations
-
-func (g *Gateway) InitiateMultipartUpload(c *gin.Context) {
-	bucket := c.Param("bucket")
-	key := c.Param("key")[1:]
-
-	// TODO: Create multipart upload record in metadata
-	// TODO: Generate upload ID
-
-	_, _ = bucket, key
-	uploadID := "todo-generate-upload-id"
-
-	c.XML(http.StatusOK, gin.H{
-		"InitiateMultipartUploadResult": gin.H{
-			"Bucket":   bucket,
-			"Key":      key,
-			"UploadId": uploadID,
-		},
-	})
-}
-
-func (g *Gateway) UploadPart(c *gin.Context) {
-	bucket := c.Param("bucket")
-	key := c.Param("key")[1:]
-	uploadID := c.Query("uploadId")
-	partNumber := c.Query("partNumber")
-
-	// TODO: Validate upload ID exists
-	// TODO: Get placement for this part
-	// TODO: Write part to data nodes
-	// TODO: Store part metadata
-
-	_, _, _, _ = bucket, key, uploadID, partNumber
-
-	etag := "\"todo-calculate-part-etag\""
-	c.Header("ETag", etag)
-	c.Status(http.StatusOK)
-}
-
-func (g *Gateway) CompleteMultipartUpload(c *gin.Context) {
-	bucket := c.Param("bucket")
-	key := c.Param("key")[1:]
-	uploadID := c.Query("uploadId")
-
-	// TODO: Parse CompleteMultipartUpload XML request
-	// TODO: Validate all parts exist
-	// TODO: Create final object metadata
-	// TODO: Calculate final ETag
-	// TODO: Clean up multipart upload record
-
-	_, _, _ = bucket, key, uploadID
-
-	etag := "\"todo-calculate-final-etag\""
-	c.XML(http.StatusOK, gin.H{
-		"CompleteMultipartUploadResult": gin.H{
-			"Location": "/" + bucket + "/" + key,
-			"Bucket":   bucket,
-			"Key":      key,
-			"ETag":     etag,
-		},
-	})
-}
-
-func (g *Gateway) AbortMultipartUpload(c *gin.Context) {
-	bucket := c.Param("bucket")
-	key := c.Param("key")[1:]
-	uploadID := c.Query("uploadId")
-
-	// TODO: Delete multipart upload record
-	// TODO: Schedule cleanup of uploaded parts
-
-	_, _, _ = bucket, key, uploadID
-	c.Status(http.StatusNoContent)
-}
-
-func (g *Gateway) ListParts(c *gin.Context) {
-	bucket := c.Param("bucket")
-	key := c.Param("key")[1:]
-	uploadID := c.Query("uploadId")
-
-	// TODO: List parts for this multipart upload
-
-	_, _, _ = bucket, key, uploadID
-
-	c.XML(http.StatusOK, gin.H{
-		"ListPartsResult": gin.H{
-			"Bucket":   bucket,
-			"Key":      key,
-			"UploadId": uploadID,
-			"Part":     []gin.H{},
-		},
-	})
-}
-
-func (g *Gateway) ListMultipartUploads(c *gin.Context) {
-	bucket := c.Param("bucket")
-	prefix := c.Query("prefix")
-
-	// TODO: List in-progress multipart uploads
-
-	_, _ = bucket, prefix
-
-	c.XML(http.StatusOK, gin.H{
-		"ListMultipartUploadsResult": gin.H{
-			"Bucket": bucket,
-			"Prefix": prefix,
-			"Upload": []gin.H{},
-		},
-	})
-}
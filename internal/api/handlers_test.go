@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// listStore holds one bucket with the given keys, in order
+type listStore struct {
+	metadata.Service
+	bucket *metadata.Bucket
+	keys   []string
+}
+
+func (s *listStore) GetBucket(ctx context.Context, name string) (*metadata.Bucket, error) {
+	if name != s.bucket.Name {
+		return nil, metadata.ErrBucketNotFound
+	}
+	return s.bucket, nil
+}
+
+func (s *listStore) ListObjects(ctx context.Context, bucketName, prefix, after string, limit int) ([]*metadata.Object, error) {
+	var objs []*metadata.Object
+	for _, key := range s.keys {
+		if len(objs) == limit {
+			break
+		}
+		if strings.HasPrefix(key, prefix) && key > after {
+			objs = append(objs, &metadata.Object{BucketName: bucketName, ObjectKey: key, ETag: "etag"})
+		}
+	}
+	return objs, nil
+}
+
+var listKeys = []string{
+	"a.txt", "logs/2024/1", "logs/2024/2", "logs/2025/1", "my file", "photos/x.jpg", "photos/y.jpg", "z",
+}
+
+// list sends a ListObjects request and returns its keys and common prefixes
+func list(t *testing.T, srv *httptest.Server, query string) (listBucketResult, []string) {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL + "/bkt?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list %q: status %d: %s", query, resp.StatusCode, body)
+	}
+	var result listBucketResult
+	if err := xml.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, obj := range result.Contents {
+		entries = append(entries, obj.Key)
+	}
+	for _, p := range result.CommonPrefixes {
+		entries = append(entries, p.Prefix)
+	}
+	return result, entries
+}
+
+func TestListObjects(t *testing.T) {
+	store := &listStore{bucket: &metadata.Bucket{Name: "bkt"}, keys: listKeys}
+	srv := httptest.NewServer(SetupRouter(NewGateway(Config{Metadata: store}), "test"))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		query     string
+		entries   []string
+		truncated bool
+		next      string
+	}{
+		{"all", "", listKeys, false, ""},
+		{"delimiter", "delimiter=/", []string{"a.txt", "my file", "z", "logs/", "photos/"}, false, ""},
+		{"prefix", "prefix=logs/&delimiter=/", []string{"logs/2024/", "logs/2025/"}, false, ""},
+		{"prefix without delimiter", "prefix=logs/2024", []string{"logs/2024/1", "logs/2024/2"}, false, ""},
+		{"truncated at a common prefix", "delimiter=/&max-keys=2", []string{"a.txt", "logs/"}, true, "logs/"},
+		{"truncated at a key", "delimiter=/&max-keys=3", []string{"a.txt", "my file", "logs/"}, true, "my file"},
+		{"marker", "marker=logs/2024/1", []string{"logs/2024/2", "logs/2025/1", "my file", "photos/x.jpg", "photos/y.jpg", "z"}, false, ""},
+		{"marker at a common prefix", "delimiter=/&marker=logs/", []string{"my file", "z", "photos/"}, false, ""},
+		{"no keys", "max-keys=0", nil, false, ""},
+		{"url encoding", "prefix=my+&encoding-type=url", []string{"my+file"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, entries := list(t, srv, tt.query)
+			if !reflect.DeepEqual(entries, tt.entries) {
+				t.Errorf("entries %q, want %q", entries, tt.entries)
+			}
+			if result.IsTruncated != tt.truncated || result.NextMarker != tt.next {
+				t.Errorf("truncated %t at %q, want %t at %q", result.IsTruncated, result.NextMarker, tt.truncated, tt.next)
+			}
+		})
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); s3ErrorCode(t, body) != ErrNoSuchBucket {
+		t.Errorf("listing a missing bucket: %s", body)
+	}
+}
+
+// TestListObjectsPages checks that paging through a listing returns every
+// entry once, in V1 and V2
+func TestListObjectsPages(t *testing.T) {
+	store := &listStore{bucket: &metadata.Bucket{Name: "bkt"}, keys: listKeys}
+	srv := httptest.NewServer(SetupRouter(NewGateway(Config{Metadata: store}), "test"))
+	defer srv.Close()
+
+	for _, delimiter := range []string{"", "/"} {
+		_, want := list(t, srv, "delimiter="+delimiter)
+		for _, maxKeys := range []string{"1", "2", "3"} {
+			for _, v2 := range []bool{false, true} {
+				var got []string
+				query := url.Values{"delimiter": {delimiter}, "max-keys": {maxKeys}}
+				if v2 {
+					query.Set("list-type", "2")
+				}
+				for pages := 0; ; pages++ {
+					if pages > len(listKeys) {
+						t.Fatalf("delimiter %q, max-keys %s: listing does not end", delimiter, maxKeys)
+					}
+					result, entries := list(t, srv, query.Encode())
+					got = append(got, entries...)
+					if !result.IsTruncated {
+						break
+					}
+					if v2 {
+						if result.KeyCount == nil || *result.KeyCount != len(entries) {
+							t.Fatalf("KeyCount %v, want %d", result.KeyCount, len(entries))
+						}
+						query.Set("continuation-token", result.NextContinuationToken)
+					} else {
+						query.Set("marker", result.NextMarker)
+					}
+				}
+				if !sameEntries(got, want) {
+					t.Errorf("delimiter %q, max-keys %s, v2 %t: pages list %q, want %q", delimiter, maxKeys, v2, got, want)
+				}
+			}
+		}
+	}
+}
+
+// sameEntries reports whether a and b hold the same entries, in any order
+func sameEntries(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		if count[s]--; count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// TestListObjectsAnonymous lists a bucket whose policy lets anyone list one
+// prefix
+func TestListObjectsAnonymous(t *testing.T) {
+	store := &listStore{
+		bucket: &metadata.Bucket{Name: "bkt", Owner: "alice", Policy: `{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": "*",
+				"Action": "s3:ListBucket",
+				"Resource": "arn:aws:s3:::bkt",
+				"Condition": {"StringEquals": {"s3:prefix": "photos/", "s3:delimiter": "/"}}
+			}]
+		}`},
+		keys: listKeys,
+	}
+	srv := httptest.NewServer(SetupRouter(NewGateway(Config{Metadata: store, AuthEnabled: true}), "test"))
+	defer srv.Close()
+
+	_, entries := list(t, srv, "prefix=photos/&delimiter=/")
+	if want := []string{"photos/x.jpg", "photos/y.jpg"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries %q, want %q", entries, want)
+	}
+	for _, query := range []string{"", "prefix=logs/&delimiter=/", "prefix=photos/"} {
+		resp, err := srv.Client().Get(srv.URL + "/bkt?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || s3ErrorCode(t, body) != ErrAccessDenied {
+			t.Errorf("list %q: status %d: %s", query, resp.StatusCode, body)
+		}
+	}
+}
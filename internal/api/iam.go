@@ -0,0 +1,467 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// maxAdminBodySize bounds the JSON body of a signed admin request
+const maxAdminBodySize = 1 << 20
+
+// iamNamePattern matches the user and group names IAM accepts
+var iamNamePattern = regexp.MustCompile(`^[A-Za-z0-9+=,.@_-]{1,64}$`)
+
+// AdminAuthMiddleware guards the user, group, access key, quota, rate limit,
+// repair priority and encryption endpoints of the admin API. With auth
+// enabled they must be signed by a root access key; a user's key cannot
+// mint credentials or lift limits.
+func (g *Gateway) AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !g.authEnabled {
+			c.Next()
+			return
+		}
+		key, ok := g.authenticate(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if key.UserName != "" {
+			g.errorResponse(c, http.StatusForbidden, ErrAccessDenied,
+				"Only root access keys may manage users, groups and access keys")
+			c.Abort()
+			return
+		}
+		// Bodies are decoded with JSON decoders, which stop at the end of
+		// the document and so would never see a body that does not match
+		// its signed SHA-256: read it whole first
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAdminBodySize+1))
+		switch {
+		case errors.Is(err, auth.ErrContentSHA256Mismatch):
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "reading body: " + err.Error()})
+			return
+		case len(body) > maxAdminBodySize:
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge,
+				gin.H{"error": fmt.Sprintf("body must be at most %d bytes", maxAdminBodySize)})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Set(contextAccessKey, key.AccessKeyID)
+		c.Next()
+	}
+}
+
+// iamError maps metadata errors of the IAM endpoints to JSON responses
+func iamError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, metadata.ErrUserNotFound), errors.Is(err, metadata.ErrGroupNotFound),
+		errors.Is(err, metadata.ErrAccessKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, metadata.ErrUserExists), errors.Is(err, metadata.ErrGroupExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// bindName reads a {"name": ...} body and checks the name is a valid IAM
+// user or group name
+func bindName(c *gin.Context) (string, bool) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !iamNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "body must be {\"name\": <1-64 letters, digits or +=,.@_->}",
+		})
+		return "", false
+	}
+	return req.Name, true
+}
+
+func userJSON(u *metadata.User) gin.H {
+	groups := u.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return gin.H{
+		"name":       u.Name,
+		"groups":     groups,
+		"created_at": u.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func groupJSON(grp *metadata.Group) gin.H {
+	members := grp.Members
+	if members == nil {
+		members = []string{}
+	}
+	return gin.H{
+		"name":       grp.Name,
+		"members":    members,
+		"created_at": grp.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// accessKeyJSON describes an access key without its secret
+func accessKeyJSON(k *metadata.AccessKey) gin.H {
+	status := string(k.Status)
+	if k.Status == metadata.AccessKeyActive && k.Expired(time.Now()) {
+		status = "expired"
+	}
+	h := gin.H{
+		"access_key_id": k.AccessKeyID,
+		"user":          k.UserName,
+		"status":        status,
+		"created_at":    k.CreatedAt.Format(time.RFC3339),
+	}
+	if !k.ExpiresAt.IsZero() {
+		h["expires_at"] = k.ExpiresAt.Format(time.RFC3339)
+	}
+	return h
+}
+
+// CreateUser handles POST /admin/users with a JSON body {"name": ...}
+func (g *Gateway) CreateUser(c *gin.Context) {
+	name, ok := bindName(c)
+	if !ok {
+		return
+	}
+	user, err := g.metadata.CreateUser(c.Request.Context(), name)
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, userJSON(user))
+}
+
+// ListUsers handles GET /admin/users
+func (g *Gateway) ListUsers(c *gin.Context) {
+	users, err := g.metadata.ListUsers(c.Request.Context())
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	list := make([]gin.H, 0, len(users))
+	for _, u := range users {
+		list = append(list, userJSON(u))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": list})
+}
+
+// GetUser handles GET /admin/users/:user, listing the user's groups and
+// access keys
+func (g *Gateway) GetUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := g.metadata.GetUser(ctx, c.Param("user"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	keys, err := g.metadata.ListAccessKeys(ctx, user.Name)
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	resp := userJSON(user)
+	list := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, accessKeyJSON(k))
+	}
+	resp["access_keys"] = list
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteUser handles DELETE /admin/users/:user. The user's access keys are
+// deleted with it.
+func (g *Gateway) DeleteUser(c *gin.Context) {
+	if err := g.metadata.DeleteUser(c.Request.Context(), c.Param("user")); err != nil {
+		iamError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateAccessKey handles POST /admin/users/:user/keys with an optional
+// JSON body {"expires_in": "720h"}. The response is the only time the
+// secret access key is shown.
+func (g *Gateway) CreateAccessKey(c *gin.Context) {
+	if !g.requireSecrets(c) {
+		return
+	}
+	var req struct {
+		ExpiresIn string `json:"expires_in"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "body must be {\"expires_in\": <duration>}"})
+			return
+		}
+	}
+	var expiresAt time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration such as 720h"})
+			return
+		}
+		expiresAt = time.Now().Add(d)
+	}
+	key, secret, err := g.newAccessKey(c.Request.Context(), c.Param("user"), expiresAt)
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	resp := accessKeyJSON(key)
+	resp["secret_access_key"] = secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+// ListAccessKeys handles GET /admin/users/:user/keys
+func (g *Gateway) ListAccessKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := g.metadata.GetUser(ctx, c.Param("user"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	keys, err := g.metadata.ListAccessKeys(ctx, user.Name)
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	list := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, accessKeyJSON(k))
+	}
+	c.JSON(http.StatusOK, gin.H{"access_keys": list})
+}
+
+// UpdateAccessKey handles PATCH /admin/keys/:key with a JSON body
+// {"status": "active"|"inactive", "expires_at": RFC 3339 time}, either
+// field optional. An empty expires_at removes the key's expiry.
+func (g *Gateway) UpdateAccessKey(c *gin.Context) {
+	var req struct {
+		Status    *string `json:"status"`
+		ExpiresAt *string `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Status == nil && req.ExpiresAt == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "body must be {\"status\": \"active\"|\"inactive\", \"expires_at\": <RFC 3339 time>}",
+		})
+		return
+	}
+	ctx := c.Request.Context()
+	key, err := g.metadata.GetAccessKey(ctx, c.Param("key"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	if req.Status != nil {
+		switch status := metadata.AccessKeyStatus(*req.Status); status {
+		case metadata.AccessKeyActive, metadata.AccessKeyInactive:
+			key.Status = status
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active or inactive"})
+			return
+		}
+	}
+	if req.ExpiresAt != nil {
+		key.ExpiresAt = time.Time{}
+		if *req.ExpiresAt != "" {
+			if key.ExpiresAt, err = time.Parse(time.RFC3339, *req.ExpiresAt); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be an RFC 3339 time"})
+				return
+			}
+		}
+	}
+	if err := g.metadata.PutAccessKey(ctx, key); err != nil {
+		iamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accessKeyJSON(key))
+}
+
+// RotateAccessKey handles POST /admin/keys/:key/rotate with an optional
+// JSON body {"grace": "24h"}. It creates a new key for the same user and
+// retires the old one: at once, or when the grace period ends so clients
+// can switch over. The response carries the new key and its secret.
+func (g *Gateway) RotateAccessKey(c *gin.Context) {
+	if !g.requireSecrets(c) {
+		return
+	}
+	var req struct {
+		Grace string `json:"grace"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "body must be {\"grace\": <duration>}"})
+			return
+		}
+	}
+	var grace time.Duration
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "grace must be a duration such as 24h"})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	old, err := g.metadata.GetAccessKey(ctx, c.Param("key"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	key, secret, err := g.newAccessKey(ctx, old.UserName, time.Time{})
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	if grace == 0 {
+		old.Status = metadata.AccessKeyInactive
+	} else if retire := time.Now().Add(grace); old.ExpiresAt.IsZero() || retire.Before(old.ExpiresAt) {
+		old.ExpiresAt = retire
+	}
+	if err := g.metadata.PutAccessKey(ctx, old); err != nil {
+		iamError(c, err)
+		return
+	}
+
+	resp := accessKeyJSON(key)
+	resp["secret_access_key"] = secret
+	resp["replaces"] = accessKeyJSON(old)
+	c.JSON(http.StatusCreated, resp)
+}
+
+// DeleteAccessKey handles DELETE /admin/keys/:key
+func (g *Gateway) DeleteAccessKey(c *gin.Context) {
+	if err := g.metadata.DeleteAccessKey(c.Request.Context(), c.Param("key")); err != nil {
+		iamError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// requireSecrets responds 503 unless SECRETS_KEY is configured, without
+// which access key secrets can be neither sealed nor opened
+func (g *Gateway) requireSecrets(c *gin.Context) bool {
+	if g.secrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SECRETS_KEY is not configured"})
+		return false
+	}
+	return true
+}
+
+// newAccessKey generates an access key for a user, or a root key for an
+// empty user name, and stores it with its secret sealed
+func (g *Gateway) newAccessKey(ctx context.Context, userName string, expiresAt time.Time) (*metadata.AccessKey, string, error) {
+	id, err := auth.NewAccessKeyID()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := auth.NewSecretAccessKey()
+	if err != nil {
+		return nil, "", err
+	}
+	sealed, err := g.secrets.Seal(id, secret)
+	if err != nil {
+		return nil, "", fmt.Errorf("seal secret: %w", err)
+	}
+	key := &metadata.AccessKey{
+		AccessKeyID:  id,
+		UserName:     userName,
+		SealedSecret: sealed,
+		Status:       metadata.AccessKeyActive,
+		ExpiresAt:    expiresAt,
+	}
+	if err := g.metadata.PutAccessKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// CreateGroup handles POST /admin/groups with a JSON body {"name": ...}
+func (g *Gateway) CreateGroup(c *gin.Context) {
+	name, ok := bindName(c)
+	if !ok {
+		return
+	}
+	grp, err := g.metadata.CreateGroup(c.Request.Context(), name)
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, groupJSON(grp))
+}
+
+// ListGroups handles GET /admin/groups
+func (g *Gateway) ListGroups(c *gin.Context) {
+	groups, err := g.metadata.ListGroups(c.Request.Context())
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	list := make([]gin.H, 0, len(groups))
+	for _, grp := range groups {
+		list = append(list, groupJSON(grp))
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": list})
+}
+
+// GetGroup handles GET /admin/groups/:group
+func (g *Gateway) GetGroup(c *gin.Context) {
+	grp, err := g.metadata.GetGroup(c.Request.Context(), c.Param("group"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, groupJSON(grp))
+}
+
+// DeleteGroup handles DELETE /admin/groups/:group. Its members are kept.
+func (g *Gateway) DeleteGroup(c *gin.Context) {
+	if err := g.metadata.DeleteGroup(c.Request.Context(), c.Param("group")); err != nil {
+		iamError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AddGroupMember handles PUT /admin/groups/:group/members/:user
+func (g *Gateway) AddGroupMember(c *gin.Context) {
+	ctx := c.Request.Context()
+	if err := g.metadata.AddGroupMember(ctx, c.Param("group"), c.Param("user")); err != nil {
+		iamError(c, err)
+		return
+	}
+	grp, err := g.metadata.GetGroup(ctx, c.Param("group"))
+	if err != nil {
+		iamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, groupJSON(grp))
+}
+
+// RemoveGroupMember handles DELETE /admin/groups/:group/members/:user
+func (g *Gateway) RemoveGroupMember(c *gin.Context) {
+	if err := g.metadata.RemoveGroupMember(c.Request.Context(), c.Param("group"), c.Param("user")); err != nil {
+		iamError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
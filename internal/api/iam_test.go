@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// priorityStore records the repair priorities set through the admin API
+type priorityStore struct {
+	keyStore
+	priorities map[string]int
+}
+
+func (s *priorityStore) SetBucketRepairPriority(ctx context.Context, name string, priority int) error {
+	s.priorities[name] = priority
+	return nil
+}
+
+// TestAdminWithoutSecrets checks that with auth disabled and no SECRETS_KEY
+// the admin endpoints still work, except those minting access keys
+func TestAdminWithoutSecrets(t *testing.T) {
+	store := &priorityStore{priorities: make(map[string]int)}
+	srv := httptest.NewServer(SetupRouter(NewGateway(Config{Metadata: store}), "test"))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"repair priority", http.MethodPut, "/admin/buckets/bkt/repair-priority", `{"priority":3}`, http.StatusOK},
+		{"create access key", http.MethodPost, "/admin/users/alice/keys", "", http.StatusServiceUnavailable},
+		{"rotate access key", http.MethodPost, "/admin/keys/PKEXAMPLE/rotate", "", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if store.priorities["bkt"] != 3 {
+		t.Errorf("repair priority %d, want 3", store.priorities["bkt"])
+	}
+}
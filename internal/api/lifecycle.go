@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// maxLifecycleRules is the S3 limit on rules per lifecycle configuration
+const maxLifecycleRules = 1000
+
+var (
+	// errMalformedLifecycle marks a lifecycle configuration that breaks the
+	// S3 schema
+	errMalformedLifecycle = errors.New("malformed lifecycle configuration")
+
+	// errInvalidLifecycle marks a lifecycle rule with an invalid value
+	errInvalidLifecycle = errors.New("invalid lifecycle rule")
+
+	// errUnsupportedLifecycle marks lifecycle actions and filters Plinth does
+	// not implement
+	errUnsupportedLifecycle = errors.New("unsupported lifecycle rule")
+)
+
+// Lifecycle rule statuses
+const (
+	lifecycleEnabled  = "Enabled"
+	lifecycleDisabled = "Disabled"
+)
+
+// lifecycleConfiguration is the PutBucketLifecycleConfiguration request body
+// and the GetBucketLifecycleConfiguration response
+type lifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+// lifecycleRule is one rule. Actions other than
+// AbortIncompleteMultipartUpload are parsed only to be refused.
+type lifecycleRule struct {
+	ID     string           `xml:"ID,omitempty"`
+	Prefix *string          `xml:"Prefix,omitempty"` // deprecated form of Filter
+	Filter *lifecycleFilter `xml:"Filter,omitempty"`
+	Status string           `xml:"Status"`
+
+	AbortIncompleteMultipartUpload *abortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload,omitempty"`
+
+	Expiration                  *struct{} `xml:"Expiration,omitempty"`
+	Transition                  *struct{} `xml:"Transition,omitempty"`
+	NoncurrentVersionExpiration *struct{} `xml:"NoncurrentVersionExpiration,omitempty"`
+	NoncurrentVersionTransition *struct{} `xml:"NoncurrentVersionTransition,omitempty"`
+}
+
+// lifecycleFilter selects the keys a rule applies to. Only a key prefix is
+// supported.
+type lifecycleFilter struct {
+	Prefix string    `xml:"Prefix"`
+	Tag    *struct{} `xml:"Tag,omitempty"`
+	And    *struct{} `xml:"And,omitempty"`
+}
+
+type abortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int
+}
+
+func (g *Gateway) GetBucketLifecycle(c *gin.Context) {
+	if !g.authorize(c, actionGetLifecycleConfiguration) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if len(b.Lifecycle) == 0 {
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchLifecycleConfiguration, "The lifecycle configuration does not exist")
+		return
+	}
+
+	config := lifecycleConfiguration{}
+	for _, rule := range b.Lifecycle {
+		r := lifecycleRule{
+			ID:     rule.ID,
+			Filter: &lifecycleFilter{Prefix: rule.Prefix},
+			Status: lifecycleDisabled,
+		}
+		if rule.Enabled {
+			r.Status = lifecycleEnabled
+		}
+		if rule.AbortIncompleteMultipartUploadDays > 0 {
+			r.AbortIncompleteMultipartUpload = &abortIncompleteMultipartUpload{
+				DaysAfterInitiation: rule.AbortIncompleteMultipartUploadDays,
+			}
+		}
+		config.Rules = append(config.Rules, r)
+	}
+	c.XML(http.StatusOK, config)
+}
+
+func (g *Gateway) PutBucketLifecycle(c *gin.Context) {
+	if !g.authorize(c, actionPutLifecycleConfiguration) {
+		return
+	}
+	bucket := c.Param("bucket")
+	ctx := c.Request.Context()
+
+	contentMD5, err := parseContentMD5(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidDigest, err.Error())
+		return
+	}
+	hasher, err := checksum.NewMultiHasher(checksum.MD5)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	data, ok := g.readConfig(c)
+	if !ok {
+		return
+	}
+	hasher.Write(data)
+	var config lifecycleConfiguration
+	if err := xml.Unmarshal(data, &config); err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The XML you provided was not well-formed or did not validate against our published schema")
+		return
+	}
+	if err := hasher.Verify(contentMD5); err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrBadDigest, err.Error())
+		return
+	}
+
+	rules, err := lifecycleRules(config)
+	switch {
+	case errors.Is(err, errMalformedLifecycle):
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML, err.Error())
+		return
+	case errors.Is(err, errInvalidLifecycle):
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	case errors.Is(err, errUnsupportedLifecycle):
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, err.Error())
+		return
+	}
+	if err := g.metadata.SetBucketLifecycle(ctx, bucket, rules); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) DeleteBucketLifecycle(c *gin.Context) {
+	if !g.authorize(c, actionPutLifecycleConfiguration) {
+		return
+	}
+	if err := g.metadata.SetBucketLifecycle(c.Request.Context(), c.Param("bucket"), nil); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// lifecycleRules validates a lifecycle configuration and converts it to
+// metadata rules
+func lifecycleRules(config lifecycleConfiguration) ([]metadata.LifecycleRule, error) {
+	if len(config.Rules) == 0 || len(config.Rules) > maxLifecycleRules {
+		return nil, fmt.Errorf("%w: a configuration holds 1 to %d rules", errMalformedLifecycle, maxLifecycleRules)
+	}
+	ids := make(map[string]bool)
+	rules := make([]metadata.LifecycleRule, 0, len(config.Rules))
+	for i, r := range config.Rules {
+		if r.ID == "" {
+			r.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if len(r.ID) > 255 {
+			return nil, fmt.Errorf("%w: rule %d: ID is longer than 255 characters", errInvalidLifecycle, i+1)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("%w: rule ID %q is not unique", errInvalidLifecycle, r.ID)
+		}
+		ids[r.ID] = true
+
+		if r.Status != lifecycleEnabled && r.Status != lifecycleDisabled {
+			return nil, fmt.Errorf("%w: rule %q: Status must be Enabled or Disabled", errMalformedLifecycle, r.ID)
+		}
+		if r.Expiration != nil || r.Transition != nil ||
+			r.NoncurrentVersionExpiration != nil || r.NoncurrentVersionTransition != nil {
+			return nil, fmt.Errorf("%w: rule %q: only the AbortIncompleteMultipartUpload action is supported",
+				errUnsupportedLifecycle, r.ID)
+		}
+		if r.AbortIncompleteMultipartUpload == nil {
+			return nil, fmt.Errorf("%w: rule %q: at least one action needs to be specified", errMalformedLifecycle, r.ID)
+		}
+		if r.AbortIncompleteMultipartUpload.DaysAfterInitiation < 1 {
+			return nil, fmt.Errorf("%w: rule %q: DaysAfterInitiation must be a positive integer", errInvalidLifecycle, r.ID)
+		}
+
+		rule := metadata.LifecycleRule{
+			ID:                                 r.ID,
+			Enabled:                            r.Status == lifecycleEnabled,
+			AbortIncompleteMultipartUploadDays: r.AbortIncompleteMultipartUpload.DaysAfterInitiation,
+		}
+		switch {
+		case r.Filter != nil && r.Prefix != nil:
+			return nil, fmt.Errorf("%w: rule %q: Prefix and Filter cannot both be given", errMalformedLifecycle, r.ID)
+		case r.Filter != nil:
+			if r.Filter.Tag != nil || r.Filter.And != nil {
+				return nil, fmt.Errorf("%w: rule %q: only prefix filters are supported", errUnsupportedLifecycle, r.ID)
+			}
+			rule.Prefix = r.Filter.Prefix
+		case r.Prefix != nil:
+			rule.Prefix = *r.Prefix
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
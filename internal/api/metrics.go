@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How a request was made, the access label of the S3 metrics: signed with
+// an access key, anonymous, or with authentication disabled
+const (
+	accessSigned    = "signed"
+	accessAnonymous = "anonymous"
+	accessOpen      = "open"
+)
+
+var (
+	s3Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_s3_requests_total",
+		Help: "S3 requests that passed authentication, by access and response status.",
+	}, []string{"access", "method", "status"})
+
+	s3EgressBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_s3_egress_bytes_total",
+		Help: "Object bytes served by GetObject, by access.",
+	}, []string{"access"})
+
+	s3Throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_s3_throttled_requests_total",
+		Help: "S3 requests refused with SlowDown, by the kind of key that was over its limit.",
+	}, []string{"limit"})
+
+	quotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_quota_rejected_writes_total",
+		Help: "PutObject and CompleteMultipartUpload requests refused with QuotaExceeded, by quota scope.",
+	}, []string{"scope"})
+
+	quotaSoftExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_quota_soft_exceeded_total",
+		Help: "Writes that took a bucket's or user's usage over a soft quota, by scope and resource.",
+	}, []string{"scope", "resource"})
+
+	encryptionKeysRewrapped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "plinth_sse_data_keys_rewrapped_total",
+		Help: "Data keys rewrapped with the current master key by POST /admin/encryption/rotate.",
+	})
+)
+
+func countRequest(c *gin.Context, access string) {
+	s3Requests.WithLabelValues(access, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+}
+
+// recordEgress counts object bytes served from bucket, in the metrics and
+// in the bucket's cost_tracking row. Anonymous reads are counted apart so
+// public datasets show what they cost.
+func (g *Gateway) recordEgress(c *gin.Context, bucket string, n int64) {
+	if n == 0 {
+		return
+	}
+	anonymous := c.GetBool(contextAnonymous)
+	access := accessSigned
+	switch {
+	case anonymous:
+		access = accessAnonymous
+	case !g.authEnabled:
+		access = accessOpen
+	}
+	s3EgressBytes.WithLabelValues(access).Add(float64(n))
+
+	// The client may be gone by now; the bytes were served all the same
+	ctx := context.WithoutCancel(c.Request.Context())
+	if err := g.metadata.RecordEgress(ctx, bucket, n, anonymous); err != nil {
+		log.Printf("GET %s: %v", bucket, err)
+	}
+}
@@ -26,7 +26,9 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, HEAD, OPTIONS")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Authorization, Range, x-amz-*")
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Length, Content-Type, x-amz-request-id")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Length, Content-Type, x-amz-request-id, "+
+			"x-amz-checksum-crc32, x-amz-checksum-crc32c, x-amz-checksum-crc64nvme, x-amz-checksum-sha1, x-amz-checksum-sha256, "+
+			"x-amz-checksum-type, Content-Range, Accept-Ranges")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -55,31 +57,6 @@ func MetricsMiddleware() gin.HandlerFunc {
 	}
 }
 
-// AuthMiddleware handles authentication (to be implemented)
-func AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// TODO: Implement authentication
-		// - AWS SigV4 signature verification
-		// - API key validation
-		// - Pre-signed URL validation
-
-		// For now, allow all requests
-		c.Next()
-	}
-}
-
-// RateLimitMiddleware limits requests per client (to be implemented)
-func RateLimitMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// TODO: Implement rate limiting
-		// - Per-IP rate limiting
-		// - Per-bucket rate limiting
-		// - Configurable limits
-
-		c.Next()
-	}
-}
-
 // LoggingMiddleware provides structured logging
 func LoggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
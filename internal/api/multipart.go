@@ -0,0 +1,611 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+// S3 limits on multipart uploads
+const (
+	minPartSize      = 5 << 20 // every part but the last
+	maxPartNumber    = 10000
+	defaultListLimit = 1000
+)
+
+var (
+	// errInvalidPart marks a completed part that was not uploaded or whose
+	// ETag or checksum does not match
+	errInvalidPart = errors.New("one or more of the specified parts could not be found")
+
+	// errInvalidPartOrder marks completed parts not in ascending order
+	errInvalidPartOrder = errors.New("the list of parts was not in ascending order")
+
+	// errEntityTooSmall marks a part other than the last below minPartSize
+	errEntityTooSmall = errors.New("your proposed upload is smaller than the minimum allowed size")
+)
+
+// completeMultipartUpload is the CompleteMultipartUpload request body
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// completedPart names one part of the object and, optionally, the checksum
+// the client expects it to have
+type completedPart struct {
+	PartNumber        int
+	ETag              string
+	ChecksumCRC32     string
+	ChecksumCRC32C    string
+	ChecksumCRC64NVME string
+	ChecksumSHA1      string
+	ChecksumSHA256    string
+}
+
+// checksum returns the base64 part checksum given for algo, if any
+func (p completedPart) checksum(algo checksum.Algorithm) string {
+	switch algo {
+	case checksum.CRC32:
+		return p.ChecksumCRC32
+	case checksum.CRC32C:
+		return p.ChecksumCRC32C
+	case checksum.CRC64NVME:
+		return p.ChecksumCRC64NVME
+	case checksum.SHA1:
+		return p.ChecksumSHA1
+	case checksum.SHA256:
+		return p.ChecksumSHA256
+	}
+	return ""
+}
+
+func (g *Gateway) InitiateMultipartUpload(c *gin.Context) {
+	if !g.authorize(c, actionPutObject) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	ctx := c.Request.Context()
+
+	algo, sumType, err := parseMultipartChecksum(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	b, err := g.metadata.GetBucket(ctx, bucket)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	// The ID is chosen here so a new data key can be wrapped for the upload
+	uploadID := metadata.NewID()
+	encryption, _, ok := g.writeEncryption(c, b, uploadKeyOwner(uploadID))
+	if !ok {
+		return
+	}
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	upload := &metadata.MultipartUpload{
+		UploadID:          uploadID,
+		BucketName:        bucket,
+		ObjectKey:         key,
+		ContentType:       contentType,
+		ChecksumAlgorithm: algo,
+		ChecksumType:      sumType,
+		// The parts are sealed with the upload's data key, which is
+		// unwrapped for each part, or with the customer-provided key
+		// given with each part
+		Encryption: encryption,
+	}
+	if err := g.metadata.CreateMultipartUpload(ctx, upload); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	if algo != "" {
+		c.Header(headerChecksumAlgorithm, algo.S3Name())
+		c.Header(headerChecksumType, string(sumType))
+	}
+	setEncryptionHeaders(c, upload.Encryption)
+	c.XML(http.StatusOK, gin.H{
+		"InitiateMultipartUploadResult": gin.H{
+			"Bucket":   bucket,
+			"Key":      key,
+			"UploadId": upload.UploadID,
+		},
+	})
+}
+
+func (g *Gateway) UploadPart(c *gin.Context) {
+	if !g.authorize(c, actionPutObject) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	uploadID := c.Query("uploadId")
+	ctx := c.Request.Context()
+
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", maxPartNumber))
+		return
+	}
+	checksumReq, err := parseChecksumRequest(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	contentMD5, err := parseContentMD5(c.Request.Header)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidDigest, err.Error())
+		return
+	}
+	body, contentLength, ok := g.objectBody(c)
+	if !ok {
+		return
+	}
+
+	upload, err := g.metadata.GetMultipartUpload(ctx, bucket, key, uploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	algo := upload.ChecksumAlgorithm
+	if algo != "" && checksumReq.Algorithm != "" && checksumReq.Algorithm != algo {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest,
+			fmt.Sprintf("the upload was created with the %s checksum algorithm, got %s",
+				algo.S3Name(), checksumReq.Algorithm.S3Name()))
+		return
+	}
+	if algo == "" {
+		algo = checksumReq.Algorithm
+	}
+	dataKey, ok := g.readKey(c, sseCustomerHeaders, upload.Encryption, uploadKeyOwner(upload.UploadID))
+	if !ok {
+		return
+	}
+
+	// Every part is hashed with the upload's algorithm, whether or not the
+	// client sent a value, so the object checksum can be derived on completion.
+	hasher, err := checksum.NewMultiHasher(checksum.XXHash, checksum.MD5, algo)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	sealed, sent, err := sealBody(body, hasher, dataKey)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	nodeIDs, err := g.placeObject(ctx, bucket, key)
+	if err != nil {
+		g.writeError(c, err)
+		return
+	}
+
+	part := &metadata.Part{
+		ID:         metadata.NewID(),
+		UploadID:   upload.UploadID,
+		PartNumber: partNumber,
+	}
+	stored, err := g.writeReplicas(ctx, part.ID, placement.KeyHash(placement.RingKey(bucket, key)), nodeIDs, sealed, sent)
+	if err != nil {
+		g.writeError(c, err)
+		return
+	}
+
+	if contentLength >= 0 && hasher.Size() != contentLength {
+		g.deleteReplicas(part.ID, stored)
+		g.writeError(c, errIncompleteBody)
+		return
+	}
+	if err := checksumReq.readTrailer(c.Request.Trailer); err != nil {
+		g.deleteReplicas(part.ID, stored)
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := hasher.Verify(contentMD5, checksumReq.Expected); err != nil {
+		g.deleteReplicas(part.ID, stored)
+		g.writeError(c, err)
+		return
+	}
+
+	md5sum, _ := hasher.Sum(checksum.MD5)
+	part.ETag = md5sum.Hex()
+	part.SizeBytes = hasher.Size()
+	part.Checksum, _ = sent.Sum(checksum.XXHash)
+	part.Placement = stored
+	if upload.ChecksumAlgorithm != "" {
+		part.S3Checksum, _ = hasher.Sum(upload.ChecksumAlgorithm)
+	}
+
+	replaced, err := g.metadata.PutPart(ctx, part)
+	if err != nil {
+		g.deleteReplicas(part.ID, stored)
+		g.lookupError(c, err)
+		return
+	}
+	if replaced != nil {
+		g.deleteReplicas(replaced.ID, replaced.Placement)
+	}
+
+	c.Header("ETag", "\""+part.ETag+"\"")
+	if sum, ok := hasher.Sum(algo); ok {
+		c.Header(algo.S3Header(), sum.Base64())
+	}
+	setEncryptionHeaders(c, upload.Encryption)
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) CompleteMultipartUpload(c *gin.Context) {
+	if !g.authorize(c, actionPutObject) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	uploadID := c.Query("uploadId")
+	ctx := c.Request.Context()
+
+	data, ok := g.readConfig(c)
+	if !ok {
+		return
+	}
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(data, &req); err != nil || len(req.Parts) == 0 {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The XML you provided was not well-formed or did not validate against our published schema")
+		return
+	}
+
+	upload, err := g.metadata.GetMultipartUpload(ctx, bucket, key, uploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	uploaded, err := g.metadata.ListParts(ctx, upload.UploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	parts, err := selectParts(upload, req.Parts, uploaded)
+	if err != nil {
+		g.writeError(c, err)
+		return
+	}
+
+	obj := &metadata.Object{
+		ID:          metadata.NewID(),
+		BucketName:  bucket,
+		ObjectKey:   key,
+		ContentType: upload.ContentType,
+		Metadata:    upload.Metadata,
+		PartsCount:  len(parts),
+	}
+	if upload.Encryption != nil {
+		// The parts keep the upload's data key, wrapped for the object
+		encryption := *upload.Encryption
+		if err := g.rewrapDataKey(&encryption, uploadKeyOwner(upload.UploadID), objectKeyOwner(obj.ID)); err != nil {
+			g.lookupError(c, err)
+			return
+		}
+		obj.Encryption = &encryption
+	}
+	if obj.ETag, err = multipartETag(parts); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if upload.ChecksumAlgorithm != "" {
+		if obj.S3Checksum, err = multipartChecksum(upload, parts); err != nil {
+			g.lookupError(c, err)
+			return
+		}
+		obj.S3ChecksumType = upload.ChecksumType
+
+		// The client may send the object checksum it expects
+		if expected := c.GetHeader(upload.ChecksumAlgorithm.S3Header()); expected != "" &&
+			expected != s3ChecksumValue(obj) && expected != obj.S3Checksum.Base64() {
+			g.errorResponse(c, http.StatusBadRequest, ErrBadDigest,
+				fmt.Sprintf("%s checksum mismatch: expected %s, got %s",
+					upload.ChecksumAlgorithm, expected, s3ChecksumValue(obj)))
+			return
+		}
+	}
+
+	b, err := g.metadata.GetBucket(ctx, bucket)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	var size int64
+	for _, part := range parts {
+		size += part.SizeBytes
+	}
+	quotas, ok := g.checkQuota(c, b, size)
+	if !ok {
+		return
+	}
+
+	if err := g.assembleObject(ctx, obj, parts); err != nil {
+		g.writeError(c, err)
+		return
+	}
+	if err := g.metadata.CompleteMultipartUpload(ctx, upload.UploadID, obj); err != nil {
+		g.discardObject(obj, obj.Placement)
+		g.lookupError(c, err)
+		return
+	}
+	g.quotaWritten(ctx, quotas, size)
+
+	// The part replicas, including parts left out of the object, are no
+	// longer referenced. Deleting them can take a while for large uploads,
+	// so it does not hold up the response.
+	go func() {
+		for _, part := range uploaded {
+			g.deleteReplicas(part.ID, part.Placement)
+		}
+	}()
+
+	if !obj.NullVersion {
+		c.Header(headerVersionID, obj.VersionID)
+	}
+	setEncryptionHeaders(c, obj.Encryption)
+	result := gin.H{
+		"Location": "/" + bucket + "/" + key,
+		"Bucket":   bucket,
+		"Key":      key,
+		"ETag":     "\"" + obj.ETag + "\"",
+	}
+	if !obj.S3Checksum.IsZero() {
+		result["Checksum"+obj.S3Checksum.Algorithm.S3Name()] = s3ChecksumValue(obj)
+		result["ChecksumType"] = string(obj.S3ChecksumType)
+	}
+	c.XML(http.StatusOK, gin.H{"CompleteMultipartUploadResult": result})
+}
+
+func (g *Gateway) AbortMultipartUpload(c *gin.Context) {
+	if !g.authorize(c, actionAbortMultipartUpload) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	uploadID := c.Query("uploadId")
+	ctx := c.Request.Context()
+
+	upload, err := g.metadata.GetMultipartUpload(ctx, bucket, key, uploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	parts, err := g.metadata.AbortMultipartUpload(ctx, upload.UploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	for _, part := range parts {
+		g.deleteReplicas(part.ID, part.Placement)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (g *Gateway) ListParts(c *gin.Context) {
+	if !g.authorize(c, actionListMultipartUploadParts) {
+		return
+	}
+	bucket := c.Param("bucket")
+	key := c.Param("key")[1:]
+	uploadID := c.Query("uploadId")
+	ctx := c.Request.Context()
+
+	marker, err := strconv.Atoi(c.DefaultQuery("part-number-marker", "0"))
+	if err != nil || marker < 0 {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "part-number-marker must be a non-negative integer")
+		return
+	}
+	maxParts, err := queryLimit(c, "max-parts")
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	}
+
+	upload, err := g.metadata.GetMultipartUpload(ctx, bucket, key, uploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	parts, err := g.metadata.ListParts(ctx, upload.UploadID)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	entries := []gin.H{}
+	truncated := false
+	next := marker
+	for _, part := range parts {
+		if part.PartNumber <= marker {
+			continue
+		}
+		if len(entries) == maxParts {
+			truncated = true
+			break
+		}
+		entry := gin.H{
+			"PartNumber":   part.PartNumber,
+			"ETag":         "\"" + part.ETag + "\"",
+			"Size":         part.SizeBytes,
+			"LastModified": part.UploadedAt.UTC().Format(timeFormatISO8601),
+		}
+		if !part.S3Checksum.IsZero() {
+			entry["Checksum"+part.S3Checksum.Algorithm.S3Name()] = part.S3Checksum.Base64()
+		}
+		entries = append(entries, entry)
+		next = part.PartNumber
+	}
+
+	result := gin.H{
+		"Bucket":               bucket,
+		"Key":                  key,
+		"UploadId":             upload.UploadID,
+		"PartNumberMarker":     marker,
+		"NextPartNumberMarker": next,
+		"MaxParts":             maxParts,
+		"IsTruncated":          truncated,
+		"Part":                 entries,
+	}
+	if upload.ChecksumAlgorithm != "" {
+		result["ChecksumAlgorithm"] = upload.ChecksumAlgorithm.S3Name()
+		result["ChecksumType"] = string(upload.ChecksumType)
+	}
+	c.XML(http.StatusOK, gin.H{"ListPartsResult": result})
+}
+
+func (g *Gateway) ListMultipartUploads(c *gin.Context) {
+	if !g.authorize(c, actionListBucketMultipartUploads) {
+		return
+	}
+	bucket := c.Param("bucket")
+	prefix := c.Query("prefix")
+	ctx := c.Request.Context()
+
+	maxUploads, err := queryLimit(c, "max-uploads")
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	}
+	if _, err := g.metadata.GetBucket(ctx, bucket); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	uploads, err := g.metadata.ListMultipartUploads(ctx, bucket, prefix, maxUploads+1)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	truncated := len(uploads) > maxUploads
+	if truncated {
+		uploads = uploads[:maxUploads]
+	}
+
+	entries := make([]gin.H, 0, len(uploads))
+	for _, upload := range uploads {
+		entry := gin.H{
+			"Key":       upload.ObjectKey,
+			"UploadId":  upload.UploadID,
+			"Initiated": upload.InitiatedAt.UTC().Format(timeFormatISO8601),
+		}
+		if upload.ChecksumAlgorithm != "" {
+			entry["ChecksumAlgorithm"] = upload.ChecksumAlgorithm.S3Name()
+			entry["ChecksumType"] = string(upload.ChecksumType)
+		}
+		entries = append(entries, entry)
+	}
+
+	c.XML(http.StatusOK, gin.H{
+		"ListMultipartUploadsResult": gin.H{
+			"Bucket":      bucket,
+			"Prefix":      prefix,
+			"MaxUploads":  maxUploads,
+			"IsTruncated": truncated,
+			"Upload":      entries,
+		},
+	})
+}
+
+// queryLimit parses a max-* listing parameter, capped at defaultListLimit
+func queryLimit(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultListLimit, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	if n > defaultListLimit {
+		n = defaultListLimit
+	}
+	return n, nil
+}
+
+// selectParts matches the parts named in a complete request against the
+// uploaded parts and returns them in object order
+func selectParts(upload *metadata.MultipartUpload, requested []completedPart, uploaded []*metadata.Part) ([]*metadata.Part, error) {
+	byNumber := make(map[int]*metadata.Part, len(uploaded))
+	for _, part := range uploaded {
+		byNumber[part.PartNumber] = part
+	}
+
+	parts := make([]*metadata.Part, 0, len(requested))
+	for i, req := range requested {
+		if i > 0 && req.PartNumber <= requested[i-1].PartNumber {
+			return nil, errInvalidPartOrder
+		}
+		part, ok := byNumber[req.PartNumber]
+		if !ok || strings.Trim(req.ETag, `"`) != part.ETag {
+			return nil, fmt.Errorf("%w: part %d", errInvalidPart, req.PartNumber)
+		}
+		if want := req.checksum(upload.ChecksumAlgorithm); want != "" && want != part.S3Checksum.Base64() {
+			return nil, fmt.Errorf("%w: part %d %s checksum does not match", errInvalidPart, req.PartNumber,
+				upload.ChecksumAlgorithm.S3Name())
+		}
+		if i < len(requested)-1 && part.SizeBytes < minPartSize {
+			return nil, fmt.Errorf("%w: part %d is %d bytes", errEntityTooSmall, req.PartNumber, part.SizeBytes)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// multipartETag returns the S3 ETag of a multipart object: the MD5 of the
+// concatenated part MD5s, suffixed with the part count
+func multipartETag(parts []*metadata.Part) (string, error) {
+	h := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return "", fmt.Errorf("part %d: invalid ETag %q", part.PartNumber, part.ETag)
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(parts)), nil
+}
+
+// multipartChecksum derives the object checksum from the part checksums,
+// either combining the CRCs into a full-object CRC or hashing the part
+// checksums into a composite one. No part data is read.
+func multipartChecksum(upload *metadata.MultipartUpload, parts []*metadata.Part) (checksum.Value, error) {
+	sums := make([]checksum.Value, len(parts))
+	for i, part := range parts {
+		if part.S3Checksum.Algorithm != upload.ChecksumAlgorithm {
+			return checksum.Value{}, fmt.Errorf("part %d has no %s checksum", part.PartNumber, upload.ChecksumAlgorithm)
+		}
+		sums[i] = part.S3Checksum
+	}
+
+	if upload.ChecksumType != checksum.TypeFullObject {
+		return checksum.Composite(upload.ChecksumAlgorithm, sums)
+	}
+	combined := sums[0]
+	for i := 1; i < len(parts); i++ {
+		var err error
+		if combined, err = checksum.Combine(combined, sums[i], parts[i].SizeBytes); err != nil {
+			return checksum.Value{}, err
+		}
+	}
+	return combined, nil
+}
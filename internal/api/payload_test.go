@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// keyStore is a metadata store holding just a root access key and the
+// versioning of buckets; any other call panics
+type keyStore struct {
+	metadata.Service
+	key        *metadata.AccessKey
+	versioning map[string]metadata.VersioningStatus
+}
+
+func (s *keyStore) GetAccessKey(ctx context.Context, accessKeyID string) (*metadata.AccessKey, error) {
+	if accessKeyID != s.key.AccessKeyID {
+		return nil, metadata.ErrAccessKeyNotFound
+	}
+	return s.key, nil
+}
+
+func (s *keyStore) SetBucketVersioning(ctx context.Context, name string, status metadata.VersioningStatus) error {
+	s.versioning[name] = status
+	return nil
+}
+
+const (
+	testAccessKeyID = "AKIDEXAMPLE"
+	testSecret      = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// signedGateway serves a gateway configured with cfg, with auth enabled
+// and a root access key
+func signedGateway(t *testing.T, cfg Config) (*httptest.Server, *keyStore) {
+	t.Helper()
+	box, err := auth.NewSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal(testAccessKeyID, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &keyStore{
+		key: &metadata.AccessKey{
+			AccessKeyID:  testAccessKeyID,
+			SealedSecret: sealed,
+			Status:       metadata.AccessKeyActive,
+		},
+		versioning: make(map[string]metadata.VersioningStatus),
+	}
+	cfg.Metadata, cfg.AuthEnabled, cfg.Secrets = store, true, box
+	g := NewGateway(cfg)
+	srv := httptest.NewServer(SetupRouter(g, "test"))
+	t.Cleanup(srv.Close)
+	return srv, store
+}
+
+// sendSigned signs a request for signedBody and sends body instead
+func sendSigned(t *testing.T, srv *httptest.Server, method, path string, signedBody, body []byte) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	payload := sha256.Sum256(signedBody)
+	if err := auth.SignRequest(req, testAccessKeyID, testSecret, "us-east-1", hex.EncodeToString(payload[:]), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readBody(t, resp)
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestTamperedConfigBody checks that configuration and admin requests whose
+// body does not match the signed x-amz-content-sha256 are refused, although
+// their decoders stop reading at the end of the document
+func TestTamperedConfigBody(t *testing.T) {
+	srv, store := signedGateway(t, Config{})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		signed   string
+		tampered string
+		s3       bool
+	}{
+		{"versioning", http.MethodPut, "/bkt?versioning",
+			`<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`,
+			`<VersioningConfiguration><Status>Suspended</Status></VersioningConfiguration>`, true},
+		{"public access block", http.MethodPut, "/bkt?publicAccessBlock",
+			`<PublicAccessBlockConfiguration><BlockPublicPolicy>true</BlockPublicPolicy></PublicAccessBlockConfiguration>`,
+			`<PublicAccessBlockConfiguration><BlockPublicPolicy>fals</BlockPublicPolicy></PublicAccessBlockConfiguration>`, true},
+		{"encryption", http.MethodPut, "/bkt?encryption",
+			`<ServerSideEncryptionConfiguration><Rule><ApplyServerSideEncryptionByDefault><SSEAlgorithm>AES256</SSEAlgorithm></ApplyServerSideEncryptionByDefault></Rule></ServerSideEncryptionConfiguration>`,
+			`<ServerSideEncryptionConfiguration><Rule><ApplyServerSideEncryptionByDefault><SSEAlgorithm>AES257</SSEAlgorithm></ApplyServerSideEncryptionByDefault></Rule></ServerSideEncryptionConfiguration>`, true},
+		{"lifecycle", http.MethodPut, "/bkt?lifecycle",
+			`<LifecycleConfiguration><Rule><ID>a</ID><Status>Enabled</Status><Filter></Filter><Expiration><Days>30</Days></Expiration></Rule></LifecycleConfiguration>`,
+			`<LifecycleConfiguration><Rule><ID>a</ID><Status>Enabled</Status><Filter></Filter><Expiration><Days>1</Days></Expiration></Rule></LifecycleConfiguration>`, true},
+		{"complete multipart upload", http.MethodPost, "/bkt/key?uploadId=00000000-0000-0000-0000-000000000001",
+			`<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"a"</ETag></Part></CompleteMultipartUpload>`,
+			`<CompleteMultipartUpload><Part><PartNumber>2</PartNumber><ETag>"a"</ETag></Part></CompleteMultipartUpload>`, true},
+		{"rate limits", http.MethodPut, "/admin/rate-limits",
+			`{"source_ip":{"requests":{"rate":100}}}`,
+			`{"source_ip":{"requests":{"rate":999}}}`, false},
+		{"create user", http.MethodPost, "/admin/users",
+			`{"name":"alice"}`,
+			`{"name":"mallory"}`, false},
+		{"bucket quota", http.MethodPut, "/admin/buckets/bkt/quota",
+			`{"max_bytes":100}`,
+			`{"max_bytes":999}`, false},
+		{"repair priority", http.MethodPut, "/admin/buckets/bkt/repair-priority",
+			`{"priority":1}`,
+			`{"priority":9}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := sendSigned(t, srv, tt.method, tt.path, []byte(tt.signed), []byte(tt.tampered))
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", resp.StatusCode, body)
+			}
+			if tt.s3 {
+				var e struct{ Error S3Error }
+				if err := xml.Unmarshal([]byte(body), &e); err != nil || e.Error.Code != ErrXAmzContentSHA256Mismatch {
+					t.Fatalf("error %q, want %s: %s", e.Error.Code, ErrXAmzContentSHA256Mismatch, body)
+				}
+			} else if !strings.Contains(body, auth.ErrContentSHA256Mismatch.Error()) {
+				t.Fatalf("body %s, want the SHA-256 mismatch", body)
+			}
+		})
+	}
+
+	// The body it was signed with is accepted
+	signed := []byte(tests[0].signed)
+	resp, body := sendSigned(t, srv, http.MethodPut, "/bkt?versioning", signed, signed)
+	if resp.StatusCode != http.StatusOK || store.versioning["bkt"] != metadata.VersioningEnabled {
+		t.Fatalf("status %d, versioning %q: %s", resp.StatusCode, store.versioning["bkt"], body)
+	}
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/policy"
+)
+
+// S3 actions that bucket policies grant and deny. An action on a specific
+// version appends "Version" to the action, as versioned() does.
+const (
+	actionListBucket                 = "s3:ListBucket"
+	actionListBucketVersions         = "s3:ListBucketVersions"
+	actionListBucketMultipartUploads = "s3:ListBucketMultipartUploads"
+	actionDeleteBucket               = "s3:DeleteBucket"
+	actionGetObject                  = "s3:GetObject"
+	actionGetObjectVersion           = "s3:GetObjectVersion"
+	actionPutObject                  = "s3:PutObject"
+	actionDeleteObject               = "s3:DeleteObject"
+	actionAbortMultipartUpload       = "s3:AbortMultipartUpload"
+	actionListMultipartUploadParts   = "s3:ListMultipartUploadParts"
+	actionGetLifecycleConfiguration  = "s3:GetLifecycleConfiguration"
+	actionPutLifecycleConfiguration  = "s3:PutLifecycleConfiguration"
+	actionGetBucketVersioning        = "s3:GetBucketVersioning"
+	actionPutBucketVersioning        = "s3:PutBucketVersioning"
+	actionGetBucketPolicy            = "s3:GetBucketPolicy"
+	actionPutBucketPolicy            = "s3:PutBucketPolicy"
+	actionDeleteBucketPolicy         = "s3:DeleteBucketPolicy"
+	actionGetBucketAcl               = "s3:GetBucketAcl"
+	actionPutBucketAcl               = "s3:PutBucketAcl"
+	actionGetBucketPublicAccessBlock = "s3:GetBucketPublicAccessBlock"
+	actionPutBucketPublicAccessBlock = "s3:PutBucketPublicAccessBlock"
+	actionGetEncryptionConfiguration = "s3:GetEncryptionConfiguration"
+	actionPutEncryptionConfiguration = "s3:PutEncryptionConfiguration"
+)
+
+// versioned returns the action on a specific version when the request
+// names one: s3:GetObject becomes s3:GetObjectVersion
+func versioned(c *gin.Context, action string) string {
+	if _, ok := c.GetQuery("versionId"); ok {
+		return action + "Version"
+	}
+	return action
+}
+
+// resource is what a request acts on: a bucket, or an object in it and
+// possibly one of its versions
+type resource struct {
+	bucket    string
+	key       string // empty for a bucket
+	versionID string
+	versioned bool // a version is named, if only by an empty versionId
+}
+
+// requestResource returns the bucket, or the object for object routes,
+// that the request's path and versionId name
+func requestResource(c *gin.Context) resource {
+	res := resource{bucket: c.Param("bucket")}
+	if key := c.Param("key"); key != "" {
+		res.key = key[1:]
+	}
+	res.versionID, res.versioned = c.GetQuery("versionId")
+	return res
+}
+
+// authorize checks that the requester may perform action on the request's
+// bucket, or on its object for object routes, and writes AccessDenied if
+// not. Root keys may do anything. Requests for missing buckets are let
+// through so the handler reports NoSuchBucket.
+func (g *Gateway) authorize(c *gin.Context, action string) bool {
+	return g.authorizeResource(c, action, requestResource(c))
+}
+
+// authorizeResource is authorize for a resource other than the one the
+// request's path names, such as the source of a copy
+func (g *Gateway) authorizeResource(c *gin.Context, action string, res resource) bool {
+	if !g.authEnabled {
+		return true
+	}
+	anonymous := c.GetBool(contextAnonymous)
+	if !anonymous && c.GetString(contextUser) == "" {
+		return true
+	}
+
+	b, err := g.metadata.GetBucket(c.Request.Context(), res.bucket)
+	if errors.Is(err, metadata.ErrBucketNotFound) {
+		return true
+	}
+	if err != nil {
+		g.lookupError(c, err)
+		return false
+	}
+	allowed, err := g.allowed(c, b, action, res)
+	if err != nil {
+		g.lookupError(c, err)
+		return false
+	}
+	if !allowed {
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Access Denied")
+	}
+	return allowed
+}
+
+// allowed decides a user's or anonymous request on bucket b. An explicit
+// Deny in the bucket policy wins. The owner may do anything else, and may
+// always manage the policy itself; other requesters need an Allow from the
+// policy or, to read, a public-read ACL. The public access block can take
+// away what the ACL and a public policy grant anonymous requesters.
+func (g *Gateway) allowed(c *gin.Context, b *metadata.Bucket, action string, res resource) (bool, error) {
+	user := c.GetString(contextUser)
+	anonymous := c.GetBool(contextAnonymous)
+	owner := !anonymous && b.Owner == user
+	if owner && (action == actionGetBucketPolicy || action == actionPutBucketPolicy || action == actionDeleteBucketPolicy) {
+		return true, nil
+	}
+	block := g.publicAccessBlock(b)
+
+	if b.Policy != "" {
+		p, err := policy.Parse([]byte(b.Policy), b.Name)
+		if err != nil {
+			return false, err
+		}
+		var u *metadata.User
+		if !anonymous {
+			if u, err = g.metadata.GetUser(c.Request.Context(), user); err != nil {
+				return false, err
+			}
+		}
+		switch p.Evaluate(g.policyRequest(c, action, res, u)) {
+		case policy.Deny:
+			return false, nil
+		case policy.Allow:
+			if !anonymous || !block.RestrictPublicBuckets || !p.IsPublic() {
+				return true, nil
+			}
+		}
+	}
+	if owner {
+		return true, nil
+	}
+	return b.ACL == metadata.ACLPublicRead && !block.IgnorePublicAcls && publicReadActions[action], nil
+}
+
+// policyRequest describes a request for policy evaluation: its action on
+// res, the user and groups making it (none if u is nil, for anonymous
+// requests), and its condition keys
+func (g *Gateway) policyRequest(c *gin.Context, action string, res resource, u *metadata.User) *policy.Request {
+	r := &policy.Request{
+		Action:   action,
+		Resource: policy.BucketARN(res.bucket),
+	}
+	if res.key != "" {
+		r.Resource = policy.ObjectARN(res.bucket, res.key)
+	}
+	if u != nil {
+		r.Principals = append(r.Principals, policy.UserARN(u.Name))
+		for _, grp := range u.Groups {
+			r.Principals = append(r.Principals, policy.GroupARN(grp))
+		}
+		r.Set(policy.KeyUsername, u.Name)
+	}
+
+	now := time.Now().UTC()
+	// RemoteIP, unlike ClientIP, cannot be set by the client with
+	// X-Forwarded-For
+	r.Set(policy.KeySourceIP, c.RemoteIP())
+	r.Set(policy.KeyCurrentTime, now.Format(time.RFC3339))
+	r.Set(policy.KeyEpochTime, strconv.FormatInt(now.Unix(), 10))
+	r.Set(policy.KeySecureTransport, strconv.FormatBool(c.Request.TLS != nil))
+	if ua := c.GetHeader("User-Agent"); ua != "" {
+		r.Set(policy.KeyUserAgent, ua)
+	}
+	if referer := c.GetHeader("Referer"); referer != "" {
+		r.Set(policy.KeyReferer, referer)
+	}
+	if action == actionListBucket || action == actionListBucketVersions {
+		for key, param := range map[string]string{
+			policy.KeyPrefix:    "prefix",
+			policy.KeyDelimiter: "delimiter",
+			policy.KeyMaxKeys:   "max-keys",
+		} {
+			if v, ok := c.GetQuery(param); ok {
+				r.Set(key, v)
+			}
+		}
+	}
+	if res.versioned {
+		r.Set(policy.KeyVersionID, res.versionID)
+	}
+	return r
+}
+
+func (g *Gateway) GetBucketPolicy(c *gin.Context) {
+	if !g.authorize(c, actionGetBucketPolicy) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if b.Policy == "" {
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchBucketPolicy, "The bucket policy does not exist")
+		return
+	}
+	c.Data(http.StatusOK, "application/json", []byte(b.Policy))
+}
+
+func (g *Gateway) PutBucketPolicy(c *gin.Context) {
+	if !g.authorize(c, actionPutBucketPolicy) {
+		return
+	}
+	bucket := c.Param("bucket")
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, policy.MaxSize+1))
+	if err != nil {
+		g.writeError(c, err)
+		return
+	}
+	p, err := policy.Parse(data, bucket)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedPolicy, err.Error())
+		return
+	}
+	if p.IsPublic() && g.blocksPublicPolicy(c, bucket) {
+		return
+	}
+	if err := g.metadata.SetBucketPolicy(c.Request.Context(), bucket, string(data)); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (g *Gateway) DeleteBucketPolicy(c *gin.Context) {
+	if !g.authorize(c, actionDeleteBucketPolicy) {
+		return
+	}
+	if err := g.metadata.SetBucketPolicy(c.Request.Context(), c.Param("bucket"), ""); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
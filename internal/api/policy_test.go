@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// userStore knows users, each in no group
+type userStore struct {
+	metadata.Service
+}
+
+func (userStore) GetUser(ctx context.Context, name string) (*metadata.User, error) {
+	return &metadata.User{Name: name}, nil
+}
+
+// TestAllowed decides requests on a bucket owned by alice, by alice, by bob
+// and by anonymous requesters, under the bucket's ACL, policy and public
+// access block
+func TestAllowed(t *testing.T) {
+	const (
+		publicRead = `{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"}}`
+		bobWrites  = `{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam:::user/bob"}, "Action": "s3:PutObject", "Resource": "arn:aws:s3:::bkt/*"}}`
+		denyAll    = `{"Version": "2012-10-17", "Statement": {"Effect": "Deny", "Principal": "*", "Action": "s3:*", "Resource": ["arn:aws:s3:::bkt", "arn:aws:s3:::bkt/*"]}}`
+	)
+	restrict := &metadata.PublicAccessBlock{RestrictPublicBuckets: true}
+	ignoreACLs := &metadata.PublicAccessBlock{IgnorePublicAcls: true}
+
+	tests := []struct {
+		name        string
+		user        string // empty for anonymous
+		action      string
+		acl         metadata.CannedACL
+		policy      string
+		block       *metadata.PublicAccessBlock
+		blockGlobal bool
+		want        bool
+	}{
+		{"owner", "alice", actionPutObject, metadata.ACLPrivate, "", nil, false, true},
+		{"non-owner", "bob", actionGetObject, metadata.ACLPrivate, "", nil, false, false},
+		{"anonymous", "", actionGetObject, metadata.ACLPrivate, "", nil, false, false},
+
+		{"public-read ACL, anonymous read", "", actionGetObject, metadata.ACLPublicRead, "", nil, false, true},
+		{"public-read ACL, non-owner read", "bob", actionGetObject, metadata.ACLPublicRead, "", nil, false, true},
+		{"public-read ACL, anonymous write", "", actionPutObject, metadata.ACLPublicRead, "", nil, false, false},
+		{"IgnorePublicAcls", "", actionGetObject, metadata.ACLPublicRead, "", ignoreACLs, false, false},
+		{"IgnorePublicAcls, owner", "alice", actionGetObject, metadata.ACLPublicRead, "", ignoreACLs, false, true},
+		{"public access blocked globally", "", actionGetObject, metadata.ACLPublicRead, "", nil, true, false},
+
+		{"public policy, anonymous", "", actionGetObject, metadata.ACLPrivate, publicRead, nil, false, true},
+		{"public policy, other action", "", actionDeleteObject, metadata.ACLPrivate, publicRead, nil, false, false},
+		{"RestrictPublicBuckets, anonymous", "", actionGetObject, metadata.ACLPrivate, publicRead, restrict, false, false},
+		{"RestrictPublicBuckets, non-owner", "bob", actionGetObject, metadata.ACLPrivate, publicRead, restrict, false, true},
+		{"RestrictPublicBuckets leaves the ACL", "", actionGetObject, metadata.ACLPublicRead, publicRead, restrict, false, true},
+
+		{"policy grants a user", "bob", actionPutObject, metadata.ACLPrivate, bobWrites, nil, false, true},
+		{"policy grants another user", "carol", actionPutObject, metadata.ACLPrivate, bobWrites, nil, false, false},
+		{"deny binds the owner", "alice", actionGetObject, metadata.ACLPrivate, denyAll, nil, false, false},
+		{"deny beats the ACL", "", actionGetObject, metadata.ACLPublicRead, denyAll, nil, false, false},
+		{"owner manages the policy despite a deny", "alice", actionDeleteBucketPolicy, metadata.ACLPrivate, denyAll, nil, false, true},
+		{"non-owner cannot manage the policy", "bob", actionGetBucketPolicy, metadata.ACLPrivate, "", nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGateway(Config{Metadata: userStore{}, AuthEnabled: true, BlockPublicAccess: tt.blockGlobal})
+			b := &metadata.Bucket{Name: "bkt", Owner: "alice", ACL: tt.acl, Policy: tt.policy, PublicAccessBlock: tt.block}
+
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/bkt/key", nil)
+			if tt.user == "" {
+				c.Set(contextAnonymous, true)
+			} else {
+				c.Set(contextUser, tt.user)
+			}
+			res := resource{bucket: "bkt", key: "key"}
+			if tt.action == actionGetBucketPolicy || tt.action == actionDeleteBucketPolicy {
+				res.key = ""
+			}
+
+			got, err := g.allowed(c, b, tt.action, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("allowed = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
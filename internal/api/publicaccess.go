@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// headerACL carries a canned ACL on CreateBucket and PutBucketAcl
+const headerACL = "x-amz-acl"
+
+// publicReadActions are what a public-read bucket ACL grants everyone.
+// Plinth has no object ACLs, so the bucket's ACL covers its objects.
+var publicReadActions = map[string]bool{
+	actionListBucket:                 true,
+	actionListBucketVersions:         true,
+	actionListBucketMultipartUploads: true,
+	actionGetObject:                  true,
+	actionGetObjectVersion:           true,
+}
+
+// URIs of the ACL grantees Plinth reports
+const (
+	granteeAllUsers = "http://acs.amazonaws.com/groups/global/AllUsers"
+	xmlnsXSI        = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// accessControlPolicy is the GetBucketAcl response
+type accessControlPolicy struct {
+	XMLName xml.Name `xml:"AccessControlPolicy"`
+	Owner   aclOwner `xml:"Owner"`
+	Grants  []grant  `xml:"AccessControlList>Grant"`
+}
+
+type aclOwner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type grant struct {
+	Grantee    grantee `xml:"Grantee"`
+	Permission string  `xml:"Permission"`
+}
+
+type grantee struct {
+	XMLNS       string `xml:"xmlns:xsi,attr"`
+	Type        string `xml:"xsi:type,attr"`
+	ID          string `xml:"ID,omitempty"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+	URI         string `xml:"URI,omitempty"`
+}
+
+// publicAccessBlockConfiguration is the PutPublicAccessBlock request body
+// and the GetPublicAccessBlock response
+type publicAccessBlockConfiguration struct {
+	XMLName               xml.Name `xml:"PublicAccessBlockConfiguration"`
+	BlockPublicAcls       bool     `xml:"BlockPublicAcls"`
+	IgnorePublicAcls      bool     `xml:"IgnorePublicAcls"`
+	BlockPublicPolicy     bool     `xml:"BlockPublicPolicy"`
+	RestrictPublicBuckets bool     `xml:"RestrictPublicBuckets"`
+}
+
+// publicAccessBlock returns the settings in force for b: its own, or all
+// of them when the gateway blocks public access everywhere
+func (g *Gateway) publicAccessBlock(b *metadata.Bucket) metadata.PublicAccessBlock {
+	if g.blockPublicAccess {
+		return metadata.PublicAccessBlock{
+			BlockPublicAcls:       true,
+			IgnorePublicAcls:      true,
+			BlockPublicPolicy:     true,
+			RestrictPublicBuckets: true,
+		}
+	}
+	if b == nil || b.PublicAccessBlock == nil {
+		return metadata.PublicAccessBlock{}
+	}
+	return *b.PublicAccessBlock
+}
+
+// publicBlocked reports whether the public access block of bucket refuses
+// to make it public, as blocked decides, and writes AccessDenied if so
+func (g *Gateway) publicBlocked(c *gin.Context, bucket string, blocked func(metadata.PublicAccessBlock) bool) bool {
+	b, err := g.metadata.GetBucket(c.Request.Context(), bucket)
+	if err != nil && !errors.Is(err, metadata.ErrBucketNotFound) {
+		g.lookupError(c, err)
+		return true
+	}
+	if blocked(g.publicAccessBlock(b)) {
+		g.errorResponse(c, http.StatusForbidden, ErrAccessDenied, "Access Denied: public access to this bucket is blocked")
+		return true
+	}
+	return false
+}
+
+func (g *Gateway) blocksPublicPolicy(c *gin.Context, bucket string) bool {
+	return g.publicBlocked(c, bucket, func(block metadata.PublicAccessBlock) bool { return block.BlockPublicPolicy })
+}
+
+func (g *Gateway) blocksPublicACL(c *gin.Context, bucket string) bool {
+	return g.publicBlocked(c, bucket, func(block metadata.PublicAccessBlock) bool { return block.BlockPublicAcls })
+}
+
+// cannedACL reads the x-amz-acl header, writing the error response if it
+// names an ACL Plinth does not support. A missing header means private.
+func (g *Gateway) cannedACL(c *gin.Context) (metadata.CannedACL, bool) {
+	switch acl := metadata.CannedACL(c.GetHeader(headerACL)); acl {
+	case "", metadata.ACLPrivate:
+		return metadata.ACLPrivate, true
+	case metadata.ACLPublicRead:
+		return acl, true
+	case "public-read-write", "authenticated-read", "aws-exec-read", "bucket-owner-read", "bucket-owner-full-control", "log-delivery-write":
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "Only the private and public-read canned ACLs are supported")
+		return "", false
+	default:
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, "Invalid canned ACL "+string(acl))
+		return "", false
+	}
+}
+
+func (g *Gateway) GetBucketACL(c *gin.Context) {
+	if !g.authorize(c, actionGetBucketAcl) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	owner := aclOwner{ID: "plinth", DisplayName: "plinth"}
+	if b.Owner != "" {
+		owner = aclOwner{ID: b.Owner, DisplayName: b.Owner}
+	}
+	acp := accessControlPolicy{
+		Owner: owner,
+		Grants: []grant{{
+			Grantee:    grantee{XMLNS: xmlnsXSI, Type: "CanonicalUser", ID: owner.ID, DisplayName: owner.DisplayName},
+			Permission: "FULL_CONTROL",
+		}},
+	}
+	if b.ACL == metadata.ACLPublicRead {
+		acp.Grants = append(acp.Grants, grant{
+			Grantee:    grantee{XMLNS: xmlnsXSI, Type: "Group", URI: granteeAllUsers},
+			Permission: "READ",
+		})
+	}
+	c.XML(http.StatusOK, acp)
+}
+
+// PutBucketACL sets a canned ACL from the x-amz-acl header. Grants in the
+// request body or x-amz-grant-* headers are not supported.
+func (g *Gateway) PutBucketACL(c *gin.Context) {
+	if !g.authorize(c, actionPutBucketAcl) {
+		return
+	}
+	bucket := c.Param("bucket")
+
+	if c.GetHeader(headerACL) == "" {
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "Only canned ACLs set with the x-amz-acl header are supported")
+		return
+	}
+	acl, ok := g.cannedACL(c)
+	if !ok {
+		return
+	}
+	if acl == metadata.ACLPublicRead && g.blocksPublicACL(c, bucket) {
+		return
+	}
+	if err := g.metadata.SetBucketACL(c.Request.Context(), bucket, acl); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) GetPublicAccessBlock(c *gin.Context) {
+	if !g.authorize(c, actionGetBucketPublicAccessBlock) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	if b.PublicAccessBlock == nil {
+		g.errorResponse(c, http.StatusNotFound, ErrNoSuchPublicAccessBlockConfiguration,
+			"The public access block configuration was not found")
+		return
+	}
+	block := b.PublicAccessBlock
+	c.XML(http.StatusOK, publicAccessBlockConfiguration{
+		BlockPublicAcls:       block.BlockPublicAcls,
+		IgnorePublicAcls:      block.IgnorePublicAcls,
+		BlockPublicPolicy:     block.BlockPublicPolicy,
+		RestrictPublicBuckets: block.RestrictPublicBuckets,
+	})
+}
+
+func (g *Gateway) PutPublicAccessBlock(c *gin.Context) {
+	if !g.authorize(c, actionPutBucketPublicAccessBlock) {
+		return
+	}
+	var config publicAccessBlockConfiguration
+	data, ok := g.readConfig(c)
+	if !ok {
+		return
+	}
+	if err := xml.Unmarshal(data, &config); err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The XML you provided was not well-formed or did not validate against our published schema")
+		return
+	}
+	block := &metadata.PublicAccessBlock{
+		BlockPublicAcls:       config.BlockPublicAcls,
+		IgnorePublicAcls:      config.IgnorePublicAcls,
+		BlockPublicPolicy:     config.BlockPublicPolicy,
+		RestrictPublicBuckets: config.RestrictPublicBuckets,
+	}
+	if err := g.metadata.SetBucketPublicAccessBlock(c.Request.Context(), c.Param("bucket"), block); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) DeletePublicAccessBlock(c *gin.Context) {
+	if !g.authorize(c, actionPutBucketPublicAccessBlock) {
+		return
+	}
+	if err := g.metadata.SetBucketPublicAccessBlock(c.Request.Context(), c.Param("bucket"), nil); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// maxQuotaEvents caps GET /admin/quota-events
+const maxQuotaEvents = 1000
+
+// quotaUsage is the quota and usage of a bucket or user as a write found
+// them
+type quotaUsage struct {
+	scope metadata.QuotaScope
+	name  string
+	quota metadata.Quota
+	usage metadata.Usage
+}
+
+// checkQuota checks that storing size more bytes in one more object keeps
+// bucket b and its owner within their hard quotas, and writes
+// QuotaExceeded if not. Overwrites count in full too: the usage counters
+// only drop once the repair worker purges the version replaced. The usages
+// it returns are for quotaWritten once the object is committed.
+func (g *Gateway) checkQuota(c *gin.Context, b *metadata.Bucket, size int64) ([]quotaUsage, bool) {
+	ctx := c.Request.Context()
+	var usages []quotaUsage
+	if b.Quota != nil {
+		usage, err := g.metadata.BucketUsage(ctx, b.Name)
+		if err != nil {
+			g.lookupError(c, err)
+			return nil, false
+		}
+		usages = append(usages, quotaUsage{metadata.QuotaScopeBucket, b.Name, *b.Quota, usage})
+	}
+	if b.Owner != "" {
+		u, err := g.metadata.GetUser(ctx, b.Owner)
+		if err != nil && !errors.Is(err, metadata.ErrUserNotFound) {
+			g.lookupError(c, err)
+			return nil, false
+		}
+		if u != nil && u.Quota != nil {
+			usage, err := g.metadata.UserUsage(ctx, u.Name)
+			if err != nil {
+				g.lookupError(c, err)
+				return nil, false
+			}
+			usages = append(usages, quotaUsage{metadata.QuotaScopeUser, u.Name, *u.Quota, usage})
+		}
+	}
+
+	for _, q := range usages {
+		var msg string
+		switch {
+		case q.quota.MaxBytes > 0 && q.usage.Bytes+size > q.quota.MaxBytes:
+			msg = fmt.Sprintf("%d of %d bytes used", q.usage.Bytes, q.quota.MaxBytes)
+		case q.quota.MaxObjects > 0 && q.usage.Objects+1 > q.quota.MaxObjects:
+			msg = fmt.Sprintf("%d of %d objects stored", q.usage.Objects, q.quota.MaxObjects)
+		default:
+			continue
+		}
+		quotaRejections.WithLabelValues(string(q.scope)).Inc()
+		g.errorResponse(c, http.StatusForbidden, ErrQuotaExceeded,
+			fmt.Sprintf("The %s quota of %s is exceeded: %s", q.scope, q.name, msg))
+		return nil, false
+	}
+	return usages, true
+}
+
+// quotaWritten raises a quota event for every soft quota the committed
+// write of size bytes took usage over. Usage already over a soft quota
+// raises no new event.
+func (g *Gateway) quotaWritten(ctx context.Context, usages []quotaUsage, size int64) {
+	// The client may be gone by now; the object was stored all the same
+	ctx = context.WithoutCancel(ctx)
+	for _, q := range usages {
+		for _, crossed := range []struct {
+			resource      string
+			before, limit int64
+			after         int64
+		}{
+			{metadata.QuotaBytes, q.usage.Bytes, q.quota.SoftMaxBytes, q.usage.Bytes + size},
+			{metadata.QuotaObjects, q.usage.Objects, q.quota.SoftMaxObjects, q.usage.Objects + 1},
+		} {
+			if crossed.limit == 0 || crossed.before > crossed.limit || crossed.after <= crossed.limit {
+				continue
+			}
+			event := &metadata.QuotaEvent{
+				Scope:    q.scope,
+				Name:     q.name,
+				Resource: crossed.resource,
+				Usage:    crossed.after,
+				Limit:    crossed.limit,
+			}
+			quotaSoftExceeded.WithLabelValues(string(q.scope), crossed.resource).Inc()
+			log.Printf("%s %s is over its soft quota: %d of %d %s", q.scope, q.name, event.Usage, event.Limit, event.Resource)
+			if err := g.metadata.RecordQuotaEvent(ctx, event); err != nil {
+				log.Printf("%s %s: %v", q.scope, q.name, err)
+			}
+		}
+	}
+}
+
+// bindQuota reads a quota from the request body, writing the error
+// response if it is not a valid one
+func bindQuota(c *gin.Context) (*metadata.Quota, bool) {
+	var quota metadata.Quota
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&quota); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quota: " + err.Error()})
+		return nil, false
+	}
+	var msg string
+	switch {
+	case quota.MaxBytes < 0 || quota.MaxObjects < 0 || quota.SoftMaxBytes < 0 || quota.SoftMaxObjects < 0:
+		msg = "quota limits must not be negative"
+	case quota.MaxBytes > 0 && quota.SoftMaxBytes > quota.MaxBytes:
+		msg = "soft_max_bytes must not be above max_bytes"
+	case quota.MaxObjects > 0 && quota.SoftMaxObjects > quota.MaxObjects:
+		msg = "soft_max_objects must not be above max_objects"
+	case quota == metadata.Quota{}:
+		msg = "quota sets no limit; DELETE it instead"
+	default:
+		return &quota, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+	return nil, false
+}
+
+func quotaJSON(scope metadata.QuotaScope, name string, quota *metadata.Quota, usage metadata.Usage) gin.H {
+	return gin.H{
+		string(scope): name,
+		"quota":       quota,
+		"usage": gin.H{
+			"bytes":   usage.Bytes,
+			"objects": usage.Objects,
+		},
+	}
+}
+
+// quotaError maps metadata errors of the quota endpoints to JSON responses
+func quotaError(c *gin.Context, err error) {
+	if errors.Is(err, metadata.ErrBucketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	iamError(c, err)
+}
+
+// GetBucketQuota handles GET /admin/buckets/:bucket/quota
+func (g *Gateway) GetBucketQuota(c *gin.Context) {
+	ctx := c.Request.Context()
+	b, err := g.metadata.GetBucket(ctx, c.Param("bucket"))
+	if err != nil {
+		quotaError(c, err)
+		return
+	}
+	usage, err := g.metadata.BucketUsage(ctx, b.Name)
+	if err != nil {
+		quotaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, quotaJSON(metadata.QuotaScopeBucket, b.Name, b.Quota, usage))
+}
+
+// PutBucketQuota handles PUT /admin/buckets/:bucket/quota with a JSON body
+// {"max_bytes": n, "max_objects": n, "soft_max_bytes": n,
+// "soft_max_objects": n}, any of which may be left out for no limit
+func (g *Gateway) PutBucketQuota(c *gin.Context) {
+	quota, ok := bindQuota(c)
+	if !ok {
+		return
+	}
+	bucket := c.Param("bucket")
+	if err := g.metadata.SetBucketQuota(c.Request.Context(), bucket, quota); err != nil {
+		quotaError(c, err)
+		return
+	}
+	g.GetBucketQuota(c)
+}
+
+// DeleteBucketQuota handles DELETE /admin/buckets/:bucket/quota
+func (g *Gateway) DeleteBucketQuota(c *gin.Context) {
+	if err := g.metadata.SetBucketQuota(c.Request.Context(), c.Param("bucket"), nil); err != nil {
+		quotaError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetUserQuota handles GET /admin/users/:user/quota
+func (g *Gateway) GetUserQuota(c *gin.Context) {
+	ctx := c.Request.Context()
+	u, err := g.metadata.GetUser(ctx, c.Param("user"))
+	if err != nil {
+		quotaError(c, err)
+		return
+	}
+	usage, err := g.metadata.UserUsage(ctx, u.Name)
+	if err != nil {
+		quotaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, quotaJSON(metadata.QuotaScopeUser, u.Name, u.Quota, usage))
+}
+
+// PutUserQuota handles PUT /admin/users/:user/quota with a body as for
+// PutBucketQuota. The quota covers all the buckets the user owns.
+func (g *Gateway) PutUserQuota(c *gin.Context) {
+	quota, ok := bindQuota(c)
+	if !ok {
+		return
+	}
+	if err := g.metadata.SetUserQuota(c.Request.Context(), c.Param("user"), quota); err != nil {
+		quotaError(c, err)
+		return
+	}
+	g.GetUserQuota(c)
+}
+
+// DeleteUserQuota handles DELETE /admin/users/:user/quota
+func (g *Gateway) DeleteUserQuota(c *gin.Context) {
+	if err := g.metadata.SetUserQuota(c.Request.Context(), c.Param("user"), nil); err != nil {
+		quotaError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListQuotaEvents handles GET /admin/quota-events?limit=n, the soft quota
+// breaches, newest first
+func (g *Gateway) ListQuotaEvents(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxQuotaEvents {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxQuotaEvents)})
+			return
+		}
+		limit = n
+	}
+	events, err := g.metadata.ListQuotaEvents(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := make([]gin.H, 0, len(events))
+	for _, e := range events {
+		list = append(list, gin.H{
+			"id":         e.ID,
+			"scope":      e.Scope,
+			"name":       e.Name,
+			"resource":   e.Resource,
+			"usage":      e.Usage,
+			"limit":      e.Limit,
+			"created_at": e.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"events": list})
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// usageStore holds a bucket's usage and records quota events
+type usageStore struct {
+	metadata.Service
+	usage  metadata.Usage
+	events []*metadata.QuotaEvent
+}
+
+func (s *usageStore) BucketUsage(ctx context.Context, bucketName string) (metadata.Usage, error) {
+	return s.usage, nil
+}
+
+func (s *usageStore) RecordQuotaEvent(ctx context.Context, event *metadata.QuotaEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestCheckQuota(t *testing.T) {
+	quota := &metadata.Quota{MaxBytes: 1000, MaxObjects: 10, SoftMaxBytes: 900}
+
+	tests := []struct {
+		name   string
+		usage  metadata.Usage
+		size   int64
+		ok     bool
+		events int
+	}{
+		{"within quota", metadata.Usage{Bytes: 500, Objects: 5}, 100, true, 0},
+		{"up to the byte quota", metadata.Usage{Bytes: 900, Objects: 5}, 100, true, 1},
+		{"over the soft byte quota", metadata.Usage{Bytes: 850, Objects: 5}, 100, true, 1},
+		{"already over the soft byte quota", metadata.Usage{Bytes: 901, Objects: 5}, 50, true, 0},
+		{"over the object quota", metadata.Usage{Bytes: 500, Objects: 10}, 100, false, 0},
+		{"over the byte quota", metadata.Usage{Bytes: 950, Objects: 5}, 100, false, 0},
+		// The replaced version counts until it is purged, so overwriting a
+		// key of the same size or smaller still adds to usage
+		{"overwrite at the byte quota", metadata.Usage{Bytes: 1000, Objects: 5}, 300, false, 0},
+		{"smaller overwrite at the byte quota", metadata.Usage{Bytes: 1000, Objects: 5}, 1, false, 0},
+		{"empty overwrite at the object quota", metadata.Usage{Bytes: 500, Objects: 10}, 0, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &usageStore{usage: tt.usage}
+			g := NewGateway(Config{Metadata: store})
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPut, "/bkt/key", nil)
+
+			b := &metadata.Bucket{Name: "bkt", Quota: quota}
+			usages, ok := g.checkQuota(c, b, tt.size)
+			if ok != tt.ok {
+				t.Fatalf("checkQuota = %t, want %t: %s", ok, tt.ok, w.Body)
+			}
+			if !ok {
+				if w.Code != http.StatusForbidden || s3ErrorCode(t, w.Body.String()) != ErrQuotaExceeded {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				return
+			}
+			g.quotaWritten(context.Background(), usages, tt.size)
+			if len(store.events) != tt.events {
+				t.Fatalf("%d quota events, want %d", len(store.events), tt.events)
+			}
+			if tt.events > 0 && store.events[0].Usage != tt.usage.Bytes+tt.size {
+				t.Errorf("event usage %d, want %d", store.events[0].Usage, tt.usage.Bytes+tt.size)
+			}
+		})
+	}
+}
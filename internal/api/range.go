@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// errInvalidRange marks a Range header that cannot be satisfied
+var errInvalidRange = errors.New("the requested range is not satisfiable")
+
+// parseRange parses a single-range Range header against an object of size
+// bytes and returns the half-open interval [start, end) to serve. ok is false
+// when the header is absent, malformed or asks for several ranges, in which
+// case the whole object is served as S3 does.
+func parseRange(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	// Suffix range: the last n bytes
+	if first == "" {
+		n, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true, nil
+	}
+
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size
+	if last != "" {
+		stop, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || stop < start {
+			return 0, 0, false, nil
+		}
+		if stop+1 < end {
+			end = stop + 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+	return start, end, true, nil
+}
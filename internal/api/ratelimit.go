@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/ratelimit"
+)
+
+// RateLimitMode is how gateways enforce the rate limits together
+type RateLimitMode string
+
+const (
+	// RateLimitLocal has every gateway enforce the full limits on its own
+	// traffic, for a single gateway
+	RateLimitLocal RateLimitMode = "local"
+
+	// RateLimitSplit has every gateway enforce an equal share of the
+	// limits. Gateways count each other through leases in the metadata
+	// store.
+	RateLimitSplit RateLimitMode = "split"
+
+	// RateLimitShared has gateways exchange what they charged to each key
+	// through the metadata store, each debiting what the others used
+	RateLimitShared RateLimitMode = "shared"
+)
+
+// gatewayLeasePrefix names the leases gateways splitting the rate limits
+// renew to count each other
+const gatewayLeasePrefix = "gateway/"
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// RateLimitMiddleware throttles S3 requests by source IP and bucket. It
+// runs before authentication, so that unsigned or badly signed requests
+// are throttled too and cannot make the gateway verify signatures without
+// limit.
+func (g *Gateway) RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// RemoteIP, unlike ClientIP, cannot be set by the client with
+		// X-Forwarded-For
+		keys := []string{ratelimit.Key(ratelimit.KindSourceIP, c.RemoteIP())}
+		if bucket := c.Param("bucket"); bucket != "" {
+			keys = append(keys, ratelimit.Key(ratelimit.KindBucket, bucket))
+		}
+		g.rateLimit(c, keys)
+	}
+}
+
+// AccessKeyRateLimitMiddleware throttles S3 requests by the access key
+// they were signed with. It runs after authentication; anonymous requests
+// pass.
+func (g *Gateway) AccessKeyRateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetString(contextAccessKey)
+		if key == "" {
+			c.Next()
+			return
+		}
+		g.rateLimit(c, []string{ratelimit.Key(ratelimit.KindAccessKey, key)})
+	}
+}
+
+// rateLimit refuses a request with SlowDown while any of keys is out of
+// request tokens or in byte debt; once served, its request body and
+// response bytes are charged to all of them
+func (g *Gateway) rateLimit(c *gin.Context, keys []string) {
+	if limited, retryAfter := g.limiter.Reserve(keys...); limited != "" {
+		kind, _, _ := strings.Cut(limited, ":")
+		s3Throttled.WithLabelValues(kind).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+		g.errorResponse(c, http.StatusServiceUnavailable, ErrSlowDown, "Please reduce your request rate.")
+		c.Abort()
+		return
+	}
+
+	body := &countingReader{ReadCloser: c.Request.Body}
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = body
+	}
+	c.Next()
+
+	n := body.n
+	if size := c.Writer.Size(); size > 0 {
+		n += int64(size)
+	}
+	g.limiter.Charge(n, keys...)
+}
+
+// RunRateLimiter keeps the rate limiter in step with the metadata store
+// until ctx is done: every interval it picks up limits set through another
+// gateway, forgets idle keys and, as the mode requires, counts the
+// gateways splitting the limits or exchanges usage with them
+func (g *Gateway) RunRateLimiter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if g.rateLimitMode == RateLimitSplit {
+		defer g.releaseGatewayLease()
+	}
+	for {
+		g.syncRateLimiter(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Gateway) syncRateLimiter(ctx context.Context, interval time.Duration) {
+	if err := g.loadRateLimits(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("rate limits: %v", err)
+	}
+	g.limiter.Prune()
+
+	switch g.rateLimitMode {
+	case RateLimitSplit:
+		n, err := g.countGateways(ctx, 3*interval)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("rate limits: %v", err)
+			}
+			return
+		}
+		g.limiter.SetShare(n)
+	case RateLimitShared:
+		local := g.limiter.Usage()
+		usage := make(map[string]metadata.RateLimitUsage, len(local))
+		for key, u := range local {
+			usage[key] = metadata.RateLimitUsage{Requests: u.Requests, Bytes: u.Bytes}
+		}
+		remote, err := g.metadata.SyncRateLimitUsage(ctx, g.gatewayID, usage)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("rate limits: %v", err)
+			}
+			return
+		}
+		debit := make(map[string]ratelimit.Usage, len(remote))
+		for key, u := range remote {
+			debit[key] = ratelimit.Usage{Requests: u.Requests, Bytes: u.Bytes}
+		}
+		g.limiter.Debit(debit)
+	}
+}
+
+// loadRateLimits applies the limits stored in the metadata store, if any
+func (g *Gateway) loadRateLimits(ctx context.Context) error {
+	stored, err := g.metadata.GetRateLimitConfig(ctx)
+	if err != nil || stored == "" {
+		return err
+	}
+	var config ratelimit.Config
+	if err := json.Unmarshal([]byte(stored), &config); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	g.limiter.SetConfig(config)
+	return nil
+}
+
+// countGateways renews this gateway's lease and counts the gateways
+// holding one
+func (g *Gateway) countGateways(ctx context.Context, ttl time.Duration) (int, error) {
+	if _, err := g.metadata.AcquireLease(ctx, gatewayLeasePrefix+g.gatewayID, g.gatewayID, ttl); err != nil {
+		return 0, err
+	}
+	leases, err := g.metadata.ListLeases(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range leases {
+		if strings.HasPrefix(l.Name, gatewayLeasePrefix) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// releaseGatewayLease gives up this gateway's lease, so the others take
+// over its share at once
+func (g *Gateway) releaseGatewayLease() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.metadata.ReleaseLease(ctx, gatewayLeasePrefix+g.gatewayID, g.gatewayID); err != nil {
+		log.Printf("release lease %s: %v", gatewayLeasePrefix+g.gatewayID, err)
+	}
+}
+
+// GetRateLimits handles GET /admin/rate-limits
+func (g *Gateway) GetRateLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, g.limiter.Config())
+}
+
+// PutRateLimits handles PUT /admin/rate-limits with the limits as JSON, as
+// GetRateLimits returns them. They take effect at once on this gateway and
+// within the sync interval on the others.
+func (g *Gateway) PutRateLimits(c *gin.Context) {
+	var config ratelimit.Config
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rate limits: " + err.Error()})
+		return
+	}
+	if err := config.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := g.metadata.SetRateLimitConfig(c.Request.Context(), string(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	g.limiter.SetConfig(config)
+	c.JSON(http.StatusOK, config)
+}
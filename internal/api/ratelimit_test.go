@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/auth"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/ratelimit"
+)
+
+func s3ErrorCode(t *testing.T, body string) string {
+	t.Helper()
+	var e struct{ Error S3Error }
+	if err := xml.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("parse error %q: %v", body, err)
+	}
+	return e.Error.Code
+}
+
+// sendUnknownKey sends a request signed with an access key the gateway
+// does not know
+func sendUnknownKey(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/bkt?versioning", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.SignRequest(req, "AKIDUNKNOWN", testSecret, "us-east-1", auth.EmptySHA256, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3ErrorCode(t, readBody(t, resp))
+}
+
+// TestRateLimitOrder checks that source IPs are throttled before requests
+// are authenticated, and access keys after
+func TestRateLimitOrder(t *testing.T) {
+	once := ratelimit.Limits{Requests: ratelimit.Limit{Rate: 0.001, Burst: 1}}
+	versioning := []byte(`<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+
+	t.Run("source IP", func(t *testing.T) {
+		srv, _ := signedGateway(t, Config{RateLimits: ratelimit.Config{SourceIP: once}})
+		for i, want := range []string{ErrInvalidAccessKeyID, ErrSlowDown} {
+			if code := sendUnknownKey(t, srv); code != want {
+				t.Fatalf("request %d with an unknown key: %s, want %s", i+1, code, want)
+			}
+		}
+	})
+
+	t.Run("access key", func(t *testing.T) {
+		srv, _ := signedGateway(t, Config{RateLimits: ratelimit.Config{AccessKey: once}})
+		resp, body := sendSigned(t, srv, http.MethodPut, "/bkt?versioning", versioning, versioning)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("first signed request: status %d: %s", resp.StatusCode, body)
+		}
+		resp, body = sendSigned(t, srv, http.MethodPut, "/bkt?versioning", versioning, versioning)
+		if code := s3ErrorCode(t, body); resp.StatusCode != http.StatusServiceUnavailable || code != ErrSlowDown {
+			t.Fatalf("second signed request: status %d, %s", resp.StatusCode, code)
+		}
+		// Requests that fail authentication are not charged to a key
+		if code := sendUnknownKey(t, srv); code != ErrInvalidAccessKeyID {
+			t.Fatalf("request with an unknown key: %s, want %s", code, ErrInvalidAccessKeyID)
+		}
+	})
+}
+
+// rateLimitStore keeps the rate limits, leases and usage reports gateways
+// exchange, on a clock the test moves. Leases and reports expire as in
+// the leases and rate_limit_usage tables.
+type rateLimitStore struct {
+	metadata.Service
+
+	mu      sync.Mutex
+	now     time.Time
+	config  string
+	leases  map[string]*metadata.Lease
+	usage   map[string]map[string]metadata.RateLimitUsage
+	updated map[string]time.Time
+}
+
+func newRateLimitStore() *rateLimitStore {
+	return &rateLimitStore{
+		now:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		leases:  make(map[string]*metadata.Lease),
+		usage:   make(map[string]map[string]metadata.RateLimitUsage),
+		updated: make(map[string]time.Time),
+	}
+}
+
+func (s *rateLimitStore) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *rateLimitStore) GetRateLimitConfig(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config, nil
+}
+
+func (s *rateLimitStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[name]
+	if ok && l.Holder != holder && !l.ExpiresAt.Before(s.now) {
+		return false, nil
+	}
+	if !ok || l.Holder != holder {
+		l = &metadata.Lease{Name: name, Holder: holder, AcquiredAt: s.now}
+		s.leases[name] = l
+	}
+	l.ExpiresAt = s.now.Add(ttl)
+	return true, nil
+}
+
+func (s *rateLimitStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[name]; ok && l.Holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *rateLimitStore) ListLeases(ctx context.Context) ([]*metadata.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leases []*metadata.Lease
+	for _, l := range s.leases {
+		if l.ExpiresAt.After(s.now) {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+func (s *rateLimitStore) SyncRateLimitUsage(ctx context.Context, gatewayID string, usage map[string]metadata.RateLimitUsage) (map[string]metadata.RateLimitUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage[gatewayID], s.updated[gatewayID] = usage, s.now
+	remote := make(map[string]metadata.RateLimitUsage)
+	for gateway, reported := range s.usage {
+		if gateway == gatewayID || s.now.Sub(s.updated[gateway]) > metadata.RateLimitUsageTTL {
+			continue
+		}
+		for key, u := range reported {
+			if _, ok := usage[key]; ok {
+				total := remote[key]
+				total.Requests += u.Requests
+				total.Bytes += u.Bytes
+				remote[key] = total
+			}
+		}
+	}
+	return remote, nil
+}
+
+// served returns how many of n requests of key g serves
+func served(g *Gateway, key string, n int) int {
+	served := 0
+	for i := 0; i < n; i++ {
+		if limited, _ := g.limiter.Reserve(key); limited == "" {
+			served++
+		}
+	}
+	return served
+}
+
+// TestRateLimitModes syncs gateways with the metadata store in each mode
+// and counts the requests each then serves. The limits hardly refill
+// while the test runs.
+func TestRateLimitModes(t *testing.T) {
+	const interval = time.Second
+	ctx := context.Background()
+	limits := ratelimit.Config{SourceIP: ratelimit.Limits{Requests: ratelimit.Limit{Rate: 0.001, Burst: 4}}}
+	gateways := func(store *rateLimitStore, mode RateLimitMode) (*Gateway, *Gateway) {
+		return NewGateway(Config{Metadata: store, RateLimits: limits, RateLimitMode: mode, GatewayID: "g1"}),
+			NewGateway(Config{Metadata: store, RateLimits: limits, RateLimitMode: mode, GatewayID: "g2"})
+	}
+	ip := func(n int) string {
+		return ratelimit.Key(ratelimit.KindSourceIP, "10.0.0."+strconv.Itoa(n))
+	}
+
+	t.Run("local", func(t *testing.T) {
+		store := newRateLimitStore()
+		g1, g2 := gateways(store, RateLimitLocal)
+		g1.syncRateLimiter(ctx, interval)
+		g2.syncRateLimiter(ctx, interval)
+		if len(store.leases) != 0 || len(store.usage) != 0 {
+			t.Fatal("local gateways exchanged leases or usage")
+		}
+		if n := served(g1, ip(1), 10) + served(g2, ip(1), 10); n != 8 {
+			t.Errorf("two local gateways served %d requests, want the full limit each", n)
+		}
+
+		// Limits set through another gateway are picked up
+		store.config = `{"source_ip": {"requests": {"rate": 0.001, "burst": 1}}}`
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(2), 10); n != 1 {
+			t.Errorf("served %d requests under the stored limits, want 1", n)
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		store := newRateLimitStore()
+		g1, g2 := gateways(store, RateLimitSplit)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(1), 10); n != 4 {
+			t.Fatalf("a lone gateway served %d requests, want 4", n)
+		}
+		g2.syncRateLimiter(ctx, interval)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(2), 10) + served(g2, ip(2), 10); n != 4 {
+			t.Errorf("two gateways served %d requests, want 2 each", n)
+		}
+
+		// A gateway that stops renewing its lease stops counting once the
+		// lease expires, three intervals on
+		store.advance(3*interval - time.Millisecond)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(3), 10); n != 2 {
+			t.Errorf("served %d requests with the other lease just renewed, want 2", n)
+		}
+		store.advance(time.Millisecond)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(4), 10); n != 4 {
+			t.Errorf("served %d requests with the other lease expired, want 4", n)
+		}
+
+		// A gateway that stops gives up its lease at once
+		g2.syncRateLimiter(ctx, interval)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(5), 10); n != 2 {
+			t.Fatalf("served %d requests with the other gateway back, want 2", n)
+		}
+		g2.releaseGatewayLease()
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(6), 10); n != 4 {
+			t.Errorf("served %d requests with the other lease released, want 4", n)
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		store := newRateLimitStore()
+		g1, g2 := gateways(store, RateLimitShared)
+		if n := served(g1, ip(1), 1) + served(g2, ip(1), 1); n != 2 {
+			t.Fatalf("served %d requests", n)
+		}
+		// The first exchange only records what the others used before
+		g1.syncRateLimiter(ctx, interval)
+		g2.syncRateLimiter(ctx, interval)
+		g1.syncRateLimiter(ctx, interval)
+
+		if n := served(g2, ip(1), 2); n != 2 {
+			t.Fatalf("served %d requests", n)
+		}
+		g2.syncRateLimiter(ctx, interval)
+		g1.syncRateLimiter(ctx, interval)
+		if n := served(g1, ip(1), 10); n != 1 {
+			t.Errorf("served %d requests after the other gateway used 2 more, want 1", n)
+		}
+		if len(store.leases) != 0 {
+			t.Error("sharing gateways took leases")
+		}
+	})
+}
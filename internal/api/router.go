@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // SetupRouter creates and configures the Gin router
@@ -23,11 +24,10 @@ func SetupRouter(gateway *Gateway, environment string) *gin.Engine {
 	router.Use(RequestIDMiddleware())
 	router.Use(CORSMiddleware())
 	router.Use(MetricsMiddleware())
-	// router.Use(AuthMiddleware()) // Enable when implemented
 
 	// Health check endpoint (non-S3)
 	router.GET("/health", healthCheckHandler)
-	router.GET("/metrics", metricsHandler) // Prometheus metrics
+	router.GET("/metrics", gin.WrapH(promhttp.Handler())) // Prometheus metrics
 
 	// Admin API (non-S3)
 	admin := router.Group("/admin")
@@ -36,16 +36,51 @@ func SetupRouter(gateway *Gateway, environment string) *gin.Engine {
 		admin.GET("/nodes", nodesStatusHandler)
 		admin.GET("/costs/by-bucket", costsByBucketHandler)
 		admin.GET("/costs/top-objects", topObjectsHandler)
-		admin.GET("/repair/status", repairStatusHandler)
+		admin.GET("/repair/status", gateway.RepairStatus)
 	}
 
-	// S3 API routes
-	setupS3Routes(router, gateway)
+	// Users, groups, access keys, quotas, rate limits, repair priorities and
+	// encryption keys, managed with a root access key
+	iam := router.Group("/admin", gateway.AdminAuthMiddleware())
+	{
+		iam.POST("/users", gateway.CreateUser)
+		iam.GET("/users", gateway.ListUsers)
+		iam.GET("/users/:user", gateway.GetUser)
+		iam.DELETE("/users/:user", gateway.DeleteUser)
+		iam.POST("/users/:user/keys", gateway.CreateAccessKey)
+		iam.GET("/users/:user/keys", gateway.ListAccessKeys)
+		iam.PATCH("/keys/:key", gateway.UpdateAccessKey)
+		iam.POST("/keys/:key/rotate", gateway.RotateAccessKey)
+		iam.DELETE("/keys/:key", gateway.DeleteAccessKey)
+		iam.POST("/groups", gateway.CreateGroup)
+		iam.GET("/groups", gateway.ListGroups)
+		iam.GET("/groups/:group", gateway.GetGroup)
+		iam.DELETE("/groups/:group", gateway.DeleteGroup)
+		iam.PUT("/groups/:group/members/:user", gateway.AddGroupMember)
+		iam.DELETE("/groups/:group/members/:user", gateway.RemoveGroupMember)
+		iam.GET("/users/:user/quota", gateway.GetUserQuota)
+		iam.PUT("/users/:user/quota", gateway.PutUserQuota)
+		iam.DELETE("/users/:user/quota", gateway.DeleteUserQuota)
+		iam.GET("/buckets/:bucket/quota", gateway.GetBucketQuota)
+		iam.PUT("/buckets/:bucket/quota", gateway.PutBucketQuota)
+		iam.DELETE("/buckets/:bucket/quota", gateway.DeleteBucketQuota)
+		iam.GET("/quota-events", gateway.ListQuotaEvents)
+		iam.GET("/rate-limits", gateway.GetRateLimits)
+		iam.PUT("/rate-limits", gateway.PutRateLimits)
+		iam.GET("/encryption", gateway.GetEncryption)
+		iam.POST("/encryption/rotate", gateway.RotateEncryption)
+		iam.PUT("/buckets/:bucket/repair-priority", gateway.SetBucketRepairPriority)
+	}
+
+	// S3 API routes, throttled by source IP and bucket, signed with AWS
+	// SigV4 when auth is enabled, then throttled by access key
+	setupS3Routes(router.Group("", gateway.RateLimitMiddleware(), gateway.AuthMiddleware(),
+		gateway.AccessKeyRateLimitMiddleware()), gateway)
 
 	return router
 }
 
-func setupS3Routes(router *gin.Engine, gateway *Gateway) {
+func setupS3Routes(router *gin.RouterGroup, gateway *Gateway) {
 	// Root-level operations
 	router.GET("/", gateway.ListBuckets)
 
@@ -54,8 +89,8 @@ func setupS3Routes(router *gin.Engine, gateway *Gateway) {
 	{
 		// Bucket operations
 		bucket.HEAD("", gateway.HeadBucket)
-		bucket.PUT("", gateway.CreateBucket)
-		bucket.DELETE("", gateway.DeleteBucket)
+		bucket.PUT("", handleBucketPut(gateway))
+		bucket.DELETE("", handleBucketDelete(gateway))
 		bucket.GET("", handleBucketGet(gateway))
 
 		// Object operations
@@ -71,25 +106,120 @@ func setupS3Routes(router *gin.Engine, gateway *Gateway) {
 
 func handleBucketGet(gateway *Gateway) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Check for multipart upload listing
-		if c.Query("uploads") != "" {
+		// Check for multipart upload listing (?uploads carries no value)
+		if _, ok := c.GetQuery("uploads"); ok {
 			gateway.ListMultipartUploads(c)
 			return
 		}
+		if _, ok := c.GetQuery("acl"); ok {
+			gateway.GetBucketACL(c)
+			return
+		}
+		if _, ok := c.GetQuery("publicAccessBlock"); ok {
+			gateway.GetPublicAccessBlock(c)
+			return
+		}
+		if _, ok := c.GetQuery("policy"); ok {
+			gateway.GetBucketPolicy(c)
+			return
+		}
+		if _, ok := c.GetQuery("lifecycle"); ok {
+			gateway.GetBucketLifecycle(c)
+			return
+		}
+		if _, ok := c.GetQuery("encryption"); ok {
+			gateway.GetBucketEncryption(c)
+			return
+		}
+		if _, ok := c.GetQuery("versioning"); ok {
+			gateway.GetBucketVersioning(c)
+			return
+		}
+		if _, ok := c.GetQuery("versions"); ok {
+			gateway.ListObjectVersions(c)
+			return
+		}
 
 		// Default: list objects
 		gateway.ListObjects(c)
 	}
 }
 
+func handleBucketPut(gateway *Gateway) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.GetQuery("acl"); ok {
+			gateway.PutBucketACL(c)
+			return
+		}
+		if _, ok := c.GetQuery("publicAccessBlock"); ok {
+			gateway.PutPublicAccessBlock(c)
+			return
+		}
+		if _, ok := c.GetQuery("policy"); ok {
+			gateway.PutBucketPolicy(c)
+			return
+		}
+		if _, ok := c.GetQuery("lifecycle"); ok {
+			gateway.PutBucketLifecycle(c)
+			return
+		}
+		if _, ok := c.GetQuery("encryption"); ok {
+			gateway.PutBucketEncryption(c)
+			return
+		}
+		if _, ok := c.GetQuery("versioning"); ok {
+			gateway.PutBucketVersioning(c)
+			return
+		}
+
+		// Default: create bucket
+		gateway.CreateBucket(c)
+	}
+}
+
+func handleBucketDelete(gateway *Gateway) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.GetQuery("publicAccessBlock"); ok {
+			gateway.DeletePublicAccessBlock(c)
+			return
+		}
+		if _, ok := c.GetQuery("policy"); ok {
+			gateway.DeleteBucketPolicy(c)
+			return
+		}
+		if _, ok := c.GetQuery("lifecycle"); ok {
+			gateway.DeleteBucketLifecycle(c)
+			return
+		}
+		if _, ok := c.GetQuery("encryption"); ok {
+			gateway.DeleteBucketEncryption(c)
+			return
+		}
+
+		// Default: delete bucket
+		gateway.DeleteBucket(c)
+	}
+}
+
 func handleObjectPut(gateway *Gateway) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		copySource := c.GetHeader(headerCopySource) != ""
+
 		// Check for multipart upload part
 		if c.Query("uploadId") != "" {
+			if copySource {
+				gateway.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "UploadPartCopy is not supported")
+				return
+			}
 			gateway.UploadPart(c)
 			return
 		}
 
+		if copySource {
+			gateway.CopyObject(c)
+			return
+		}
+
 		// Default: put object
 		gateway.PutObject(c)
 	}
@@ -110,8 +240,8 @@ func handleObjectDelete(gateway *Gateway) gin.HandlerFunc {
 
 func handleObjectPost(gateway *Gateway) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Initiate multipart upload
-		if c.Query("uploads") != "" {
+		// Initiate multipart upload (?uploads carries no value)
+		if _, ok := c.GetQuery("uploads"); ok {
 			gateway.InitiateMultipartUpload(c)
 			return
 		}
@@ -139,11 +269,6 @@ func healthCheckHandler(c *gin.Context) {
 	})
 }
 
-func metricsHandler(c *gin.Context) {
-	// TODO: Return Prometheus metrics
-	c.String(http.StatusOK, "# TODO: Prometheus metrics\n")
-}
-
 func clusterStatusHandler(c *gin.Context) {
 	// TODO: Implement cluster status check
 	c.JSON(http.StatusOK, gin.H{
@@ -197,13 +322,3 @@ func topObjectsHandler(c *gin.Context) {
 		},
 	})
 }
-
-func repairStatusHandler(c *gin.Context) {
-	// TODO: Query repair worker status
-	c.JSON(http.StatusOK, gin.H{
-		"status":           "running",
-		"last_run":         "2026-01-08T11:55:00Z",
-		"objects_repaired": 0,
-		"under_replicated": 0,
-	})
-}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/auth"
+)
+
+// headerDecodedContentLength is the payload length of an aws-chunked body
+const headerDecodedContentLength = "x-amz-decoded-content-length"
+
+// objectBody returns the payload of a PutObject or UploadPart request and
+// its length, -1 if unknown. The AWS CLI and SDKs send aws-chunked bodies,
+// announced by a STREAMING-* x-amz-content-sha256; these are decoded as
+// they are read, their chunk signatures are checked if the request was
+// authenticated, and their trailing headers are set in the request's
+// Trailer once the body has been read. On failure the error response has
+// been written.
+func (g *Gateway) objectBody(c *gin.Context) (io.Reader, int64, bool) {
+	r := c.Request
+	mode := r.Header.Get(auth.HeaderContentSHA256)
+	if !auth.IsStreaming(mode) {
+		return r.Body, r.ContentLength, true
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get(headerDecodedContentLength), 10, 64)
+	if err != nil || length < 0 {
+		g.errorResponse(c, http.StatusLengthRequired, ErrMissingContentLength,
+			"You must provide the x-amz-decoded-content-length header with an aws-chunked payload")
+		return nil, 0, false
+	}
+	var declared []string
+	if names := r.Header.Get(headerTrailer); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			declared = append(declared, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	value, _ := c.Get(contextChunkSigner)
+	signer, _ := value.(*auth.ChunkSigner)
+	if r.Trailer == nil {
+		r.Trailer = make(http.Header)
+	}
+	body, err := auth.NewChunkedReader(r.Body, mode, signer, declared, r.Trailer)
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return nil, 0, false
+	}
+	return body, length, true
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// S3 versioning headers
+const (
+	headerVersionID    = "x-amz-version-id"
+	headerDeleteMarker = "x-amz-delete-marker"
+)
+
+// versioningConfiguration is the PutBucketVersioning request body and the
+// GetBucketVersioning response. Status is empty for a bucket that never had
+// versioning enabled.
+type versioningConfiguration struct {
+	XMLName   xml.Name `xml:"VersioningConfiguration"`
+	Status    string   `xml:"Status,omitempty"`
+	MfaDelete string   `xml:"MfaDelete,omitempty"`
+}
+
+// listVersionsResult is the ListObjectVersions response
+type listVersionsResult struct {
+	XMLName             xml.Name            `xml:"ListVersionsResult"`
+	Name                string              `xml:"Name"`
+	Prefix              string              `xml:"Prefix"`
+	KeyMarker           string              `xml:"KeyMarker"`
+	VersionIDMarker     string              `xml:"VersionIdMarker"`
+	NextKeyMarker       string              `xml:"NextKeyMarker,omitempty"`
+	NextVersionIDMarker string              `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int                 `xml:"MaxKeys"`
+	IsTruncated         bool                `xml:"IsTruncated"`
+	Versions            []objectVersion     `xml:"Version"`
+	DeleteMarkers       []deleteMarkerEntry `xml:"DeleteMarker"`
+}
+
+type objectVersion struct {
+	Key          string `xml:"Key"`
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type deleteMarkerEntry struct {
+	Key          string `xml:"Key"`
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+}
+
+// versionID returns the version ID S3 clients see for obj
+func versionID(obj *metadata.Object) string {
+	if obj.NullVersion {
+		return metadata.NullVersionID
+	}
+	return obj.VersionID
+}
+
+func (g *Gateway) GetBucketVersioning(c *gin.Context) {
+	if !g.authorize(c, actionGetBucketVersioning) {
+		return
+	}
+	b, err := g.metadata.GetBucket(c.Request.Context(), c.Param("bucket"))
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.XML(http.StatusOK, versioningConfiguration{Status: string(b.Versioning)})
+}
+
+func (g *Gateway) PutBucketVersioning(c *gin.Context) {
+	if !g.authorize(c, actionPutBucketVersioning) {
+		return
+	}
+	var config versioningConfiguration
+	data, ok := g.readConfig(c)
+	if !ok {
+		return
+	}
+	if err := xml.Unmarshal(data, &config); err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrMalformedXML,
+			"The XML you provided was not well-formed or did not validate against our published schema")
+		return
+	}
+	status := metadata.VersioningStatus(config.Status)
+	if status != metadata.VersioningEnabled && status != metadata.VersioningSuspended {
+		g.errorResponse(c, http.StatusBadRequest, ErrIllegalVersioningConfiguration,
+			"The versioning configuration specified in the request is invalid: Status must be Enabled or Suspended")
+		return
+	}
+	if config.MfaDelete == "Enabled" {
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "MFA delete is not supported")
+		return
+	}
+	if err := g.metadata.SetBucketVersioning(c.Request.Context(), c.Param("bucket"), status); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) ListObjectVersions(c *gin.Context) {
+	if !g.authorize(c, actionListBucketVersions) {
+		return
+	}
+	bucket := c.Param("bucket")
+	prefix := c.Query("prefix")
+	keyMarker := c.Query("key-marker")
+	versionIDMarker := c.Query("version-id-marker")
+	ctx := c.Request.Context()
+
+	if c.Query("delimiter") != "" {
+		g.errorResponse(c, http.StatusNotImplemented, ErrNotImplemented, "Listing versions with a delimiter is not supported")
+		return
+	}
+	if versionIDMarker != "" && keyMarker == "" {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument,
+			"A version-id marker cannot be specified without a key marker")
+		return
+	}
+	maxKeys, err := queryLimit(c, "max-keys")
+	if err != nil {
+		g.errorResponse(c, http.StatusBadRequest, ErrInvalidArgument, err.Error())
+		return
+	}
+	if _, err := g.metadata.GetBucket(ctx, bucket); err != nil {
+		g.lookupError(c, err)
+		return
+	}
+	versions, err := g.metadata.ListObjectVersions(ctx, bucket, prefix, keyMarker, versionIDMarker, maxKeys+1)
+	if err != nil {
+		g.lookupError(c, err)
+		return
+	}
+
+	result := listVersionsResult{
+		Name:            bucket,
+		Prefix:          prefix,
+		KeyMarker:       keyMarker,
+		VersionIDMarker: versionIDMarker,
+		MaxKeys:         maxKeys,
+		IsTruncated:     len(versions) > maxKeys,
+	}
+	if result.IsTruncated {
+		versions = versions[:maxKeys]
+	}
+	if result.IsTruncated && maxKeys > 0 {
+		last := versions[maxKeys-1]
+		result.NextKeyMarker = last.ObjectKey
+		result.NextVersionIDMarker = versionID(last)
+	}
+	for _, obj := range versions {
+		lastModified := obj.CreatedAt.UTC().Format(timeFormatISO8601)
+		if obj.IsDeleteMarker {
+			result.DeleteMarkers = append(result.DeleteMarkers, deleteMarkerEntry{
+				Key:          obj.ObjectKey,
+				VersionID:    versionID(obj),
+				IsLatest:     obj.IsLatest,
+				LastModified: lastModified,
+			})
+			continue
+		}
+		result.Versions = append(result.Versions, objectVersion{
+			Key:          obj.ObjectKey,
+			VersionID:    versionID(obj),
+			IsLatest:     obj.IsLatest,
+			LastModified: lastModified,
+			ETag:         "\"" + obj.ETag + "\"",
+			Size:         obj.SizeBytes,
+			StorageClass: "STANDARD",
+		})
+	}
+	c.XML(http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// AccessKeyIDPrefix starts every access key ID the gateway generates
+const AccessKeyIDPrefix = "PK"
+
+// SecretsKeySize is the size of the key that encrypts secrets at rest
+const SecretsKeySize = 32
+
+// sealVersion is the first byte of a sealed secret, so the format can change
+const sealVersion = 1
+
+// ErrUnsealable marks a sealed secret that cannot be decrypted with the
+// secrets key, because it was sealed with another key or is corrupt
+var ErrUnsealable = errors.New("secret cannot be unsealed")
+
+// NewAccessKeyID returns a random access key ID: the prefix and 18
+// base32 characters
+func NewAccessKeyID() (string, error) {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return AccessKeyIDPrefix + base32.StdEncoding.EncodeToString(b)[:18], nil
+}
+
+// NewSecretAccessKey returns a random 40-character secret access key
+func NewSecretAccessKey() (string, error) {
+	b := make([]byte, 30)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// SecretBox encrypts secret access keys at rest with AES-256-GCM. Verifying
+// a signature needs the secret itself, so it cannot be hashed; instead only
+// a holder of the secrets key can read the access key store.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates a SecretBox from a SecretsKeySize-byte key
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != SecretsKeySize {
+		return nil, fmt.Errorf("secrets key must be %d bytes, got %d", SecretsKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// ParseSecretsKey decodes a base64 secrets key, as `openssl rand -base64 32`
+// prints one
+func ParseSecretsKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secrets key is not base64: %w", err)
+	}
+	if len(key) != SecretsKeySize {
+		return nil, fmt.Errorf("secrets key must be %d bytes, got %d", SecretsKeySize, len(key))
+	}
+	return key, nil
+}
+
+// Seal encrypts the secret of an access key. The access key ID is
+// authenticated with it, so a sealed secret cannot be moved to another key.
+func (b *SecretBox) Seal(accessKeyID, secret string) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{sealVersion}, nonce...)
+	return b.aead.Seal(sealed, nonce, []byte(secret), []byte(accessKeyID)), nil
+}
+
+// Open decrypts a secret sealed for accessKeyID
+func (b *SecretBox) Open(accessKeyID string, sealed []byte) (string, error) {
+	if len(sealed) < 1+b.aead.NonceSize() || sealed[0] != sealVersion {
+		return "", ErrUnsealable
+	}
+	nonce := sealed[1 : 1+b.aead.NonceSize()]
+	secret, err := b.aead.Open(nil, nonce, sealed[1+b.aead.NonceSize():], []byte(accessKeyID))
+	if err != nil {
+		return "", ErrUnsealable
+	}
+	return string(secret), nil
+}
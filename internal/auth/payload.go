@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+)
+
+// payloadReader hashes a request body as it is read and fails the final
+// read if the body does not match the SHA-256 it was signed with
+type payloadReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+// NewPayloadReader wraps body so that reading it to the end returns
+// ErrContentSHA256Mismatch unless its SHA-256 is wantHex. An unsigned
+// payload is passed through.
+func NewPayloadReader(body io.ReadCloser, wantHex string) io.ReadCloser {
+	if wantHex == UnsignedPayload {
+		return body
+	}
+	return &payloadReader{ReadCloser: body, hash: sha256.New(), want: strings.ToLower(wantHex)}
+}
+
+func (p *payloadReader) Read(buf []byte) (int, error) {
+	n, err := p.ReadCloser.Read(buf)
+	p.hash.Write(buf[:n])
+	if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.want {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
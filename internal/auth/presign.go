@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of a pre-signed URL
+const (
+	QueryAlgorithm     = "X-Amz-Algorithm"
+	QueryCredential    = "X-Amz-Credential"
+	QueryDate          = "X-Amz-Date"
+	QueryExpires       = "X-Amz-Expires"
+	QuerySignedHeaders = "X-Amz-SignedHeaders"
+	QuerySignature     = "X-Amz-Signature"
+)
+
+// MaxPresignExpiry is the longest a pre-signed URL may stay valid, as in S3
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// ErrExpired marks a pre-signed URL used after it expired
+var ErrExpired = errors.New("request has expired")
+
+// Presigned is the signature carried in the query string of a pre-signed
+// URL. Its payload is always UNSIGNED-PAYLOAD.
+type Presigned struct {
+	Authorization
+	Date    time.Time     // X-Amz-Date, when the URL was signed
+	Expires time.Duration // X-Amz-Expires, how long it is valid from Date
+}
+
+// IsPresigned reports whether a request's query string carries a SigV4
+// signature
+func IsPresigned(query url.Values) bool {
+	return query.Has(QueryAlgorithm)
+}
+
+// ParsePresigned parses the X-Amz-* parameters of a pre-signed URL
+func ParsePresigned(query url.Values) (*Presigned, error) {
+	if query.Get(QueryAlgorithm) != Algorithm {
+		return nil, ErrUnsupported
+	}
+	for _, name := range []string{QueryCredential, QueryDate, QueryExpires, QuerySignedHeaders, QuerySignature} {
+		if query.Get(name) == "" {
+			return nil, fmt.Errorf("%w: missing %s", ErrMalformed, name)
+		}
+	}
+
+	p := &Presigned{Authorization: Authorization{Signature: query.Get(QuerySignature)}}
+	var err error
+	if p.AccessKeyID, p.Scope, err = ParseCredential(query.Get(QueryCredential)); err != nil {
+		return nil, err
+	}
+	p.SignedHeaders = strings.Split(query.Get(QuerySignedHeaders), ";")
+	if !sort.StringsAreSorted(p.SignedHeaders) {
+		return nil, fmt.Errorf("%w: %s are not sorted", ErrMalformed, QuerySignedHeaders)
+	}
+	if _, err := hex.DecodeString(p.Signature); err != nil || len(p.Signature) != 2*sha256.Size {
+		return nil, fmt.Errorf("%w: invalid %s", ErrMalformed, QuerySignature)
+	}
+	if p.Date, err = time.Parse(TimeFormat, query.Get(QueryDate)); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s %q", ErrMalformed, QueryDate, query.Get(QueryDate))
+	}
+	seconds, err := strconv.ParseInt(query.Get(QueryExpires), 10, 64)
+	if err != nil || seconds <= 0 {
+		return nil, fmt.Errorf("%w: %s must be a positive number of seconds", ErrMalformed, QueryExpires)
+	}
+	if seconds > int64(MaxPresignExpiry/time.Second) {
+		return nil, fmt.Errorf("%w: %s must be less than a week (in seconds); that is, the given %s must be less than %d seconds",
+			ErrMalformed, QueryExpires, QueryExpires, int64(MaxPresignExpiry/time.Second))
+	}
+	p.Expires = time.Duration(seconds) * time.Second
+	return p, nil
+}
+
+// CheckExpiry returns ErrExpired once the URL's validity has passed, and
+// ErrClockSkew if it was signed further in the future than MaxClockSkew
+func (p *Presigned) CheckExpiry(now time.Time) error {
+	if now.After(p.Date.Add(p.Expires)) {
+		return fmt.Errorf("%w: expired at %s, server time %s", ErrExpired,
+			p.Date.Add(p.Expires).Format(TimeFormat), now.UTC().Format(TimeFormat))
+	}
+	if p.Date.Sub(now) > MaxClockSkew {
+		return fmt.Errorf("%w: request time %s, server time %s", ErrClockSkew,
+			p.Date.Format(TimeFormat), now.UTC().Format(TimeFormat))
+	}
+	return nil
+}
+
+// VerifyPresigned checks the query-string signature of r, already parsed
+// into p, against the access key's secret. Headers that are not signed,
+// x-amz- ones included, are ignored as S3 does for pre-signed URLs.
+func VerifyPresigned(r *http.Request, p *Presigned, secret string) error {
+	if err := checkScope(&p.Authorization, p.Date); err != nil {
+		return err
+	}
+	want, err := Signature(r, p.SignedHeaders, UnsignedPayload, secret, p.Scope, p.Date, QuerySignature)
+	if err != nil {
+		return err
+	}
+	if !SignaturesEqual(want, p.Signature) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// Presign returns a URL that lets whoever holds it make a method request
+// to rawURL, signed at t with the given access key and valid for expires.
+// Only the host is signed, so the request may carry any headers.
+func Presign(method, rawURL, accessKeyID, secret, region string, t time.Time, expires time.Duration) (string, error) {
+	if expires < time.Second || expires > MaxPresignExpiry {
+		return "", fmt.Errorf("expiry must be between 1s and %s", MaxPresignExpiry)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("URL %q has no host", rawURL)
+	}
+	t = t.UTC()
+	scope := Scope{Date: t.Format(DateFormat), Region: region, Service: Service}
+	query := u.Query()
+	query.Set(QueryAlgorithm, Algorithm)
+	query.Set(QueryCredential, accessKeyID+"/"+scope.String())
+	query.Set(QueryDate, t.Format(TimeFormat))
+	query.Set(QueryExpires, strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set(QuerySignedHeaders, "host")
+	query.Del(QuerySignature)
+	u.RawQuery = query.Encode()
+
+	r := &http.Request{Method: method, URL: u, Host: u.Host, Header: make(http.Header)}
+	signature, err := Signature(r, []string{"host"}, UnsignedPayload, secret, scope, t)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery += "&" + QuerySignature + "=" + signature
+	return u.String(), nil
+}
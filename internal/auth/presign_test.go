@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresignS3Example(t *testing.T) {
+	tm := parseTime(t, exampleTime)
+	const want = "aeeed9bbccd4d02ee5c0109b86d86835f995330da4c265957d157751f604d404"
+
+	signed, err := Presign(http.MethodGet, "https://examplebucket.s3.amazonaws.com/test.txt",
+		exampleAccessKeyID, exampleSecret, "us-east-1", tm, 86400*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(signed, "&"+QuerySignature+"="+want) {
+		t.Fatalf("URL %s, want signature %s", signed, want)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePresigned(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.AccessKeyID != exampleAccessKeyID || p.Scope != exampleScope || p.Expires != 24*time.Hour {
+		t.Fatalf("parsed %+v", p)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  string
+		header http.Header
+		secret string
+		want   error
+	}{
+		{"signed", http.MethodGet, "/test.txt", u.RawQuery, nil, exampleSecret, nil},
+		{"unsigned headers", http.MethodGet, "/test.txt", u.RawQuery,
+			http.Header{"X-Amz-Meta-Foo": {"bar"}, "Range": {"bytes=0-9"}}, exampleSecret, nil},
+		{"wrong secret", http.MethodGet, "/test.txt", u.RawQuery, nil, suiteSecret, ErrSignatureMismatch},
+		{"method", http.MethodPut, "/test.txt", u.RawQuery, nil, exampleSecret, ErrSignatureMismatch},
+		{"path", http.MethodGet, "/other.txt", u.RawQuery, nil, exampleSecret, ErrSignatureMismatch},
+		{"query", http.MethodGet, "/test.txt", u.RawQuery + "&versionId=1", nil, exampleSecret, ErrSignatureMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = make(http.Header)
+			}
+			r := &http.Request{
+				Method: tt.method,
+				URL:    &url.URL{Path: tt.path, RawQuery: tt.query},
+				Host:   u.Host,
+				Header: header,
+			}
+			if err := VerifyPresigned(r, p, tt.secret); err != tt.want {
+				t.Errorf("verify: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPresignedExpiry(t *testing.T) {
+	tm := parseTime(t, exampleTime)
+	signed, err := Presign(http.MethodGet, "https://examplebucket.s3.amazonaws.com/test.txt",
+		exampleAccessKeyID, exampleSecret, "us-east-1", tm, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	p, err := ParsePresigned(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		wantErr bool
+	}{
+		{"valid", tm.Add(30 * time.Minute), false},
+		{"expired", tm.Add(time.Hour + time.Second), true},
+		{"signed in the future", tm.Add(-time.Hour), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.CheckExpiry(tt.now); (err != nil) != tt.wantErr {
+				t.Errorf("CheckExpiry: %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Presign(http.MethodGet, "https://examplebucket.s3.amazonaws.com/test.txt",
+		exampleAccessKeyID, exampleSecret, "us-east-1", tm, MaxPresignExpiry+time.Second); err == nil {
+		t.Error("Presign accepted an expiry beyond the maximum")
+	}
+	query := u.Query()
+	query.Set(QueryExpires, "604801")
+	if _, err := ParsePresigned(query); !errors.Is(err, ErrMalformed) {
+		t.Errorf("ParsePresigned with a long expiry: %v, want ErrMalformed", err)
+	}
+}
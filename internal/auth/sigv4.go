@@ -0,0 +1,400 @@
+// Package auth implements AWS Signature Version 4: parsing the
+// Authorization header, building the canonical request and string to sign,
+// and deriving signing keys, for both verifying and signing requests.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Algorithm is the only signing algorithm supported
+const Algorithm = "AWS4-HMAC-SHA256"
+
+// Service is the service name in S3 credential scopes
+const Service = "s3"
+
+// scopeTerminator ends every credential scope
+const scopeTerminator = "aws4_request"
+
+// Formats of the request timestamp and the credential scope date
+const (
+	TimeFormat = "20060102T150405Z"
+	DateFormat = "20060102"
+)
+
+// MaxClockSkew is how far a request's timestamp may be from the server's
+// clock
+const MaxClockSkew = 15 * time.Minute
+
+// Values of x-amz-content-sha256 that are not a hash of the payload
+const (
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	EmptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Request headers used by SigV4
+const (
+	HeaderDate          = "X-Amz-Date"
+	HeaderContentSHA256 = "X-Amz-Content-Sha256"
+	HeaderSecurityToken = "X-Amz-Security-Token"
+)
+
+var (
+	// ErrMalformed marks an Authorization header or credential scope that
+	// cannot be parsed
+	ErrMalformed = errors.New("malformed authorization")
+
+	// ErrUnsupported marks an authorization scheme other than SigV4
+	ErrUnsupported = errors.New("unsupported authorization mechanism")
+
+	// ErrMissingDate marks a request without X-Amz-Date or Date
+	ErrMissingDate = errors.New("missing request date")
+
+	// ErrClockSkew marks a request signed too far from the server's time
+	ErrClockSkew = errors.New("request time too skewed")
+
+	// ErrSignatureMismatch marks a signature that does not match the request
+	ErrSignatureMismatch = errors.New("signature does not match")
+
+	// ErrContentSHA256Mismatch marks a payload whose SHA-256 differs from
+	// the X-Amz-Content-Sha256 it was signed with
+	ErrContentSHA256Mismatch = errors.New("payload SHA-256 does not match x-amz-content-sha256")
+)
+
+// Scope is a credential scope: the date, region and service a signing key
+// is valid for
+type Scope struct {
+	Date    string // YYYYMMDD
+	Region  string
+	Service string
+}
+
+// String returns the scope as it appears in the string to sign
+func (s Scope) String() string {
+	return s.Date + "/" + s.Region + "/" + s.Service + "/" + scopeTerminator
+}
+
+// Authorization is a parsed SigV4 Authorization header
+type Authorization struct {
+	AccessKeyID   string
+	Scope         Scope
+	SignedHeaders []string // lowercase, sorted
+	Signature     string   // hex
+}
+
+// ParseAuthorization parses an Authorization header of the form
+//
+//	AWS4-HMAC-SHA256 Credential=AKID/20150830/us-east-1/s3/aws4_request,
+//	SignedHeaders=host;x-amz-date, Signature=<hex>
+func ParseAuthorization(header string) (*Authorization, error) {
+	algo, rest, _ := strings.Cut(header, " ")
+	if algo != Algorithm {
+		return nil, ErrUnsupported
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(rest, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q has no value", ErrMalformed, field)
+		}
+		fields[name] = value
+	}
+
+	auth := &Authorization{Signature: fields["Signature"]}
+	var err error
+	if auth.AccessKeyID, auth.Scope, err = ParseCredential(fields["Credential"]); err != nil {
+		return nil, err
+	}
+	if fields["SignedHeaders"] == "" {
+		return nil, fmt.Errorf("%w: missing SignedHeaders", ErrMalformed)
+	}
+	auth.SignedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(auth.SignedHeaders) {
+		return nil, fmt.Errorf("%w: SignedHeaders are not sorted", ErrMalformed)
+	}
+	if _, err := hex.DecodeString(auth.Signature); err != nil || len(auth.Signature) != 2*sha256.Size {
+		return nil, fmt.Errorf("%w: invalid Signature", ErrMalformed)
+	}
+	return auth, nil
+}
+
+// ParseCredential splits a credential, <access key>/<scope>, into the
+// access key ID and the scope
+func ParseCredential(credential string) (string, Scope, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" {
+		return "", Scope{}, fmt.Errorf("%w: credential %q is not <key>/<date>/<region>/<service>/aws4_request",
+			ErrMalformed, credential)
+	}
+	if parts[4] != scopeTerminator {
+		return "", Scope{}, fmt.Errorf("%w: credential should end with %q", ErrMalformed, scopeTerminator)
+	}
+	if _, err := time.Parse(DateFormat, parts[1]); err != nil {
+		return "", Scope{}, fmt.Errorf("%w: invalid credential date %q", ErrMalformed, parts[1])
+	}
+	return parts[0], Scope{Date: parts[1], Region: parts[2], Service: parts[3]}, nil
+}
+
+// RequestTime returns the time a request was signed at, from X-Amz-Date or
+// else Date
+func RequestTime(h http.Header) (time.Time, error) {
+	if v := h.Get(HeaderDate); v != "" {
+		t, err := time.Parse(TimeFormat, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid X-Amz-Date %q", ErrMissingDate, v)
+		}
+		return t, nil
+	}
+	if v := h.Get("Date"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid Date %q", ErrMissingDate, v)
+		}
+		return t.UTC(), nil
+	}
+	return time.Time{}, ErrMissingDate
+}
+
+// CheckSkew returns ErrClockSkew if t is more than MaxClockSkew from now
+func CheckSkew(t, now time.Time) error {
+	if d := now.Sub(t); d > MaxClockSkew || d < -MaxClockSkew {
+		return fmt.Errorf("%w: request time %s, server time %s", ErrClockSkew,
+			t.Format(TimeFormat), now.UTC().Format(TimeFormat))
+	}
+	return nil
+}
+
+// CanonicalRequest builds the canonical request of r. uri is the canonical
+// URI (see CanonicalURI), signedHeaders the lowercase sorted header names
+// and payloadHash the hex SHA-256 of the payload or UnsignedPayload. Query
+// parameters named in exclude are left out, as X-Amz-Signature is from a
+// pre-signed URL.
+func CanonicalRequest(r *http.Request, uri string, signedHeaders []string, payloadHash string, exclude ...string) (string, error) {
+	query, err := CanonicalQuery(r.URL.RawQuery, exclude...)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uri)
+	b.WriteByte('\n')
+	b.WriteString(query)
+	b.WriteByte('\n')
+	for _, name := range signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(canonicalHeaderValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String(), nil
+}
+
+// CanonicalURI returns the canonical URI S3 signs: the decoded path with
+// each segment URI-encoded once and no normalisation
+func CanonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+// CanonicalQuery returns the query parameters URI-encoded and sorted by
+// name, then value
+func CanonicalQuery(rawQuery string, exclude ...string) (string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("%w: query: %v", ErrMalformed, err)
+	}
+	var pairs [][2]string
+	for name, vals := range values {
+		if contains(exclude, name) {
+			continue
+		}
+		for _, v := range vals {
+			pairs = append(pairs, [2]string{uriEncode(name, true), uriEncode(v, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&"), nil
+}
+
+// canonicalHeaderValue returns the values of a header joined by commas,
+// each trimmed and with runs of spaces collapsed. Go moves some headers
+// out of r.Header, so those are read from the request itself.
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{fmt.Sprint(r.ContentLength)}
+		}
+	case "transfer-encoding":
+		values = r.TransferEncoding
+	default:
+		values = r.Header.Values(name)
+	}
+	// values may belong to r.Header or r.TransferEncoding, which later
+	// handlers read as they are
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// StringToSign builds the string to sign from the request time, the
+// credential scope and the canonical request
+func StringToSign(t time.Time, scope Scope, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	return Algorithm + "\n" + t.UTC().Format(TimeFormat) + "\n" + scope.String() + "\n" + hex.EncodeToString(sum[:])
+}
+
+// SigningKey derives the key that signs requests within scope
+func SigningKey(secret string, scope Scope) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), scope.Date)
+	key = hmacSHA256(key, scope.Region)
+	key = hmacSHA256(key, scope.Service)
+	return hmacSHA256(key, scopeTerminator)
+}
+
+// Sign returns the hex signature of stringToSign
+func Sign(signingKey []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// SignaturesEqual compares two hex signatures in constant time
+func SignaturesEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte but the RFC 3986 unreserved
+// characters, and '/' too if encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Signature computes the signature of r over signedHeaders, made at t
+// within scope with the given secret and payload hash
+func Signature(r *http.Request, signedHeaders []string, payloadHash, secret string, scope Scope, t time.Time, exclude ...string) (string, error) {
+	canonical, err := CanonicalRequest(r, CanonicalURI(r.URL.Path), signedHeaders, payloadHash, exclude...)
+	if err != nil {
+		return "", err
+	}
+	return Sign(SigningKey(secret, scope), StringToSign(t, scope, canonical)), nil
+}
+
+// Verify checks the Authorization header of r, already parsed into auth,
+// against the access key's secret. t is the request time; the payload is
+// taken to be signed with the hash in X-Amz-Content-Sha256.
+func Verify(r *http.Request, auth *Authorization, secret string, t time.Time) error {
+	if err := checkScope(auth, t); err != nil {
+		return err
+	}
+	for name := range r.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") && !contains(auth.SignedHeaders, name) {
+			return fmt.Errorf("%w: header %s must be signed", ErrMalformed, name)
+		}
+	}
+	want, err := Signature(r, auth.SignedHeaders, r.Header.Get(HeaderContentSHA256), secret, auth.Scope, t)
+	if err != nil {
+		return err
+	}
+	if !SignaturesEqual(want, auth.Signature) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// checkScope checks that auth's credential scope is for the day of t and
+// that it signs the host
+func checkScope(auth *Authorization, t time.Time) error {
+	if auth.Scope.Date != t.UTC().Format(DateFormat) {
+		return fmt.Errorf("%w: credential date %s does not match request date %s",
+			ErrMalformed, auth.Scope.Date, t.UTC().Format(DateFormat))
+	}
+	if !contains(auth.SignedHeaders, "host") {
+		return fmt.Errorf("%w: the host header must be signed", ErrMalformed)
+	}
+	return nil
+}
+
+// SignRequest signs r at t with an Authorization header, signing the host
+// and every x-amz- header. payloadHash is set as X-Amz-Content-Sha256.
+func SignRequest(r *http.Request, accessKeyID, secret, region, payloadHash string, t time.Time) error {
+	t = t.UTC()
+	r.Header.Set(HeaderDate, t.Format(TimeFormat))
+	r.Header.Set(HeaderContentSHA256, payloadHash)
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	signed := []string{"host"}
+	for name := range r.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-md5" || name == "content-type" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+	scope := Scope{Date: t.Format(DateFormat), Region: region, Service: Service}
+	signature, err := Signature(r, signed, payloadHash, secret, scope, t)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, accessKeyID, scope, strings.Join(signed, ";"), signature))
+	return nil
+}
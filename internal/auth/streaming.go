@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// x-amz-content-sha256 values of aws-chunked payloads. The signed forms
+// carry a signature per chunk, chained from the request's signature; the
+// trailer forms end with trailing headers, typically a checksum.
+const (
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Algorithms of the chunk and trailer strings to sign
+const (
+	chunkAlgorithm   = "AWS4-HMAC-SHA256-PAYLOAD"
+	trailerAlgorithm = "AWS4-HMAC-SHA256-TRAILER"
+)
+
+// headerTrailerSignature is the trailing header signing the trailer
+const headerTrailerSignature = "x-amz-trailer-signature"
+
+// maxChunkLine bounds a chunk header or trailer line
+const maxChunkLine = 4096
+
+var (
+	// ErrMalformedChunk marks an aws-chunked body that breaks the framing
+	ErrMalformedChunk = errors.New("malformed aws-chunked payload")
+
+	// ErrChunkSignatureMismatch marks a chunk or trailer whose signature
+	// does not match its data
+	ErrChunkSignatureMismatch = errors.New("chunk signature does not match")
+)
+
+// IsStreaming reports whether an x-amz-content-sha256 value announces an
+// aws-chunked payload
+func IsStreaming(contentSHA256 string) bool {
+	switch contentSHA256 {
+	case StreamingPayload, StreamingPayloadTrailer, StreamingUnsignedTrailer:
+		return true
+	}
+	return false
+}
+
+// ChunkSigner computes the chained signatures of an aws-chunked payload.
+// Each chunk's signature covers its data and the previous signature,
+// starting from the seed signature of the request's headers.
+type ChunkSigner struct {
+	key   []byte
+	scope Scope
+	time  time.Time
+	prev  string
+}
+
+// NewChunkSigner creates a chunk signer for a request signed at t within
+// scope, whose Authorization header carries the seed signature
+func NewChunkSigner(secret string, scope Scope, t time.Time, seed string) *ChunkSigner {
+	return &ChunkSigner{key: SigningKey(secret, scope), scope: scope, time: t, prev: seed}
+}
+
+// Sign returns the signature of the next chunk, whose data has the hex
+// SHA-256 dataHash
+func (s *ChunkSigner) Sign(dataHash string) string {
+	s.prev = Sign(s.key, chunkAlgorithm+"\n"+s.time.UTC().Format(TimeFormat)+"\n"+s.scope.String()+"\n"+
+		s.prev+"\n"+EmptySHA256+"\n"+dataHash)
+	return s.prev
+}
+
+// SignTrailer returns the signature of the trailing headers, whose
+// canonical form ("name:value\n" each) has the hex SHA-256 trailerHash
+func (s *ChunkSigner) SignTrailer(trailerHash string) string {
+	s.prev = Sign(s.key, trailerAlgorithm+"\n"+s.time.UTC().Format(TimeFormat)+"\n"+s.scope.String()+"\n"+
+		s.prev+"\n"+trailerHash)
+	return s.prev
+}
+
+// chunkedReader decodes an aws-chunked body as it is read. Each chunk is
+// passed through as it arrives and its signature checked once the chunk
+// ends, so a bad chunk fails the read that reaches its end rather than
+// being held back.
+type chunkedReader struct {
+	r        *bufio.Reader
+	signed   bool         // chunks carry signatures
+	trailing bool         // trailing headers follow the last chunk
+	signer   *ChunkSigner // nil when signatures are not checked
+	declared []string     // trailing header names from x-amz-trailer
+	trailer  http.Header
+
+	started   bool
+	remaining int64 // bytes left in the current chunk
+	signature string
+	hash      hash.Hash
+	err       error // sticky; io.EOF once the trailer is read
+}
+
+// NewChunkedReader decodes an aws-chunked body sent with the given
+// x-amz-content-sha256 value. Chunk and trailer signatures are checked
+// against signer, unless it is nil. declared lists the trailing header
+// names the request announced in x-amz-trailer; their values are set in
+// trailer when the body has been read to the end.
+func NewChunkedReader(body io.Reader, contentSHA256 string, signer *ChunkSigner, declared []string, trailer http.Header) (io.Reader, error) {
+	if !IsStreaming(contentSHA256) {
+		return nil, fmt.Errorf("%w: %q is not a streaming payload", ErrMalformedChunk, contentSHA256)
+	}
+	c := &chunkedReader{
+		r:        bufio.NewReader(body),
+		signed:   contentSHA256 != StreamingUnsignedTrailer,
+		trailing: contentSHA256 != StreamingPayload,
+		declared: declared,
+		trailer:  trailer,
+		hash:     sha256.New(),
+	}
+	if c.signed {
+		c.signer = signer
+	}
+	if !c.trailing && len(declared) > 0 {
+		return nil, fmt.Errorf("%w: %s payloads have no trailer", ErrMalformedChunk, contentSHA256)
+	}
+	return c, nil
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.signer != nil {
+		c.hash.Write(p[:n])
+	}
+	c.remaining -= int64(n)
+	switch {
+	case err == io.EOF:
+		c.err = fmt.Errorf("%w: body ends inside a chunk", ErrMalformedChunk)
+	case err != nil:
+		c.err = err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, c.err
+}
+
+// nextChunk finishes the current chunk and starts the next. After the
+// final, empty chunk it reads the trailer and returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	if c.started {
+		if line, err := c.readLine(false); err != nil || len(line) != 0 {
+			return fmt.Errorf("%w: chunk data not followed by CRLF", ErrMalformedChunk)
+		}
+		if err := c.verifyChunk(); err != nil {
+			return err
+		}
+	}
+	c.started = true
+
+	line, err := c.readLine(false)
+	if err == io.EOF {
+		return fmt.Errorf("%w: body ends before the final chunk", ErrMalformedChunk)
+	}
+	if err != nil {
+		return err
+	}
+	sizeField, ext, _ := strings.Cut(string(line), ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, sizeField)
+	}
+	c.signature = ""
+	if name, value, ok := strings.Cut(ext, "="); ok && name == "chunk-signature" {
+		c.signature = value
+	}
+	if c.signed && c.signature == "" {
+		return fmt.Errorf("%w: chunk without chunk-signature", ErrMalformedChunk)
+	}
+	c.hash.Reset()
+	c.remaining = size
+	if size > 0 {
+		return nil
+	}
+
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if err := c.readTrailer(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// verifyChunk checks the signature of the chunk just read
+func (c *chunkedReader) verifyChunk() error {
+	if c.signer == nil {
+		return nil
+	}
+	if !SignaturesEqual(c.signer.Sign(hex.EncodeToString(c.hash.Sum(nil))), c.signature) {
+		return ErrChunkSignatureMismatch
+	}
+	return nil
+}
+
+// readTrailer reads the trailing headers up to the blank line that ends
+// the body, checking the trailer signature if the chunks are signed.
+// Trailer lines may end in a bare LF, and a blank line may separate the
+// trailer signature from the headers it signs, as MinIO clients send them.
+func (c *chunkedReader) readTrailer() error {
+	var canonical strings.Builder
+	var signature string
+	for {
+		line, err := c.readLine(true)
+		if err == io.EOF {
+			if !c.trailing {
+				return nil // some clients omit the final CRLF
+			}
+			return fmt.Errorf("%w: body ends inside the trailer", ErrMalformedChunk)
+		}
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			if c.trailing && c.signed && signature == "" && canonical.Len() > 0 {
+				continue
+			}
+			break
+		}
+		if !c.trailing {
+			return fmt.Errorf("%w: unexpected trailer", ErrMalformedChunk)
+		}
+		name, value, ok := strings.Cut(string(line), ":")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		switch {
+		case !ok:
+			return fmt.Errorf("%w: invalid trailer line %q", ErrMalformedChunk, line)
+		case name == headerTrailerSignature && c.signed:
+			signature = value
+		case !contains(c.declared, name):
+			return fmt.Errorf("%w: trailer %s was not declared in x-amz-trailer", ErrMalformedChunk, name)
+		default:
+			canonical.WriteString(name + ":" + value + "\n")
+			c.trailer.Set(name, value)
+		}
+	}
+	for _, name := range c.declared {
+		if c.trailer.Get(name) == "" {
+			return fmt.Errorf("%w: missing trailer %s", ErrMalformedChunk, name)
+		}
+	}
+	if !c.trailing || !c.signed {
+		return nil
+	}
+	if signature == "" {
+		return fmt.Errorf("%w: missing %s", ErrMalformedChunk, headerTrailerSignature)
+	}
+	if c.signer != nil {
+		sum := sha256.Sum256([]byte(canonical.String()))
+		if !SignaturesEqual(c.signer.SignTrailer(hex.EncodeToString(sum[:])), signature) {
+			return ErrChunkSignatureMismatch
+		}
+	}
+	return nil
+}
+
+// readLine reads a CRLF-terminated line without its terminator. A bare LF
+// ends the line too if lenient is set.
+func (c *chunkedReader) readLine(lenient bool) ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	switch {
+	case err == io.EOF && len(line) == 0:
+		return nil, io.EOF
+	case errors.Is(err, bufio.ErrBufferFull) || len(line) > maxChunkLine:
+		return nil, fmt.Errorf("%w: line too long", ErrMalformedChunk)
+	case err != nil:
+		return nil, fmt.Errorf("%w: %w", ErrMalformedChunk, err)
+	}
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return line[:len(line)-2], nil
+	}
+	if !lenient {
+		return nil, fmt.Errorf("%w: line not terminated by CRLF", ErrMalformedChunk)
+	}
+	return line[:len(line)-1], nil
+}
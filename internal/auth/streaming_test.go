@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkedExample is the aws-chunked PUT in the S3 API reference (Signature
+// Calculations for the Authorization Header: Transferring Payload in
+// Multiple Chunks): 65536 and 1024 bytes of 'a' and the final chunk
+var chunkedExample = struct {
+	seed   string
+	chunks []string
+	sigs   []string
+}{
+	seed:   "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	chunks: []string{strings.Repeat("a", 65536), strings.Repeat("a", 1024), ""},
+	sigs: []string{
+		"ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648",
+		"0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497",
+		"b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9",
+	},
+}
+
+// exampleChunkedBody encodes the example's chunks with their signatures
+func exampleChunkedBody() string {
+	var b strings.Builder
+	for i, chunk := range chunkedExample.chunks {
+		fmt.Fprintf(&b, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), chunkedExample.sigs[i], chunk)
+	}
+	return b.String()
+}
+
+func exampleChunkSigner(t *testing.T) *ChunkSigner {
+	return NewChunkSigner(exampleSecret, exampleScope, parseTime(t, exampleTime), chunkedExample.seed)
+}
+
+func TestChunkSignaturesS3Example(t *testing.T) {
+	r := newRequest(t, http.MethodPut, "http://s3.amazonaws.com/examplebucket/chunkObject.txt", "", map[string]string{
+		"X-Amz-Date":                   exampleTime,
+		"X-Amz-Storage-Class":          "REDUCED_REDUNDANCY",
+		"X-Amz-Content-Sha256":         StreamingPayload,
+		"X-Amz-Decoded-Content-Length": "66560",
+		"Content-Encoding":             "aws-chunked",
+		"Content-Length":               "66824",
+	})
+	seed, err := Signature(r, []string{"content-encoding", "content-length", "host", "x-amz-content-sha256",
+		"x-amz-date", "x-amz-decoded-content-length", "x-amz-storage-class"},
+		StreamingPayload, exampleSecret, exampleScope, parseTime(t, exampleTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != chunkedExample.seed {
+		t.Fatalf("seed signature %s, want %s", seed, chunkedExample.seed)
+	}
+
+	signer := exampleChunkSigner(t)
+	for i, chunk := range chunkedExample.chunks {
+		if got := signer.Sign(sha256Hex(chunk)); got != chunkedExample.sigs[i] {
+			t.Errorf("chunk %d: signature %s, want %s", i, got, chunkedExample.sigs[i])
+		}
+	}
+	if n := len(exampleChunkedBody()); n != 66824 {
+		t.Errorf("encoded body is %d bytes, want the example's Content-Length 66824", n)
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	body := exampleChunkedBody()
+	lastChunk := strings.LastIndex(body, "0;chunk-signature=")
+
+	tests := []struct {
+		name    string
+		body    string
+		signer  bool
+		want    string
+		wantErr error
+	}{
+		{"signed", body, true, strings.Repeat("a", 66560), nil},
+		{"unchecked", body, false, strings.Repeat("a", 66560), nil},
+		{"tampered data", strings.Replace(body, "aaaa\r\n400;", "aaab\r\n400;", 1), true, "", ErrChunkSignatureMismatch},
+		{"swapped signatures", strings.Replace(body, chunkedExample.sigs[1], chunkedExample.sigs[0], 1), true, "", ErrChunkSignatureMismatch},
+		{"truncated chunk", body[:65000], true, "", ErrMalformedChunk},
+		{"no final chunk", body[:lastChunk], true, "", ErrMalformedChunk},
+		{"bad chunk size", strings.Replace(body, "400;", "4g0;", 1), true, "", ErrMalformedChunk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var signer *ChunkSigner
+			if tt.signer {
+				signer = exampleChunkSigner(t)
+			}
+			r, err := NewChunkedReader(strings.NewReader(tt.body), StreamingPayload, signer, nil, make(http.Header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("read: %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestChunkedReaderTrailer(t *testing.T) {
+	const checksum = "x-amz-checksum-crc32:NhCmhg=="
+	declared := []string{"x-amz-checksum-crc32"}
+
+	signer := exampleChunkSigner(t)
+	data := signer.Sign(sha256Hex("hello"))
+	final := signer.Sign(EmptySHA256)
+	trailerSig := signer.SignTrailer(sha256Hex(checksum + "\n"))
+	signed := fmt.Sprintf("5;chunk-signature=%s\r\nhello\r\n0;chunk-signature=%s\r\n%s\r\n%s:%s\r\n\r\n",
+		data, final, checksum, headerTrailerSignature, trailerSig)
+
+	tests := []struct {
+		name          string
+		contentSHA256 string
+		body          string
+		wantErr       error
+	}{
+		{"unsigned", StreamingUnsignedTrailer, "5\r\nhello\r\n0\r\n" + checksum + "\r\n\r\n", nil},
+		{"signed", StreamingPayloadTrailer, signed, nil},
+		{"tampered trailer", StreamingPayloadTrailer, strings.Replace(signed, "NhCmhg==", "AAAAAA==", 1), ErrChunkSignatureMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trailer := make(http.Header)
+			r, err := NewChunkedReader(strings.NewReader(tt.body), tt.contentSHA256, exampleChunkSigner(t), declared, trailer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("read: %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(got) != "hello" {
+				t.Errorf("decoded %q, want %q", got, "hello")
+			}
+			if v := trailer.Get("x-amz-checksum-crc32"); v != "NhCmhg==" {
+				t.Errorf("trailer checksum %q, want %q", v, "NhCmhg==")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package checksum
+
+import (
+	"bytes"
+	"hash"
+	"io"
+)
+
+// DefaultBlockSize is the block size used for per-block replica checksums
+const DefaultBlockSize = 1 << 20
+
+// BlockHasher computes a checksum for every fixed-size block written to it.
+// Each raw digest is appended to out as soon as its block is complete, so the
+// digests of a multi-GB stream are never held in memory.
+type BlockHasher struct {
+	algo      Algorithm
+	blockSize int64
+	out       io.Writer
+	h         hash.Hash
+	filled    int64
+	count     int64
+}
+
+// NewBlockHasher creates a block hasher writing digests to out
+func NewBlockHasher(algo Algorithm, blockSize int64, out io.Writer) (*BlockHasher, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHasher{algo: algo, blockSize: blockSize, out: out, h: h}, nil
+}
+
+// Write hashes p, emitting a digest at every block boundary
+func (b *BlockHasher) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int64(len(p))
+		if room := b.blockSize - b.filled; n > room {
+			n = room
+		}
+		b.h.Write(p[:n])
+		b.filled += n
+		written += int(n)
+		p = p[n:]
+
+		if b.filled == b.blockSize {
+			if err := b.emit(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close emits the digest of the final partial block, if any
+func (b *BlockHasher) Close() error {
+	if b.filled == 0 {
+		return nil
+	}
+	return b.emit()
+}
+
+// Count returns the number of block digests emitted so far
+func (b *BlockHasher) Count() int64 {
+	return b.count
+}
+
+func (b *BlockHasher) emit() error {
+	if _, err := b.out.Write(b.h.Sum(nil)); err != nil {
+		return err
+	}
+	b.h.Reset()
+	b.filled = 0
+	b.count++
+	return nil
+}
+
+// BlockCount returns how many blocks an object of size bytes spans
+func BlockCount(size, blockSize int64) int64 {
+	return (size + blockSize - 1) / blockSize
+}
+
+// VerifyBlock checks one block of data against its raw digest
+func VerifyBlock(algo Algorithm, data, sum []byte) error {
+	h, err := NewHash(algo)
+	if err != nil {
+		return err
+	}
+	h.Write(data)
+	if actual := h.Sum(nil); !bytes.Equal(actual, sum) {
+		return &MismatchError{
+			Expected: Value{Algorithm: algo, Sum: sum},
+			Actual:   Value{Algorithm: algo, Sum: actual},
+		}
+	}
+	return nil
+}
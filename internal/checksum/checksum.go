@@ -1,66 +1,124 @@
 package checksum
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"hash"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
 
 	"github.com/cespare/xxhash/v2"
 )
 
+// ErrUnknownAlgorithm is returned for algorithms Plinth does not implement
+var ErrUnknownAlgorithm = errors.New("unknown checksum algorithm")
+
 // Algorithm represents a checksum algorithm
 type Algorithm string
 
 const (
 	// XXHash is the default fast checksum algorithm
 	XXHash Algorithm = "xxhash"
+
+	// CRC32 is the IEEE CRC-32 used by S3 flexible checksums
+	CRC32 Algorithm = "crc32"
+
+	// CRC32C is the Castagnoli CRC-32 used by S3 flexible checksums
+	CRC32C Algorithm = "crc32c"
+
+	// CRC64NVME is the NVMe CRC-64 used by S3 flexible checksums
+	CRC64NVME Algorithm = "crc64nvme"
+
+	// SHA1 is the SHA-1 digest used by S3 flexible checksums
+	SHA1 Algorithm = "sha1"
+
+	// SHA256 is the SHA-256 digest used by S3 flexible checksums
+	SHA256 Algorithm = "sha256"
+
+	// MD5 is the digest behind S3 ETags and Content-MD5
+	MD5 Algorithm = "md5"
+)
+
+var (
+	crc32cTable    = crc32.MakeTable(crc32.Castagnoli)
+	crc64NVMETable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
 )
 
 // Calculator provides checksum calculation functionality
 type Calculator interface {
 	// Calculate computes checksum from a reader
-	Calculate(r io.Reader) (string, error)
+	Calculate(r io.Reader) (Value, error)
 
 	// Verify checks if data matches the expected checksum
-	Verify(r io.Reader, expected string) (bool, error)
+	Verify(r io.Reader, expected Value) (bool, error)
 }
 
-// xxHashCalculator implements Calculator using xxHash
-type xxHashCalculator struct{}
+// hashCalculator implements Calculator on top of NewHash
+type hashCalculator struct {
+	algo Algorithm
+}
 
 // NewCalculator creates a new checksum calculator
-func NewCalculator(algo Algorithm) Calculator {
-	switch algo {
-	case XXHash:
-		return &xxHashCalculator{}
-	default:
-		return &xxHashCalculator{}
+func NewCalculator(algo Algorithm) (Calculator, error) {
+	if !algo.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algo)
 	}
+	return &hashCalculator{algo: algo}, nil
 }
 
-// Calculate computes xxHash checksum
-func (c *xxHashCalculator) Calculate(r io.Reader) (string, error) {
-	h := xxhash.New()
+// Calculate computes the checksum of everything read from r
+func (c *hashCalculator) Calculate(r io.Reader) (Value, error) {
+	h, err := NewHash(c.algo)
+	if err != nil {
+		return Value{}, err
+	}
 	if _, err := io.Copy(h, r); err != nil {
-		return "", err
+		return Value{}, err
 	}
-	return string(h.Sum(nil)), nil
+	return Value{Algorithm: c.algo, Sum: h.Sum(nil)}, nil
 }
 
-// Verify checks if data matches expected xxHash checksum
-func (c *xxHashCalculator) Verify(r io.Reader, expected string) (bool, error) {
+// Verify checks if data matches the expected checksum
+func (c *hashCalculator) Verify(r io.Reader, expected Value) (bool, error) {
 	actual, err := c.Calculate(r)
 	if err != nil {
 		return false, err
 	}
-	return actual == expected, nil
+	return actual.Equal(expected), nil
 }
 
 // NewHash creates a new hash instance for the algorithm
-func NewHash(algo Algorithm) hash.Hash {
+func NewHash(algo Algorithm) (hash.Hash, error) {
 	switch algo {
 	case XXHash:
-		return xxhash.New()
+		return xxhash.New(), nil
+	case CRC32:
+		return crc32.NewIEEE(), nil
+	case CRC32C:
+		return crc32.New(crc32cTable), nil
+	case CRC64NVME:
+		return crc64.New(crc64NVMETable), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algo)
+	}
+}
+
+// Valid reports whether the algorithm is implemented
+func (a Algorithm) Valid() bool {
+	switch a {
+	case XXHash, CRC32, CRC32C, CRC64NVME, SHA1, SHA256, MD5:
+		return true
 	default:
-		return xxhash.New()
+		return false
 	}
 }
@@ -0,0 +1,150 @@
+package checksum
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Golden digests: the standard check values ("123456789") of each CRC, the
+// FIPS 180 and RFC 1321 examples, and the xxHash64 reference values
+var golden = []struct {
+	algo Algorithm
+	data string
+	hex  string
+}{
+	{XXHash, "", "ef46db3751d8e999"},
+	{XXHash, "abc", "44bc2cf5ad770999"},
+	{CRC32, "", "00000000"},
+	{CRC32, "123456789", "cbf43926"},
+	{CRC32C, "", "00000000"},
+	{CRC32C, "123456789", "e3069283"},
+	{CRC64NVME, "", "0000000000000000"},
+	{CRC64NVME, "123456789", "ae8b14860a799888"},
+	{SHA1, "", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+	{SHA1, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+	{SHA1, strings.Repeat("a", 1000000), "34aa973cd4c4daa4f61eeb2bdbad27316534016f"},
+	{SHA256, "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	{SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	{SHA256, strings.Repeat("a", 1000000), "cdc76e5c9914fb9281a1c7e284d73e67f1809a48a497200e046d39ccc7112cd0"},
+	{MD5, "", "d41d8cd98f00b204e9800998ecf8427e"},
+	{MD5, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+	{MD5, strings.Repeat("a", 1000000), "7707d6ae4e027c70eea2a935c2296f21"},
+}
+
+func TestCalculateGolden(t *testing.T) {
+	for _, tt := range golden {
+		t.Run(string(tt.algo), func(t *testing.T) {
+			c, err := NewCalculator(tt.algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Calculate(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Algorithm != tt.algo || got.Hex() != tt.hex {
+				t.Errorf("%s of %d bytes: %s, want %s", tt.algo, len(tt.data), got.Hex(), tt.hex)
+			}
+
+			want, err := ParseHex(tt.algo, tt.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := c.Verify(strings.NewReader(tt.data), want); err != nil || !ok {
+				t.Errorf("Verify: %t, %v", ok, err)
+			}
+			if ok, _ := c.Verify(strings.NewReader(tt.data+"x"), want); ok {
+				t.Error("Verify accepted different data")
+			}
+		})
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	c, _ := NewCalculator(XXHash)
+	v, _ := c.Calculate(strings.NewReader("abc"))
+	if got := v.Base64(); got != "RLws9a13CZk=" {
+		t.Errorf("base64 %s", got)
+	}
+	if got := v.String(); got != v.Hex() {
+		t.Errorf("String() = %s, want the hex digest", got)
+	}
+	parsed, err := ParseBase64(XXHash, v.Base64())
+	if err != nil || !parsed.Equal(v) {
+		t.Errorf("ParseBase64 = %v, %v", parsed, err)
+	}
+	parsed, err = ParseHex(XXHash, strings.ToUpper(v.Hex()))
+	if err != nil || !parsed.Equal(v) {
+		t.Errorf("ParseHex of upper case = %v, %v", parsed, err)
+	}
+
+	for _, bad := range []string{"44bc2c", "zz", ""} {
+		if _, err := ParseHex(XXHash, bad); err == nil {
+			t.Errorf("ParseHex(%q) succeeded", bad)
+		}
+	}
+	if _, err := ParseBase64(XXHash, "not base64"); err == nil {
+		t.Error("ParseBase64 of bad base64 succeeded")
+	}
+	if !(Value{}).IsZero() || v.IsZero() {
+		t.Error("IsZero")
+	}
+}
+
+func TestS3Encoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		algo   Algorithm
+		data   string
+		base64 string
+	}{
+		{"CRC32", CRC32, "hello", "NhCmhg=="},
+		{"CRC32C", CRC32C, "123456789", "4waSgw=="},
+		{"CRC64NVME", CRC64NVME, "123456789", "rosUhgp5mIg="},
+		{"SHA1", SHA1, "abc", "qZk+NkcGgWq6PiVxeFDCbJzQ2J0="},
+		{"SHA256", SHA256, "", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algo, err := ParseS3Algorithm(tt.name)
+			if err != nil || algo != tt.algo {
+				t.Fatalf("ParseS3Algorithm(%q) = %q, %v", tt.name, algo, err)
+			}
+			c, _ := NewCalculator(algo)
+			got, _ := c.Calculate(strings.NewReader(tt.data))
+			if got.Base64() != tt.base64 {
+				t.Errorf("base64 %s, want %s", got.Base64(), tt.base64)
+			}
+			parsed, err := ParseBase64(algo, tt.base64)
+			if err != nil || !parsed.Equal(got) {
+				t.Errorf("ParseBase64 = %v, %v", parsed, err)
+			}
+		})
+	}
+
+	if _, err := ParseS3Algorithm("MD5"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("ParseS3Algorithm(MD5): %v, want ErrUnknownAlgorithm", err)
+	}
+	if _, err := ParseBase64(CRC32, "rosUhgp5mIg="); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("ParseBase64 of a CRC64 as CRC32: %v, want ErrInvalidValue", err)
+	}
+}
+
+func TestValueText(t *testing.T) {
+	c, _ := NewCalculator(CRC32C)
+	v, _ := c.Calculate(strings.NewReader("123456789"))
+	text, err := v.MarshalText()
+	if err != nil || string(text) != "crc32c:e3069283" {
+		t.Fatalf("MarshalText = %q, %v", text, err)
+	}
+	var got Value
+	if err := got.UnmarshalText(text); err != nil || !got.Equal(v) {
+		t.Fatalf("UnmarshalText = %v, %v", got, err)
+	}
+	for _, bad := range []string{"e3069283", "crc32c:zz", "crc32c:e30692", "adler32:00000000"} {
+		if err := got.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded", bad)
+		}
+	}
+}
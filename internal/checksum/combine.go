@@ -0,0 +1,152 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrNotCombinable is returned when checksums of an algorithm cannot be
+// combined across parts
+var ErrNotCombinable = errors.New("checksum algorithm cannot be combined")
+
+// Type says how the S3 checksum of a multipart object is derived
+type Type string
+
+const (
+	// TypeFullObject is a checksum of the object's data, computed for
+	// multipart objects by combining the part CRCs without rehashing
+	TypeFullObject Type = "FULL_OBJECT"
+
+	// TypeComposite is a checksum of the concatenated part checksums,
+	// reported with a "-<parts>" suffix
+	TypeComposite Type = "COMPOSITE"
+)
+
+// ParseType converts an x-amz-checksum-type value to a Type
+func ParseType(s string) (Type, error) {
+	switch t := Type(s); t {
+	case TypeFullObject, TypeComposite:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown checksum type %q", s)
+}
+
+// crcParams describes a reflected CRC with all-ones init and final XOR
+type crcParams struct {
+	poly  uint64 // reflected polynomial
+	width uint
+}
+
+var crcs = map[Algorithm]crcParams{
+	CRC32:     {poly: 0xedb88320, width: 32},
+	CRC32C:    {poly: 0x82f63b78, width: 32},
+	CRC64NVME: {poly: 0x9a6c9329ac4bc9b5, width: 64},
+}
+
+// SupportsType reports whether S3 allows the algorithm with checksum type t.
+// CRCs can be combined into full-object checksums; CRC64NVME only supports
+// that, and SHA digests only support composite checksums.
+func (a Algorithm) SupportsType(t Type) bool {
+	_, isCRC := crcs[a]
+	switch t {
+	case TypeFullObject:
+		return isCRC
+	case TypeComposite:
+		return a.IsS3() && a != CRC64NVME
+	}
+	return false
+}
+
+// DefaultType returns the checksum type S3 uses for multipart uploads of the
+// algorithm when the client does not choose one
+func (a Algorithm) DefaultType() Type {
+	if a == CRC64NVME {
+		return TypeFullObject
+	}
+	return TypeComposite
+}
+
+// Combine returns the checksum of the concatenation of two byte strings given
+// the checksum of each and the length of the second, without reading the
+// data. Only CRC algorithms can be combined.
+func Combine(first, second Value, secondLen int64) (Value, error) {
+	if first.Algorithm != second.Algorithm {
+		return Value{}, fmt.Errorf("combine %s with %s: algorithms differ", first.Algorithm, second.Algorithm)
+	}
+	p, ok := crcs[first.Algorithm]
+	if !ok {
+		return Value{}, fmt.Errorf("%w: %s", ErrNotCombinable, first.Algorithm)
+	}
+	if len(first.Sum) != int(p.width/8) || len(second.Sum) != int(p.width/8) {
+		return Value{}, ErrInvalidValue
+	}
+
+	crc1, crc2 := p.decode(first.Sum), p.decode(second.Sum)
+	crc := p.multModP(p.xPow8n(secondLen), crc1) ^ crc2
+	return Value{Algorithm: first.Algorithm, Sum: p.encode(crc)}, nil
+}
+
+// Composite returns the checksum of the concatenated raw part checksums, the
+// value S3 reports (with a "-<parts>" suffix) for COMPOSITE multipart objects
+func Composite(algo Algorithm, parts []Value) (Value, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return Value{}, err
+	}
+	for i, part := range parts {
+		if part.Algorithm != algo {
+			return Value{}, fmt.Errorf("part %d: expected %s checksum, got %q", i+1, algo, part.Algorithm)
+		}
+		h.Write(part.Sum)
+	}
+	return Value{Algorithm: algo, Sum: h.Sum(nil)}, nil
+}
+
+func (p crcParams) decode(sum []byte) uint64 {
+	if p.width == 32 {
+		return uint64(binary.BigEndian.Uint32(sum))
+	}
+	return binary.BigEndian.Uint64(sum)
+}
+
+func (p crcParams) encode(crc uint64) []byte {
+	if p.width == 32 {
+		return binary.BigEndian.AppendUint32(nil, uint32(crc))
+	}
+	return binary.BigEndian.AppendUint64(nil, crc)
+}
+
+// multModP returns a*b modulo the polynomial, in reflected bit order
+func (p crcParams) multModP(a, b uint64) uint64 {
+	m := uint64(1) << (p.width - 1)
+	var product uint64
+	for a != 0 {
+		if a&m != 0 {
+			product ^= b
+			a &^= m
+		}
+		m >>= 1
+		if b&1 != 0 {
+			b = (b >> 1) ^ p.poly
+		} else {
+			b >>= 1
+		}
+	}
+	return product
+}
+
+// xPow8n returns x^(8n) modulo the polynomial, the operator that shifts a
+// CRC past n zero bytes
+func (p crcParams) xPow8n(n int64) uint64 {
+	result := uint64(1) << (p.width - 1) // x^0
+	square := uint64(1) << (p.width - 9) // x^8
+	for n > 0 {
+		if n&1 != 0 {
+			result = p.multModP(square, result)
+		}
+		square = p.multModP(square, square)
+		n >>= 1
+	}
+	return result
+}
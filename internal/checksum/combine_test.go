@@ -0,0 +1,182 @@
+package checksum
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func sum(t *testing.T, algo Algorithm, data []byte) Value {
+	t.Helper()
+	c, err := NewCalculator(algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Calculate(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// testData returns n bytes that are not a repeating pattern of short period
+func testData(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x)
+	}
+	return data
+}
+
+func TestCombine(t *testing.T) {
+	data := testData(70000)
+	splits := []int{0, 1, 9, 64, 4095, 4096, 65536, 69999, 70000}
+	for _, algo := range []Algorithm{CRC32, CRC32C, CRC64NVME} {
+		whole := sum(t, algo, data)
+		for _, at := range splits {
+			first, second := sum(t, algo, data[:at]), sum(t, algo, data[at:])
+			got, err := Combine(first, second, int64(len(data)-at))
+			if err != nil {
+				t.Fatalf("%s split at %d: %v", algo, at, err)
+			}
+			if !got.Equal(whole) {
+				t.Errorf("%s split at %d: %s, want %s", algo, at, got.Hex(), whole.Hex())
+			}
+		}
+	}
+
+	// "1234" + "56789" combine to the check value
+	for _, tt := range golden {
+		if _, ok := crcs[tt.algo]; !ok || tt.data == "" {
+			continue
+		}
+		first := sum(t, tt.algo, []byte(tt.data[:4]))
+		second := sum(t, tt.algo, []byte(tt.data[4:]))
+		if got, _ := Combine(first, second, int64(len(tt.data)-4)); got.Hex() != tt.hex {
+			t.Errorf("%s: combined %s, want %s", tt.algo, got.Hex(), tt.hex)
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	crc := sum(t, CRC32, []byte("a"))
+	tests := []struct {
+		name          string
+		first, second Value
+		want          error
+	}{
+		{"SHA-256", sum(t, SHA256, []byte("a")), sum(t, SHA256, []byte("b")), ErrNotCombinable},
+		{"MD5", sum(t, MD5, []byte("a")), sum(t, MD5, []byte("b")), ErrNotCombinable},
+		{"short digest", Value{Algorithm: CRC32, Sum: []byte{1, 2}}, crc, ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Combine(tt.first, tt.second, 1); !errors.Is(err, tt.want) {
+				t.Errorf("Combine: %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if _, err := Combine(crc, sum(t, CRC32C, []byte("a")), 1); err == nil {
+		t.Error("Combine accepted checksums of different algorithms")
+	}
+}
+
+// TestMultipart derives checksums of multipart objects from their parts
+// the way CompleteMultipartUpload does
+func TestMultipart(t *testing.T) {
+	data := testData(5<<20 + 5<<20 + 1234)
+	sizes := []int{5 << 20, 5 << 20, 1234}
+	partData := make([][]byte, len(sizes))
+	for i, off := 0, 0; i < len(sizes); i++ {
+		partData[i] = data[off : off+sizes[i]]
+		off += sizes[i]
+	}
+
+	t.Run("full object", func(t *testing.T) {
+		for _, algo := range []Algorithm{CRC32, CRC32C, CRC64NVME} {
+			if !algo.SupportsType(TypeFullObject) {
+				t.Fatalf("%s does not support %s", algo, TypeFullObject)
+			}
+			combined := sum(t, algo, partData[0])
+			for _, part := range partData[1:] {
+				var err error
+				if combined, err = Combine(combined, sum(t, algo, part), int64(len(part))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if whole := sum(t, algo, data); !combined.Equal(whole) {
+				t.Errorf("%s: combined %s, want the object's %s", algo, combined.Hex(), whole.Hex())
+			}
+		}
+	})
+
+	t.Run("composite", func(t *testing.T) {
+		for _, algo := range []Algorithm{CRC32, CRC32C, SHA1, SHA256} {
+			if !algo.SupportsType(TypeComposite) {
+				t.Fatalf("%s does not support %s", algo, TypeComposite)
+			}
+			parts := make([]Value, len(partData))
+			var raw []byte
+			for i, part := range partData {
+				parts[i] = sum(t, algo, part)
+				raw = append(raw, parts[i].Sum...)
+			}
+			got, err := Composite(algo, parts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := sum(t, algo, raw); !got.Equal(want) {
+				t.Errorf("%s: composite %s, want %s", algo, got.Hex(), want.Hex())
+			}
+		}
+	})
+
+	t.Run("composite golden", func(t *testing.T) {
+		// The CRC32 of 3610a686 3a771143, the big-endian part CRCs of
+		// "hello" and "world"
+		parts := []Value{sum(t, CRC32, []byte("hello")), sum(t, CRC32, []byte("world"))}
+		got, err := Composite(CRC32, parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hex() != "c299fbb6" {
+			t.Errorf("composite %s, want c299fbb6", got.Hex())
+		}
+		if _, err := Composite(CRC32, []Value{parts[0], sum(t, CRC32C, []byte("world"))}); err == nil {
+			t.Error("Composite accepted a part checksum of another algorithm")
+		}
+	})
+}
+
+func TestSupportsType(t *testing.T) {
+	tests := []struct {
+		algo                Algorithm
+		fullObject, compose bool
+		defaultType         Type
+	}{
+		{CRC32, true, true, TypeComposite},
+		{CRC32C, true, true, TypeComposite},
+		{CRC64NVME, true, false, TypeFullObject},
+		{SHA1, false, true, TypeComposite},
+		{SHA256, false, true, TypeComposite},
+		{MD5, false, false, TypeComposite},
+		{XXHash, false, false, TypeComposite},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algo), func(t *testing.T) {
+			if got := tt.algo.SupportsType(TypeFullObject); got != tt.fullObject {
+				t.Errorf("SupportsType(%s) = %t", TypeFullObject, got)
+			}
+			if got := tt.algo.SupportsType(TypeComposite); got != tt.compose {
+				t.Errorf("SupportsType(%s) = %t", TypeComposite, got)
+			}
+			if tt.algo.IsS3() && tt.algo.DefaultType() != tt.defaultType {
+				t.Errorf("DefaultType = %s, want %s", tt.algo.DefaultType(), tt.defaultType)
+			}
+		})
+	}
+}
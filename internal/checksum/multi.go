@@ -0,0 +1,120 @@
+package checksum
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrMismatch is returned when computed data does not match an expected checksum
+var ErrMismatch = errors.New("checksum mismatch")
+
+// MismatchError describes which checksum failed verification
+type MismatchError struct {
+	Expected Value
+	Actual   Value
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s",
+		e.Expected.Algorithm, e.Expected.Hex(), e.Actual.Hex())
+}
+
+// Is makes errors.Is(err, ErrMismatch) match
+func (e *MismatchError) Is(target error) bool {
+	return target == ErrMismatch
+}
+
+// MultiHasher computes several checksums in a single pass over a stream.
+// It is an io.Writer; wrap a body with Reader to hash it while it is being
+// forwarded elsewhere, so large objects are never read twice.
+type MultiHasher struct {
+	algos  []Algorithm
+	hashes map[Algorithm]hash.Hash
+	writer io.Writer
+	size   int64
+}
+
+// NewMultiHasher creates a hasher for the given algorithms. Duplicates and
+// empty algorithm names are ignored.
+func NewMultiHasher(algos ...Algorithm) (*MultiHasher, error) {
+	m := &MultiHasher{hashes: make(map[Algorithm]hash.Hash, len(algos))}
+	writers := make([]io.Writer, 0, len(algos))
+	for _, algo := range algos {
+		if algo == "" {
+			continue
+		}
+		if _, ok := m.hashes[algo]; ok {
+			continue
+		}
+		h, err := NewHash(algo)
+		if err != nil {
+			return nil, err
+		}
+		m.algos = append(m.algos, algo)
+		m.hashes[algo] = h
+		writers = append(writers, h)
+	}
+	m.writer = io.MultiWriter(writers...)
+	return m, nil
+}
+
+// Write feeds p to every hash
+func (m *MultiHasher) Write(p []byte) (int, error) {
+	n, err := m.writer.Write(p)
+	m.size += int64(n)
+	return n, err
+}
+
+// Reader returns a reader that hashes everything read from r
+func (m *MultiHasher) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, m)
+}
+
+// Size returns the number of bytes hashed so far
+func (m *MultiHasher) Size() int64 {
+	return m.size
+}
+
+// Algorithms returns the algorithms being computed, in creation order
+func (m *MultiHasher) Algorithms() []Algorithm {
+	return m.algos
+}
+
+// Sum returns the current checksum for algo. The second result is false if
+// the hasher was not created with algo.
+func (m *MultiHasher) Sum(algo Algorithm) (Value, bool) {
+	h, ok := m.hashes[algo]
+	if !ok {
+		return Value{}, false
+	}
+	return Value{Algorithm: algo, Sum: h.Sum(nil)}, true
+}
+
+// Sums returns the current checksum for every algorithm
+func (m *MultiHasher) Sums() map[Algorithm]Value {
+	sums := make(map[Algorithm]Value, len(m.algos))
+	for _, algo := range m.algos {
+		sums[algo], _ = m.Sum(algo)
+	}
+	return sums
+}
+
+// Verify compares the hashed data against each expected value. Zero values
+// are skipped. A *MismatchError is returned for the first value that differs.
+func (m *MultiHasher) Verify(expected ...Value) error {
+	for _, want := range expected {
+		if want.IsZero() {
+			continue
+		}
+		got, ok := m.Sum(want.Algorithm)
+		if !ok {
+			return fmt.Errorf("%w: %s was not computed", ErrUnknownAlgorithm, want.Algorithm)
+		}
+		if !got.Equal(want) {
+			return &MismatchError{Expected: want, Actual: got}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package checksum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// S3Algorithms lists the algorithms accepted as S3 flexible checksums
+var S3Algorithms = []Algorithm{CRC32, CRC32C, CRC64NVME, SHA1, SHA256}
+
+// ParseS3Algorithm converts an S3 algorithm name (e.g. "CRC32C") to an Algorithm
+func ParseS3Algorithm(name string) (Algorithm, error) {
+	algo := Algorithm(strings.ToLower(name))
+	if !algo.IsS3() {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, name)
+	}
+	return algo, nil
+}
+
+// IsS3 reports whether the algorithm can be used as an S3 flexible checksum
+func (a Algorithm) IsS3() bool {
+	for _, algo := range S3Algorithms {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// S3Name returns the name S3 uses for the algorithm (e.g. "CRC64NVME")
+func (a Algorithm) S3Name() string {
+	return strings.ToUpper(string(a))
+}
+
+// S3Header returns the x-amz-checksum-* header carrying values of the algorithm
+func (a Algorithm) S3Header() string {
+	return "x-amz-checksum-" + string(a)
+}
@@ -0,0 +1,113 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidValue is returned when an encoded checksum cannot be parsed
+var ErrInvalidValue = errors.New("invalid checksum value")
+
+// Value is a computed checksum digest.
+//
+// Sum holds the raw digest bytes in big-endian order, exactly as returned by
+// hash.Hash.Sum. Raw bytes are never stored or sent anywhere directly; use Hex
+// for metadata columns and logs, and Base64 for S3 headers and XML bodies.
+type Value struct {
+	Algorithm Algorithm
+	Sum       []byte
+}
+
+// IsZero reports whether the value holds no digest
+func (v Value) IsZero() bool {
+	return len(v.Sum) == 0
+}
+
+// Hex returns the lowercase hex encoding of the digest
+func (v Value) Hex() string {
+	return hex.EncodeToString(v.Sum)
+}
+
+// Base64 returns the standard padded base64 encoding of the digest
+func (v Value) Base64() string {
+	return base64.StdEncoding.EncodeToString(v.Sum)
+}
+
+// String returns the canonical hex encoding of the digest
+func (v Value) String() string {
+	return v.Hex()
+}
+
+// Equal reports whether two values carry the same algorithm and digest
+func (v Value) Equal(other Value) bool {
+	return v.Algorithm == other.Algorithm && bytes.Equal(v.Sum, other.Sum)
+}
+
+// MarshalText encodes the value as "<algorithm>:<hex>"
+func (v Value) MarshalText() ([]byte, error) {
+	if v.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(string(v.Algorithm) + ":" + v.Hex()), nil
+}
+
+// UnmarshalText decodes a value produced by MarshalText
+func (v *Value) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*v = Value{}
+		return nil
+	}
+	algo, encoded, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return fmt.Errorf("%w: missing algorithm prefix", ErrInvalidValue)
+	}
+	parsed, err := ParseHex(Algorithm(algo), encoded)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+// ParseHex decodes a hex-encoded digest for the given algorithm
+func ParseHex(algo Algorithm, s string) (Value, error) {
+	sum, err := hex.DecodeString(strings.ToLower(s))
+	if err != nil {
+		return Value{}, fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	return newValue(algo, sum)
+}
+
+// ParseBase64 decodes a base64-encoded digest for the given algorithm
+func ParseBase64(algo Algorithm, s string) (Value, error) {
+	sum, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return Value{}, fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	return newValue(algo, sum)
+}
+
+// newValue checks the digest length against the algorithm's output size
+func newValue(algo Algorithm, sum []byte) (Value, error) {
+	want, err := Size(algo)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(sum) != want {
+		return Value{}, fmt.Errorf("%w: %s digest must be %d bytes, got %d", ErrInvalidValue, algo, want, len(sum))
+	}
+	return Value{Algorithm: algo, Sum: sum}, nil
+}
+
+// Size returns the digest length in bytes for the algorithm
+func Size(algo Algorithm) (int, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return 0, err
+	}
+	return h.Size(), nil
+}
@@ -0,0 +1,332 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/merkle"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client talks to the storage service of a single data node
+type Client interface {
+	// Put streams a replica of the object at ring position token to the node
+	// and returns what the node stored
+	Put(ctx context.Context, key string, token uint64, r io.Reader) (*ReplicaInfo, error)
+
+	// Get reads length bytes of a replica starting at offset (-1 reads to the
+	// end). Data is verified block by block on the node; reading past a
+	// corrupt block returns a *CorruptBlockError.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns replica metadata
+	Stat(ctx context.Context, key string) (*ReplicaInfo, error)
+
+	// Delete removes a replica
+	Delete(ctx context.Context, key string) error
+
+	// DeleteIfUnmodified removes a replica only if it was last written at
+	// modTime, and returns ErrModified otherwise
+	DeleteIfUnmodified(ctx context.Context, key string, modTime time.Time) error
+
+	// Verify checks a whole replica and returns the corrupt block ranges
+	Verify(ctx context.Context, key string) ([]BlockRange, error)
+
+	// Compose builds a replica from replicas already on the node
+	Compose(ctx context.Context, key string, sources []string) (*ReplicaInfo, error)
+
+	// Quarantine sets a corrupt replica aside; it is no longer served
+	Quarantine(ctx context.Context, key string) error
+
+	// Digests returns the Merkle digests of ring ranges of the node's
+	// inventory; Client satisfies merkle.Source
+	Digests(ctx context.Context, ranges []merkle.Range) ([]merkle.Digest, error)
+
+	// List returns the replicas in a ring range
+	List(ctx context.Context, r merkle.Range) ([]ReplicaInfo, error)
+
+	// Health probes the node, checking that it is nodeID
+	Health(ctx context.Context, nodeID string) (*HealthResponse, error)
+
+	// Close releases the connection
+	Close() error
+}
+
+// grpcClient implements Client over a gRPC connection
+type grpcClient struct {
+	conn *grpc.ClientConn
+}
+
+// Dial creates a client for the data node at addr. The connection is
+// established lazily on first use.
+func Dial(addr string) (Client, error) {
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial data node %s: %w", addr, err)
+	}
+	return &grpcClient{conn: conn}, nil
+}
+
+func (c *grpcClient) Put(ctx context.Context, key string, token uint64, r io.Reader) (*ReplicaInfo, error) {
+	// Cancelling the stream (rather than closing it) on a read error makes
+	// the node discard the partial replica.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Put")
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.SendMsg(&PutRequest{Key: key, Token: token}); err != nil {
+		return nil, c.streamError(stream, err)
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.SendMsg(&PutRequest{Data: buf[:n]}); err != nil {
+				return nil, c.streamError(stream, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return nil, fromStatus(err)
+	}
+	resp := &PutResponse{}
+	if err := stream.RecvMsg(resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return &resp.Replica, nil
+}
+
+// streamError returns the server's status when SendMsg fails with io.EOF
+func (c *grpcClient) streamError(stream grpc.ClientStream, err error) error {
+	if err == io.EOF {
+		if recvErr := stream.RecvMsg(&PutResponse{}); recvErr != nil {
+			return fromStatus(recvErr)
+		}
+	}
+	return fromStatus(err)
+}
+
+func (c *grpcClient) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[1], "/"+serviceName+"/Get")
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	if err := stream.SendMsg(&GetRequest{Key: key, Offset: offset, Length: length}); err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+
+	// Receive the first chunk eagerly so missing replicas fail here rather
+	// than on the first Read.
+	r := &getStreamReader{key: key, stream: stream, cancel: cancel}
+	first := &GetResponse{}
+	if err := stream.RecvMsg(first); err != nil {
+		if err != io.EOF {
+			cancel()
+			return nil, fromStatus(err)
+		}
+		r.err = io.EOF
+	}
+	r.accept(first)
+	return r, nil
+}
+
+// getStreamReader adapts the Get response stream to an io.ReadCloser
+type getStreamReader struct {
+	key    string
+	stream grpc.ClientStream
+	buf    []byte
+	err    error // returned once buf is drained
+	cancel context.CancelFunc
+}
+
+// accept buffers a received message
+func (r *getStreamReader) accept(msg *GetResponse) {
+	r.buf = msg.Data
+	if msg.Corrupt != nil {
+		r.err = &CorruptBlockError{Key: r.key, Block: *msg.Corrupt}
+	}
+}
+
+func (r *getStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		msg := &GetResponse{}
+		if err := r.stream.RecvMsg(msg); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, fromStatus(err)
+		}
+		r.accept(msg)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *getStreamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (c *grpcClient) Stat(ctx context.Context, key string) (*ReplicaInfo, error) {
+	resp := &StatResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Stat", &StatRequest{Key: key}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return &resp.Replica, nil
+}
+
+func (c *grpcClient) Delete(ctx context.Context, key string) error {
+	resp := &DeleteResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Delete", &DeleteRequest{Key: key}, resp); err != nil {
+		return fromStatus(err)
+	}
+	return nil
+}
+
+func (c *grpcClient) DeleteIfUnmodified(ctx context.Context, key string, modTime time.Time) error {
+	resp := &DeleteResponse{}
+	req := &DeleteRequest{Key: key, IfModTime: modTime}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Delete", req, resp); err != nil {
+		return fromStatus(err)
+	}
+	return nil
+}
+
+func (c *grpcClient) Verify(ctx context.Context, key string) ([]BlockRange, error) {
+	resp := &VerifyResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Verify", &VerifyRequest{Key: key}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.BadBlocks, nil
+}
+
+func (c *grpcClient) Compose(ctx context.Context, key string, sources []string) (*ReplicaInfo, error) {
+	resp := &ComposeResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Compose", &ComposeRequest{Key: key, Sources: sources}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return &resp.Replica, nil
+}
+
+func (c *grpcClient) Quarantine(ctx context.Context, key string) error {
+	resp := &QuarantineResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Quarantine", &QuarantineRequest{Key: key}, resp); err != nil {
+		return fromStatus(err)
+	}
+	return nil
+}
+
+func (c *grpcClient) Digests(ctx context.Context, ranges []merkle.Range) ([]merkle.Digest, error) {
+	resp := &DigestsResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Digests", &DigestsRequest{Ranges: ranges}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.Digests, nil
+}
+
+func (c *grpcClient) List(ctx context.Context, r merkle.Range) ([]ReplicaInfo, error) {
+	resp := &ListResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/List", &ListRequest{Range: r}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.Replicas, nil
+}
+
+func (c *grpcClient) Health(ctx context.Context, nodeID string) (*HealthResponse, error) {
+	resp := &HealthResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Health", &HealthRequest{NodeID: nodeID}, resp); err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp, nil
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// Pool holds one client per data node, keyed by node ID
+type Pool struct {
+	mu      sync.Mutex
+	addrs   map[string]string
+	clients map[string]Client
+}
+
+// NewPool creates an empty client pool
+func NewPool() *Pool {
+	return &Pool{
+		addrs:   make(map[string]string),
+		clients: make(map[string]Client),
+	}
+}
+
+// Add registers the address of a data node
+func (p *Pool) Add(nodeID, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs[nodeID] = addr
+}
+
+// Get returns the client for a node, dialing it on first use
+func (p *Pool) Get(nodeID string) (Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c, ok := p.clients[nodeID]; ok {
+		return c, nil
+	}
+	addr, ok := p.addrs[nodeID]
+	if !ok {
+		return nil, fmt.Errorf("unknown data node %q", nodeID)
+	}
+	c, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[nodeID] = c
+	return c, nil
+}
+
+// Close closes every client in the pool
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for id, c := range p.clients {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.clients, id)
+	}
+	return firstErr
+}
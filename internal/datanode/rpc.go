@@ -0,0 +1,164 @@
+package datanode
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/merkle"
+	"google.golang.org/grpc/encoding"
+)
+
+// The storage service is described by hand (see service.go) and its messages
+// are plain Go structs encoded with gob, so there is no protobuf code
+// generation step. Clients select the codec with grpc.CallContentSubtype.
+
+const (
+	serviceName = "plinth.datanode.Storage"
+	codecName   = "gob"
+
+	// chunkSize is the payload size of each streamed message
+	chunkSize = 1 << 20
+)
+
+// PutRequest streams a replica to a data node. The first message carries the
+// key and the ring position of the object the replica belongs to; every
+// message may carry data.
+type PutRequest struct {
+	Key   string
+	Token uint64
+	Data  []byte
+}
+
+// PutResponse is returned once the replica is durable
+type PutResponse struct {
+	Replica ReplicaInfo
+}
+
+// GetRequest reads Length bytes of a replica starting at Offset. A negative
+// Length reads to the end of the replica.
+type GetRequest struct {
+	Key    string
+	Offset int64
+	Length int64
+}
+
+// GetResponse carries one chunk of verified replica data. When a block fails
+// verification the node sends a final message with Corrupt set and ends the
+// stream; every byte sent before it was verified.
+type GetResponse struct {
+	Data    []byte
+	Corrupt *BlockRange
+}
+
+// StatRequest asks for a replica's metadata
+type StatRequest struct {
+	Key string
+}
+
+// StatResponse describes a replica
+type StatResponse struct {
+	Replica ReplicaInfo
+}
+
+// DeleteRequest removes a replica. If IfModTime is set, the replica is only
+// removed if it was last written at that time.
+type DeleteRequest struct {
+	Key       string
+	IfModTime time.Time
+}
+
+// DeleteResponse acknowledges a delete
+type DeleteResponse struct {
+	Key string
+}
+
+// VerifyRequest asks a node to check a whole replica against its checksums
+type VerifyRequest struct {
+	Key string
+}
+
+// VerifyResponse lists the blocks that failed verification
+type VerifyResponse struct {
+	Key       string
+	BadBlocks []BlockRange
+}
+
+// ComposeRequest asks a node to build a replica by concatenating replicas it
+// already holds, in order
+type ComposeRequest struct {
+	Key     string
+	Sources []string
+}
+
+// ComposeResponse is returned once the composed replica is durable
+type ComposeResponse struct {
+	Replica ReplicaInfo
+}
+
+// QuarantineRequest asks a node to set a corrupt replica aside
+type QuarantineRequest struct {
+	Key string
+}
+
+// QuarantineResponse acknowledges a quarantine
+type QuarantineResponse struct {
+	Key string
+}
+
+// DigestsRequest asks for the Merkle digests of ring ranges of the node's
+// inventory
+type DigestsRequest struct {
+	Ranges []merkle.Range
+}
+
+// DigestsResponse carries one digest per requested range, in order
+type DigestsResponse struct {
+	Digests []merkle.Digest
+}
+
+// ListRequest asks for the replicas in a ring range
+type ListRequest struct {
+	Range merkle.Range
+}
+
+// ListResponse describes every replica in the range
+type ListResponse struct {
+	Replicas []ReplicaInfo
+}
+
+// HealthRequest probes a data node. NodeID is the ID the caller knows the
+// node by; a node with a different ID refuses, so a misconfigured address
+// never passes for another node.
+type HealthRequest struct {
+	NodeID string
+}
+
+// HealthResponse reports who answered and how many replicas it holds
+type HealthResponse struct {
+	NodeID   string
+	Replicas int
+}
+
+// gobCodec implements grpc encoding.Codec with encoding/gob
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
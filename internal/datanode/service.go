@@ -0,0 +1,368 @@
+package datanode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storageServer is the handler type checked by grpc.Server.RegisterService
+type storageServer interface {
+	stat(ctx context.Context, req *StatRequest) (*StatResponse, error)
+	delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error)
+	verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error)
+	compose(ctx context.Context, req *ComposeRequest) (*ComposeResponse, error)
+	quarantine(ctx context.Context, req *QuarantineRequest) (*QuarantineResponse, error)
+	digests(ctx context.Context, req *DigestsRequest) (*DigestsResponse, error)
+	list(ctx context.Context, req *ListRequest) (*ListResponse, error)
+	health(ctx context.Context, req *HealthRequest) (*HealthResponse, error)
+	put(stream grpc.ServerStream) error
+	get(stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*storageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Stat", Handler: statHandler},
+		{MethodName: "Delete", Handler: deleteHandler},
+		{MethodName: "Verify", Handler: verifyHandler},
+		{MethodName: "Compose", Handler: composeHandler},
+		{MethodName: "Quarantine", Handler: quarantineHandler},
+		{MethodName: "Digests", Handler: digestsHandler},
+		{MethodName: "List", Handler: listHandler},
+		{MethodName: "Health", Handler: healthHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Put", Handler: putHandler, ClientStreams: true},
+		{StreamName: "Get", Handler: getHandler, ServerStreams: true},
+	},
+}
+
+// Server exposes a Store over gRPC
+type Server struct {
+	nodeID string
+	store  *Store
+}
+
+// NewServer creates a storage service for the given store
+func NewServer(nodeID string, store *Store) *Server {
+	return &Server{nodeID: nodeID, store: store}
+}
+
+// Register adds the storage service to a gRPC server
+func (s *Server) Register(g *grpc.Server) {
+	g.RegisterService(&serviceDesc, s)
+}
+
+func (s *Server) stat(ctx context.Context, req *StatRequest) (*StatResponse, error) {
+	info, err := s.store.Stat(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &StatResponse{Replica: *info}, nil
+}
+
+func (s *Server) delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	var err error
+	if req.IfModTime.IsZero() {
+		err = s.store.Delete(req.Key)
+	} else {
+		err = s.store.DeleteIfUnmodified(req.Key, req.IfModTime)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteResponse{Key: req.Key}, nil
+}
+
+func (s *Server) verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	bad, err := s.store.Verify(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	for _, b := range bad {
+		log.Printf("node %s: replica %s corrupt at offset %d (%d bytes)", s.nodeID, req.Key, b.Offset, b.Length)
+	}
+	return &VerifyResponse{Key: req.Key, BadBlocks: bad}, nil
+}
+
+func (s *Server) compose(ctx context.Context, req *ComposeRequest) (*ComposeResponse, error) {
+	if req.Key == "" || len(req.Sources) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "compose needs a key and at least one source")
+	}
+	info, err := s.store.Compose(req.Key, req.Sources)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &ComposeResponse{Replica: *info}, nil
+}
+
+func (s *Server) quarantine(ctx context.Context, req *QuarantineRequest) (*QuarantineResponse, error) {
+	if err := s.store.Quarantine(req.Key); err != nil {
+		return nil, toStatus(err)
+	}
+	log.Printf("node %s: replica %s quarantined", s.nodeID, req.Key)
+	return &QuarantineResponse{Key: req.Key}, nil
+}
+
+func (s *Server) digests(ctx context.Context, req *DigestsRequest) (*DigestsResponse, error) {
+	return &DigestsResponse{Digests: s.store.Digests(req.Ranges)}, nil
+}
+
+func (s *Server) list(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	replicas, err := s.store.List(req.Range)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ListResponse{Replicas: make([]ReplicaInfo, len(replicas))}
+	for i, info := range replicas {
+		resp.Replicas[i] = *info
+	}
+	return resp, nil
+}
+
+func (s *Server) health(ctx context.Context, req *HealthRequest) (*HealthResponse, error) {
+	if req.NodeID != "" && req.NodeID != s.nodeID {
+		return nil, status.Errorf(codes.FailedPrecondition, "this is node %s, not %s", s.nodeID, req.NodeID)
+	}
+	return &HealthResponse{NodeID: s.nodeID, Replicas: s.store.Len()}, nil
+}
+
+func (s *Server) put(stream grpc.ServerStream) error {
+	first := &PutRequest{}
+	if err := stream.RecvMsg(first); err != nil {
+		return err
+	}
+	if first.Key == "" {
+		return status.Error(codes.InvalidArgument, "missing replica key")
+	}
+
+	info, err := s.store.Put(first.Key, first.Token, &putStreamReader{stream: stream, buf: first.Data})
+	if err != nil {
+		return toStatus(err)
+	}
+	return stream.SendMsg(&PutResponse{Replica: *info})
+}
+
+func (s *Server) get(stream grpc.ServerStream) error {
+	req := &GetRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+
+	info, err := s.store.Stat(req.Key)
+	if err != nil {
+		return toStatus(err)
+	}
+	if req.Offset < 0 || req.Offset > info.Size {
+		return status.Errorf(codes.OutOfRange, "offset %d outside replica of %d bytes", req.Offset, info.Size)
+	}
+
+	r, _, err := s.store.OpenRange(req.Key, req.Offset, req.Length)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.SendMsg(&GetResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		var corrupt *CorruptBlockError
+		if errors.As(err, &corrupt) {
+			log.Printf("node %s: %v", s.nodeID, corrupt)
+			if err := stream.SendMsg(&GetResponse{Corrupt: &corrupt.Block}); err != nil {
+				return err
+			}
+			return status.Error(codes.DataLoss, corrupt.Error())
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+// putStreamReader adapts the Put request stream to an io.Reader
+type putStreamReader struct {
+	stream grpc.ServerStream
+	buf    []byte
+}
+
+func (r *putStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg := &PutRequest{}
+		if err := r.stream.RecvMsg(msg); err != nil {
+			return 0, err
+		}
+		r.buf = msg.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// toStatus converts store errors to gRPC status errors
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrCorrupt):
+		return status.Error(codes.DataLoss, err.Error())
+	case errors.Is(err, ErrModified):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// fromStatus converts gRPC status errors back to store errors
+func fromStatus(err error) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %s", ErrNotFound, status.Convert(err).Message())
+	case codes.DataLoss:
+		return fmt.Errorf("%w: %s", ErrCorrupt, status.Convert(err).Message())
+	case codes.Aborted:
+		return fmt.Errorf("%w: %s", ErrModified, status.Convert(err).Message())
+	}
+	return err
+}
+
+// gRPC method handlers
+
+func statHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &StatRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).stat(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Stat"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).stat(ctx, req.(*StatRequest))
+	})
+}
+
+func deleteHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &DeleteRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).delete(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Delete"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).delete(ctx, req.(*DeleteRequest))
+	})
+}
+
+func verifyHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &VerifyRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).verify(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Verify"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).verify(ctx, req.(*VerifyRequest))
+	})
+}
+
+func composeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &ComposeRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).compose(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Compose"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).compose(ctx, req.(*ComposeRequest))
+	})
+}
+
+func quarantineHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &QuarantineRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).quarantine(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Quarantine"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).quarantine(ctx, req.(*QuarantineRequest))
+	})
+}
+
+func digestsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &DigestsRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).digests(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Digests"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).digests(ctx, req.(*DigestsRequest))
+	})
+}
+
+func listHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &ListRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).list(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/List"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).list(ctx, req.(*ListRequest))
+	})
+}
+
+func healthHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &HealthRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(storageServer).health(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/Health"}
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(storageServer).health(ctx, req.(*HealthRequest))
+	})
+}
+
+func putHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(storageServer).put(stream)
+}
+
+func getHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(storageServer).get(stream)
+}
@@ -0,0 +1,716 @@
+package datanode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/merkle"
+)
+
+var (
+	// ErrNotFound is returned when a replica does not exist on the node
+	ErrNotFound = errors.New("replica not found")
+
+	// ErrCorrupt is returned when replica data fails checksum verification
+	ErrCorrupt = errors.New("replica corrupt")
+
+	// ErrModified is returned by a conditional delete when the replica has
+	// been rewritten since it was inspected
+	ErrModified = errors.New("replica modified")
+)
+
+// blockAlgorithm is the checksum used for per-block replica checksums
+const blockAlgorithm = checksum.XXHash
+
+// ReplicaInfo describes a replica stored on a data node
+type ReplicaInfo struct {
+	Key       string
+	Token     uint64 // ring position of the object the replica belongs to
+	Size      int64
+	Checksum  checksum.Value // xxHash of the replica data
+	BlockSize int64          // 0 when the replica has no block checksums
+	ModTime   time.Time
+}
+
+// sidecarFormat is the format of sidecars that hold the block checksums and
+// whose data file is stamped with the replica's ModTime. Sidecars without a
+// format predate it and keep the checksums in a .blocks file.
+const sidecarFormat = 1
+
+// sidecar is the content of a replica's .meta file
+type sidecar struct {
+	ReplicaInfo
+	Format    int    `json:",omitempty"`
+	BlockSums []byte `json:",omitempty"` // raw digest of every block
+}
+
+// errMismatch is returned when a data file is not the one its sidecar
+// describes, because the replica is being replaced or a crash interrupted
+// the replacement
+var errMismatch = errors.New("replica data does not match its metadata")
+
+// Open retries while the data file does not match its sidecar, which lasts
+// only as long as the rename between them when a Put is in flight
+const (
+	openAttempts   = 5
+	openRetryDelay = 10 * time.Millisecond
+)
+
+// BlockRange is a byte range [Offset, Offset+Length) of a replica
+type BlockRange struct {
+	Offset int64
+	Length int64
+}
+
+// CorruptBlockError reports a block whose data does not match its checksum
+type CorruptBlockError struct {
+	Key   string
+	Block BlockRange
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf("replica %s: corrupt block at offset %d (%d bytes)", e.Key, e.Block.Offset, e.Block.Length)
+}
+
+// Is makes errors.Is(err, ErrCorrupt) match
+func (e *CorruptBlockError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// Store keeps replicas on local disk.
+//
+// Layout:
+//
+//	<root>/objects/ab/cd/abcd1234...       replica data
+//	<root>/objects/ab/cd/abcd1234....meta  JSON-encoded ReplicaInfo and block checksums
+//	<root>/tmp/                            in-flight writes, cleared when the store opens
+//	<root>/quarantine/                     corrupt replicas set aside by the scrubber
+//
+// File names are the SHA-256 of the replica key, so keys may contain any
+// characters. A replica is published by renaming its .meta sidecar and then
+// its data into place. The data file is stamped with the replica's ModTime,
+// so a reader that finds the other version of the data behind a sidecar
+// waits for the second rename, and a replica whose second rename a crash
+// prevented is dropped when the store opens.
+//
+// Block checksums let a range of a large replica be verified by reading only
+// the blocks it overlaps.
+//
+// The store also keeps a Merkle tree over its inventory, rebuilt from the
+// sidecars when the store is opened, so anti-entropy can compare ring ranges
+// with other nodes without walking the disk.
+type Store struct {
+	root string
+	tree *merkle.Tree
+}
+
+const (
+	objectsDir    = "objects"
+	tmpDir        = "tmp"
+	quarantineDir = "quarantine"
+	metaSuffix    = ".meta"
+	blocksSuffix  = ".blocks"
+)
+
+// NewStore opens (creating if necessary) a store rooted at dir
+func NewStore(dir string) (*Store, error) {
+	for _, sub := range []string{objectsDir, tmpDir, quarantineDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	// Writes in flight when the node stopped are abandoned
+	tmp, err := os.ReadDir(filepath.Join(dir, tmpDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range tmp {
+		if err := os.RemoveAll(filepath.Join(dir, tmpDir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store{root: dir, tree: merkle.New(merkle.DefaultDepth)}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load inventory: %w", err)
+	}
+	return s, nil
+}
+
+// load builds the Merkle tree from the sidecars, removing what a crash left
+// half written or half deleted: sidecars whose data is missing or is not the
+// data they describe, and files that have no sidecar
+func (s *Store) load() error {
+	return filepath.WalkDir(filepath.Join(s.root, objectsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		base, isMeta := strings.CutSuffix(path, metaSuffix)
+		if !isMeta {
+			base = strings.TrimSuffix(path, blocksSuffix)
+			if _, err := os.Stat(base + metaSuffix); !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			log.Printf("store %s: removing %s, which has no sidecar", s.root, path)
+			return os.Remove(path)
+		}
+
+		sc, err := readMeta(base)
+		if err != nil {
+			return err
+		}
+		f, err := openData(base, sc)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, errMismatch) {
+			log.Printf("store %s: dropping replica %s: %v", s.root, sc.Key, err)
+			return removeReplica(base)
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+		s.tree.Put(sc.Key, sc.Token, sc.Checksum.Sum)
+		return nil
+	})
+}
+
+// path returns the data file path for a replica key
+func (s *Store) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.root, objectsDir, name[0:2], name[2:4], name)
+}
+
+// Put writes a replica placed on the ring at token from r, computing its
+// whole-replica and per-block checksums in the same pass. An existing replica
+// with the same key is replaced atomically.
+func (s *Store) Put(key string, token uint64, r io.Reader) (*ReplicaInfo, error) {
+	hasher, err := checksum.NewMultiHasher(checksum.XXHash)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(s.root, tmpDir), "put-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var sums bytes.Buffer
+	blocks, err := checksum.NewBlockHasher(blockAlgorithm, checksum.DefaultBlockSize, &sums)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(io.MultiWriter(tmp, blocks), hasher.Reader(r)); err != nil {
+		return nil, err
+	}
+	if err := blocks.Close(); err != nil {
+		return nil, err
+	}
+	// The data file's modification time is what ties it to its sidecar
+	now := time.Now()
+	if err := os.Chtimes(tmp.Name(), now, now); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	sum, _ := hasher.Sum(checksum.XXHash)
+	info := &ReplicaInfo{
+		Key:       key,
+		Token:     token,
+		Size:      hasher.Size(),
+		Checksum:  sum,
+		BlockSize: checksum.DefaultBlockSize,
+		ModTime:   fi.ModTime().UTC(),
+	}
+
+	dst := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	sc := &sidecar{ReplicaInfo: *info, Format: sidecarFormat, BlockSums: sums.Bytes()}
+	if err := s.writeMeta(dst, sc); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(dst + blocksSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return nil, err
+	}
+	s.tree.Put(key, token, sum.Sum)
+	return info, nil
+}
+
+// syncDir makes the renames into dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeMeta atomically writes the sidecar for the data file at dst
+func (s *Store) writeMeta(dst string, sc *sidecar) error {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(s.root, tmpDir), "meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst+metaSuffix)
+}
+
+// readMeta loads the sidecar for the data file at path
+func readMeta(path string) (*sidecar, error) {
+	data, err := os.ReadFile(path + metaSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := &sidecar{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("corrupt replica metadata %s: %w", path, err)
+	}
+	return sc, nil
+}
+
+// openData opens the data file at path, checking that it is the one sc
+// describes
+func openData(path string, sc *sidecar) (*os.File, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sc.Format < sidecarFormat {
+		return f, nil // data written before it was stamped
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != sc.Size || !fi.ModTime().Equal(sc.ModTime) {
+		f.Close()
+		return nil, errMismatch
+	}
+	return f, nil
+}
+
+// Stat returns information about a replica
+func (s *Store) Stat(key string) (*ReplicaInfo, error) {
+	sc, err := readMeta(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return &sc.ReplicaInfo, nil
+}
+
+// Open opens a replica for reading
+func (s *Store) Open(key string) (*os.File, *ReplicaInfo, error) {
+	f, sc, err := s.open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, &sc.ReplicaInfo, nil
+}
+
+// open opens a replica's data and returns its sidecar, waiting out a Put
+// that has renamed the sidecar but not yet the data
+func (s *Store) open(key string) (*os.File, *sidecar, error) {
+	path := s.path(key)
+	for attempt := 1; ; attempt++ {
+		sc, err := readMeta(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		f, err := openData(path, sc)
+		if err == nil {
+			return f, sc, nil
+		}
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, errMismatch) {
+			return nil, nil, err
+		}
+		if attempt == openAttempts {
+			if errors.Is(err, errMismatch) {
+				return nil, nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, key, err)
+			}
+			return nil, nil, err
+		}
+		time.Sleep(openRetryDelay)
+	}
+}
+
+// Delete removes a replica. Deleting a missing replica is not an error.
+func (s *Store) Delete(key string) error {
+	s.tree.Remove(key)
+	return removeReplica(s.path(key))
+}
+
+// removeReplica removes the files of the replica whose data file is at path,
+// sidecar first
+func removeReplica(path string) error {
+	for _, name := range []string{path + metaSuffix, path + blocksSuffix, path} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteIfUnmodified removes a replica only if it was last written at
+// modTime, so a replica judged garbage is not lost if it has been rewritten
+// since. A missing replica is not an error.
+func (s *Store) DeleteIfUnmodified(key string, modTime time.Time) error {
+	info, err := s.Stat(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime.Equal(modTime) {
+		return ErrModified
+	}
+	return s.Delete(key)
+}
+
+// Quarantine moves a replica out of the store without deleting it, so a
+// corrupt replica stops being served but can still be inspected. The
+// replica keeps its file names under <root>/quarantine; quarantining a key
+// again replaces the earlier copy.
+func (s *Store) Quarantine(key string) error {
+	path := s.path(key)
+	if _, err := readMeta(path); err != nil {
+		return err
+	}
+	s.tree.Remove(key)
+
+	dst := filepath.Join(s.root, quarantineDir, filepath.Base(path))
+	// Move the sidecar first so the replica disappears before its data does
+	for _, suffix := range []string{metaSuffix, blocksSuffix, ""} {
+		if err := os.Rename(path+suffix, dst+suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compose writes a replica made of the source replicas concatenated in
+// order, as when completing a multipart upload. Every source block is
+// verified as it is read; the sources are left in place. The replica takes
+// the token of the first source, since parts are placed like their object.
+func (s *Store) Compose(key string, sources []string) (*ReplicaInfo, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("compose needs at least one source")
+	}
+	first, err := s.Stat(sources[0])
+	if err != nil {
+		return nil, fmt.Errorf("compose source %s: %w", sources[0], err)
+	}
+	r := &composeReader{store: s, sources: sources}
+	defer r.Close()
+	return s.Put(key, first.Token, r)
+}
+
+// composeReader reads a sequence of replicas, opening one at a time
+type composeReader struct {
+	store   *Store
+	sources []string
+	cur     io.ReadCloser
+}
+
+func (r *composeReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.sources) == 0 {
+				return 0, io.EOF
+			}
+			cur, _, err := r.store.OpenRange(r.sources[0], 0, -1)
+			if err != nil {
+				return 0, fmt.Errorf("compose source %s: %w", r.sources[0], err)
+			}
+			r.cur = cur
+			r.sources = r.sources[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *composeReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// Walk calls fn for every replica in the store
+func (s *Store) Walk(fn func(*ReplicaInfo) error) error {
+	return filepath.WalkDir(filepath.Join(s.root, objectsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		sc, err := readMeta(strings.TrimSuffix(path, metaSuffix))
+		if errors.Is(err, ErrNotFound) {
+			return nil // deleted while walking
+		}
+		if err != nil {
+			return err
+		}
+		return fn(&sc.ReplicaInfo)
+	})
+}
+
+// Len returns the number of replicas in the store
+func (s *Store) Len() int {
+	return s.tree.Len()
+}
+
+// Digests returns the Merkle digest of each ring range
+func (s *Store) Digests(ranges []merkle.Range) []merkle.Digest {
+	digests := make([]merkle.Digest, len(ranges))
+	for i, r := range ranges {
+		digests[i] = s.tree.Digest(r)
+	}
+	return digests
+}
+
+// List returns the replicas whose tokens lie in a ring range
+func (s *Store) List(r merkle.Range) ([]*ReplicaInfo, error) {
+	var replicas []*ReplicaInfo
+	for _, key := range s.tree.Keys(r) {
+		info, err := s.Stat(key)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since the tree was read
+		}
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, info)
+	}
+	return replicas, nil
+}
+
+// OpenRange opens length bytes of a replica starting at offset (-1 reads to
+// the end). Every block the range overlaps is read whole and verified before
+// any of its bytes are returned; a failing block yields a *CorruptBlockError.
+func (s *Store) OpenRange(key string, offset, length int64) (io.ReadCloser, *ReplicaInfo, error) {
+	f, sc, err := s.open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &sc.ReplicaInfo
+	if offset < 0 || offset > info.Size {
+		f.Close()
+		return nil, nil, fmt.Errorf("offset %d outside replica of %d bytes", offset, info.Size)
+	}
+	end := info.Size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+
+	r := &blockReader{key: key, data: f, sums: sc.BlockSums, info: info, offset: offset, end: end}
+	if info.BlockSize > 0 && sc.Format < sidecarFormat {
+		sums, err := os.ReadFile(s.path(key) + blocksSuffix)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%w: %s: missing block checksums: %v", ErrCorrupt, key, err)
+		}
+		r.sums = sums
+	}
+	return r, info, nil
+}
+
+// Verify reads a whole replica and returns the ranges of every block that
+// fails verification. If every block passes but the data does not match the
+// whole-replica checksum, or the replica has no block checksums and fails
+// that checksum, the whole replica is reported as a single range.
+func (s *Store) Verify(key string) ([]BlockRange, error) {
+	rc, info, err := s.OpenRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	r := rc.(*blockReader)
+
+	if info.BlockSize == 0 {
+		calc, err := checksum.NewCalculator(info.Checksum.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := calc.Verify(r, info.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return []BlockRange{{Offset: 0, Length: info.Size}}, nil
+		}
+		return nil, nil
+	}
+
+	whole, err := checksum.NewHash(info.Checksum.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var bad []BlockRange
+	for i := int64(0); i < checksum.BlockCount(info.Size, info.BlockSize); i++ {
+		block, err := r.readBlock(i)
+		var corrupt *CorruptBlockError
+		if errors.As(err, &corrupt) {
+			bad = append(bad, corrupt.Block)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		whole.Write(block)
+	}
+	if len(bad) == 0 && !bytes.Equal(whole.Sum(nil), info.Checksum.Sum) {
+		return []BlockRange{{Offset: 0, Length: info.Size}}, nil
+	}
+	return bad, nil
+}
+
+// blockReader returns replica data one verified block at a time
+type blockReader struct {
+	key     string
+	data    *os.File
+	sums    []byte // raw digest of every block
+	info    *ReplicaInfo
+	offset  int64
+	end     int64
+	buf     []byte
+	pending []byte
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.offset >= r.end {
+			return 0, io.EOF
+		}
+		if r.info.BlockSize == 0 {
+			n := int64(len(p))
+			if remaining := r.end - r.offset; n > remaining {
+				n = remaining
+			}
+			n2, err := r.data.ReadAt(p[:n], r.offset)
+			r.offset += int64(n2)
+			if err == io.EOF && n2 > 0 {
+				err = nil
+			}
+			return n2, err
+		}
+
+		index := r.offset / r.info.BlockSize
+		block, err := r.readBlock(index)
+		if err != nil {
+			return 0, err
+		}
+		start := index * r.info.BlockSize
+		stop := start + int64(len(block))
+		if stop > r.end {
+			stop = r.end
+		}
+		r.pending = block[r.offset-start : stop-start]
+		r.offset = stop
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readBlock reads and verifies block index
+func (r *blockReader) readBlock(index int64) ([]byte, error) {
+	start := index * r.info.BlockSize
+	length := r.info.BlockSize
+	if remaining := r.info.Size - start; length > remaining {
+		length = remaining
+	}
+	if int64(cap(r.buf)) < length {
+		r.buf = make([]byte, r.info.BlockSize)
+	}
+	block := r.buf[:length]
+	corrupt := &CorruptBlockError{Key: r.key, Block: BlockRange{Offset: start, Length: length}}
+
+	if _, err := r.data.ReadAt(block, start); err != nil {
+		if err == io.EOF {
+			return nil, corrupt // truncated replica
+		}
+		return nil, err
+	}
+
+	size, _ := checksum.Size(blockAlgorithm)
+	if int64(len(r.sums)) < (index+1)*int64(size) {
+		return nil, corrupt
+	}
+	sum := r.sums[index*int64(size) : (index+1)*int64(size)]
+	if err := checksum.VerifyBlock(blockAlgorithm, block, sum); err != nil {
+		return nil, corrupt
+	}
+	return block, nil
+}
+
+func (r *blockReader) Close() error {
+	return r.data.Close()
+}
@@ -0,0 +1,105 @@
+package datanode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestStoreReplace reads a replica while it is replaced over and over: every
+// read returns one version or the other, never a mix or a checksum error
+func TestStoreReplace(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := [][]byte{bytes.Repeat([]byte("a"), 3<<20+5), bytes.Repeat([]byte("b"), 1<<20)}
+	if _, err := s.Put("key", 1, bytes.NewReader(versions[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := s.Put("key", 1, bytes.NewReader(versions[(i+1)%2])); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+		rc, _, err := s.OpenRange("key", 0, -1)
+		if err != nil {
+			t.Fatalf("open during a replace: %v", err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read during a replace: %v", err)
+		}
+		if !bytes.Equal(data, versions[0]) && !bytes.Equal(data, versions[1]) {
+			t.Fatalf("read %d bytes that are neither version", len(data))
+		}
+	}
+}
+
+// TestStoreOpenCleansUp reopens a store holding what a crash leaves: an
+// abandoned write, data with no sidecar and a sidecar published without its
+// data
+func TestStoreOpenCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"kept", "torn"} {
+		if _, err := s.Put(key, 1, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	abandoned := filepath.Join(dir, tmpDir, "put-1")
+	orphan := s.path("orphan")
+	for _, name := range []string{abandoned, orphan} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The data the sidecar of "torn" replaced
+	if err := os.WriteFile(s.path("torn"), []byte("older"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("%d replicas, want 1", s.Len())
+	}
+	if _, err := s.Stat("kept"); err != nil {
+		t.Errorf("stat kept: %v", err)
+	}
+	if _, err := s.Stat("torn"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat torn: %v, want ErrNotFound", err)
+	}
+	for _, name := range []string{abandoned, orphan, s.path("torn")} {
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left in place: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package merkle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Source serves range digests of one replica holder's tree
+type Source interface {
+	// Digests returns the digest of every range, in order
+	Digests(ctx context.Context, ranges []Range) ([]Digest, error)
+}
+
+// DiffConfig tunes how far Diff descends
+type DiffConfig struct {
+	// Fanout is the number of sub-ranges a divergent range is split into
+	Fanout int
+
+	// MaxEntries stops the descent once no source holds more than this many
+	// entries in a divergent range; listing it is cheaper than splitting
+	// further
+	MaxEntries int64
+}
+
+// DefaultDiffConfig descends 16 ways at a time down to ranges of at most 64
+// replicas
+var DefaultDiffConfig = DiffConfig{Fanout: 16, MaxEntries: 64}
+
+// Diff compares r across sources and returns the sub-ranges in which they
+// disagree. Matching ranges are never split, so the number of round trips
+// grows with the depth of the differences rather than the size of the
+// inventories. Each round asks every source for all of its ranges at once.
+func Diff(ctx context.Context, r Range, sources []Source, cfg DiffConfig) ([]Range, error) {
+	if cfg.Fanout < 2 {
+		cfg.Fanout = DefaultDiffConfig.Fanout
+	}
+	if cfg.MaxEntries < 1 {
+		cfg.MaxEntries = DefaultDiffConfig.MaxEntries
+	}
+	if len(sources) < 2 {
+		return nil, nil
+	}
+
+	var divergent []Range
+	frontier := []Range{r}
+	for len(frontier) > 0 {
+		digests, err := fetchDigests(ctx, frontier, sources)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []Range
+		for i, rng := range frontier {
+			agree := true
+			var most int64
+			for _, d := range digests {
+				if !d[i].Equal(digests[0][i]) {
+					agree = false
+				}
+				if d[i].Count > most {
+					most = d[i].Count
+				}
+			}
+			switch {
+			case agree:
+			case most <= cfg.MaxEntries || rng.span() == 0:
+				divergent = append(divergent, rng)
+			default:
+				next = append(next, rng.Split(cfg.Fanout)...)
+			}
+		}
+		frontier = next
+	}
+	return divergent, nil
+}
+
+// fetchDigests asks every source for the digests of ranges concurrently
+func fetchDigests(ctx context.Context, ranges []Range, sources []Source) ([][]Digest, error) {
+	digests := make([][]Digest, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src Source) {
+			defer wg.Done()
+			digests[i], errs[i] = src.Digests(ctx, ranges)
+			if errs[i] == nil && len(digests[i]) != len(ranges) {
+				errs[i] = fmt.Errorf("got %d digests for %d ranges", len(digests[i]), len(ranges))
+			}
+		}(i, src)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
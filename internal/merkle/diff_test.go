@@ -0,0 +1,136 @@
+package merkle
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// treeSource serves digests from a local tree, counting the rounds asked
+type treeSource struct {
+	tree   *Tree
+	rounds int
+}
+
+func (s *treeSource) Digests(ctx context.Context, ranges []Range) ([]Digest, error) {
+	s.rounds++
+	digests := make([]Digest, len(ranges))
+	for i, r := range ranges {
+		digests[i] = s.tree.Digest(r)
+	}
+	return digests, nil
+}
+
+// failingSource fails every request, or answers with too few digests
+type failingSource struct {
+	err error
+}
+
+func (s failingSource) Digests(ctx context.Context, ranges []Range) ([]Digest, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return nil, nil
+}
+
+// covered reports whether token lies in one of ranges
+func covered(ranges []Range, token uint64) bool {
+	for _, r := range ranges {
+		if r.Contains(token) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	base := randomEntries(rng, 5000)
+	cfg := DiffConfig{Fanout: 4, MaxEntries: 8}
+
+	// with returns base changed by change
+	with := func(change func(es entries)) *Tree {
+		es := make(entries, len(base))
+		for key, e := range base {
+			es[key] = e
+		}
+		change(es)
+		return es.tree(12)
+	}
+	same := func(entries) {}
+	changed := base["key-7"]
+	missing := base["key-8"]
+	extra := replica{token: rng.Uint64(), sum: []byte("extra")}
+
+	tests := []struct {
+		name   string
+		a, b   *Tree
+		r      Range
+		tokens []uint64 // tokens the divergent ranges must cover
+	}{
+		{"identical", with(same), with(same), FullRange, nil},
+		{"one differing entry", with(same), with(func(es entries) {
+			es["key-7"] = replica{changed.token, []byte("corrupt")}
+		}), FullRange, []uint64{changed.token}},
+		{"missing on the second", with(same), with(func(es entries) { delete(es, "key-8") }), FullRange, []uint64{missing.token}},
+		{"missing on the first", with(func(es entries) { delete(es, "key-8") }), with(same), FullRange, []uint64{missing.token}},
+		{"missing on either side", with(func(es entries) { es["extra"] = extra }), with(func(es entries) { delete(es, "key-8") }),
+			FullRange, []uint64{extra.token, missing.token}},
+		{"differences in several places", with(func(es entries) { es["extra"] = extra }), with(func(es entries) {
+			delete(es, "key-8")
+			es["key-7"] = replica{changed.token, []byte("corrupt")}
+		}), FullRange, []uint64{extra.token, missing.token, changed.token}},
+		{"difference outside the range", with(same), with(func(es entries) { delete(es, "key-8") }),
+			Range{First: missing.token + 1, Last: missing.token - 1}, nil},
+		{"difference in a wrapping range", with(same), with(func(es entries) { delete(es, "key-8") }),
+			Range{First: missing.token, Last: missing.token - 1<<62}, []uint64{missing.token}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := &treeSource{tree: tt.a}, &treeSource{tree: tt.b}
+			divergent, err := Diff(context.Background(), tt.r, []Source{a, b}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tokens == nil && len(divergent) != 0 {
+				t.Fatalf("divergent ranges %v, want none", divergent)
+			}
+			for _, token := range tt.tokens {
+				if !covered(divergent, token) {
+					t.Errorf("token %016x not in the divergent ranges %v", token, divergent)
+				}
+			}
+			for _, r := range divergent {
+				if n := tt.a.Digest(r).Count; n > cfg.MaxEntries && r.span() > 0 {
+					t.Errorf("divergent range %v holds %d entries, more than %d", r, n, cfg.MaxEntries)
+				}
+				if tt.a.Digest(r).Equal(tt.b.Digest(r)) {
+					t.Errorf("range %v reported divergent, but agrees", r)
+				}
+			}
+			if len(divergent) > 2*len(tt.tokens) {
+				t.Errorf("%d divergent ranges for %d differences", len(divergent), len(tt.tokens))
+			}
+			if a.rounds != b.rounds || a.rounds > 12 {
+				t.Errorf("sources asked %d and %d rounds", a.rounds, b.rounds)
+			}
+		})
+	}
+}
+
+func TestDiffSources(t *testing.T) {
+	ctx := context.Background()
+	one := &treeSource{tree: randomEntries(rand.New(rand.NewSource(4)), 10).tree(4)}
+	if divergent, err := Diff(ctx, FullRange, []Source{one}, DefaultDiffConfig); err != nil || divergent != nil {
+		t.Errorf("one source: %v, %v", divergent, err)
+	}
+
+	failure := errors.New("node down")
+	if _, err := Diff(ctx, FullRange, []Source{one, failingSource{failure}}, DefaultDiffConfig); !errors.Is(err, failure) {
+		t.Errorf("failing source: %v", err)
+	}
+	if _, err := Diff(ctx, FullRange, []Source{one, failingSource{}}, DefaultDiffConfig); err == nil {
+		t.Error("source answering too few digests accepted")
+	}
+}
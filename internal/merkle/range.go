@@ -0,0 +1,51 @@
+package merkle
+
+import (
+	"fmt"
+	"math"
+)
+
+// Range is an inclusive range [First, Last] of ring tokens. A range whose
+// First is greater than its Last wraps past the top of the ring.
+type Range struct {
+	First uint64
+	Last  uint64
+}
+
+// FullRange covers the whole ring
+var FullRange = Range{First: 0, Last: math.MaxUint64}
+
+// Contains reports whether token lies in the range
+func (r Range) Contains(token uint64) bool {
+	if r.First <= r.Last {
+		return token >= r.First && token <= r.Last
+	}
+	return token >= r.First || token <= r.Last
+}
+
+// span returns the number of tokens in the range minus one, so the full
+// ring fits in a uint64
+func (r Range) span() uint64 {
+	return r.Last - r.First
+}
+
+// Split divides the range into at most n contiguous sub-ranges of nearly
+// equal width, in ring order starting at First
+func (r Range) Split(n int) []Range {
+	if n < 2 || r.span() == 0 {
+		return []Range{r}
+	}
+	step := r.span()/uint64(n) + 1
+	parts := make([]Range, 0, n)
+	first, remaining := r.First, r.span()
+	for remaining >= step {
+		parts = append(parts, Range{First: first, Last: first + step - 1})
+		first += step
+		remaining -= step
+	}
+	return append(parts, Range{First: first, Last: first + remaining})
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("[%016x, %016x]", r.First, r.Last)
+}
@@ -0,0 +1,65 @@
+package merkle
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		r     Range
+		token uint64
+		want  bool
+	}{
+		{Range{First: 10, Last: 20}, 10, true},
+		{Range{First: 10, Last: 20}, 20, true},
+		{Range{First: 10, Last: 20}, 21, false},
+		{Range{First: 10, Last: 20}, 9, false},
+		{Range{First: math.MaxUint64 - 5, Last: 5}, math.MaxUint64, true},
+		{Range{First: math.MaxUint64 - 5, Last: 5}, 0, true},
+		{Range{First: math.MaxUint64 - 5, Last: 5}, 6, false},
+		{FullRange, 0, true},
+		{FullRange, math.MaxUint64, true},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Contains(tt.token); got != tt.want {
+			t.Errorf("%v.Contains(%d) = %t", tt.r, tt.token, got)
+		}
+	}
+}
+
+func TestRangeSplit(t *testing.T) {
+	tests := []struct {
+		r    Range
+		n    int
+		want int
+	}{
+		{FullRange, 16, 16},
+		{FullRange, 3, 3},
+		{Range{First: 100, Last: 199}, 4, 4},
+		{Range{First: 100, Last: 102}, 16, 3},
+		{Range{First: 7, Last: 7}, 16, 1},
+		{Range{First: 100, Last: 199}, 1, 1},
+		{Range{First: math.MaxUint64 - 9, Last: 9}, 4, 4}, // wrapping
+	}
+	for _, tt := range tests {
+		parts := tt.r.Split(tt.n)
+		if len(parts) != tt.want {
+			t.Errorf("%v.Split(%d): %d parts, want %d", tt.r, tt.n, len(parts), tt.want)
+		}
+		// The parts run from First to Last without gaps or overlaps
+		next := tt.r.First
+		var total uint64
+		for _, p := range parts {
+			if p.First != next || p.First > p.Last {
+				t.Errorf("%v.Split(%d): part %v out of order in %v", tt.r, tt.n, p, parts)
+				break
+			}
+			next = p.Last + 1
+			total += p.span() + 1
+		}
+		if parts[len(parts)-1].Last != tt.r.Last || total != tt.r.span()+1 {
+			t.Errorf("%v.Split(%d) = %v does not cover the range", tt.r, tt.n, parts)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package merkle implements the hash trees data nodes keep over their
+// replica inventory for anti-entropy.
+//
+// Every replica is placed on the ring at its token, the ring position of the
+// object it belongs to. Two nodes responsible for the same ring range should
+// hold the same replicas in it, so comparing the digests of that range on
+// each node tells whether they agree without listing either inventory.
+// Where digests differ the range is split and its halves compared in turn,
+// and only the small ranges where the nodes really disagree are listed
+// (Dynamo, section 4.7).
+package merkle
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DefaultDepth is the number of levels below the root; the tree has
+// 2^DefaultDepth leaves
+const DefaultDepth = 16
+
+// Digest summarises the replicas in a range
+type Digest struct {
+	Range Range
+	Hash  uint64 // XOR of the entry hashes of every replica in the range
+	Count int64  // number of replicas in the range
+}
+
+// Equal reports whether two digests describe the same set of replicas
+func (d Digest) Equal(other Digest) bool {
+	return d.Hash == other.Hash && d.Count == other.Count
+}
+
+// Tree is a hash tree over a set of keyed entries placed on the ring.
+//
+// Leaves split the ring into 2^depth equal ranges and hold the entries in
+// them. Inner nodes combine their children with XOR rather than hashing
+// their concatenation, so the digest of any range, including ring ranges
+// that do not line up with the leaves, can be assembled from O(depth) nodes
+// plus the entries of the two leaves at its ends. Adding or removing an
+// entry updates one node per level.
+type Tree struct {
+	mu     sync.RWMutex
+	depth  uint
+	hashes []uint64 // hashes[1] is the root; leaf i is hashes[1<<depth + i]
+	counts []int64
+	leaves []map[string]entry
+	tokens map[string]uint64 // key -> token, to find an entry's leaf
+}
+
+type entry struct {
+	token uint64
+	hash  uint64
+}
+
+// New creates an empty tree with 2^depth leaves
+func New(depth int) *Tree {
+	if depth < 1 || depth > 24 {
+		depth = DefaultDepth
+	}
+	return &Tree{
+		depth:  uint(depth),
+		hashes: make([]uint64, 2<<depth),
+		counts: make([]int64, 2<<depth),
+		leaves: make([]map[string]entry, 1<<depth),
+		tokens: make(map[string]uint64),
+	}
+}
+
+// EntryHash returns the hash a replica contributes to the tree. It covers the
+// key and the replica's checksum, so replicas with the same key but
+// different contents hash differently.
+func EntryHash(key string, sum []byte) uint64 {
+	d := xxhash.New()
+	d.WriteString(key)
+	d.Write([]byte{0})
+	d.Write(sum)
+	return d.Sum64()
+}
+
+// Put adds the entry for key at token, replacing any previous entry for key
+func (t *Tree) Put(key string, token uint64, sum []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(key)
+	leaf := t.leaf(token)
+	if t.leaves[leaf] == nil {
+		t.leaves[leaf] = make(map[string]entry)
+	}
+	e := entry{token: token, hash: EntryHash(key, sum)}
+	t.leaves[leaf][key] = e
+	t.tokens[key] = token
+	t.update(leaf, e.hash, 1)
+}
+
+// Remove deletes the entry for key, if any
+func (t *Tree) Remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(key)
+}
+
+func (t *Tree) remove(key string) {
+	token, ok := t.tokens[key]
+	if !ok {
+		return
+	}
+	leaf := t.leaf(token)
+	e := t.leaves[leaf][key]
+	delete(t.leaves[leaf], key)
+	delete(t.tokens, key)
+	t.update(leaf, e.hash, -1)
+}
+
+// update folds an entry hash into a leaf and all its ancestors
+func (t *Tree) update(leaf int, hash uint64, count int64) {
+	for i := 1<<t.depth + leaf; i > 0; i /= 2 {
+		t.hashes[i] ^= hash
+		t.counts[i] += count
+	}
+}
+
+// leaf returns the index of the leaf holding token
+func (t *Tree) leaf(token uint64) int {
+	return int(token >> (64 - t.depth))
+}
+
+// Len returns the number of entries in the tree
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tokens)
+}
+
+// Digest returns the digest of the entries in r
+func (t *Tree) Digest(r Range) Digest {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	d := Digest{Range: r}
+	if r.First > r.Last {
+		d.Hash, d.Count = t.digest(r.First, FullRange.Last)
+		hash, count := t.digest(0, r.Last)
+		d.Hash ^= hash
+		d.Count += count
+		return d
+	}
+	d.Hash, d.Count = t.digest(r.First, r.Last)
+	return d
+}
+
+// digest combines the entries with tokens in [first, last], first <= last
+func (t *Tree) digest(first, last uint64) (uint64, int64) {
+	lo, hi := t.leaf(first), t.leaf(last)
+	shift := 64 - t.depth
+	loWhole := first == uint64(lo)<<shift
+	hiWhole := last == uint64(hi)<<shift|(1<<shift-1)
+
+	if lo == hi {
+		if loWhole && hiWhole {
+			return t.hashes[1<<t.depth+lo], t.counts[1<<t.depth+lo]
+		}
+		return t.scan(lo, first, last)
+	}
+
+	var hash uint64
+	var count int64
+	from, to := lo, hi
+	if !loWhole {
+		hash, count = t.scan(lo, first, last)
+		from++
+	}
+	if !hiWhole {
+		h, c := t.scan(hi, first, last)
+		hash ^= h
+		count += c
+		to--
+	}
+	if from <= to {
+		h, c := t.span(from, to)
+		hash ^= h
+		count += c
+	}
+	return hash, count
+}
+
+// scan combines the entries of one leaf with tokens in [first, last]
+func (t *Tree) scan(leaf int, first, last uint64) (uint64, int64) {
+	var hash uint64
+	var count int64
+	for _, e := range t.leaves[leaf] {
+		if e.token >= first && e.token <= last {
+			hash ^= e.hash
+			count++
+		}
+	}
+	return hash, count
+}
+
+// span combines whole leaves [from, to] by walking up from both ends
+func (t *Tree) span(from, to int) (uint64, int64) {
+	var hash uint64
+	var count int64
+	lo, hi := 1<<t.depth+from, 1<<t.depth+to+1
+	for lo < hi {
+		if lo&1 == 1 {
+			hash ^= t.hashes[lo]
+			count += t.counts[lo]
+			lo++
+		}
+		if hi&1 == 1 {
+			hi--
+			hash ^= t.hashes[hi]
+			count += t.counts[hi]
+		}
+		lo /= 2
+		hi /= 2
+	}
+	return hash, count
+}
+
+// Keys returns the keys of the entries in r, in no particular order
+func (t *Tree) Keys(r Range) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var keys []string
+	collect := func(first, last uint64) {
+		for leaf := t.leaf(first); leaf <= t.leaf(last); leaf++ {
+			for key, e := range t.leaves[leaf] {
+				if e.token >= first && e.token <= last {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	if r.First > r.Last {
+		collect(r.First, FullRange.Last)
+		collect(0, r.Last)
+	} else {
+		collect(r.First, r.Last)
+	}
+	return keys
+}
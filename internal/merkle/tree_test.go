@@ -0,0 +1,180 @@
+package merkle
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// replica is an entry a tree is built from in tests
+type replica struct {
+	token uint64
+	sum   []byte
+}
+
+// entries are replicas by key
+type entries map[string]replica
+
+// randomEntries returns n entries with random tokens
+func randomEntries(rng *rand.Rand, n int) entries {
+	es := make(entries, n)
+	for i := 0; i < n; i++ {
+		es[fmt.Sprintf("key-%d", i)] = replica{rng.Uint64(), []byte(fmt.Sprint(i))}
+	}
+	return es
+}
+
+func (es entries) tree(depth int) *Tree {
+	t := New(depth)
+	for key, e := range es {
+		t.Put(key, e.token, e.sum)
+	}
+	return t
+}
+
+// digest computes the digest of r from the entries themselves
+func (es entries) digest(r Range) Digest {
+	d := Digest{Range: r}
+	for key, e := range es {
+		if r.Contains(e.token) {
+			d.Hash ^= EntryHash(key, e.sum)
+			d.Count++
+		}
+	}
+	return d
+}
+
+func (es entries) keys(r Range) []string {
+	var keys []string
+	for key, e := range es {
+		if r.Contains(e.token) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestTreeDigest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const depth = 8
+	es := randomEntries(rng, 2000)
+	// Entries on the edges of the ring and of a leaf
+	leaf := uint64(1) << (64 - depth)
+	for i, token := range []uint64{0, math.MaxUint64, leaf - 1, leaf, 5 * leaf} {
+		es[fmt.Sprintf("edge-%d", i)] = replica{token, []byte("edge")}
+	}
+	tree := es.tree(depth)
+	if tree.Len() != len(es) {
+		t.Fatalf("Len %d, want %d", tree.Len(), len(es))
+	}
+
+	ranges := []Range{
+		FullRange,
+		{First: 0, Last: 0},
+		{First: math.MaxUint64, Last: math.MaxUint64},
+		{First: 0, Last: leaf - 1},            // one whole leaf
+		{First: leaf, Last: 6*leaf - 1},       // whole leaves
+		{First: leaf - 1, Last: leaf},         // across a leaf boundary
+		{First: leaf + 10, Last: leaf + 1000}, // within a leaf
+		{First: 5 * leaf, Last: 3 * leaf},     // wrapping
+		{First: math.MaxUint64, Last: 0},      // wrapping, two tokens
+	}
+	for i := 0; i < 200; i++ {
+		ranges = append(ranges, Range{First: rng.Uint64(), Last: rng.Uint64()})
+	}
+	for _, r := range ranges {
+		want := es.digest(r)
+		if got := tree.Digest(r); got != want {
+			t.Errorf("Digest(%v) = %d entries, hash %x; want %d, %x", r, got.Count, got.Hash, want.Count, want.Hash)
+		}
+		got := tree.Keys(r)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(es.keys(r)) {
+			t.Errorf("Keys(%v): %d keys, want %d", r, len(got), len(es.keys(r)))
+		}
+	}
+}
+
+// TestTreeOrder checks that a tree's digests depend on its entries, not the
+// order they were added in
+func TestTreeOrder(t *testing.T) {
+	es := randomEntries(rand.New(rand.NewSource(2)), 500)
+	keys := make([]string, 0, len(es))
+	for key := range es {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	a, b := New(10), New(10)
+	for i := range keys {
+		e := es[keys[i]]
+		a.Put(keys[i], e.token, e.sum)
+		e = es[keys[len(keys)-1-i]]
+		b.Put(keys[len(keys)-1-i], e.token, e.sum)
+	}
+	if a.Digest(FullRange) != b.Digest(FullRange) {
+		t.Error("trees of the same entries differ")
+	}
+}
+
+func TestTreePut(t *testing.T) {
+	tree := New(4)
+	empty := tree.Digest(FullRange)
+	if empty.Hash != 0 || empty.Count != 0 {
+		t.Fatalf("empty tree digest %+v", empty)
+	}
+
+	tree.Put("a", 1, []byte("v1"))
+	tree.Put("b", 2, []byte("v1"))
+	before := tree.Digest(FullRange)
+
+	// The same replica again changes nothing
+	tree.Put("a", 1, []byte("v1"))
+	if got := tree.Digest(FullRange); got != before || tree.Len() != 2 {
+		t.Errorf("putting an entry again: %+v, %d entries", got, tree.Len())
+	}
+
+	// New contents replace the entry
+	tree.Put("a", 1, []byte("v2"))
+	updated := tree.Digest(FullRange)
+	if updated.Count != 2 || updated.Equal(before) {
+		t.Errorf("updated entry: %+v", updated)
+	}
+	tree.Put("a", 1, []byte("v1"))
+	if got := tree.Digest(FullRange); got != before {
+		t.Errorf("entry put back: %+v, want %+v", got, before)
+	}
+
+	// A new token moves the entry
+	tree.Put("a", math.MaxUint64, []byte("v1"))
+	if got := tree.Keys(Range{First: 0, Last: 1}); len(got) != 0 {
+		t.Errorf("keys at the old token: %q", got)
+	}
+	if got := tree.Keys(Range{First: math.MaxUint64, Last: math.MaxUint64}); len(got) != 1 || got[0] != "a" {
+		t.Errorf("keys at the new token: %q", got)
+	}
+
+	tree.Remove("a")
+	tree.Remove("a")
+	tree.Remove("missing")
+	if got := tree.Digest(FullRange); got.Count != 1 || got.Hash != EntryHash("b", []byte("v1")) || tree.Len() != 1 {
+		t.Errorf("after removing a: %+v, %d entries", got, tree.Len())
+	}
+	tree.Remove("b")
+	if got := tree.Digest(FullRange); got != empty {
+		t.Errorf("emptied tree digest %+v", got)
+	}
+}
+
+func TestEntryHash(t *testing.T) {
+	if EntryHash("a", []byte("1")) == EntryHash("a", []byte("2")) {
+		t.Error("entries with different checksums hash alike")
+	}
+	// The separator keeps the key and checksum from running together
+	if EntryHash("ab", []byte("c")) == EntryHash("a", []byte("bc")) {
+		t.Error("entries with shifted keys hash alike")
+	}
+}
@@ -0,0 +1,18 @@
+package metadata
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// NewID returns a random (version 4) UUID for records whose ID must be known
+// before they are written, such as part replicas
+func NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("metadata: reading random bytes: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -2,7 +2,51 @@ package metadata
 
 import (
 	"context"
+	"errors"
 	"time"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+)
+
+var (
+	// ErrBucketNotFound is returned when a bucket does not exist
+	ErrBucketNotFound = errors.New("bucket not found")
+
+	// ErrBucketExists is returned when creating a bucket that already exists
+	ErrBucketExists = errors.New("bucket already exists")
+
+	// ErrBucketNotEmpty is returned when deleting a bucket that still holds objects
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+
+	// ErrObjectNotFound is returned when an object or version does not exist
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrObjectSuperseded is returned when committing a pending object whose
+	// key has been written or deleted since the object was created
+	ErrObjectSuperseded = errors.New("object superseded by a later write")
+
+	// ErrPlacementConflict is returned when updating the placement of an
+	// object that is no longer committed or whose placement has changed
+	ErrPlacementConflict = errors.New("object placement changed")
+
+	// ErrAccessKeyNotFound is returned when an access key does not exist
+	ErrAccessKeyNotFound = errors.New("access key not found")
+
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrUserExists is returned when creating a user that already exists
+	ErrUserExists = errors.New("user already exists")
+
+	// ErrGroupNotFound is returned when a group does not exist
+	ErrGroupNotFound = errors.New("group not found")
+
+	// ErrGroupExists is returned when creating a group that already exists
+	ErrGroupExists = errors.New("group already exists")
+
+	// ErrUploadNotFound is returned when a multipart upload does not exist or
+	// is no longer active
+	ErrUploadNotFound = errors.New("multipart upload not found")
 )
 
 // ObjectState represents the state of an object
@@ -20,47 +64,537 @@ type Object struct {
 	BucketName     string
 	ObjectKey      string
 	VersionID      string
+	NullVersion    bool // the "null" version, written while versioning was off or suspended
 	IsLatest       bool
 	IsDeleteMarker bool
 	SizeBytes      int64
 	ETag           string
 	ContentType    string
-	Placement      []string // Node IDs where replicas exist
+	Checksum       checksum.Value // Internal integrity checksum (xxHash) of the data
+	S3Checksum     checksum.Value // Client-requested S3 flexible checksum, if any
+	S3ChecksumType checksum.Type  // How S3Checksum was derived; empty for single uploads
+	PartsCount     int            // Number of parts of a multipart object, 0 otherwise
+	Placement      []string       // Node IDs where replicas exist
 	State          ObjectState
 	Metadata       map[string]string
 	Tags           map[string]string
+	Encryption     *Encryption // nil if the data is not encrypted at rest
+	NoncurrentAt   time.Time   // when the version stopped being the latest; zero while it is
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 }
 
+// StoredSize returns the size of each of the object's replicas: SizeBytes,
+// or what the data took once encrypted
+func (o *Object) StoredSize() int64 {
+	if o.Encryption != nil {
+		return o.Encryption.StoredSize
+	}
+	return o.SizeBytes
+}
+
+// Encryption describes how data is encrypted at rest, in the format of
+// package sse. A multipart upload's parts share the upload's data key and
+// are sealed one by one; the object assembled from them keeps the key and
+// the part sizes.
+//
+// Data encrypted with a customer-provided key (SSE-C) has no data key and
+// no KeyID: the customer's key is used as one, and only a salted
+// fingerprint of it is kept.
+type Encryption struct {
+	Algorithm      string  `json:"algorithm"`                 // as in x-amz-server-side-encryption
+	KeyID          string  `json:"key_id"`                    // master key DataKey is wrapped with
+	DataKey        []byte  `json:"data_key"`                  // wrapped data key
+	KeySalt        []byte  `json:"key_salt,omitempty"`        // salt of KeyFingerprint
+	KeyFingerprint []byte  `json:"key_fingerprint,omitempty"` // of the customer-provided key
+	StoredSize     int64   `json:"stored_size,omitempty"`     // sealed size of a committed object
+	Parts          []int64 `json:"parts,omitempty"`           // plaintext sizes of a multipart object's parts
+}
+
+// CustomerKey reports whether the data is encrypted with a
+// customer-provided key
+func (e *Encryption) CustomerKey() bool {
+	return len(e.KeyFingerprint) > 0
+}
+
+// DataKey is the wrapped data key of an object or of a multipart upload,
+// as ListDataKeys finds it
+type DataKey struct {
+	ObjectID string // empty for an upload's key
+	UploadID string // empty for an object's key
+	KeyID    string
+	DataKey  []byte
+}
+
+// UploadState represents the state of a multipart upload
+type UploadState string
+
+const (
+	UploadStateActive    UploadState = "active"
+	UploadStateCompleted UploadState = "completed"
+	UploadStateAborted   UploadState = "aborted"
+)
+
+// MultipartUpload represents a multipart upload in the metadata store
+type MultipartUpload struct {
+	UploadID          string
+	BucketName        string
+	ObjectKey         string
+	ContentType       string
+	ChecksumAlgorithm checksum.Algorithm // S3 checksum carried by every part, if any
+	ChecksumType      checksum.Type      // How part checksums combine into the object's
+	Encryption        *Encryption        // of every part; nil if they are not encrypted
+	Metadata          map[string]string
+	State             UploadState
+	InitiatedAt       time.Time
+}
+
+// Part represents one uploaded part of a multipart upload. Its data is
+// stored on the data nodes as a replica keyed by ID.
+type Part struct {
+	ID         string
+	UploadID   string
+	PartNumber int
+	SizeBytes  int64
+	ETag       string
+	Checksum   checksum.Value // Internal integrity checksum (xxHash) of the part
+	S3Checksum checksum.Value // Part checksum in the upload's S3 algorithm, if any
+	Placement  []string
+	UploadedAt time.Time
+}
+
+// RepairStatus is the state of a repair action
+type RepairStatus string
+
+const (
+	RepairStatusPending    RepairStatus = "pending"
+	RepairStatusInProgress RepairStatus = "in_progress"
+	RepairStatusCompleted  RepairStatus = "completed"
+	RepairStatusFailed     RepairStatus = "failed"
+)
+
+// Repair issue types
+const (
+	IssueUnderReplicated  = "under_replicated"  // fewer live replicas than the replication factor
+	IssueMissingReplica   = "missing_replica"   // a placement node lost its replica
+	IssueChecksumMismatch = "checksum_mismatch" // a placement node holds different data
+	IssueCorruptReplica   = "corrupt_replica"   // the scrubber quarantined a replica failing its checksums
+)
+
+// RepairRecord is one action of the repair worker, kept in repair_log.
+// Pending records form the repair queue, ordered by RemainingReplicas, then
+// BucketPriority (highest first), then DetectedAt.
+type RepairRecord struct {
+	ID                string
+	ObjectID          string
+	IssueType         string
+	Status            RepairStatus
+	SourceNode        string
+	TargetNodes       []string
+	RemainingReplicas int // healthy replicas left when the issue was found
+	BucketPriority    int // the bucket's RepairPriority, set on enqueue
+	ClaimedBy         string
+	ClaimExpiresAt    time.Time // another worker may take the repair over after this
+	Error             string
+	DetectedAt        time.Time
+	RepairedAt        time.Time // zero until the repair completes
+}
+
+// AtRiskReplicas is the number of remaining replicas at or below which an
+// object is one failure away from data loss. Its repairs preempt background
+// traffic.
+const AtRiskReplicas = 1
+
+// RepairQueueDepth counts the open repairs of objects with the same number
+// of remaining replicas
+type RepairQueueDepth struct {
+	RemainingReplicas int
+	Pending           int64
+	InProgress        int64
+}
+
+// ScrubProgress is the scrubber's position in its pass over one data node.
+// Replicas are scrubbed in ring token order, so Cursor/2^64 approximates how
+// much of the node has been verified.
+type ScrubProgress struct {
+	NodeID              string
+	Cursor              uint64    // next ring token to scrub
+	PassStartedAt       time.Time // zero between passes
+	LastPassCompletedAt time.Time
+	BytesScrubbed       int64 // in the current pass
+	ReplicasScrubbed    int64
+	CorruptFound        int64
+	UpdatedAt           time.Time
+}
+
+// Lease gives one repair process exclusive use of a named piece of work,
+// such as scrubbing one data node, until it expires
+type Lease struct {
+	Name       string
+	Holder     string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// RateLimitUsage is the running total of requests and bytes one gateway
+// has charged to a rate limit key
+type RateLimitUsage struct {
+	Requests int64
+	Bytes    int64
+}
+
+// RateLimitUsageTTL is how long a gateway's rate limit usage counts after
+// it last reported it
+const RateLimitUsageTTL = 10 * time.Minute
+
 // Bucket represents a bucket in the metadata store
 type Bucket struct {
-	ID                string
-	Name              string
-	VersioningEnabled bool
-	Region            string
-	CreatedAt         time.Time
-	UpdatedAt         time.Time
+	ID             string
+	Name           string
+	Versioning     VersioningStatus // empty until versioning is first enabled
+	Region         string
+	RepairPriority int             // higher is repaired first among equally at-risk objects
+	Lifecycle      []LifecycleRule // nil if the bucket has no lifecycle configuration
+	Owner          string          // user that created the bucket; empty for root
+	Policy         string          // bucket policy document; empty if the bucket has none
+	ACL            CannedACL
+	// PublicAccessBlock is nil if the bucket has no public access block
+	// configuration
+	PublicAccessBlock *PublicAccessBlock
+	Quota             *Quota // nil if the bucket has no quota
+	// Encryption is the server-side encryption algorithm applied to
+	// objects written without one; empty for none
+	Encryption string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// VersioningStatus is a bucket's versioning state. A bucket starts
+// unversioned (the empty status) and, once versioning has been enabled,
+// can only be suspended, never returned to unversioned.
+type VersioningStatus string
+
+const (
+	VersioningEnabled   VersioningStatus = "Enabled"
+	VersioningSuspended VersioningStatus = "Suspended"
+)
+
+// NullVersionID is the version ID of the null version of a key. Objects
+// written while a bucket is unversioned or versioning is suspended are null
+// versions; each write replaces the key's previous null version.
+const NullVersionID = "null"
+
+// LifecycleRule is one rule of a bucket's lifecycle configuration, applying
+// to the keys under Prefix. AbortIncompleteMultipartUploadDays is the only
+// action supported: multipart uploads initiated that many days ago and still
+// active are aborted and their parts deleted.
+type LifecycleRule struct {
+	ID                                 string `json:"id"`
+	Prefix                             string `json:"prefix"`
+	Enabled                            bool   `json:"enabled"`
+	AbortIncompleteMultipartUploadDays int    `json:"abort_incomplete_multipart_upload_days"`
+}
+
+// CannedACL is a bucket's canned access control list. Plinth supports the
+// two that matter without per-object ACLs: private, and public-read, which
+// lets anyone list the bucket and read its objects.
+type CannedACL string
+
+const (
+	ACLPrivate    CannedACL = "private"
+	ACLPublicRead CannedACL = "public-read"
+)
+
+// PublicAccessBlock limits public access to a bucket, like S3's
+// PublicAccessBlockConfiguration. BlockPublicAcls and BlockPublicPolicy
+// refuse to make the bucket public; IgnorePublicAcls and
+// RestrictPublicBuckets stop an existing public ACL or policy from
+// granting anonymous access.
+type PublicAccessBlock struct {
+	BlockPublicAcls       bool `json:"block_public_acls"`
+	IgnorePublicAcls      bool `json:"ignore_public_acls"`
+	BlockPublicPolicy     bool `json:"block_public_policy"`
+	RestrictPublicBuckets bool `json:"restrict_public_buckets"`
+}
+
+// Quota limits the bytes and objects stored in a bucket, or in all the
+// buckets a user owns. Writes that would take usage over a hard limit
+// (MaxBytes, MaxObjects) are refused; writes that take it over a soft
+// limit succeed and raise a QuotaEvent. Zero means no limit.
+type Quota struct {
+	MaxBytes       int64 `json:"max_bytes,omitempty"`
+	MaxObjects     int64 `json:"max_objects,omitempty"`
+	SoftMaxBytes   int64 `json:"soft_max_bytes,omitempty"`
+	SoftMaxObjects int64 `json:"soft_max_objects,omitempty"`
+}
+
+// Usage is what a bucket, or a user's buckets, store: every version
+// counts until it is purged, as in cost_tracking
+type Usage struct {
+	Bytes   int64
+	Objects int64
+}
+
+// QuotaScope is what a quota applies to
+type QuotaScope string
+
+const (
+	QuotaScopeBucket QuotaScope = "bucket"
+	QuotaScopeUser   QuotaScope = "user"
+)
+
+// Resources a quota limits
+const (
+	QuotaBytes   = "bytes"
+	QuotaObjects = "objects"
+)
+
+// QuotaEvent records a write that took a bucket's or user's usage over a
+// soft quota
+type QuotaEvent struct {
+	ID        int64
+	Scope     QuotaScope
+	Name      string // bucket or user name
+	Resource  string // QuotaBytes or QuotaObjects
+	Usage     int64  // after the write
+	Limit     int64
+	CreatedAt time.Time
+}
+
+// AccessKey is a credential that signs S3 requests. Requests signed with an
+// inactive or expired key are refused. Keys without a user are root keys,
+// which also administer users, groups and keys.
+type AccessKey struct {
+	AccessKeyID  string
+	UserName     string // empty for root keys
+	SealedSecret []byte // secret access key encrypted by auth.SecretBox
+	Status       AccessKeyStatus
+	ExpiresAt    time.Time // zero if the key never expires
+	CreatedAt    time.Time
+}
+
+// Expired reports whether the key's expiry has passed at now
+func (k *AccessKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// AccessKeyStatus is whether an access key may sign requests
+type AccessKeyStatus string
+
+const (
+	AccessKeyActive   AccessKeyStatus = "active"
+	AccessKeyInactive AccessKeyStatus = "inactive"
+)
+
+// User is a principal that owns access keys. Usage is attributed to the
+// user whose key signed a request.
+type User struct {
+	Name      string
+	Groups    []string // names of the groups the user belongs to, sorted
+	Quota     *Quota   // on all the buckets the user owns; nil if none
+	CreatedAt time.Time
+}
+
+// Group is a named set of users
+type Group struct {
+	Name      string
+	Members   []string // user names, sorted
+	CreatedAt time.Time
 }
 
 // Service defines the interface for metadata operations
 type Service interface {
 	// Bucket operations
-	CreateBucket(ctx context.Context, name string) (*Bucket, error)
+	// CreateBucket creates a bucket owned by owner, a user name or empty
+	// for root
+	CreateBucket(ctx context.Context, name, owner string) (*Bucket, error)
 	GetBucket(ctx context.Context, name string) (*Bucket, error)
 	DeleteBucket(ctx context.Context, name string) error
 	ListBuckets(ctx context.Context) ([]*Bucket, error)
+	SetBucketRepairPriority(ctx context.Context, name string, priority int) error
+	SetBucketVersioning(ctx context.Context, name string, status VersioningStatus) error
+	// SetBucketLifecycle replaces the bucket's lifecycle rules; no rules
+	// removes its lifecycle configuration
+	SetBucketLifecycle(ctx context.Context, name string, rules []LifecycleRule) error
+	// SetBucketPolicy replaces the bucket's policy document; an empty
+	// policy removes it
+	SetBucketPolicy(ctx context.Context, name, policy string) error
+	SetBucketACL(ctx context.Context, name string, acl CannedACL) error
+	// SetBucketPublicAccessBlock replaces the bucket's public access block
+	// configuration; nil removes it
+	SetBucketPublicAccessBlock(ctx context.Context, name string, block *PublicAccessBlock) error
+	// SetBucketQuota replaces the bucket's quota; nil removes it
+	SetBucketQuota(ctx context.Context, name string, quota *Quota) error
+	// SetBucketEncryption sets the bucket's default encryption algorithm;
+	// an empty one removes it
+	SetBucketEncryption(ctx context.Context, name, algorithm string) error
 
 	// Object operations
 	CreateObject(ctx context.Context, obj *Object) error
 	GetObject(ctx context.Context, bucketName, objectKey string) (*Object, error)
+	// GetObjectVersion returns a committed version, which may be a delete
+	// marker; versionID may be NullVersionID
 	GetObjectVersion(ctx context.Context, bucketName, objectKey, versionID string) (*Object, error)
-	DeleteObject(ctx context.Context, bucketName, objectKey string) error
-	ListObjects(ctx context.Context, bucketName, prefix string, limit int) ([]*Object, error)
+	GetObjectByID(ctx context.Context, objectID string) (*Object, error)
+	// DeleteObject removes the latest version of a key. In buckets with
+	// versioning a delete marker becomes the latest version and is
+	// returned; the old version is kept as a noncurrent version unless
+	// versioning is suspended and it is the null version. In unversioned
+	// buckets the version is tombstoned and no marker is returned.
+	DeleteObject(ctx context.Context, bucketName, objectKey string) (*Object, error)
+	// DeleteObjectVersion tombstones one version and returns it as it was.
+	// If it was the latest, the newest remaining version takes its place.
+	DeleteObjectVersion(ctx context.Context, bucketName, objectKey, versionID string) (*Object, error)
+	// ListObjects returns up to limit latest versions of keys under prefix
+	// that sort after the given key, by key. Delete markers are left out.
+	ListObjects(ctx context.Context, bucketName, prefix, after string, limit int) ([]*Object, error)
+	// ListObjectVersions returns up to limit committed versions, delete
+	// markers included, of keys under prefix, by key and then newest first.
+	// The listing starts after keyMarker, or after its version
+	// versionIDMarker if that is given.
+	ListObjectVersions(ctx context.Context, bucketName, prefix, keyMarker, versionIDMarker string, limit int) ([]*Object, error)
+
+	// Two-phase writes: objects are created pending, then committed or aborted
+	CommitObject(ctx context.Context, obj *Object) error
+	AbortObject(ctx context.Context, objectID string) error
+
+	// Recovery of interrupted writes. ListPendingObjects returns up to limit
+	// objects created pending before cutoff, oldest first.
+	// CommitPendingObject commits one like CommitObject unless a version of
+	// its key was created after it, and returns ErrObjectSuperseded then.
+	ListPendingObjects(ctx context.Context, cutoff time.Time, limit int) ([]*Object, error)
+	CommitPendingObject(ctx context.Context, obj *Object) error
+
+	// Multipart uploads. CreateMultipartUpload keeps an upload ID set by the
+	// caller and assigns one otherwise. Completing an upload commits the
+	// pending object built from its parts and forgets the parts; aborting
+	// returns the parts so their replicas can be deleted.
+	CreateMultipartUpload(ctx context.Context, upload *MultipartUpload) error
+	GetMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) (*MultipartUpload, error)
+	ListMultipartUploads(ctx context.Context, bucketName, prefix string, limit int) ([]*MultipartUpload, error)
+	PutPart(ctx context.Context, part *Part) (replaced *Part, err error)
+	ListParts(ctx context.Context, uploadID string) ([]*Part, error)
+	CompleteMultipartUpload(ctx context.Context, uploadID string, obj *Object) error
+	AbortMultipartUpload(ctx context.Context, uploadID string) ([]*Part, error)
+
+	// Lifecycle expiry of multipart uploads. ListStaleMultipartUploads
+	// returns up to limit active uploads of keys under prefix initiated
+	// before cutoff, oldest first. ExpireMultipartUpload aborts an upload
+	// like AbortMultipartUpload and adds its parts' bytes to the bucket's
+	// reclaimed bytes in cost_tracking.
+	ListStaleMultipartUploads(ctx context.Context, bucketName, prefix string, cutoff time.Time, limit int) ([]*MultipartUpload, error)
+	ExpireMultipartUpload(ctx context.Context, uploadID string) ([]*Part, error)
+
+	// Garbage collection. ExpireNoncurrentVersions tombstones up to limit
+	// versions that stopped being the latest before cutoff. ListTombstones
+	// returns up to limit tombstoned versions that stopped being the latest
+	// before cutoff, oldest first, starting after the version afterID that
+	// stopped being the latest at afterTime; an empty afterID starts at the
+	// oldest. PurgeObject removes the record of a tombstoned version and
+	// takes it off its bucket's cost counters; it returns ErrObjectNotFound
+	// if the record is gone or not tombstoned.
+	ExpireNoncurrentVersions(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+	ListTombstones(ctx context.Context, cutoff, afterTime time.Time, afterID string, limit int) ([]*Object, error)
+	PurgeObject(ctx context.Context, objectID string) error
+
+	// RecordEgress adds bytes served from a bucket to its egress counters in
+	// cost_tracking; anonymous bytes are also counted on their own
+	RecordEgress(ctx context.Context, bucketName string, bytes int64, anonymous bool) error
+
+	// Placement operations. UpdateObjectPlacement replaces the placement
+	// of a committed object, provided it is still expected; otherwise it
+	// returns ErrPlacementConflict.
+	UpdateObjectPlacement(ctx context.Context, objectID string, expected, nodeIDs []string) error
+
+	// ReplicaPlacements maps each replica key that names an object (in any
+	// state) or a multipart part to the nodes it is placed on. Keys owned
+	// by neither are absent from the result.
+	ReplicaPlacements(ctx context.Context, keys []string) (map[string][]string, error)
+
+	// Repair operations. Replicas on offlineNodes do not count towards the
+	// replication factor; the objects with the fewest live replicas come first.
+	FindUnderReplicatedObjects(ctx context.Context, replicationFactor int, offlineNodes []string, limit int) ([]*Object, error)
+	CreateRepair(ctx context.Context, rec *RepairRecord) error
+	// UpdateRepair returns ErrObjectNotFound if the record is gone or
+	// another worker has taken over its claim
+	UpdateRepair(ctx context.Context, rec *RepairRecord) error
+	ListRepairs(ctx context.Context, status RepairStatus, limit int) ([]*RepairRecord, error)
+
+	// Repair queue. EnqueueRepair adds a pending repair, merging it into a
+	// pending repair of the same issue on the same object: the targets are
+	// combined and the lower remaining-replica count kept. ClaimRepairs
+	// marks up to limit repairs in progress for holder until ttl passes and
+	// returns them in queue order. It takes pending repairs and in-progress
+	// ones whose claim has expired; concurrent claimers never get the same
+	// record. RenewRepairClaim extends holder's claim on an in-progress
+	// repair until ttl passes; it returns ErrObjectNotFound if the repair
+	// is gone, finished or claimed by another worker.
+	EnqueueRepair(ctx context.Context, rec *RepairRecord) error
+	ClaimRepairs(ctx context.Context, holder string, ttl time.Duration, limit int) ([]*RepairRecord, error)
+	RenewRepairClaim(ctx context.Context, id, holder string, ttl time.Duration) error
+	RepairQueueDepth(ctx context.Context) ([]RepairQueueDepth, error)
+
+	// Scrub progress, one row per data node. GetScrubProgress returns a
+	// fresh record for a node that has never been scrubbed.
+	GetScrubProgress(ctx context.Context, nodeID string) (*ScrubProgress, error)
+	SaveScrubProgress(ctx context.Context, p *ScrubProgress) error
+	ListScrubProgress(ctx context.Context) ([]*ScrubProgress, error)
+
+	// Leases coordinate repair processes. AcquireLease takes or renews the
+	// named lease for holder until ttl passes and reports whether holder
+	// has it; it fails while another holder's lease is unexpired.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, holder string) error
+	ListLeases(ctx context.Context) ([]*Lease, error)
+
+	// Access keys. PutAccessKey creates the key or replaces its secret,
+	// status and expiry; it returns ErrUserNotFound if the key's user does
+	// not exist. ListAccessKeys lists a user's keys, or the root keys for
+	// an empty user name, oldest first.
+	GetAccessKey(ctx context.Context, accessKeyID string) (*AccessKey, error)
+	PutAccessKey(ctx context.Context, key *AccessKey) error
+	ListAccessKeys(ctx context.Context, userName string) ([]*AccessKey, error)
+	DeleteAccessKey(ctx context.Context, accessKeyID string) error
+
+	// Users and groups. Deleting a user deletes its access keys and group
+	// memberships; deleting a group leaves its members in place.
+	CreateUser(ctx context.Context, name string) (*User, error)
+	GetUser(ctx context.Context, name string) (*User, error)
+	ListUsers(ctx context.Context) ([]*User, error)
+	DeleteUser(ctx context.Context, name string) error
+	CreateGroup(ctx context.Context, name string) (*Group, error)
+	GetGroup(ctx context.Context, name string) (*Group, error)
+	ListGroups(ctx context.Context) ([]*Group, error)
+	DeleteGroup(ctx context.Context, name string) error
+	AddGroupMember(ctx context.Context, groupName, userName string) error
+	RemoveGroupMember(ctx context.Context, groupName, userName string) error
+	// SetUserQuota replaces the quota on the buckets a user owns; nil
+	// removes it
+	SetUserQuota(ctx context.Context, name string, quota *Quota) error
+
+	// Quotas. BucketUsage and UserUsage read the usage counters kept in
+	// cost_tracking; a user's usage is that of the buckets it owns.
+	BucketUsage(ctx context.Context, bucketName string) (Usage, error)
+	UserUsage(ctx context.Context, userName string) (Usage, error)
+	RecordQuotaEvent(ctx context.Context, event *QuotaEvent) error
+	// ListQuotaEvents returns up to limit events, newest first
+	ListQuotaEvents(ctx context.Context, limit int) ([]*QuotaEvent, error)
 
-	// Placement operations
-	UpdateObjectPlacement(ctx context.Context, objectID string, nodeIDs []string) error
+	// Rate limits. GetRateLimitConfig returns the JSON configuration last
+	// set with SetRateLimitConfig, or "" if none has been. Gateways sharing
+	// their limits call SyncRateLimitUsage with the totals they have
+	// charged to each key, and get back the sums of what the other
+	// gateways reported for those keys within RateLimitUsageTTL.
+	GetRateLimitConfig(ctx context.Context) (string, error)
+	SetRateLimitConfig(ctx context.Context, config string) error
+	SyncRateLimitUsage(ctx context.Context, gatewayID string, usage map[string]RateLimitUsage) (map[string]RateLimitUsage, error)
 
-	// Repair operations
-	FindUnderReplicatedObjects(ctx context.Context, replicationFactor int) ([]*Object, error)
+	// Master key rotation. ListDataKeys returns up to limit data keys of
+	// objects and active multipart uploads wrapped with a master key other
+	// than keyID, leaving out data encrypted with customer-provided keys,
+	// which have none. RewrapDataKey replaces one with the same data key wrapped
+	// with master key keyID; it returns ErrObjectNotFound if the object or
+	// upload is gone or its key was rewrapped since it was listed.
+	ListDataKeys(ctx context.Context, keyID string, limit int) ([]*DataKey, error)
+	RewrapDataKey(ctx context.Context, key *DataKey, keyID string, wrapped []byte) error
 }
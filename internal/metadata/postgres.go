@@ -0,0 +1,2308 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mrmushfiq/plinth/internal/checksum"
+)
+
+// PostgresService implements Service on top of the PostgreSQL schema in
+// deploy/sql/init.sql
+type PostgresService struct {
+	db *sql.DB
+}
+
+var _ Service = (*PostgresService)(nil)
+
+// NewPostgresService creates a metadata service backed by db
+func NewPostgresService(db *sql.DB) *PostgresService {
+	return &PostgresService{db: db}
+}
+
+// DSN builds a lib/pq connection string
+func DSN(host, port, user, password, dbName string) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbName)
+}
+
+// SQLSTATE codes checked by the service
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+)
+
+// Bucket operations
+
+func (s *PostgresService) CreateBucket(ctx context.Context, name, owner string) (*Bucket, error) {
+	b, err := scanBucket(s.db.QueryRowContext(ctx, `
+		INSERT INTO buckets (name, owner) VALUES ($1, $2)
+		RETURNING `+bucketColumns,
+		name, sql.NullString{String: owner, Valid: owner != ""},
+	))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+			return nil, ErrBucketExists
+		}
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("create bucket: %w", err)
+	}
+	return b, nil
+}
+
+func (s *PostgresService) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	b, err := scanBucket(s.db.QueryRowContext(ctx, `
+		SELECT `+bucketColumns+`
+		FROM buckets WHERE name = $1`,
+		name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBucketNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get bucket: %w", err)
+	}
+	return b, nil
+}
+
+func (s *PostgresService) DeleteBucket(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("delete bucket: %w", err)
+	}
+	defer tx.Rollback()
+
+	var hasObjects bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM objects
+			WHERE bucket_name = $1 AND state <> 'tombstoned'
+		)`,
+		name,
+	).Scan(&hasObjects)
+	if err != nil {
+		return fmt.Errorf("delete bucket: %w", err)
+	}
+	if hasObjects {
+		return ErrBucketNotEmpty
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM buckets WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("delete bucket: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresService) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+bucketColumns+`
+		FROM buckets ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list buckets: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []*Bucket
+	for rows.Next() {
+		b, err := scanBucket(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list buckets: %w", err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *PostgresService) SetBucketRepairPriority(ctx context.Context, name string, priority int) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET repair_priority = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, priority,
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket repair priority: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketLifecycle(ctx context.Context, name string, rules []LifecycleRule) error {
+	var lifecycle []byte
+	if len(rules) > 0 {
+		var err error
+		if lifecycle, err = json.Marshal(rules); err != nil {
+			return err
+		}
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET lifecycle = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, lifecycle,
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket lifecycle: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketPolicy(ctx context.Context, name, policy string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET policy = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, sql.NullString{String: policy, Valid: policy != ""},
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket policy: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketACL(ctx context.Context, name string, acl CannedACL) error {
+	if acl != ACLPrivate && acl != ACLPublicRead {
+		return fmt.Errorf("set bucket acl: invalid canned ACL %q", acl)
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET acl = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, string(acl),
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket acl: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketPublicAccessBlock(ctx context.Context, name string, block *PublicAccessBlock) error {
+	var config []byte
+	if block != nil {
+		var err error
+		if config, err = json.Marshal(block); err != nil {
+			return err
+		}
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET public_access_block = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, config,
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket public access block: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketQuota(ctx context.Context, name string, quota *Quota) error {
+	config, err := marshalQuota(quota)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET quota = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, config,
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket quota: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) SetBucketEncryption(ctx context.Context, name, algorithm string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET default_encryption = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, sql.NullString{String: algorithm, Valid: algorithm != ""},
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket encryption: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+// marshalEncryption encodes encryption for a JSONB column, nil if the data
+// is not encrypted
+func marshalEncryption(encryption *Encryption) ([]byte, error) {
+	if encryption == nil {
+		return nil, nil
+	}
+	return json.Marshal(encryption)
+}
+
+// marshalQuota encodes a quota for a JSONB column, nil for no quota
+func marshalQuota(quota *Quota) ([]byte, error) {
+	if quota == nil {
+		return nil, nil
+	}
+	return json.Marshal(quota)
+}
+
+// SetBucketVersioning refuses to return a bucket to unversioned: its null
+// versions and the rest would no longer be told apart
+func (s *PostgresService) SetBucketVersioning(ctx context.Context, name string, status VersioningStatus) error {
+	if status != VersioningEnabled && status != VersioningSuspended {
+		return fmt.Errorf("set bucket versioning: invalid status %q", status)
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE buckets SET versioning_status = $2, updated_at = NOW()
+		WHERE name = $1`,
+		name, string(status),
+	)
+	if err != nil {
+		return fmt.Errorf("set bucket versioning: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+// bucketColumns is the column list read by scanBucket
+const bucketColumns = `id, name, versioning_status, region, repair_priority, lifecycle, owner, policy,
+	acl, public_access_block, quota, default_encryption, created_at, updated_at`
+
+func scanBucket(row rowScanner) (*Bucket, error) {
+	b := &Bucket{}
+	var (
+		versioning    sql.NullString
+		lifecycle     []byte
+		owner, policy sql.NullString
+		acl           string
+		block, quota  []byte
+		encryption    sql.NullString
+	)
+	err := row.Scan(&b.ID, &b.Name, &versioning, &b.Region, &b.RepairPriority, &lifecycle,
+		&owner, &policy, &acl, &block, &quota, &encryption, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	b.Versioning = VersioningStatus(versioning.String)
+	b.Owner, b.Policy = owner.String, policy.String
+	b.ACL = CannedACL(acl)
+	b.Encryption = encryption.String
+	if err := unmarshalJSON(lifecycle, &b.Lifecycle); err != nil {
+		return nil, fmt.Errorf("bucket %s: lifecycle: %w", b.Name, err)
+	}
+	if err := unmarshalJSON(block, &b.PublicAccessBlock); err != nil {
+		return nil, fmt.Errorf("bucket %s: public access block: %w", b.Name, err)
+	}
+	if err := unmarshalJSON(quota, &b.Quota); err != nil {
+		return nil, fmt.Errorf("bucket %s: quota: %w", b.Name, err)
+	}
+	return b, nil
+}
+
+// Object operations
+
+// objectColumns is the column list read by scanObject
+const objectColumns = `id, bucket_name, object_key, version_id, null_version, is_latest, is_delete_marker,
+	size_bytes, etag, content_type, checksum, s3_checksum, s3_checksum_type, parts_count,
+	placement, state, metadata, tags, encryption, noncurrent_at, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanObject(row rowScanner) (*Object, error) {
+	obj := &Object{}
+	var (
+		contentType, sum, s3Sum, s3SumType sql.NullString
+		partsCount                         sql.NullInt64
+		placement, meta, tags, encryption  []byte
+		noncurrentAt                       sql.NullTime
+	)
+	err := row.Scan(&obj.ID, &obj.BucketName, &obj.ObjectKey, &obj.VersionID, &obj.NullVersion, &obj.IsLatest,
+		&obj.IsDeleteMarker, &obj.SizeBytes, &obj.ETag, &contentType, &sum, &s3Sum, &s3SumType,
+		&partsCount, &placement, &obj.State, &meta, &tags, &encryption, &noncurrentAt, &obj.CreatedAt, &obj.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	obj.NoncurrentAt = noncurrentAt.Time
+	obj.ContentType = contentType.String
+	obj.S3ChecksumType = checksum.Type(s3SumType.String)
+	obj.PartsCount = int(partsCount.Int64)
+	if err := obj.Checksum.UnmarshalText([]byte(sum.String)); err != nil {
+		return nil, fmt.Errorf("object %s: checksum: %w", obj.ID, err)
+	}
+	if err := obj.S3Checksum.UnmarshalText([]byte(s3Sum.String)); err != nil {
+		return nil, fmt.Errorf("object %s: s3 checksum: %w", obj.ID, err)
+	}
+	if err := unmarshalJSON(placement, &obj.Placement); err != nil {
+		return nil, fmt.Errorf("object %s: placement: %w", obj.ID, err)
+	}
+	if err := unmarshalJSON(meta, &obj.Metadata); err != nil {
+		return nil, fmt.Errorf("object %s: metadata: %w", obj.ID, err)
+	}
+	if err := unmarshalJSON(tags, &obj.Tags); err != nil {
+		return nil, fmt.Errorf("object %s: tags: %w", obj.ID, err)
+	}
+	if err := unmarshalJSON(encryption, &obj.Encryption); err != nil {
+		return nil, fmt.Errorf("object %s: encryption: %w", obj.ID, err)
+	}
+	return obj, nil
+}
+
+func (s *PostgresService) CreateObject(ctx context.Context, obj *Object) error {
+	placement, err := json.Marshal(obj.Placement)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(obj.Metadata)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(obj.Tags)
+	if err != nil {
+		return err
+	}
+	encryption, err := marshalEncryption(obj.Encryption)
+	if err != nil {
+		return err
+	}
+	sum, _ := obj.Checksum.MarshalText()
+	s3Sum, _ := obj.S3Checksum.MarshalText()
+	if obj.State == "" {
+		obj.State = ObjectStateCommitted
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create object: %w", err)
+	}
+	defer tx.Rollback()
+
+	if obj.IsLatest {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE objects SET is_latest = FALSE, noncurrent_at = NOW()
+			WHERE bucket_name = $1 AND object_key = $2 AND is_latest`,
+			obj.BucketName, obj.ObjectKey,
+		); err != nil {
+			return fmt.Errorf("create object: %w", err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO objects (id, bucket_name, object_key, version_id, is_latest, is_delete_marker,
+			size_bytes, etag, content_type, checksum, s3_checksum, s3_checksum_type, parts_count,
+			placement, state, metadata, tags, null_version, encryption)
+		VALUES (COALESCE(NULLIF($1, '')::uuid, uuid_generate_v4()), $2, $3,
+			COALESCE(NULLIF($4, '')::uuid, uuid_generate_v4()), $5, $6, $7, $8, $9,
+			NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, ''), $13, $14, $15, $16, $17, $18, $19)
+		RETURNING id, version_id, created_at, updated_at`,
+		obj.ID, obj.BucketName, obj.ObjectKey, obj.VersionID, obj.IsLatest, obj.IsDeleteMarker,
+		obj.SizeBytes, obj.ETag, obj.ContentType, string(sum), string(s3Sum), string(obj.S3ChecksumType),
+		obj.PartsCount, placement, obj.State, meta, tags, obj.NullVersion, encryption,
+	).Scan(&obj.ID, &obj.VersionID, &obj.CreatedAt, &obj.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("create object: %w", err)
+	}
+	if obj.State == ObjectStateCommitted && !obj.IsDeleteMarker {
+		if err := addBucketUsage(ctx, tx, obj.BucketName, obj.SizeBytes, 1); err != nil {
+			return fmt.Errorf("create object: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresService) GetObject(ctx context.Context, bucketName, objectKey string) (*Object, error) {
+	obj, err := scanObject(s.db.QueryRowContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE bucket_name = $1 AND object_key = $2 AND is_latest
+			AND state = 'committed' AND NOT is_delete_marker`,
+		bucketName, objectKey,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get object: %w", err)
+	}
+	return obj, nil
+}
+
+func (s *PostgresService) GetObjectVersion(ctx context.Context, bucketName, objectKey, versionID string) (*Object, error) {
+	obj, err := scanObject(s.db.QueryRowContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE bucket_name = $1 AND object_key = $2 AND state = 'committed'
+			AND `+versionMatch("$3"),
+		bucketName, objectKey, versionID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get object version: %w", err)
+	}
+	return obj, nil
+}
+
+func (s *PostgresService) GetObjectByID(ctx context.Context, objectID string) (*Object, error) {
+	if !isUUID(objectID) {
+		return nil, ErrObjectNotFound
+	}
+	obj, err := scanObject(s.db.QueryRowContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE id = $1::uuid`,
+		objectID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get object by id: %w", err)
+	}
+	return obj, nil
+}
+
+// versionMatch is the condition selecting the version whose S3 version ID
+// is the parameter param, which may be NullVersionID
+func versionMatch(param string) string {
+	return `CASE WHEN ` + param + ` = '` + NullVersionID + `' THEN null_version
+		ELSE version_id::text = ` + param + ` END`
+}
+
+// bucketVersioning returns the versioning status of a bucket within tx
+func bucketVersioning(ctx context.Context, tx *sql.Tx, bucketName string) (VersioningStatus, error) {
+	var status sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT versioning_status FROM buckets WHERE name = $1`, bucketName).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrBucketNotFound
+	}
+	return VersioningStatus(status.String), err
+}
+
+// replaceLatest demotes the latest version of a key other than exceptID
+// before a new version takes its place. A new null version also replaces
+// the key's current null version, which is tombstoned.
+func replaceLatest(ctx context.Context, tx *sql.Tx, bucketName, objectKey, exceptID string, nullVersion bool) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE objects SET
+			is_latest = FALSE,
+			noncurrent_at = NOW(),
+			state = CASE WHEN $4 AND null_version THEN 'tombstoned'::object_state ELSE state END
+		WHERE bucket_name = $1 AND object_key = $2 AND id::text <> $3
+			AND (is_latest OR ($4 AND null_version AND state = 'committed'))`,
+		bucketName, objectKey, exceptID, nullVersion,
+	)
+	return err
+}
+
+func (s *PostgresService) DeleteObject(ctx context.Context, bucketName, objectKey string) (*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("delete object: %w", err)
+	}
+	defer tx.Rollback()
+
+	versioning, err := bucketVersioning(ctx, tx, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("delete object: %w", err)
+	}
+
+	if versioning == "" {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE objects SET state = 'tombstoned', is_latest = FALSE, noncurrent_at = NOW()
+			WHERE bucket_name = $1 AND object_key = $2 AND is_latest AND state = 'committed'`,
+			bucketName, objectKey,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("delete object: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil, ErrObjectNotFound
+		}
+		return nil, tx.Commit()
+	}
+
+	// With versioning suspended the marker is the null version
+	nullVersion := versioning == VersioningSuspended
+	if err := replaceLatest(ctx, tx, bucketName, objectKey, "", nullVersion); err != nil {
+		return nil, fmt.Errorf("delete object: %w", err)
+	}
+	marker, err := scanObject(tx.QueryRowContext(ctx, `
+		INSERT INTO objects (bucket_name, object_key, null_version, is_latest, is_delete_marker,
+			size_bytes, etag, placement, state)
+		VALUES ($1, $2, $3, TRUE, TRUE, 0, '', '[]', 'committed')
+		RETURNING `+objectColumns,
+		bucketName, objectKey, nullVersion,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("delete object: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("delete object: %w", err)
+	}
+	return marker, nil
+}
+
+// DeleteObjectVersion locks the key's versions so the version promoted in
+// place of a deleted latest one cannot race a write of the key
+func (s *PostgresService) DeleteObjectVersion(ctx context.Context, bucketName, objectKey, versionID string) (*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("delete object version: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		SELECT 1 FROM objects WHERE bucket_name = $1 AND object_key = $2 FOR UPDATE`,
+		bucketName, objectKey,
+	); err != nil {
+		return nil, fmt.Errorf("delete object version: %w", err)
+	}
+	obj, err := scanObject(tx.QueryRowContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE bucket_name = $1 AND object_key = $2 AND state = 'committed'
+			AND `+versionMatch("$3"),
+		bucketName, objectKey, versionID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("delete object version: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE objects SET state = 'tombstoned', is_latest = FALSE, noncurrent_at = NOW()
+		WHERE id = $1`,
+		obj.ID,
+	); err != nil {
+		return nil, fmt.Errorf("delete object version: %w", err)
+	}
+	if obj.IsLatest {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE objects SET is_latest = TRUE, noncurrent_at = NULL
+			WHERE id = (
+				SELECT id FROM objects
+				WHERE bucket_name = $1 AND object_key = $2 AND state = 'committed'
+				ORDER BY created_at DESC, id DESC
+				LIMIT 1
+			)`,
+			bucketName, objectKey,
+		); err != nil {
+			return nil, fmt.Errorf("delete object version: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("delete object version: %w", err)
+	}
+	return obj, nil
+}
+
+func (s *PostgresService) ListObjects(ctx context.Context, bucketName, prefix, after string, limit int) ([]*Object, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE bucket_name = $1 AND starts_with(object_key, $2) AND object_key > $3
+			AND is_latest AND state = 'committed' AND NOT is_delete_marker
+		ORDER BY object_key
+		LIMIT $4`,
+		bucketName, prefix, after, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	return collectObjects(rows)
+}
+
+// ListObjectVersions pages through a key's versions by creation time. The
+// version marker is looked up among tombstoned versions too, so a version
+// deleted between pages does not restart its key.
+func (s *PostgresService) ListObjectVersions(ctx context.Context, bucketName, prefix, keyMarker, versionIDMarker string, limit int) ([]*Object, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE bucket_name = $1 AND starts_with(object_key, $2) AND state = 'committed'
+			AND (object_key > $3 OR (object_key = $3 AND (created_at, id) < (
+				SELECT created_at, id FROM objects
+				WHERE bucket_name = $1 AND object_key = $3 AND $4 <> '' AND state <> 'pending'
+					AND `+versionMatch("$4")+`
+				ORDER BY state = 'committed' DESC, created_at DESC
+				LIMIT 1
+			)))
+		ORDER BY object_key, created_at DESC, id DESC
+		LIMIT $5`,
+		bucketName, prefix, keyMarker, versionIDMarker, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list object versions: %w", err)
+	}
+	return collectObjects(rows)
+}
+
+// CommitObject records the final size, ETag, checksums and placement of a
+// pending object and makes it the latest version of its key. Unless
+// versioning is enabled it becomes the key's null version, and the null
+// version it replaces is tombstoned.
+func (s *PostgresService) CommitObject(ctx context.Context, obj *Object) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := commitObject(ctx, tx, obj); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+	obj.State = ObjectStateCommitted
+	obj.IsLatest = true
+	return nil
+}
+
+// commitObject is CommitObject within tx
+func commitObject(ctx context.Context, tx *sql.Tx, obj *Object) error {
+	placement, err := json.Marshal(obj.Placement)
+	if err != nil {
+		return err
+	}
+	encryption, err := marshalEncryption(obj.Encryption)
+	if err != nil {
+		return err
+	}
+	sum, _ := obj.Checksum.MarshalText()
+	s3Sum, _ := obj.S3Checksum.MarshalText()
+
+	versioning, err := bucketVersioning(ctx, tx, obj.BucketName)
+	if err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+	nullVersion := versioning != VersioningEnabled
+	if err := replaceLatest(ctx, tx, obj.BucketName, obj.ObjectKey, obj.ID, nullVersion); err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE objects SET
+			state = 'committed', is_latest = TRUE, null_version = $9, size_bytes = $2, etag = $3,
+			checksum = NULLIF($4, ''), s3_checksum = NULLIF($5, ''),
+			s3_checksum_type = NULLIF($6, ''), parts_count = $7, placement = $8, encryption = $10
+		WHERE id = $1 AND state = 'pending'
+		RETURNING created_at, updated_at`,
+		obj.ID, obj.SizeBytes, obj.ETag, string(sum), string(s3Sum),
+		string(obj.S3ChecksumType), obj.PartsCount, placement, nullVersion, encryption,
+	).Scan(&obj.CreatedAt, &obj.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+	obj.NullVersion = nullVersion
+	if err := addBucketUsage(ctx, tx, obj.BucketName, obj.SizeBytes, 1); err != nil {
+		return fmt.Errorf("commit object: %w", err)
+	}
+	return nil
+}
+
+// addBucketUsage adjusts the bytes and object count that a bucket's storage
+// cost is estimated from. Counts never drop below zero, so versions stored
+// before the counters were kept cannot drive them negative when purged.
+func addBucketUsage(ctx context.Context, tx *sql.Tx, bucketName string, bytes, objects int64) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE cost_tracking SET
+			total_bytes = GREATEST(total_bytes + $2, 0),
+			object_count = GREATEST(object_count + $3, 0),
+			last_calculated_at = NOW()
+		WHERE bucket_name = $1`,
+		bucketName, bytes, objects,
+	)
+	return err
+}
+
+func (s *PostgresService) RecordEgress(ctx context.Context, bucketName string, bytes int64, anonymous bool) error {
+	anonymousBytes := int64(0)
+	if anonymous {
+		anonymousBytes = bytes
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE cost_tracking SET
+			bytes_read_current_month = bytes_read_current_month + $2,
+			anonymous_bytes_read_current_month = anonymous_bytes_read_current_month + $3,
+			updated_at = NOW()
+		WHERE bucket_name = $1`,
+		bucketName, bytes, anonymousBytes,
+	)
+	if err != nil {
+		return fmt.Errorf("record egress: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) ListPendingObjects(ctx context.Context, cutoff time.Time, limit int) ([]*Object, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE state = 'pending' AND created_at < $1
+		ORDER BY created_at, id
+		LIMIT $2`,
+		cutoff, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list pending objects: %w", err)
+	}
+	return collectObjects(rows)
+}
+
+// CommitPendingObject locks the key's versions so a concurrent write
+// cannot slip in between the check and the commit
+func (s *PostgresService) CommitPendingObject(ctx context.Context, obj *Object) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("commit pending object: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		SELECT 1 FROM objects WHERE bucket_name = $1 AND object_key = $2 FOR UPDATE`,
+		obj.BucketName, obj.ObjectKey,
+	); err != nil {
+		return fmt.Errorf("commit pending object: %w", err)
+	}
+
+	var superseded bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM objects o, objects p
+			WHERE p.id = $1 AND p.state = 'pending'
+				AND o.bucket_name = p.bucket_name AND o.object_key = p.object_key
+				AND o.id <> p.id AND o.state <> 'pending' AND o.created_at > p.created_at
+		)`,
+		obj.ID,
+	).Scan(&superseded)
+	if err != nil {
+		return fmt.Errorf("commit pending object: %w", err)
+	}
+	if superseded {
+		return ErrObjectSuperseded
+	}
+	if err := commitObject(ctx, tx, obj); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit pending object: %w", err)
+	}
+	obj.State = ObjectStateCommitted
+	obj.IsLatest = true
+	return nil
+}
+
+// AbortObject removes the record of a pending object
+func (s *PostgresService) AbortObject(ctx context.Context, objectID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM objects WHERE id = $1 AND state = 'pending'`, objectID)
+	if err != nil {
+		return fmt.Errorf("abort object: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+// Multipart operations
+
+// uploadColumns is the column list read by scanUpload
+const uploadColumns = `upload_id, bucket_name, object_key, content_type, checksum_algorithm,
+	checksum_type, encryption, metadata, state, initiated_at`
+
+func scanUpload(row rowScanner) (*MultipartUpload, error) {
+	u := &MultipartUpload{}
+	var (
+		contentType, algo, sumType sql.NullString
+		encryption, meta           []byte
+	)
+	err := row.Scan(&u.UploadID, &u.BucketName, &u.ObjectKey, &contentType, &algo, &sumType,
+		&encryption, &meta, &u.State, &u.InitiatedAt)
+	if err != nil {
+		return nil, err
+	}
+	u.ContentType = contentType.String
+	u.ChecksumAlgorithm = checksum.Algorithm(algo.String)
+	u.ChecksumType = checksum.Type(sumType.String)
+	if err := unmarshalJSON(encryption, &u.Encryption); err != nil {
+		return nil, fmt.Errorf("upload %s: encryption: %w", u.UploadID, err)
+	}
+	if err := unmarshalJSON(meta, &u.Metadata); err != nil {
+		return nil, fmt.Errorf("upload %s: metadata: %w", u.UploadID, err)
+	}
+	return u, nil
+}
+
+// partColumns is the column list read by scanPart
+const partColumns = `id, upload_id, part_number, size_bytes, etag, checksum, s3_checksum,
+	placement, uploaded_at`
+
+func scanPart(row rowScanner) (*Part, error) {
+	p := &Part{}
+	var (
+		sum, s3Sum sql.NullString
+		placement  []byte
+	)
+	err := row.Scan(&p.ID, &p.UploadID, &p.PartNumber, &p.SizeBytes, &p.ETag, &sum, &s3Sum,
+		&placement, &p.UploadedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Checksum.UnmarshalText([]byte(sum.String)); err != nil {
+		return nil, fmt.Errorf("part %s: checksum: %w", p.ID, err)
+	}
+	if err := p.S3Checksum.UnmarshalText([]byte(s3Sum.String)); err != nil {
+		return nil, fmt.Errorf("part %s: s3 checksum: %w", p.ID, err)
+	}
+	if err := unmarshalJSON(placement, &p.Placement); err != nil {
+		return nil, fmt.Errorf("part %s: placement: %w", p.ID, err)
+	}
+	return p, nil
+}
+
+func (s *PostgresService) CreateMultipartUpload(ctx context.Context, upload *MultipartUpload) error {
+	meta, err := json.Marshal(upload.Metadata)
+	if err != nil {
+		return err
+	}
+	encryption, err := marshalEncryption(upload.Encryption)
+	if err != nil {
+		return err
+	}
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO multipart_uploads (upload_id, bucket_name, object_key, content_type,
+			checksum_algorithm, checksum_type, encryption, metadata)
+		VALUES (COALESCE(NULLIF($1, '')::uuid, uuid_generate_v4()), $2, $3, $4,
+			NULLIF($5, ''), NULLIF($6, ''), $7, $8)
+		RETURNING upload_id, state, initiated_at`,
+		upload.UploadID, upload.BucketName, upload.ObjectKey, upload.ContentType,
+		string(upload.ChecksumAlgorithm), string(upload.ChecksumType), encryption, meta,
+	).Scan(&upload.UploadID, &upload.State, &upload.InitiatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			return ErrBucketNotFound
+		}
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) GetMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) (*MultipartUpload, error) {
+	if !isUUID(uploadID) {
+		return nil, ErrUploadNotFound
+	}
+	u, err := scanUpload(s.db.QueryRowContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE upload_id = $1::uuid AND bucket_name = $2 AND object_key = $3 AND state = 'active'`,
+		uploadID, bucketName, objectKey,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get multipart upload: %w", err)
+	}
+	return u, nil
+}
+
+func (s *PostgresService) ListMultipartUploads(ctx context.Context, bucketName, prefix string, limit int) ([]*MultipartUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE bucket_name = $1 AND starts_with(object_key, $2) AND state = 'active'
+		ORDER BY object_key, initiated_at
+		LIMIT $3`,
+		bucketName, prefix, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list multipart uploads: %w", err)
+	}
+	defer rows.Close()
+
+	var uploads []*MultipartUpload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// PutPart records an uploaded part, replacing any earlier upload of the same
+// part number. The replaced part is returned so its replicas can be deleted.
+func (s *PostgresService) PutPart(ctx context.Context, part *Part) (*Part, error) {
+	if !isUUID(part.UploadID) {
+		return nil, ErrUploadNotFound
+	}
+	placement, err := json.Marshal(part.Placement)
+	if err != nil {
+		return nil, err
+	}
+	sum, _ := part.Checksum.MarshalText()
+	s3Sum, _ := part.S3Checksum.MarshalText()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("put part: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Holding the upload row keeps a concurrent complete or abort from
+	// missing this part.
+	var state UploadState
+	err = tx.QueryRowContext(ctx, `
+		SELECT state FROM multipart_uploads WHERE upload_id = $1::uuid FOR SHARE`,
+		part.UploadID,
+	).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && state != UploadStateActive) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("put part: %w", err)
+	}
+
+	replaced, err := scanPart(tx.QueryRowContext(ctx, `
+		DELETE FROM multipart_parts WHERE upload_id = $1::uuid AND part_number = $2
+		RETURNING `+partColumns,
+		part.UploadID, part.PartNumber,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		replaced = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("put part: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO multipart_parts (id, upload_id, part_number, size_bytes, etag, checksum,
+			s3_checksum, placement)
+		VALUES (COALESCE(NULLIF($1, '')::uuid, uuid_generate_v4()), $2::uuid, $3, $4, $5,
+			NULLIF($6, ''), NULLIF($7, ''), $8)
+		RETURNING id, uploaded_at`,
+		part.ID, part.UploadID, part.PartNumber, part.SizeBytes, part.ETag, string(sum),
+		string(s3Sum), placement,
+	).Scan(&part.ID, &part.UploadedAt)
+	if err != nil {
+		return nil, fmt.Errorf("put part: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("put part: %w", err)
+	}
+	return replaced, nil
+}
+
+func (s *PostgresService) ListParts(ctx context.Context, uploadID string) ([]*Part, error) {
+	if !isUUID(uploadID) {
+		return nil, ErrUploadNotFound
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+partColumns+`
+		FROM multipart_parts
+		WHERE upload_id = $1::uuid
+		ORDER BY part_number`,
+		uploadID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list parts: %w", err)
+	}
+	return collectParts(rows)
+}
+
+// CompleteMultipartUpload commits the pending object assembled from the
+// upload's parts, marks the upload completed and forgets its parts, all in
+// one transaction
+func (s *PostgresService) CompleteMultipartUpload(ctx context.Context, uploadID string, obj *Object) error {
+	if !isUUID(uploadID) {
+		return ErrUploadNotFound
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE multipart_uploads SET state = 'completed'
+		WHERE upload_id = $1::uuid AND state = 'active'`,
+		uploadID,
+	)
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUploadNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM multipart_parts WHERE upload_id = $1::uuid`, uploadID); err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	if err := commitObject(ctx, tx, obj); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	obj.State = ObjectStateCommitted
+	obj.IsLatest = true
+	return nil
+}
+
+// AbortMultipartUpload marks an upload aborted and returns its parts, whose
+// records are removed
+func (s *PostgresService) AbortMultipartUpload(ctx context.Context, uploadID string) ([]*Part, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("abort multipart upload: %w", err)
+	}
+	defer tx.Rollback()
+
+	parts, err := abortUpload(ctx, tx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("abort multipart upload: %w", err)
+	}
+	return parts, nil
+}
+
+// abortUpload is AbortMultipartUpload within tx
+func abortUpload(ctx context.Context, tx *sql.Tx, uploadID string) ([]*Part, error) {
+	if !isUUID(uploadID) {
+		return nil, ErrUploadNotFound
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE multipart_uploads SET state = 'aborted'
+		WHERE upload_id = $1::uuid AND state = 'active'`,
+		uploadID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("abort multipart upload: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrUploadNotFound
+	}
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM multipart_parts WHERE upload_id = $1::uuid
+		RETURNING `+partColumns,
+		uploadID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("abort multipart upload: %w", err)
+	}
+	parts, err := collectParts(rows)
+	if err != nil {
+		return nil, fmt.Errorf("abort multipart upload: %w", err)
+	}
+	return parts, nil
+}
+
+func (s *PostgresService) ListStaleMultipartUploads(ctx context.Context, bucketName, prefix string, cutoff time.Time, limit int) ([]*MultipartUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE bucket_name = $1 AND starts_with(object_key, $2) AND state = 'active'
+			AND initiated_at < $3
+		ORDER BY initiated_at
+		LIMIT $4`,
+		bucketName, prefix, cutoff, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list stale multipart uploads: %w", err)
+	}
+	defer rows.Close()
+
+	var uploads []*MultipartUpload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// ExpireMultipartUpload records the reclaimed bytes in the same transaction
+// as the abort, so each expired upload is counted exactly once
+func (s *PostgresService) ExpireMultipartUpload(ctx context.Context, uploadID string) ([]*Part, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("expire multipart upload: %w", err)
+	}
+	defer tx.Rollback()
+
+	parts, err := abortUpload(ctx, tx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, part := range parts {
+		size += part.SizeBytes
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE cost_tracking SET
+			reclaimed_multipart_bytes = reclaimed_multipart_bytes + $2,
+			expired_multipart_uploads = expired_multipart_uploads + 1,
+			last_calculated_at = NOW()
+		WHERE bucket_name = (SELECT bucket_name FROM multipart_uploads WHERE upload_id = $1::uuid)`,
+		uploadID, size,
+	); err != nil {
+		return nil, fmt.Errorf("expire multipart upload: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("expire multipart upload: %w", err)
+	}
+	return parts, nil
+}
+
+// Placement operations
+
+// UpdateObjectPlacement only changes the placement read before the
+// replicas were moved, so it cannot undo a concurrent repair, overwrite or
+// deletion of the object
+func (s *PostgresService) UpdateObjectPlacement(ctx context.Context, objectID string, expected, nodeIDs []string) error {
+	if !isUUID(objectID) {
+		return ErrObjectNotFound
+	}
+	from, err := json.Marshal(expected)
+	if err != nil {
+		return err
+	}
+	placement, err := json.Marshal(nodeIDs)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE objects SET placement = $3
+		WHERE id = $1::uuid AND state = 'committed' AND placement = $2::jsonb`,
+		objectID, from, placement,
+	)
+	if err != nil {
+		return fmt.Errorf("update placement: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPlacementConflict
+	}
+	return nil
+}
+
+func (s *PostgresService) ReplicaPlacements(ctx context.Context, keys []string) (map[string][]string, error) {
+	// Replica keys are object and part IDs; anything else cannot be owned
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if isUUID(key) {
+			ids = append(ids, key)
+		}
+	}
+	placements := make(map[string][]string, len(ids))
+	if len(ids) == 0 {
+		return placements, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id::text, placement FROM objects WHERE id = ANY($1::uuid[])
+		UNION ALL
+		SELECT id::text, placement FROM multipart_parts WHERE id = ANY($1::uuid[])`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("replica placements: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id        string
+			placement []byte
+			nodeIDs   []string
+		)
+		if err := rows.Scan(&id, &placement); err != nil {
+			return nil, fmt.Errorf("replica placements: %w", err)
+		}
+		if err := unmarshalJSON(placement, &nodeIDs); err != nil {
+			return nil, fmt.Errorf("replica %s: placement: %w", id, err)
+		}
+		placements[id] = nodeIDs
+	}
+	return placements, rows.Err()
+}
+
+// isUUID reports whether s is a UUID in canonical text form
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'):
+			return false
+		}
+	}
+	return true
+}
+
+// Garbage collection
+
+func (s *PostgresService) ExpireNoncurrentVersions(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE objects SET state = 'tombstoned'
+		WHERE id IN (
+			SELECT id FROM objects
+			WHERE state = 'committed' AND NOT is_latest AND noncurrent_at < $1
+			ORDER BY noncurrent_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)`,
+		cutoff, limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("expire noncurrent versions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+func (s *PostgresService) ListTombstones(ctx context.Context, cutoff, afterTime time.Time, afterID string, limit int) ([]*Object, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects
+		WHERE state = 'tombstoned' AND noncurrent_at < $1
+			AND ($3 = '' OR (noncurrent_at, id) > ($2, NULLIF($3, '')::uuid))
+		ORDER BY noncurrent_at, id
+		LIMIT $4`,
+		cutoff, afterTime, afterID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list tombstones: %w", err)
+	}
+	return collectObjects(rows)
+}
+
+// PurgeObject deletes the record and its bucket usage in one transaction,
+// so a crash can never leave the counters charged for a purged version or
+// credited for one still recorded
+func (s *PostgresService) PurgeObject(ctx context.Context, objectID string) error {
+	if !isUUID(objectID) {
+		return ErrObjectNotFound
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("purge object: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		bucketName string
+		size       int64
+		marker     bool
+	)
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM objects WHERE id = $1::uuid AND state = 'tombstoned'
+		RETURNING bucket_name, size_bytes, is_delete_marker`,
+		objectID,
+	).Scan(&bucketName, &size, &marker)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("purge object: %w", err)
+	}
+	if !marker {
+		if err := addBucketUsage(ctx, tx, bucketName, -size, -1); err != nil {
+			return fmt.Errorf("purge object: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("purge object: %w", err)
+	}
+	return nil
+}
+
+// Repair operations
+
+func (s *PostgresService) FindUnderReplicatedObjects(ctx context.Context, replicationFactor int, offlineNodes []string, limit int) ([]*Object, error) {
+	if offlineNodes == nil {
+		offlineNodes = []string{}
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+objectColumns+`
+		FROM objects,
+			LATERAL (
+				SELECT count(*) AS live
+				FROM jsonb_array_elements_text(placement) AS p(node_id)
+				WHERE p.node_id <> ALL($2)
+			) l
+		WHERE state = 'committed' AND NOT is_delete_marker
+			AND l.live < $1
+		ORDER BY l.live, created_at
+		LIMIT $3`,
+		replicationFactor, pq.Array(offlineNodes), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("find under-replicated objects: %w", err)
+	}
+	return collectObjects(rows)
+}
+
+func (s *PostgresService) CreateRepair(ctx context.Context, rec *RepairRecord) error {
+	if rec.Status == "" {
+		rec.Status = RepairStatusPending
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO repair_log (object_id, issue_type, repair_status, source_node, target_nodes,
+			error_message, remaining_replicas, bucket_priority)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7, $8)
+		RETURNING id, detected_at`,
+		rec.ObjectID, rec.IssueType, rec.Status, rec.SourceNode, pq.Array(rec.TargetNodes), rec.Error,
+		rec.RemainingReplicas, rec.BucketPriority,
+	).Scan(&rec.ID, &rec.DetectedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("create repair: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) UpdateRepair(ctx context.Context, rec *RepairRecord) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE repair_log
+		SET repair_status = $2, source_node = NULLIF($3, ''), target_nodes = $4,
+			error_message = NULLIF($5, ''), repaired_at = $6
+		WHERE id = $1 AND claimed_by IS NOT DISTINCT FROM NULLIF($7, '')`,
+		rec.ID, rec.Status, rec.SourceNode, pq.Array(rec.TargetNodes), rec.Error, nullTime(rec.RepairedAt),
+		rec.ClaimedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("update repair: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+// repairColumns is the column list read by scanRepair
+const repairColumns = `id, object_id, issue_type, repair_status, source_node, target_nodes,
+	remaining_replicas, bucket_priority, claimed_by, claim_expires_at, error_message,
+	detected_at, repaired_at`
+
+func scanRepair(row rowScanner) (*RepairRecord, error) {
+	rec := &RepairRecord{}
+	var (
+		source, claimedBy, errMsg  sql.NullString
+		claimExpiresAt, repairedAt sql.NullTime
+	)
+	err := row.Scan(&rec.ID, &rec.ObjectID, &rec.IssueType, &rec.Status, &source,
+		pq.Array(&rec.TargetNodes), &rec.RemainingReplicas, &rec.BucketPriority, &claimedBy,
+		&claimExpiresAt, &errMsg, &rec.DetectedAt, &repairedAt)
+	if err != nil {
+		return nil, err
+	}
+	rec.SourceNode = source.String
+	rec.ClaimedBy = claimedBy.String
+	rec.ClaimExpiresAt = claimExpiresAt.Time
+	rec.Error = errMsg.String
+	rec.RepairedAt = repairedAt.Time
+	return rec, nil
+}
+
+func (s *PostgresService) ListRepairs(ctx context.Context, status RepairStatus, limit int) ([]*RepairRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+repairColumns+`
+		FROM repair_log
+		WHERE repair_status = $1
+		ORDER BY detected_at
+		LIMIT $2`,
+		status, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list repairs: %w", err)
+	}
+	return collectRepairs(rows)
+}
+
+func collectRepairs(rows *sql.Rows) ([]*RepairRecord, error) {
+	defer rows.Close()
+
+	var recs []*RepairRecord
+	for rows.Next() {
+		rec, err := scanRepair(rows)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func (s *PostgresService) EnqueueRepair(ctx context.Context, rec *RepairRecord) error {
+	queued, err := scanRepair(s.db.QueryRowContext(ctx, `
+		INSERT INTO repair_log (object_id, issue_type, repair_status, target_nodes,
+			remaining_replicas, bucket_priority)
+		SELECT o.id, $2, 'pending', $3, $4, b.repair_priority
+		FROM objects o JOIN buckets b ON b.name = o.bucket_name
+		WHERE o.id = $1
+		ON CONFLICT (object_id, issue_type) WHERE repair_status = 'pending'
+		DO UPDATE SET
+			target_nodes = ARRAY(SELECT DISTINCT unnest(repair_log.target_nodes || EXCLUDED.target_nodes)),
+			remaining_replicas = LEAST(repair_log.remaining_replicas, EXCLUDED.remaining_replicas),
+			bucket_priority = EXCLUDED.bucket_priority
+		RETURNING `+repairColumns,
+		rec.ObjectID, rec.IssueType, pq.Array(rec.TargetNodes), rec.RemainingReplicas,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("enqueue repair: %w", err)
+	}
+	*rec = *queued
+	return nil
+}
+
+func (s *PostgresService) ClaimRepairs(ctx context.Context, holder string, ttl time.Duration, limit int) ([]*RepairRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE repair_log
+		SET repair_status = 'in_progress', claimed_by = NULLIF($1, ''),
+			claim_expires_at = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM repair_log
+			WHERE repair_status = 'pending'
+				OR (repair_status = 'in_progress' AND claim_expires_at < NOW())
+			ORDER BY remaining_replicas, bucket_priority DESC, detected_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+repairColumns,
+		holder, ttl.Milliseconds(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("claim repairs: %w", err)
+	}
+	recs, err := collectRepairs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("claim repairs: %w", err)
+	}
+
+	// RETURNING does not keep the subquery's order
+	sort.Slice(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		if a.RemainingReplicas != b.RemainingReplicas {
+			return a.RemainingReplicas < b.RemainingReplicas
+		}
+		if a.BucketPriority != b.BucketPriority {
+			return a.BucketPriority > b.BucketPriority
+		}
+		return a.DetectedAt.Before(b.DetectedAt)
+	})
+	return recs, nil
+}
+
+func (s *PostgresService) RenewRepairClaim(ctx context.Context, id, holder string, ttl time.Duration) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE repair_log
+		SET claim_expires_at = NOW() + $3 * INTERVAL '1 millisecond'
+		WHERE id = $1 AND repair_status = 'in_progress'
+			AND claimed_by IS NOT DISTINCT FROM NULLIF($2, '')`,
+		id, holder, ttl.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("renew repair claim: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) RepairQueueDepth(ctx context.Context) ([]RepairQueueDepth, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT remaining_replicas,
+			count(*) FILTER (WHERE repair_status = 'pending'),
+			count(*) FILTER (WHERE repair_status = 'in_progress')
+		FROM repair_log
+		WHERE repair_status IN ('pending', 'in_progress')
+		GROUP BY remaining_replicas
+		ORDER BY remaining_replicas`)
+	if err != nil {
+		return nil, fmt.Errorf("repair queue depth: %w", err)
+	}
+	defer rows.Close()
+
+	var depths []RepairQueueDepth
+	for rows.Next() {
+		var d RepairQueueDepth
+		if err := rows.Scan(&d.RemainingReplicas, &d.Pending, &d.InProgress); err != nil {
+			return nil, fmt.Errorf("repair queue depth: %w", err)
+		}
+		depths = append(depths, d)
+	}
+	return depths, rows.Err()
+}
+
+// Scrub progress
+
+// scrubColumns is the column list read by scanScrubProgress
+const scrubColumns = `node_id, cursor_token, pass_started_at, last_pass_completed_at,
+	bytes_scrubbed, replicas_scrubbed, corrupt_found, updated_at`
+
+func scanScrubProgress(row rowScanner) (*ScrubProgress, error) {
+	p := &ScrubProgress{}
+	var (
+		cursor             int64
+		started, completed sql.NullTime
+	)
+	err := row.Scan(&p.NodeID, &cursor, &started, &completed,
+		&p.BytesScrubbed, &p.ReplicasScrubbed, &p.CorruptFound, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	// BIGINT is signed; the token is stored bit for bit
+	p.Cursor = uint64(cursor)
+	p.PassStartedAt = started.Time
+	p.LastPassCompletedAt = completed.Time
+	return p, nil
+}
+
+func (s *PostgresService) GetScrubProgress(ctx context.Context, nodeID string) (*ScrubProgress, error) {
+	p, err := scanScrubProgress(s.db.QueryRowContext(ctx, `
+		SELECT `+scrubColumns+` FROM scrub_progress WHERE node_id = $1`,
+		nodeID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &ScrubProgress{NodeID: nodeID}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get scrub progress: %w", err)
+	}
+	return p, nil
+}
+
+func (s *PostgresService) SaveScrubProgress(ctx context.Context, p *ScrubProgress) error {
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO scrub_progress (node_id, cursor_token, pass_started_at, last_pass_completed_at,
+			bytes_scrubbed, replicas_scrubbed, corrupt_found)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (node_id) DO UPDATE SET
+			cursor_token = EXCLUDED.cursor_token,
+			pass_started_at = EXCLUDED.pass_started_at,
+			last_pass_completed_at = EXCLUDED.last_pass_completed_at,
+			bytes_scrubbed = EXCLUDED.bytes_scrubbed,
+			replicas_scrubbed = EXCLUDED.replicas_scrubbed,
+			corrupt_found = EXCLUDED.corrupt_found,
+			updated_at = NOW()
+		RETURNING updated_at`,
+		p.NodeID, int64(p.Cursor), nullTime(p.PassStartedAt), nullTime(p.LastPassCompletedAt),
+		p.BytesScrubbed, p.ReplicasScrubbed, p.CorruptFound,
+	).Scan(&p.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("save scrub progress: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) ListScrubProgress(ctx context.Context) ([]*ScrubProgress, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scrubColumns+` FROM scrub_progress ORDER BY node_id`)
+	if err != nil {
+		return nil, fmt.Errorf("list scrub progress: %w", err)
+	}
+	defer rows.Close()
+
+	var progress []*ScrubProgress
+	for rows.Next() {
+		p, err := scanScrubProgress(rows)
+		if err != nil {
+			return nil, err
+		}
+		progress = append(progress, p)
+	}
+	return progress, rows.Err()
+}
+
+// Helpers
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func collectObjects(rows *sql.Rows) ([]*Object, error) {
+	defer rows.Close()
+
+	var objects []*Object
+	for rows.Next() {
+		obj, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
+
+func collectParts(rows *sql.Rows) ([]*Part, error) {
+	defer rows.Close()
+
+	var parts []*Part
+	for rows.Next() {
+		p, err := scanPart(rows)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// unmarshalJSON decodes a nullable JSONB column into v
+func unmarshalJSON(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Leases
+
+func (s *PostgresService) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	var got string
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO leases (name, holder, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET
+			holder = EXCLUDED.holder,
+			expires_at = EXCLUDED.expires_at,
+			acquired_at = CASE WHEN leases.holder = EXCLUDED.holder THEN leases.acquired_at ELSE NOW() END
+		WHERE leases.holder = EXCLUDED.holder OR leases.expires_at < NOW()
+		RETURNING holder`,
+		name, holder, ttl.Milliseconds(),
+	).Scan(&got)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("acquire lease %s: %w", name, err)
+	}
+	return true, nil
+}
+
+func (s *PostgresService) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM leases WHERE name = $1 AND holder = $2`, name, holder)
+	if err != nil {
+		return fmt.Errorf("release lease %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *PostgresService) ListLeases(ctx context.Context) ([]*Lease, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, holder, acquired_at, expires_at
+		FROM leases
+		WHERE expires_at > NOW()
+		ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list leases: %w", err)
+	}
+	defer rows.Close()
+
+	var leases []*Lease
+	for rows.Next() {
+		l := &Lease{}
+		if err := rows.Scan(&l.Name, &l.Holder, &l.AcquiredAt, &l.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("list leases: %w", err)
+		}
+		leases = append(leases, l)
+	}
+	return leases, rows.Err()
+}
+
+// Access keys
+
+const accessKeyColumns = `access_key_id, user_name, sealed_secret, status, expires_at, created_at`
+
+func scanAccessKey(row interface{ Scan(...interface{}) error }) (*AccessKey, error) {
+	var (
+		k         = &AccessKey{}
+		userName  sql.NullString
+		expiresAt sql.NullTime
+	)
+	if err := row.Scan(&k.AccessKeyID, &userName, &k.SealedSecret, &k.Status, &expiresAt, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	k.UserName = userName.String
+	k.ExpiresAt = expiresAt.Time
+	return k, nil
+}
+
+func (s *PostgresService) GetAccessKey(ctx context.Context, accessKeyID string) (*AccessKey, error) {
+	k, err := scanAccessKey(s.db.QueryRowContext(ctx, `
+		SELECT `+accessKeyColumns+`
+		FROM access_keys
+		WHERE access_key_id = $1`,
+		accessKeyID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccessKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get access key: %w", err)
+	}
+	return k, nil
+}
+
+func (s *PostgresService) PutAccessKey(ctx context.Context, key *AccessKey) error {
+	if key.Status == "" {
+		key.Status = AccessKeyActive
+	}
+	var userName interface{}
+	if key.UserName != "" {
+		userName = key.UserName
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO access_keys (access_key_id, user_name, sealed_secret, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (access_key_id) DO UPDATE SET
+			user_name = EXCLUDED.user_name,
+			sealed_secret = EXCLUDED.sealed_secret,
+			status = EXCLUDED.status,
+			expires_at = EXCLUDED.expires_at
+		RETURNING created_at`,
+		key.AccessKeyID, userName, key.SealedSecret, key.Status, nullTime(key.ExpiresAt),
+	).Scan(&key.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("put access key: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) ListAccessKeys(ctx context.Context, userName string) ([]*AccessKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+accessKeyColumns+`
+		FROM access_keys
+		WHERE user_name IS NOT DISTINCT FROM NULLIF($1, '')
+		ORDER BY created_at, access_key_id`,
+		userName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list access keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*AccessKey
+	for rows.Next() {
+		k, err := scanAccessKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list access keys: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresService) DeleteAccessKey(ctx context.Context, accessKeyID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM access_keys WHERE access_key_id = $1`, accessKeyID)
+	if err != nil {
+		return fmt.Errorf("delete access key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAccessKeyNotFound
+	}
+	return nil
+}
+
+// Users and groups
+
+func (s *PostgresService) CreateUser(ctx context.Context, name string) (*User, error) {
+	u := &User{Name: name}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO users (name) VALUES ($1)
+		RETURNING created_at`,
+		name,
+	).Scan(&u.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+			return nil, ErrUserExists
+		}
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	return u, nil
+}
+
+// GetUser and ListUsers aggregate each user's groups in the same query
+const userQuery = `
+	SELECT u.name, u.quota, u.created_at,
+		COALESCE(ARRAY_AGG(m.group_name ORDER BY m.group_name) FILTER (WHERE m.group_name IS NOT NULL), '{}')
+	FROM users u
+	LEFT JOIN group_members m ON m.user_name = u.name`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	u := &User{}
+	var quota []byte
+	if err := row.Scan(&u.Name, &quota, &u.CreatedAt, pq.Array(&u.Groups)); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(quota, &u.Quota); err != nil {
+		return nil, fmt.Errorf("user %s: quota: %w", u.Name, err)
+	}
+	return u, nil
+}
+
+func (s *PostgresService) GetUser(ctx context.Context, name string) (*User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, userQuery+`
+		WHERE u.name = $1
+		GROUP BY u.name`,
+		name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	return u, nil
+}
+
+func (s *PostgresService) ListUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, userQuery+`
+		GROUP BY u.name
+		ORDER BY u.name`)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser relies on the foreign keys to cascade to the user's access
+// keys and group memberships
+func (s *PostgresService) DeleteUser(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresService) CreateGroup(ctx context.Context, name string) (*Group, error) {
+	g := &Group{Name: name}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO user_groups (name) VALUES ($1)
+		RETURNING created_at`,
+		name,
+	).Scan(&g.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+			return nil, ErrGroupExists
+		}
+		return nil, fmt.Errorf("create group: %w", err)
+	}
+	return g, nil
+}
+
+// GetGroup and ListGroups aggregate each group's members in the same query
+const groupQuery = `
+	SELECT g.name, g.created_at,
+		COALESCE(ARRAY_AGG(m.user_name ORDER BY m.user_name) FILTER (WHERE m.user_name IS NOT NULL), '{}')
+	FROM user_groups g
+	LEFT JOIN group_members m ON m.group_name = g.name`
+
+func scanGroup(row interface{ Scan(...interface{}) error }) (*Group, error) {
+	g := &Group{}
+	if err := row.Scan(&g.Name, &g.CreatedAt, pq.Array(&g.Members)); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *PostgresService) GetGroup(ctx context.Context, name string) (*Group, error) {
+	g, err := scanGroup(s.db.QueryRowContext(ctx, groupQuery+`
+		WHERE g.name = $1
+		GROUP BY g.name`,
+		name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get group: %w", err)
+	}
+	return g, nil
+}
+
+func (s *PostgresService) ListGroups(ctx context.Context) ([]*Group, error) {
+	rows, err := s.db.QueryContext(ctx, groupQuery+`
+		GROUP BY g.name
+		ORDER BY g.name`)
+	if err != nil {
+		return nil, fmt.Errorf("list groups: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []*Group
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list groups: %w", err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (s *PostgresService) DeleteGroup(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM user_groups WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("delete group: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// AddGroupMember is idempotent. A missing group or user is told apart from
+// the violated foreign key.
+func (s *PostgresService) AddGroupMember(ctx context.Context, groupName, userName string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO group_members (group_name, user_name) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`,
+		groupName, userName,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		if pqErr.Constraint == "group_members_user_name_fkey" {
+			return ErrUserNotFound
+		}
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("add group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveGroupMember returns ErrUserNotFound if the user is not a member
+func (s *PostgresService) RemoveGroupMember(ctx context.Context, groupName, userName string) error {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM group_members
+		WHERE group_name = $1 AND user_name = $2`,
+		groupName, userName,
+	)
+	if err != nil {
+		return fmt.Errorf("remove group member: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Rate limits
+
+func (s *PostgresService) GetRateLimitConfig(ctx context.Context) (string, error) {
+	var config string
+	err := s.db.QueryRowContext(ctx, `SELECT config FROM rate_limit_config`).Scan(&config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get rate limit config: %w", err)
+	}
+	return config, nil
+}
+
+func (s *PostgresService) SetRateLimitConfig(ctx context.Context, config string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO rate_limit_config (id, config)
+		VALUES (TRUE, $1)
+		ON CONFLICT (id) DO UPDATE SET config = EXCLUDED.config, updated_at = NOW()`,
+		config,
+	)
+	if err != nil {
+		return fmt.Errorf("set rate limit config: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) SyncRateLimitUsage(ctx context.Context, gatewayID string, usage map[string]RateLimitUsage) (map[string]RateLimitUsage, error) {
+	keys := make([]string, 0, len(usage))
+	requests := make([]int64, 0, len(usage))
+	bytes := make([]int64, 0, len(usage))
+	for key, u := range usage {
+		keys = append(keys, key)
+		requests = append(requests, u.Requests)
+		bytes = append(bytes, u.Bytes)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("sync rate limit usage: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_usage (gateway_id, limit_key, requests, bytes)
+		SELECT $1, u.limit_key, u.requests, u.bytes
+		FROM unnest($2::text[], $3::bigint[], $4::bigint[]) AS u(limit_key, requests, bytes)
+		ON CONFLICT (gateway_id, limit_key) DO UPDATE SET
+			requests = EXCLUDED.requests,
+			bytes = EXCLUDED.bytes,
+			updated_at = NOW()`,
+		gatewayID, pq.Array(keys), pq.Array(requests), pq.Array(bytes),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sync rate limit usage: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM rate_limit_usage
+		WHERE updated_at < NOW() - $1 * INTERVAL '1 millisecond'`,
+		RateLimitUsageTTL.Milliseconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sync rate limit usage: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT limit_key, SUM(requests), SUM(bytes)
+		FROM rate_limit_usage
+		WHERE gateway_id <> $1 AND limit_key = ANY($2)
+		GROUP BY limit_key`,
+		gatewayID, pq.Array(keys),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sync rate limit usage: %w", err)
+	}
+	defer rows.Close()
+
+	remote := make(map[string]RateLimitUsage)
+	for rows.Next() {
+		var (
+			key string
+			u   RateLimitUsage
+		)
+		if err := rows.Scan(&key, &u.Requests, &u.Bytes); err != nil {
+			return nil, fmt.Errorf("sync rate limit usage: %w", err)
+		}
+		remote[key] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sync rate limit usage: %w", err)
+	}
+	rows.Close()
+	return remote, tx.Commit()
+}
+
+func (s *PostgresService) SetUserQuota(ctx context.Context, name string, quota *Quota) error {
+	config, err := marshalQuota(quota)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET quota = $2 WHERE name = $1`, name, config)
+	if err != nil {
+		return fmt.Errorf("set user quota: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Quotas
+
+func (s *PostgresService) BucketUsage(ctx context.Context, bucketName string) (Usage, error) {
+	var u Usage
+	err := s.db.QueryRowContext(ctx, `
+		SELECT total_bytes, object_count
+		FROM cost_tracking
+		WHERE bucket_name = $1`,
+		bucketName,
+	).Scan(&u.Bytes, &u.Objects)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Usage{}, ErrBucketNotFound
+	}
+	if err != nil {
+		return Usage{}, fmt.Errorf("bucket usage: %w", err)
+	}
+	return u, nil
+}
+
+func (s *PostgresService) UserUsage(ctx context.Context, userName string) (Usage, error) {
+	var u Usage
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(c.total_bytes), 0), COALESCE(SUM(c.object_count), 0)
+		FROM buckets b
+		JOIN cost_tracking c ON c.bucket_name = b.name
+		WHERE b.owner = $1`,
+		userName,
+	).Scan(&u.Bytes, &u.Objects)
+	if err != nil {
+		return Usage{}, fmt.Errorf("user usage: %w", err)
+	}
+	return u, nil
+}
+
+func (s *PostgresService) RecordQuotaEvent(ctx context.Context, event *QuotaEvent) error {
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO quota_events (scope, name, resource, usage, quota_limit)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		string(event.Scope), event.Name, event.Resource, event.Usage, event.Limit,
+	).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("record quota event: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresService) ListQuotaEvents(ctx context.Context, limit int) ([]*QuotaEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, scope, name, resource, usage, quota_limit, created_at
+		FROM quota_events
+		ORDER BY id DESC
+		LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list quota events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*QuotaEvent
+	for rows.Next() {
+		e := &QuotaEvent{}
+		var scope string
+		if err := rows.Scan(&e.ID, &scope, &e.Name, &e.Resource, &e.Usage, &e.Limit, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("list quota events: %w", err)
+		}
+		e.Scope = QuotaScope(scope)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Master key rotation
+
+// ListDataKeys reads the data keys from the JSON encoding of Encryption,
+// in which they are base64
+func (s *PostgresService) ListDataKeys(ctx context.Context, keyID string, limit int) ([]*DataKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id::text, '', encryption->>'key_id', encryption->>'data_key'
+		FROM objects
+		WHERE encryption IS NOT NULL AND encryption->>'key_id' NOT IN ($1, '')
+		UNION ALL
+		SELECT '', upload_id::text, encryption->>'key_id', encryption->>'data_key'
+		FROM multipart_uploads
+		WHERE state = 'active' AND encryption IS NOT NULL AND encryption->>'key_id' NOT IN ($1, '')
+		LIMIT $2`,
+		keyID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list data keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*DataKey
+	for rows.Next() {
+		k := &DataKey{}
+		var wrapped string
+		if err := rows.Scan(&k.ObjectID, &k.UploadID, &k.KeyID, &wrapped); err != nil {
+			return nil, fmt.Errorf("list data keys: %w", err)
+		}
+		if k.DataKey, err = base64.StdEncoding.DecodeString(wrapped); err != nil {
+			return nil, fmt.Errorf("list data keys: %s%s: %w", k.ObjectID, k.UploadID, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RewrapDataKey only replaces the key if it is still wrapped with the
+// master key it was listed with
+func (s *PostgresService) RewrapDataKey(ctx context.Context, key *DataKey, keyID string, wrapped []byte) error {
+	query := `
+		UPDATE objects SET encryption = encryption || jsonb_build_object('key_id', $2::text, 'data_key', $3::text)
+		WHERE id = $1::uuid AND encryption->>'key_id' = $4`
+	id := key.ObjectID
+	if key.UploadID != "" {
+		query = `
+			UPDATE multipart_uploads SET encryption = encryption || jsonb_build_object('key_id', $2::text, 'data_key', $3::text)
+			WHERE upload_id = $1::uuid AND state = 'active' AND encryption->>'key_id' = $4`
+		id = key.UploadID
+	}
+	if !isUUID(id) {
+		return ErrObjectNotFound
+	}
+	res, err := s.db.ExecContext(ctx, query, id, keyID, base64.StdEncoding.EncodeToString(wrapped), key.KeyID)
+	if err != nil {
+		return fmt.Errorf("rewrap data key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
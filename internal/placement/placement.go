@@ -33,4 +33,17 @@ type Controller interface {
 
 	// UpdateNodeHealth updates node health status
 	UpdateNodeHealth(ctx context.Context, nodeID string, status string, capacity, used int64) error
+
+	// Partitions splits the ring into the ranges of key hashes that map to
+	// the same replica set
+	Partitions(ctx context.Context, replicationFactor int) ([]Partition, error)
+}
+
+// Partition is an inclusive range [First, Last] of key hashes whose objects
+// are all placed on Nodes. First is greater than Last when the range wraps
+// past the top of the ring.
+type Partition struct {
+	First uint64
+	Last  uint64
+	Nodes []Node
 }
@@ -0,0 +1,256 @@
+package placement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Node status values
+const (
+	StatusHealthy  = "healthy"
+	StatusDegraded = "degraded"
+	StatusOffline  = "offline"
+)
+
+var (
+	// ErrNodeNotFound is returned when a node ID is not registered
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrNodeExists is returned when registering a node twice
+	ErrNodeExists = errors.New("node already exists")
+)
+
+// DefaultVirtualNodes is the number of ring positions per node
+const DefaultVirtualNodes = 128
+
+// Ring is an in-memory consistent hash ring implementing Controller.
+// Each node owns several virtual positions so keys spread evenly and only
+// about 1/N of the keys move when a node joins or leaves.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	nodes  map[string]*Node
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash   uint64
+	nodeID string
+}
+
+var _ Controller = (*Ring)(nil)
+
+// NewRing creates a ring with vnodes positions per node
+func NewRing(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		vnodes: vnodes,
+		nodes:  make(map[string]*Node),
+	}
+}
+
+// KeyHash returns the ring position of an object key
+func KeyHash(objectKey string) uint64 {
+	return xxhash.Sum64String(objectKey)
+}
+
+// RingKey returns the key an object is placed by: its bucket and key
+func RingKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// GetNodes returns up to replicationFactor distinct nodes for the key, walking
+// the ring clockwise from the key's position and skipping offline nodes. Fewer
+// nodes are returned when not enough are available.
+func (r *Ring) GetNodes(ctx context.Context, objectKey string, replicationFactor int) ([]Node, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return nil, nil
+	}
+
+	h := KeyHash(objectKey)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	return r.walk(start, replicationFactor), nil
+}
+
+// walk returns up to n distinct nodes that are not offline, walking the ring
+// clockwise from point start. The caller holds r.mu.
+func (r *Ring) walk(start, n int) []Node {
+	seen := make(map[string]bool, n)
+	nodes := make([]Node, 0, n)
+	for i := 0; i < len(r.points) && len(nodes) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if seen[p.nodeID] {
+			continue
+		}
+		seen[p.nodeID] = true
+		if node := r.nodes[p.nodeID]; node.Status != StatusOffline {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes
+}
+
+// Partitions returns the ring ranges in clockwise order, starting with the
+// range ending at the lowest point. A key belongs to the first point at or
+// after its hash, so point i owns (point i-1, point i]; adjacent ranges
+// with the same replica set are merged.
+func (r *Ring) Partitions(ctx context.Context, replicationFactor int) ([]Partition, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return nil, nil
+	}
+
+	var parts []Partition
+	prev := r.points[len(r.points)-1].hash
+	for i, p := range r.points {
+		if i > 0 && p.hash == prev {
+			continue // colliding points own an empty range
+		}
+		part := Partition{First: prev + 1, Last: p.hash, Nodes: r.walk(i, replicationFactor)}
+		prev = p.hash
+		if n := len(parts); n > 0 && sameNodes(parts[n-1].Nodes, part.Nodes) {
+			parts[n-1].Last = part.Last
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if n := len(parts); n > 1 && sameNodes(parts[n-1].Nodes, parts[0].Nodes) {
+		parts[0].First = parts[n-1].First
+		parts = parts[:n-1]
+	}
+	return parts, nil
+}
+
+// sameNodes reports whether a and b hold the same nodes in any order
+func sameNodes(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[string]bool, len(a))
+	for _, node := range a {
+		ids[node.ID] = true
+	}
+	for _, node := range b {
+		if !ids[node.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// GetNode returns a specific node for reading
+func (r *Ring) GetNode(ctx context.Context, nodeID string) (*Node, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	node, ok := r.nodes[nodeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeID)
+	}
+	n := *node
+	return &n, nil
+}
+
+// ListNodes returns all registered nodes sorted by ID
+func (r *Ring) ListNodes(ctx context.Context) ([]Node, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// AddNode registers a new node
+func (r *Ring) AddNode(ctx context.Context, node Node) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[node.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrNodeExists, node.ID)
+	}
+	if node.Status == "" {
+		node.Status = StatusHealthy
+	}
+	r.nodes[node.ID] = &node
+	for i := 0; i < r.vnodes; i++ {
+		r.points = append(r.points, ringPoint{
+			hash:   xxhash.Sum64String(node.ID + "#" + strconv.Itoa(i)),
+			nodeID: node.ID,
+		})
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return nil
+}
+
+// RemoveNode removes a node from the cluster
+func (r *Ring) RemoveNode(ctx context.Context, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[nodeID]; !ok {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, nodeID)
+	}
+	delete(r.nodes, nodeID)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.nodeID != nodeID {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+	return nil
+}
+
+// UpdateNodeHealth updates node health status
+func (r *Ring) UpdateNodeHealth(ctx context.Context, nodeID string, status string, capacity, used int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node, ok := r.nodes[nodeID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, nodeID)
+	}
+	node.Status = status
+	node.Capacity = capacity
+	node.Used = used
+	return nil
+}
+
+// ParseNodeList parses a DATA_NODES value. Entries are either "id=host:port"
+// or a bare "host:port", in which case the node is named node<N> by position.
+func ParseNodeList(spec string) ([]Node, error) {
+	var nodes []Node
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(entry, "=")
+		if !ok {
+			id, addr = "node"+strconv.Itoa(i+1), entry
+		}
+		if id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid data node entry %q", entry)
+		}
+		nodes = append(nodes, Node{ID: id, Address: addr, Tier: "hot", Status: StatusHealthy})
+	}
+	return nodes, nil
+}
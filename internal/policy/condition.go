@@ -0,0 +1,309 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Condition keys the gateway sets on requests
+const (
+	KeySourceIP        = "aws:SourceIp"
+	KeyCurrentTime     = "aws:CurrentTime"
+	KeyEpochTime       = "aws:EpochTime"
+	KeySecureTransport = "aws:SecureTransport"
+	KeyUsername        = "aws:username"
+	KeyUserAgent       = "aws:UserAgent"
+	KeyReferer         = "aws:Referer"
+	KeyPrefix          = "s3:prefix"
+	KeyDelimiter       = "s3:delimiter"
+	KeyMaxKeys         = "s3:max-keys"
+	KeyVersionID       = "s3:VersionId"
+)
+
+// ifExists is the operator suffix that makes a condition true when the
+// request has no value for its key
+const ifExists = "IfExists"
+
+// Conditions is the Condition element: operator → condition key → values.
+// Every operator and key must match for the statement to apply.
+type Conditions map[string]map[string]Values
+
+// operator compares the request's value of a key with a condition's values
+type operator struct {
+	// match reports whether value matches one of the condition's values
+	match func(value string, values []string) bool
+
+	// negated operators are true when the request has no value for the key
+	negated bool
+
+	// check validates a condition value
+	check func(string) error
+}
+
+var operators = map[string]operator{
+	"StringEquals":              {match: anyValue(func(v, c string) bool { return v == c })},
+	"StringNotEquals":           {match: noValue(func(v, c string) bool { return v == c }), negated: true},
+	"StringEqualsIgnoreCase":    {match: anyValue(strings.EqualFold)},
+	"StringNotEqualsIgnoreCase": {match: noValue(strings.EqualFold), negated: true},
+	"StringLike":                {match: anyValue(func(v, c string) bool { return match(c, v, false) })},
+	"StringNotLike":             {match: noValue(func(v, c string) bool { return match(c, v, false) }), negated: true},
+
+	"NumericEquals":            numeric(func(a, b float64) bool { return a == b }, false),
+	"NumericNotEquals":         numeric(func(a, b float64) bool { return a != b }, true),
+	"NumericLessThan":          numeric(func(a, b float64) bool { return a < b }, false),
+	"NumericLessThanEquals":    numeric(func(a, b float64) bool { return a <= b }, false),
+	"NumericGreaterThan":       numeric(func(a, b float64) bool { return a > b }, false),
+	"NumericGreaterThanEquals": numeric(func(a, b float64) bool { return a >= b }, false),
+
+	"DateEquals":            date(func(a, b time.Time) bool { return a.Equal(b) }, false),
+	"DateNotEquals":         date(func(a, b time.Time) bool { return !a.Equal(b) }, true),
+	"DateLessThan":          date(func(a, b time.Time) bool { return a.Before(b) }, false),
+	"DateLessThanEquals":    date(func(a, b time.Time) bool { return !a.After(b) }, false),
+	"DateGreaterThan":       date(func(a, b time.Time) bool { return a.After(b) }, false),
+	"DateGreaterThanEquals": date(func(a, b time.Time) bool { return !a.Before(b) }, false),
+
+	"Bool": {match: anyValue(strings.EqualFold), check: checkBool},
+
+	"IpAddress":    {match: anyValue(ipInNetwork), check: checkNetwork},
+	"NotIpAddress": {match: noValue(ipInNetwork), negated: true, check: checkNetwork},
+
+	// Null tests whether the request has a value for the key, so match
+	// is never called for it
+	opNull: {check: checkBool},
+}
+
+// opNull is the operator that tests for a missing key
+const opNull = "Null"
+
+// anyValue matches when eq holds for one of the condition's values
+func anyValue(eq func(value, condition string) bool) func(string, []string) bool {
+	return func(value string, values []string) bool {
+		for _, c := range values {
+			if eq(value, c) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// noValue matches when eq holds for none of the condition's values
+func noValue(eq func(value, condition string) bool) func(string, []string) bool {
+	matches := anyValue(eq)
+	return func(value string, values []string) bool { return !matches(value, values) }
+}
+
+// everyValue matches when cmp holds for all of the condition's values, as
+// NumericNotEquals and DateNotEquals do: the value equals none of them
+func everyValue(cmp func(value, condition string) bool) func(string, []string) bool {
+	return func(value string, values []string) bool {
+		for _, c := range values {
+			if !cmp(value, c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func numeric(cmp func(a, b float64) bool, negated bool) operator {
+	parse := func(s string) (float64, error) { return strconv.ParseFloat(s, 64) }
+	eq := func(value, condition string) bool {
+		a, err1 := parse(value)
+		b, err2 := parse(condition)
+		return err1 == nil && err2 == nil && cmp(a, b)
+	}
+	op := operator{match: anyValue(eq), negated: negated}
+	if negated {
+		op.match = everyValue(eq)
+	}
+	op.check = func(c string) error {
+		if _, err := parse(c); err != nil {
+			return fmt.Errorf("%q is not a number", c)
+		}
+		return nil
+	}
+	return op
+}
+
+func date(cmp func(a, b time.Time) bool, negated bool) operator {
+	eq := func(value, condition string) bool {
+		a, err1 := parseDate(value)
+		b, err2 := parseDate(condition)
+		return err1 == nil && err2 == nil && cmp(a, b)
+	}
+	op := operator{match: anyValue(eq), negated: negated}
+	if negated {
+		op.match = everyValue(eq)
+	}
+	op.check = func(c string) error {
+		if _, err := parseDate(c); err != nil {
+			return fmt.Errorf("%q is not an ISO 8601 date or epoch time", c)
+		}
+		return nil
+	}
+	return op
+}
+
+// parseDate reads an ISO 8601 date or time, or seconds since the epoch
+func parseDate(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// ipInNetwork reports whether ip is in the CIDR network, or is the address
+func ipInNetwork(ip, network string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if !strings.Contains(network, "/") {
+		return addr.Equal(net.ParseIP(network))
+	}
+	_, n, err := net.ParseCIDR(network)
+	return err == nil && n.Contains(addr)
+}
+
+// allNarrow reports whether every network is an address, or a CIDR block no
+// broader than a /8 (IPv4) or /32 (IPv6)
+func allNarrow(networks []string) bool {
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			continue
+		}
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return false
+		}
+		ones, bits := n.Mask.Size()
+		if bits == 32 && ones < 8 || bits == 128 && ones < 32 {
+			return false
+		}
+	}
+	return true
+}
+
+func checkBool(c string) error {
+	if _, err := strconv.ParseBool(c); err != nil {
+		return fmt.Errorf("%q is not a boolean", c)
+	}
+	return nil
+}
+
+func checkNetwork(c string) error {
+	if strings.Contains(c, "/") {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return fmt.Errorf("%q is not a CIDR block", c)
+		}
+	} else if net.ParseIP(c) == nil {
+		return fmt.Errorf("%q is not an IP address", c)
+	}
+	return nil
+}
+
+// UnmarshalJSON accepts a single value for a condition key, and booleans
+// and numbers as well as strings
+func (c *Conditions) UnmarshalJSON(data []byte) error {
+	var raw map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("Condition must map operators to condition keys")
+	}
+	*c = make(Conditions, len(raw))
+	for op, keys := range raw {
+		(*c)[op] = make(map[string]Values, len(keys))
+		for key, value := range keys {
+			values, err := conditionValues(value)
+			if err != nil {
+				return fmt.Errorf("condition %s %s: %v", op, key, err)
+			}
+			(*c)[op][key] = values
+		}
+	}
+	return nil
+}
+
+// conditionValues reads a scalar or an array of scalars as strings
+func conditionValues(data json.RawMessage) (Values, error) {
+	var many []json.RawMessage
+	if err := json.Unmarshal(data, &many); err != nil {
+		many = []json.RawMessage{data}
+	}
+	values := make(Values, 0, len(many))
+	for _, v := range many {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			values = append(values, s)
+			continue
+		}
+		var scalar interface{}
+		if err := json.Unmarshal(v, &scalar); err != nil {
+			return nil, err
+		}
+		switch scalar.(type) {
+		case bool, float64:
+			values = append(values, string(v))
+		default:
+			return nil, fmt.Errorf("values must be strings, numbers or booleans")
+		}
+	}
+	return values, nil
+}
+
+func (c Conditions) validate() error {
+	for name, keys := range c {
+		op, ok := operators[strings.TrimSuffix(name, ifExists)]
+		if !ok {
+			return fmt.Errorf("condition operator %q is not supported", name)
+		}
+		for key, values := range keys {
+			if len(values) == 0 {
+				return fmt.Errorf("condition %s %s has no values", name, key)
+			}
+			if op.check == nil {
+				continue
+			}
+			for _, v := range values {
+				if err := op.check(v); err != nil {
+					return fmt.Errorf("condition %s %s: %v", name, key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// match reports whether every condition holds for the request context
+func (c Conditions) match(context map[string]string) bool {
+	for name, keys := range c {
+		base := strings.TrimSuffix(name, ifExists)
+		op := operators[base]
+		for key, values := range keys {
+			value, ok := context[strings.ToLower(key)]
+			if base == opNull {
+				// {"Null": {"key": "true"}} requires the key to be absent
+				if null, _ := strconv.ParseBool(values[0]); null == ok {
+					return false
+				}
+				continue
+			}
+			switch {
+			case !ok && (op.negated || base != name):
+				continue
+			case !ok, !op.match(value, values):
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package policy
+
+import "strings"
+
+// Decision is the outcome of evaluating a request against a policy
+type Decision int
+
+const (
+	// NotApplicable means no statement matched the request
+	NotApplicable Decision = iota
+	// Allow means an Allow statement matched and no Deny statement did
+	Allow
+	// Deny means a Deny statement matched
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "Allow"
+	case Deny:
+		return "Deny"
+	default:
+		return "NotApplicable"
+	}
+}
+
+// Request is what a policy is evaluated against
+type Request struct {
+	// Action is the S3 action, e.g. s3:GetObject
+	Action string
+
+	// Resource is the ARN of the bucket or object acted on
+	Resource string
+
+	// Principals are the ARNs of the requester: its user and the groups
+	// it belongs to. Empty for anonymous requests.
+	Principals []string
+
+	// Context holds condition key values by lower-case key name
+	Context map[string]string
+}
+
+// Set sets the value of condition key in the request context
+func (r *Request) Set(key, value string) {
+	if r.Context == nil {
+		r.Context = make(map[string]string)
+	}
+	r.Context[strings.ToLower(key)] = value
+}
+
+// Evaluate evaluates r against the policy's statements. A nil policy
+// applies to nothing.
+func (p *Policy) Evaluate(r *Request) Decision {
+	if p == nil {
+		return NotApplicable
+	}
+	decision := NotApplicable
+	for i := range p.Statements {
+		s := &p.Statements[i]
+		if !s.matches(r) {
+			continue
+		}
+		if s.Effect == EffectDeny {
+			return Deny
+		}
+		decision = Allow
+	}
+	return decision
+}
+
+// IsPublic reports whether the policy allows anyone, anonymous requesters
+// included, to do something: it has an Allow statement for principal "*"
+// that an IpAddress condition on aws:SourceIp does not confine to known
+// networks. Like S3, networks broader than a /8 (a /32 for IPv6) do not
+// count as confining.
+func (p *Policy) IsPublic() bool {
+	for i := range p.Statements {
+		s := &p.Statements[i]
+		if s.Effect != EffectAllow || !s.matchesPrincipal(nil) {
+			continue
+		}
+		confined := false
+		for key, networks := range s.Condition["IpAddress"] {
+			if strings.EqualFold(key, KeySourceIP) && allNarrow(networks) {
+				confined = true
+			}
+		}
+		if !confined {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Statement) matches(r *Request) bool {
+	if !s.matchesPrincipal(r.Principals) {
+		return false
+	}
+	if len(s.Action) > 0 && !matchAny(s.Action, r.Action, true) ||
+		len(s.NotAction) > 0 && matchAny(s.NotAction, r.Action, true) {
+		return false
+	}
+	if len(s.Resource) > 0 && !matchAny(s.Resource, r.Resource, false) ||
+		len(s.NotResource) > 0 && matchAny(s.NotResource, r.Resource, false) {
+		return false
+	}
+	return s.Condition.match(r.Context)
+}
+
+// matchesPrincipal reports whether the statement names the requester. "*"
+// names everyone, anonymous requesters included.
+func (s *Statement) matchesPrincipal(principals []string) bool {
+	if s.Principal == nil {
+		return false
+	}
+	for _, pattern := range s.Principal.AWS {
+		if pattern == "*" {
+			return true
+		}
+		for _, arn := range principals {
+			if principalName(pattern) == principalName(arn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principalName strips the prefix and account ID from a principal ARN,
+// leaving e.g. user/alice
+func principalName(arn string) string {
+	name := strings.TrimPrefix(arn, PrincipalPrefix)
+	if _, rest, ok := strings.Cut(name, ":"); ok {
+		return rest
+	}
+	return name
+}
+
+func matchAny(patterns []string, s string, ignoreCase bool) bool {
+	for _, pattern := range patterns {
+		if match(pattern, s, ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether s matches pattern, where * matches any run of
+// characters, / included, and ? matches any single character
+func match(pattern, s string, ignoreCase bool) bool {
+	if ignoreCase {
+		pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	}
+	// Iterative wildcard matching: on a mismatch, let the most recent *
+	// absorb one more character and retry from there
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			mark++
+			p, i = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+)
+
+// mustParse parses a policy for bucket bkt
+func mustParse(t *testing.T, doc string) *Policy {
+	t.Helper()
+	p, err := Parse([]byte(doc), "bkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+var alice = []string{UserARN("alice"), GroupARN("readers")}
+
+func TestEvaluate(t *testing.T) {
+	p := mustParse(t, `{"Version": "2012-10-17", "Statement": [
+		{"Effect": "Allow", "Principal": "*", "Action": "s3:Get*", "Resource": "arn:aws:s3:::bkt/photos/*.jpg"},
+		{"Effect": "Allow", "Principal": "*", "Action": "s3:?utObject", "Resource": "arn:aws:s3:::bkt/uploads/?.txt"},
+		{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::123456789012:user/alice"}, "Action": "s3:*", "Resource": "arn:aws:s3:::bkt/*"},
+		{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam:::group/readers"}, "Action": "s3:ListBucket", "Resource": "arn:aws:s3:::bkt"},
+		{"Effect": "Deny", "Principal": "*", "Action": "s3:DeleteObject", "Resource": "arn:aws:s3:::bkt/*"},
+		{"Effect": "Deny", "Principal": "*", "NotAction": ["s3:GetObject", "s3:ListBucket"], "Resource": "arn:aws:s3:::bkt/archive/*"},
+		{"Effect": "Deny", "Principal": "*", "Action": "s3:PutObject", "NotResource": ["arn:aws:s3:::bkt/uploads/*", "arn:aws:s3:::bkt/photos/*"]}
+	]}`)
+
+	tests := []struct {
+		name       string
+		action     string
+		resource   string
+		principals []string
+		want       Decision
+	}{
+		{"wildcard action and key", "s3:GetObject", ObjectARN("bkt", "photos/2024/cat.jpg"), nil, Allow},
+		{"action case ignored", "s3:getobjectversion", ObjectARN("bkt", "photos/cat.jpg"), nil, Allow},
+		{"key outside the wildcard", "s3:GetObject", ObjectARN("bkt", "photos/cat.png"), nil, NotApplicable},
+		{"key case kept", "s3:GetObject", ObjectARN("bkt", "photos/cat.JPG"), nil, NotApplicable},
+		{"action outside the wildcard", "s3:PutObject", ObjectARN("bkt", "photos/cat.jpg"), nil, NotApplicable},
+		{"? matches one character", "s3:PutObject", ObjectARN("bkt", "uploads/a.txt"), nil, Allow},
+		{"? matches only one character", "s3:PutObject", ObjectARN("bkt", "uploads/ab.txt"), nil, NotApplicable},
+		{"user principal, account ignored", "s3:PutObject", ObjectARN("bkt", "uploads/ab.txt"), alice, Allow},
+		{"group principal", "s3:ListBucket", BucketARN("bkt"), alice, Allow},
+		{"another user", "s3:ListBucket", BucketARN("bkt"), []string{UserARN("bob")}, NotApplicable},
+		{"anonymous is not a named principal", "s3:ListBucket", BucketARN("bkt"), nil, NotApplicable},
+		{"explicit deny beats allow", "s3:DeleteObject", ObjectARN("bkt", "photos/cat.jpg"), alice, Deny},
+		{"NotAction denies the rest", "s3:PutObject", ObjectARN("bkt", "archive/2020"), alice, Deny},
+		{"NotAction spares its actions", "s3:GetObject", ObjectARN("bkt", "archive/2020"), alice, Allow},
+		{"NotResource denies the rest", "s3:PutObject", ObjectARN("bkt", "docs/a"), alice, Deny},
+		{"NotResource spares its resources", "s3:PutObject", ObjectARN("bkt", "photos/a"), alice, Allow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Request{Action: tt.action, Resource: tt.resource, Principals: tt.principals}
+			if got := p.Evaluate(r); got != tt.want {
+				t.Errorf("Evaluate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var none *Policy
+	if got := none.Evaluate(&Request{Action: "s3:GetObject"}); got != NotApplicable {
+		t.Errorf("nil policy: Evaluate = %v", got)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		context   map[string]string
+		want      Decision
+	}{
+		{"IpAddress in network", `{"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, map[string]string{KeySourceIP: "10.1.2.3"}, Allow},
+		{"IpAddress outside network", `{"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, map[string]string{KeySourceIP: "11.1.2.3"}, NotApplicable},
+		{"IpAddress single address", `{"IpAddress": {"aws:SourceIp": ["192.0.2.1", "2001:db8::/32"]}}`, map[string]string{KeySourceIP: "192.0.2.1"}, Allow},
+		{"IpAddress IPv6", `{"IpAddress": {"aws:SourceIp": ["192.0.2.1", "2001:db8::/32"]}}`, map[string]string{KeySourceIP: "2001:db8::7"}, Allow},
+		{"IpAddress without an address", `{"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, nil, NotApplicable},
+		{"NotIpAddress", `{"NotIpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, map[string]string{KeySourceIP: "11.1.2.3"}, Allow},
+		{"NotIpAddress in network", `{"NotIpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, map[string]string{KeySourceIP: "10.1.2.3"}, NotApplicable},
+
+		{"StringEquals", `{"StringEquals": {"aws:username": "alice"}}`, map[string]string{KeyUsername: "alice"}, Allow},
+		{"StringEquals is case sensitive", `{"StringEquals": {"aws:username": "alice"}}`, map[string]string{KeyUsername: "Alice"}, NotApplicable},
+		{"StringEqualsIgnoreCase", `{"StringEqualsIgnoreCase": {"aws:username": "alice"}}`, map[string]string{KeyUsername: "Alice"}, Allow},
+		{"StringNotEquals", `{"StringNotEquals": {"aws:username": ["bob", "carol"]}}`, map[string]string{KeyUsername: "alice"}, Allow},
+		{"StringNotEquals one of", `{"StringNotEquals": {"aws:username": ["bob", "carol"]}}`, map[string]string{KeyUsername: "carol"}, NotApplicable},
+		{"StringNotEquals missing key", `{"StringNotEquals": {"aws:username": "bob"}}`, nil, Allow},
+		{"StringLike *", `{"StringLike": {"s3:prefix": "home/*"}}`, map[string]string{KeyPrefix: "home/alice/docs"}, Allow},
+		{"StringLike ?", `{"StringLike": {"s3:prefix": "home/?"}}`, map[string]string{KeyPrefix: "home/ab"}, NotApplicable},
+		{"StringLike no match", `{"StringLike": {"aws:Referer": "https://example.com/*"}}`, map[string]string{KeyReferer: "https://evil.example/"}, NotApplicable},
+		{"StringNotLike", `{"StringNotLike": {"aws:UserAgent": "*bot*"}}`, map[string]string{KeyUserAgent: "curl/8.0"}, Allow},
+		{"StringNotLike match", `{"StringNotLike": {"aws:UserAgent": "*bot*"}}`, map[string]string{KeyUserAgent: "crawlbot/1"}, NotApplicable},
+		{"key case ignored", `{"StringEquals": {"AWS:UserName": "alice"}}`, map[string]string{KeyUsername: "alice"}, Allow},
+
+		{"NumericLessThanEquals", `{"NumericLessThanEquals": {"s3:max-keys": 100}}`, map[string]string{KeyMaxKeys: "100"}, Allow},
+		{"NumericLessThanEquals over", `{"NumericLessThanEquals": {"s3:max-keys": 100}}`, map[string]string{KeyMaxKeys: "101"}, NotApplicable},
+		{"NumericGreaterThan", `{"NumericGreaterThan": {"s3:max-keys": "10"}}`, map[string]string{KeyMaxKeys: "11"}, Allow},
+		{"NumericEquals not a number", `{"NumericEquals": {"s3:max-keys": 10}}`, map[string]string{KeyMaxKeys: "ten"}, NotApplicable},
+		{"NumericNotEquals", `{"NumericNotEquals": {"s3:max-keys": [10, 20]}}`, map[string]string{KeyMaxKeys: "15"}, Allow},
+		{"NumericNotEquals one of", `{"NumericNotEquals": {"s3:max-keys": [10, 20]}}`, map[string]string{KeyMaxKeys: "20"}, NotApplicable},
+
+		{"DateLessThan", `{"DateLessThan": {"aws:CurrentTime": "2026-01-01T00:00:00Z"}}`, map[string]string{KeyCurrentTime: "2025-06-01T12:00:00Z"}, Allow},
+		{"DateLessThan after", `{"DateLessThan": {"aws:CurrentTime": "2026-01-01T00:00:00Z"}}`, map[string]string{KeyCurrentTime: "2026-01-01T00:00:00Z"}, NotApplicable},
+		{"DateLessThanEquals", `{"DateLessThanEquals": {"aws:CurrentTime": "2026-01-01"}}`, map[string]string{KeyCurrentTime: "2026-01-01T00:00:00Z"}, Allow},
+		{"DateGreaterThan epoch", `{"DateGreaterThan": {"aws:EpochTime": "1700000000"}}`, map[string]string{KeyEpochTime: "1700000001"}, Allow},
+		{"DateGreaterThanEquals", `{"DateGreaterThanEquals": {"aws:CurrentTime": "2026-01-01T00:00Z"}}`, map[string]string{KeyCurrentTime: "2025-12-31T23:59:59Z"}, NotApplicable},
+		{"DateEquals", `{"DateEquals": {"aws:CurrentTime": "2026-01-01T01:00:00+01:00"}}`, map[string]string{KeyCurrentTime: "2026-01-01T00:00:00Z"}, Allow},
+		{"DateNotEquals", `{"DateNotEquals": {"aws:CurrentTime": "2026-01-01"}}`, map[string]string{KeyCurrentTime: "2026-01-02T00:00:00Z"}, Allow},
+
+		{"Bool SecureTransport true", `{"Bool": {"aws:SecureTransport": "true"}}`, map[string]string{KeySecureTransport: "true"}, Allow},
+		{"Bool SecureTransport false", `{"Bool": {"aws:SecureTransport": true}}`, map[string]string{KeySecureTransport: "false"}, NotApplicable},
+		{"Bool SecureTransport missing", `{"Bool": {"aws:SecureTransport": "false"}}`, nil, NotApplicable},
+
+		{"Null absent", `{"Null": {"s3:VersionId": "true"}}`, nil, Allow},
+		{"Null present", `{"Null": {"s3:VersionId": "true"}}`, map[string]string{KeyVersionID: "v1"}, NotApplicable},
+		{"not Null present", `{"Null": {"s3:VersionId": "false"}}`, map[string]string{KeyVersionID: "v1"}, Allow},
+		{"IfExists missing key", `{"StringEqualsIfExists": {"aws:Referer": "https://example.com/"}}`, nil, Allow},
+		{"IfExists mismatch", `{"StringEqualsIfExists": {"aws:Referer": "https://example.com/"}}`, map[string]string{KeyReferer: "https://evil.example/"}, NotApplicable},
+
+		{"every operator must hold", `{"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}, "Bool": {"aws:SecureTransport": "true"}}`,
+			map[string]string{KeySourceIP: "10.1.2.3", KeySecureTransport: "false"}, NotApplicable},
+		{"every key must hold", `{"StringEquals": {"s3:prefix": "photos/", "s3:delimiter": "/"}}`,
+			map[string]string{KeyPrefix: "photos/"}, NotApplicable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mustParse(t, statement(fmt.Sprintf(
+				`"Effect": "Allow", "Principal": "*", "Action": "s3:ListBucket", "Resource": "arn:aws:s3:::bkt", "Condition": %s`, tt.condition)))
+			r := &Request{Action: "s3:ListBucket", Resource: BucketARN("bkt")}
+			for key, value := range tt.context {
+				r.Set(key, value)
+			}
+			if got := p.Evaluate(r); got != tt.want {
+				t.Errorf("Evaluate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		name      string
+		effect    string
+		principal string
+		condition string
+		want      bool
+	}{
+		{"anyone", "Allow", `"*"`, `{}`, true},
+		{"anyone by ARN list", "Allow", `{"AWS": ["arn:aws:iam:::user/alice", "*"]}`, `{}`, true},
+		{"a user", "Allow", `{"AWS": "arn:aws:iam:::user/alice"}`, `{}`, false},
+		{"deny to anyone", "Deny", `"*"`, `{}`, false},
+		{"other conditions", "Allow", `"*"`, `{"StringLike": {"aws:Referer": "https://example.com/*"}}`, true},
+		{"narrow network", "Allow", `"*"`, `{"IpAddress": {"aws:SourceIp": ["10.0.0.0/8", "192.0.2.1"]}}`, false},
+		{"broad network", "Allow", `"*"`, `{"IpAddress": {"aws:SourceIp": "0.0.0.0/0"}}`, true},
+		{"one broad network", "Allow", `"*"`, `{"IpAddress": {"aws:SourceIp": ["10.0.0.0/8", "8.0.0.0/7"]}}`, true},
+		{"narrow IPv6 network", "Allow", `"*"`, `{"IpAddress": {"aws:SourceIp": "2001:db8::/32"}}`, false},
+		{"broad IPv6 network", "Allow", `"*"`, `{"IpAddress": {"aws:SourceIp": "2001::/16"}}`, true},
+		{"excluded network", "Allow", `"*"`, `{"NotIpAddress": {"aws:SourceIp": "10.0.0.0/8"}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mustParse(t, statement(fmt.Sprintf(
+				`"Effect": %q, "Principal": %s, "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*", "Condition": %s`,
+				tt.effect, tt.principal, tt.condition)))
+			if got := p.IsPublic(); got != tt.want {
+				t.Errorf("IsPublic = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
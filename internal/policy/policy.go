@@ -0,0 +1,200 @@
+// Package policy parses S3 bucket policies and evaluates requests against
+// them with IAM semantics: an explicit Deny wins over any Allow, and a
+// request no statement allows is implicitly denied.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Policy language versions
+const (
+	Version2012 = "2012-10-17"
+	Version2008 = "2008-10-17"
+)
+
+// MaxSize is the S3 limit on the size of a bucket policy document
+const MaxSize = 20 * 1024
+
+// Statement effects
+const (
+	EffectAllow = "Allow"
+	EffectDeny  = "Deny"
+)
+
+// ARN prefixes of S3 resources and IAM principals. Plinth has no account
+// IDs: the account field of a principal ARN is ignored.
+const (
+	ResourcePrefix  = "arn:aws:s3:::"
+	PrincipalPrefix = "arn:aws:iam::"
+)
+
+// ErrMalformed marks a policy document that cannot be used
+var ErrMalformed = errors.New("malformed policy")
+
+// Policy is a parsed bucket policy document
+type Policy struct {
+	Version    string      `json:"Version,omitempty"`
+	ID         string      `json:"Id,omitempty"`
+	Statements []Statement `json:"Statement"`
+}
+
+// Statement is one statement of a policy. A statement applies to a request
+// when its principal, action, resource and every condition match.
+type Statement struct {
+	Sid         string     `json:"Sid,omitempty"`
+	Effect      string     `json:"Effect"`
+	Principal   *Principal `json:"Principal,omitempty"`
+	Action      Values     `json:"Action,omitempty"`
+	NotAction   Values     `json:"NotAction,omitempty"`
+	Resource    Values     `json:"Resource,omitempty"`
+	NotResource Values     `json:"NotResource,omitempty"`
+	Condition   Conditions `json:"Condition,omitempty"`
+}
+
+// Values is a policy element given as a string or an array of strings
+type Values []string
+
+// UnmarshalJSON accepts a single string or an array of strings
+func (v *Values) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*v = Values{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("expected a string or an array of strings")
+	}
+	*v = many
+	return nil
+}
+
+// Principal is the Principal element: "*" or {"AWS": <ARNs>}. Other
+// principal types do not exist in Plinth.
+type Principal struct {
+	AWS Values `json:"AWS"`
+}
+
+// UnmarshalJSON accepts "*" as a shorthand for {"AWS": "*"}
+func (p *Principal) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "*" {
+			return fmt.Errorf("Principal must be \"*\" or an object")
+		}
+		p.AWS = Values{"*"}
+		return nil
+	}
+	var m map[string]Values
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("Principal must be \"*\" or an object")
+	}
+	for kind, values := range m {
+		if kind != "AWS" {
+			return fmt.Errorf("principal type %q is not supported", kind)
+		}
+		p.AWS = values
+	}
+	return nil
+}
+
+// Parse parses and validates a policy document for bucket. Every resource
+// must name the bucket or objects in it.
+func Parse(data []byte, bucket string) (*Policy, error) {
+	if len(data) > MaxSize {
+		return nil, fmt.Errorf("%w: policies must be no larger than %d bytes", ErrMalformed, MaxSize)
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if p.Version != Version2012 && p.Version != Version2008 {
+		return nil, fmt.Errorf("%w: Version must be %s or %s", ErrMalformed, Version2012, Version2008)
+	}
+	if len(p.Statements) == 0 {
+		return nil, fmt.Errorf("%w: missing required field Statement", ErrMalformed)
+	}
+	for i := range p.Statements {
+		if err := p.Statements[i].validate(bucket); err != nil {
+			name := p.Statements[i].Sid
+			if name == "" {
+				name = fmt.Sprint(i + 1)
+			}
+			return nil, fmt.Errorf("%w: statement %s: %v", ErrMalformed, name, err)
+		}
+	}
+	return &p, nil
+}
+
+// UnmarshalJSON accepts a single statement as well as an array
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Version   string          `json:"Version"`
+		ID        string          `json:"Id"`
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Version, p.ID = raw.Version, raw.ID
+	if len(raw.Statement) == 0 {
+		return nil
+	}
+	if raw.Statement[0] == '{' {
+		p.Statements = make([]Statement, 1)
+		return json.Unmarshal(raw.Statement, &p.Statements[0])
+	}
+	return json.Unmarshal(raw.Statement, &p.Statements)
+}
+
+func (s *Statement) validate(bucket string) error {
+	if s.Effect != EffectAllow && s.Effect != EffectDeny {
+		return fmt.Errorf("Effect must be %s or %s", EffectAllow, EffectDeny)
+	}
+	if s.Principal == nil || len(s.Principal.AWS) == 0 {
+		return fmt.Errorf("missing required field Principal")
+	}
+	for _, principal := range s.Principal.AWS {
+		if principal != "*" && !strings.HasPrefix(principal, PrincipalPrefix) {
+			return fmt.Errorf("invalid principal %q", principal)
+		}
+	}
+
+	if (len(s.Action) == 0) == (len(s.NotAction) == 0) {
+		return fmt.Errorf("exactly one of Action and NotAction is required")
+	}
+	for _, action := range append(s.Action, s.NotAction...) {
+		if action != "*" && !strings.HasPrefix(strings.ToLower(action), "s3:") {
+			return fmt.Errorf("action %q does not apply to S3", action)
+		}
+	}
+
+	if (len(s.Resource) == 0) == (len(s.NotResource) == 0) {
+		return fmt.Errorf("exactly one of Resource and NotResource is required")
+	}
+	for _, resource := range append(s.Resource, s.NotResource...) {
+		name, ok := strings.CutPrefix(resource, ResourcePrefix)
+		if !ok {
+			return fmt.Errorf("resource %q is not an S3 ARN", resource)
+		}
+		if b, _, _ := strings.Cut(name, "/"); !match(b, bucket, false) {
+			return fmt.Errorf("resource %q must be in bucket %s", resource, bucket)
+		}
+	}
+
+	return s.Condition.validate()
+}
+
+// BucketARN and ObjectARN name the resources requests act on
+func BucketARN(bucket string) string { return ResourcePrefix + bucket }
+
+func ObjectARN(bucket, key string) string { return ResourcePrefix + bucket + "/" + key }
+
+// UserARN and GroupARN name the principals a request is made by
+func UserARN(name string) string { return PrincipalPrefix + ":user/" + name }
+
+func GroupARN(name string) string { return PrincipalPrefix + ":group/" + name }
@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// statement returns a policy document holding one statement, given as the
+// members of its JSON object
+func statement(members string) string {
+	return fmt.Sprintf(`{"Version": "2012-10-17", "Statement": {%s}}`, members)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		ok     bool
+	}{
+		{"valid", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), true},
+		{"statement array", `{"Version": "2012-10-17", "Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::123:user/alice"}, "Action": ["s3:Get*", "s3:List*"], "Resource": ["arn:aws:s3:::bkt", "arn:aws:s3:::bkt/*"]},
+			{"Effect": "Deny", "Principal": "*", "NotAction": "s3:GetObject", "NotResource": "arn:aws:s3:::bkt/public/*"}
+		]}`, true},
+		{"2008 version", `{"Version": "2008-10-17", "Statement": {"Effect": "Allow", "Principal": "*", "Action": "*", "Resource": "arn:aws:s3:::bkt"}}`, true},
+		{"wildcard bucket", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:*", "Resource": "arn:aws:s3:::bk?/*"`), true},
+		{"conditions", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:ListBucket", "Resource": "arn:aws:s3:::bkt",
+			"Condition": {"IpAddress": {"aws:SourceIp": ["10.0.0.0/8", "192.168.1.1"]}, "NumericLessThanEquals": {"s3:max-keys": 100}, "Bool": {"aws:SecureTransport": true}}`), true},
+
+		{"bad effect", statement(`"Effect": "Permit", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"unknown action", statement(`"Effect": "Allow", "Principal": "*", "Action": "sqs:SendMessage", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"action without service", statement(`"Effect": "Allow", "Principal": "*", "Action": "GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"resource outside the bucket", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::other/*"`), false},
+		{"resource not an S3 ARN", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "bkt/*"`), false},
+		{"Action and NotAction", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "NotAction": "s3:PutObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"no action", statement(`"Effect": "Allow", "Principal": "*", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"no resource", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject"`), false},
+		{"no principal", statement(`"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"service principal", statement(`"Effect": "Allow", "Principal": {"Service": "s3.amazonaws.com"}, "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"principal not an ARN", statement(`"Effect": "Allow", "Principal": {"AWS": "alice"}, "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+		{"unknown operator", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*", "Condition": {"StringRoughly": {"aws:UserAgent": "curl"}}`), false},
+		{"bad network", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*", "Condition": {"IpAddress": {"aws:SourceIp": "10.0.0.0/33"}}`), false},
+		{"bad date", statement(`"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*", "Condition": {"DateLessThan": {"aws:CurrentTime": "tomorrow"}}`), false},
+		{"bad version", `{"Version": "2020-01-01", "Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"}}`, false},
+		{"no statement", `{"Version": "2012-10-17"}`, false},
+		{"not JSON", `Allow everything`, false},
+		{"too large", statement(`"Sid": "` + strings.Repeat("x", MaxSize) + `", "Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*"`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.policy), "bkt")
+			if tt.ok && err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Parse: %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
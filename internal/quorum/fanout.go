@@ -0,0 +1,23 @@
+package quorum
+
+import (
+	"context"
+	"sync"
+)
+
+// Do calls fn for every node concurrently and returns the results in node
+// order once all calls have finished
+func Do(ctx context.Context, nodeIDs []string, fn func(ctx context.Context, nodeID string) (interface{}, error)) []Result {
+	results := make([]Result, len(nodeIDs))
+	var wg sync.WaitGroup
+	for i, nodeID := range nodeIDs {
+		wg.Add(1)
+		go func(i int, nodeID string) {
+			defer wg.Done()
+			data, err := fn(ctx, nodeID)
+			results[i] = Result{NodeID: nodeID, Success: err == nil, Error: err, Data: data}
+		}(i, nodeID)
+	}
+	wg.Wait()
+	return results
+}
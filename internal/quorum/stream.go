@@ -0,0 +1,109 @@
+package quorum
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// errTargetDone unblocks the fan-out when a target stops reading early
+var errTargetDone = errors.New("target stopped reading")
+
+// Target is one replica destination of a streaming write
+type Target struct {
+	NodeID string
+
+	// Write consumes r until EOF and returns node-specific result data.
+	// It must abandon the replica if r returns an error other than io.EOF.
+	Write func(ctx context.Context, r io.Reader) (interface{}, error)
+}
+
+// WriteStream copies r to every target in a single pass and waits for all of
+// them to finish. Targets that fail are dropped while the others continue;
+// the write is aborted as soon as fewer than writeQuorum targets remain.
+// Results are returned in target order even when an error is returned.
+func WriteStream(ctx context.Context, r io.Reader, targets []Target, writeQuorum int) ([]Result, error) {
+	if len(targets) < writeQuorum {
+		return nil, ErrInsufficientNodes
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]Result, len(targets))
+	fw := &fanOutWriter{
+		writers: make([]*io.PipeWriter, len(targets)),
+		quorum:  writeQuorum,
+	}
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		pr, pw := io.Pipe()
+		fw.writers[i] = pw
+		fw.live++
+
+		wg.Add(1)
+		go func(i int, t Target, pr *io.PipeReader) {
+			defer wg.Done()
+			data, err := t.Write(ctx, pr)
+			pr.CloseWithError(errTargetDone)
+			results[i] = Result{NodeID: t.NodeID, Success: err == nil, Error: err, Data: data}
+		}(i, t, pr)
+	}
+
+	_, copyErr := io.Copy(fw, r)
+	for _, pw := range fw.writers {
+		if pw == nil {
+			continue
+		}
+		if copyErr != nil {
+			pw.CloseWithError(copyErr)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
+
+	if copyErr != nil {
+		return results, copyErr
+	}
+	if Successes(results) < writeQuorum {
+		return results, ErrWriteQuorumNotMet
+	}
+	return results, nil
+}
+
+// Successes counts successful results
+func Successes(results []Result) int {
+	n := 0
+	for _, r := range results {
+		if r.Success {
+			n++
+		}
+	}
+	return n
+}
+
+// fanOutWriter writes to every live pipe and drops pipes whose reader is gone
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	live    int
+	quorum  int
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	for i, pw := range w.writers {
+		if pw == nil {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			w.writers[i] = nil
+			w.live--
+		}
+	}
+	if w.live < w.quorum {
+		return 0, ErrWriteQuorumNotMet
+	}
+	return len(p), nil
+}
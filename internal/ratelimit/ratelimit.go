@@ -0,0 +1,336 @@
+// Package ratelimit implements the token buckets the gateway throttles S3
+// requests with. Every request is charged to a set of keys, such as its
+// access key, source IP and bucket; each key has a bucket of request
+// tokens refilled at requests/sec and one of byte tokens refilled at
+// bytes/sec.
+//
+// Request tokens are taken before a request is served. Its size is only
+// known afterwards, so bytes are charged once it is done and may leave the
+// byte bucket in debt: a key in debt is refused until the debt is paid off.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of key requests are limited by. A key is its kind and value joined
+// by a colon, e.g. source_ip:10.0.0.7, as Key builds it.
+const (
+	KindAccessKey = "access_key"
+	KindSourceIP  = "source_ip"
+	KindBucket    = "bucket"
+)
+
+// IdleTimeout is how long a key may go unused before its buckets are
+// forgotten. A forgotten key starts again with full buckets.
+const IdleTimeout = 10 * time.Minute
+
+// ErrInvalidConfig is returned by Validate
+var ErrInvalidConfig = errors.New("invalid rate limit configuration")
+
+// Key returns the key of a request's value of kind
+func Key(kind, value string) string {
+	return kind + ":" + value
+}
+
+// Limit is a token bucket refilled at Rate tokens per second that holds at
+// most Burst tokens. A zero Rate means no limit; a zero Burst means Rate.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst,omitempty"`
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst == 0 {
+		return l.Rate
+	}
+	return l.Burst
+}
+
+// Limits are the request and byte buckets of one key
+type Limits struct {
+	Requests Limit `json:"requests"`
+	Bytes    Limit `json:"bytes"`
+}
+
+// Config holds the limits of every key: the defaults of each kind, and
+// overrides for individual keys, such as a busy bucket or a trusted client
+type Config struct {
+	AccessKey Limits            `json:"access_key"`
+	SourceIP  Limits            `json:"source_ip"`
+	Bucket    Limits            `json:"bucket"`
+	Overrides map[string]Limits `json:"overrides,omitempty"`
+}
+
+// Validate checks that rates and bursts are not negative, that a burst is
+// only given with a rate, and that overrides name a known kind of key
+func (c *Config) Validate() error {
+	check := func(name string, limits Limits) error {
+		for _, l := range []struct {
+			what  string
+			limit Limit
+		}{{"requests", limits.Requests}, {"bytes", limits.Bytes}} {
+			rate, burst := l.limit.Rate, l.limit.Burst
+			switch {
+			case rate < 0 || burst < 0 || math.IsNaN(rate) || math.IsNaN(burst) || math.IsInf(rate, 0) || math.IsInf(burst, 0):
+				return fmt.Errorf("%w: %s %s: rate and burst must be non-negative numbers", ErrInvalidConfig, name, l.what)
+			case rate == 0 && burst > 0:
+				return fmt.Errorf("%w: %s %s: burst without a rate", ErrInvalidConfig, name, l.what)
+			case l.what == "requests" && rate > 0 && limits.Requests.burst() < 1:
+				return fmt.Errorf("%w: %s requests: burst must be at least 1", ErrInvalidConfig, name)
+			}
+		}
+		return nil
+	}
+	for name, limits := range map[string]Limits{
+		KindAccessKey: c.AccessKey,
+		KindSourceIP:  c.SourceIP,
+		KindBucket:    c.Bucket,
+	} {
+		if err := check(name, limits); err != nil {
+			return err
+		}
+	}
+	for key, limits := range c.Overrides {
+		kind, value, _ := strings.Cut(key, ":")
+		if kind != KindAccessKey && kind != KindSourceIP && kind != KindBucket || value == "" {
+			return fmt.Errorf("%w: override %q is not kind:value with kind access_key, source_ip or bucket", ErrInvalidConfig, key)
+		}
+		if err := check(key, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limits returns the limits of key
+func (c *Config) limits(key string) Limits {
+	if limits, ok := c.Overrides[key]; ok {
+		return limits
+	}
+	kind, _, _ := strings.Cut(key, ":")
+	switch kind {
+	case KindAccessKey:
+		return c.AccessKey
+	case KindSourceIP:
+		return c.SourceIP
+	case KindBucket:
+		return c.Bucket
+	}
+	return Limits{}
+}
+
+// Usage counts the requests and bytes charged to a key
+type Usage struct {
+	Requests int64
+	Bytes    int64
+}
+
+// Limiter holds the token buckets of the keys requests are charged to. It
+// is safe for concurrent use.
+//
+// Several gateways enforce a limit together in one of two ways. With
+// SetShare each enforces its share of every limit, which is exact when
+// load is spread evenly across them. Otherwise each reports its usage with
+// Usage and debits what the others used with Debit, so the limit holds
+// whatever the spread, give or take what is used between two exchanges.
+type Limiter struct {
+	mu      sync.Mutex
+	config  Config
+	share   float64
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+// entry is the state of one key
+type entry struct {
+	requests float64 // request tokens available
+	bytes    float64 // byte tokens available; negative while in debt
+	refilled time.Time
+	used     time.Time
+
+	usage  Usage // charged here since the entry was created
+	remote Usage // charged by other gateways, as last debited
+	synced bool  // remote has been set
+}
+
+// New creates a limiter enforcing config, which must be valid
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:  config,
+		share:   1,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// Config returns the limits in force
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// SetConfig replaces the limits with config, which must be valid. Keys
+// keep the tokens they have, up to their new bursts.
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+// SetShare makes the limiter enforce 1/n of every rate and burst, for one
+// of n gateways splitting the limits evenly
+func (l *Limiter) SetShare(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.share = 1 / float64(n)
+}
+
+// Reserve takes a request token from each of keys, unless one of them has
+// none left or is in byte debt. Then it takes nothing and returns the
+// limited key and how long to wait before retrying.
+func (l *Limiter) Reserve(keys ...string) (limited string, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	entries := make([]*entry, len(keys))
+	for i, key := range keys {
+		e, limits := l.refill(key, now)
+		entries[i] = e
+		if d := wait(e, limits); d > retryAfter {
+			limited, retryAfter = key, d
+		}
+	}
+	if limited != "" {
+		return limited, retryAfter
+	}
+	for _, e := range entries {
+		e.requests--
+		e.usage.Requests++
+	}
+	return "", 0
+}
+
+// Charge takes n byte tokens from each of keys, going into debt if they
+// have fewer
+func (l *Limiter) Charge(n int64, keys ...string) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, key := range keys {
+		e, _ := l.refill(key, now)
+		e.bytes -= float64(n)
+		e.usage.Bytes += n
+	}
+}
+
+// Usage returns what has been charged to each key in use since this
+// limiter started tracking it. The counts only grow, unless the key goes
+// idle and is forgotten.
+func (l *Limiter) Usage() map[string]Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := make(map[string]Usage, len(l.entries))
+	for key, e := range l.entries {
+		usage[key] = e.usage
+	}
+	return usage
+}
+
+// Debit takes what other gateways have charged to keys from their buckets.
+// remote holds their running totals: what they charged since the last
+// Debit is taken. The first totals seen for a key are only recorded, since
+// they were charged before this limiter knew the key.
+func (l *Limiter) Debit(remote map[string]Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, total := range remote {
+		e, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		l.refill(key, now)
+		if e.synced {
+			// Totals drop when another gateway forgets an idle key or
+			// stops; nothing was used then
+			if d := total.Requests - e.remote.Requests; d > 0 {
+				e.requests -= float64(d)
+			}
+			if d := total.Bytes - e.remote.Bytes; d > 0 {
+				e.bytes -= float64(d)
+			}
+		}
+		e.remote, e.synced = total, true
+	}
+}
+
+// Prune forgets keys unused for IdleTimeout
+func (l *Limiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, e := range l.entries {
+		if now.Sub(e.used) >= IdleTimeout {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// refill returns the entry of key, created with full buckets if new, with
+// the tokens earned since it was last refilled added. The caller holds
+// l.mu.
+func (l *Limiter) refill(key string, now time.Time) (*entry, Limits) {
+	limits := l.config.limits(key)
+	requests, bytes := l.scale(limits.Requests), l.scale(limits.Bytes)
+	if requests.Rate > 0 && requests.Burst < 1 {
+		// A request needs a whole token however thinly the burst is split
+		requests.Burst = 1
+	}
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{requests: requests.burst(), bytes: bytes.burst(), refilled: now}
+		l.entries[key] = e
+	}
+	if elapsed := now.Sub(e.refilled).Seconds(); elapsed > 0 {
+		e.requests += elapsed * requests.Rate
+		e.bytes += elapsed * bytes.Rate
+		e.refilled = now
+	}
+	// Capped even when no time has passed, as the burst may have shrunk
+	e.requests = math.Min(requests.burst(), e.requests)
+	e.bytes = math.Min(bytes.burst(), e.bytes)
+	e.used = now
+	return e, Limits{Requests: requests, Bytes: bytes}
+}
+
+// scale returns this limiter's share of limit. The caller holds l.mu.
+func (l *Limiter) scale(limit Limit) Limit {
+	return Limit{Rate: limit.Rate * l.share, Burst: limit.burst() * l.share}
+}
+
+// wait returns how long e must wait for a request token and to pay off its
+// byte debt under limits, zero if it need not
+func wait(e *entry, limits Limits) time.Duration {
+	var wait float64
+	if limits.Requests.Rate > 0 && e.requests < 1 {
+		wait = (1 - e.requests) / limits.Requests.Rate
+	}
+	if limits.Bytes.Rate > 0 && e.bytes < 0 {
+		wait = math.Max(wait, -e.bytes/limits.Bytes.Rate)
+	}
+	return time.Duration(wait * float64(time.Second))
+}
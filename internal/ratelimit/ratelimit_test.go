@@ -0,0 +1,280 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// clock is a time that only moves when told to
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newLimiter returns a limiter enforcing config on the time of the clock
+// it returns
+func newLimiter(config Config) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(config)
+	l.now = c.now
+	return l, c
+}
+
+// reserve reserves n requests of key and fails unless all are served
+func reserve(t *testing.T, l *Limiter, n int, keys ...string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if limited, retryAfter := l.Reserve(keys...); limited != "" {
+			t.Fatalf("request %d of %d limited on %s for %v", i+1, n, limited, retryAfter)
+		}
+	}
+}
+
+// limited fails unless a request of keys is limited on key for retryAfter
+func limited(t *testing.T, l *Limiter, key string, retryAfter time.Duration, keys ...string) {
+	t.Helper()
+	gotKey, got := l.Reserve(keys...)
+	if gotKey != key || got != retryAfter {
+		t.Fatalf("Reserve = %q, %v, want %q, %v", gotKey, got, key, retryAfter)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	ip := Key(KindSourceIP, "10.0.0.7")
+	l, c := newLimiter(Config{SourceIP: Limits{Requests: Limit{Rate: 2, Burst: 3}}})
+
+	// A new key starts with a full burst
+	reserve(t, l, 3, ip)
+	limited(t, l, ip, 500*time.Millisecond, ip)
+
+	// Tokens are earned at the rate, fractions included
+	c.advance(250 * time.Millisecond)
+	limited(t, l, ip, 250*time.Millisecond, ip)
+	c.advance(250 * time.Millisecond)
+	reserve(t, l, 1, ip)
+	limited(t, l, ip, 500*time.Millisecond, ip)
+
+	// but never more than the burst
+	c.advance(time.Hour)
+	reserve(t, l, 3, ip)
+	limited(t, l, ip, 500*time.Millisecond, ip)
+}
+
+func TestReserveBurst(t *testing.T) {
+	bucket := Key(KindBucket, "bkt")
+	l, _ := newLimiter(Config{
+		Bucket:    Limits{Requests: Limit{Rate: 2}},
+		Overrides: map[string]Limits{Key(KindBucket, "busy"): {Requests: Limit{Rate: 1, Burst: 5}}},
+	})
+
+	// A zero burst is the rate
+	reserve(t, l, 2, bucket)
+	limited(t, l, bucket, 500*time.Millisecond, bucket)
+
+	// Overrides replace the defaults of their kind
+	reserve(t, l, 5, Key(KindBucket, "busy"))
+	limited(t, l, Key(KindBucket, "busy"), time.Second, Key(KindBucket, "busy"))
+
+	// Kinds without a limit are not limited
+	reserve(t, l, 1000, Key(KindAccessKey, "AKID"))
+}
+
+// TestReserveKeys checks that a request limited on one key takes no token
+// from the others
+func TestReserveKeys(t *testing.T) {
+	ip, bucket := Key(KindSourceIP, "10.0.0.7"), Key(KindBucket, "bkt")
+	l, _ := newLimiter(Config{
+		SourceIP: Limits{Requests: Limit{Rate: 1, Burst: 1}},
+		Bucket:   Limits{Requests: Limit{Rate: 1, Burst: 2}},
+	})
+
+	reserve(t, l, 1, ip, bucket)
+	for i := 0; i < 3; i++ {
+		limited(t, l, ip, time.Second, ip, bucket)
+	}
+	reserve(t, l, 1, bucket)
+	limited(t, l, bucket, time.Second, bucket)
+}
+
+func TestCharge(t *testing.T) {
+	key := Key(KindAccessKey, "AKID")
+	l, c := newLimiter(Config{AccessKey: Limits{
+		Requests: Limit{Rate: 10},
+		Bytes:    Limit{Rate: 100, Burst: 200},
+	}})
+
+	// Bytes are charged after the request, going into debt
+	reserve(t, l, 1, key)
+	l.Charge(350, key)
+	limited(t, l, key, 1500*time.Millisecond, key)
+
+	// A key is served again once its debt is paid off
+	c.advance(time.Second)
+	limited(t, l, key, 500*time.Millisecond, key)
+	c.advance(500 * time.Millisecond)
+	reserve(t, l, 1, key)
+
+	// The longer of the waits for a request token and for the debt counts
+	reserve(t, l, 9, key)
+	l.Charge(5, key)
+	limited(t, l, key, 100*time.Millisecond, key)
+	l.Charge(100, key)
+	limited(t, l, key, 1050*time.Millisecond, key)
+
+	if got := l.Usage()[key]; got != (Usage{Requests: 11, Bytes: 455}) {
+		t.Errorf("usage %+v", got)
+	}
+	// Nothing is charged for empty requests
+	l.Charge(0, Key(KindAccessKey, "other"))
+	if _, ok := l.Usage()[Key(KindAccessKey, "other")]; ok {
+		t.Error("empty charge tracked a key")
+	}
+}
+
+// TestShare enforces a split of the limits, as in split mode
+func TestShare(t *testing.T) {
+	config := Config{SourceIP: Limits{
+		Requests: Limit{Rate: 4, Burst: 8},
+		Bytes:    Limit{Rate: 1000},
+	}}
+	l, c := newLimiter(config)
+
+	l.SetShare(2)
+	a := Key(KindSourceIP, "a")
+	reserve(t, l, 4, a)
+	limited(t, l, a, 500*time.Millisecond, a)
+	l.Charge(1000, a)
+	limited(t, l, a, time.Second, a)
+
+	// A request needs a whole token, however many gateways share the
+	// limit: one of 16 gateways gets a burst of 1, not 1/2
+	l.SetShare(16)
+	b := Key(KindSourceIP, "b")
+	reserve(t, l, 1, b)
+	limited(t, l, b, 4*time.Second, b)
+
+	// Growing the share grows the buckets, shrinking it caps them at once
+	l.SetShare(1)
+	c.advance(time.Hour)
+	reserve(t, l, 2, b)
+	l.SetShare(2)
+	reserve(t, l, 4, b)
+	limited(t, l, b, 500*time.Millisecond, b)
+
+	// A share below one gateway is one gateway
+	l.SetShare(0)
+	c.advance(time.Hour)
+	reserve(t, l, 8, Key(KindSourceIP, "c"))
+	limited(t, l, Key(KindSourceIP, "c"), 250*time.Millisecond, Key(KindSourceIP, "c"))
+}
+
+// TestDebit exchanges usage with other gateways, as in shared mode
+func TestDebit(t *testing.T) {
+	key := Key(KindBucket, "bkt")
+	l, _ := newLimiter(Config{Bucket: Limits{
+		Requests: Limit{Rate: 1, Burst: 10},
+		Bytes:    Limit{Rate: 100, Burst: 100},
+	}})
+	reserve(t, l, 1, key)
+
+	// The first totals were charged before the key was known here
+	l.Debit(map[string]Usage{key: {Requests: 50, Bytes: 5000}})
+	reserve(t, l, 1, key)
+
+	// Then what other gateways charged since the last debit is taken
+	l.Debit(map[string]Usage{key: {Requests: 53, Bytes: 5050}})
+	reserve(t, l, 5, key)
+	limited(t, l, key, time.Second, key)
+
+	// Totals that drop took nothing; the next rise counts from them
+	l.Debit(map[string]Usage{key: {Requests: 2, Bytes: 5250}})
+	limited(t, l, key, 1500*time.Millisecond, key)
+
+	// Keys not used here are left alone
+	l.Debit(map[string]Usage{Key(KindBucket, "other"): {Requests: 10}})
+	if _, ok := l.Usage()[Key(KindBucket, "other")]; ok {
+		t.Error("debit tracked a key unused here")
+	}
+	if got := l.Usage()[key]; got != (Usage{Requests: 7}) {
+		t.Errorf("usage %+v includes what was debited", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	key := Key(KindSourceIP, "10.0.0.7")
+	l, c := newLimiter(Config{SourceIP: Limits{Requests: Limit{Rate: 0.001, Burst: 2}}})
+	reserve(t, l, 2, key)
+
+	c.advance(IdleTimeout - time.Second)
+	l.Prune()
+	if _, ok := l.Usage()[key]; !ok {
+		t.Fatal("key in use forgotten")
+	}
+
+	// A request, even a limited one, keeps the key in use
+	if limitedKey, _ := l.Reserve(key); limitedKey != key {
+		t.Fatal("request served without a token")
+	}
+	c.advance(IdleTimeout - time.Second)
+	l.Prune()
+	if _, ok := l.Usage()[key]; !ok {
+		t.Fatal("key in use forgotten")
+	}
+
+	// A forgotten key starts again with full buckets
+	c.advance(time.Second)
+	l.Prune()
+	if _, ok := l.Usage()[key]; ok {
+		t.Fatal("idle key kept")
+	}
+	reserve(t, l, 2, key)
+}
+
+func TestSetConfig(t *testing.T) {
+	key := Key(KindAccessKey, "AKID")
+	l, _ := newLimiter(Config{AccessKey: Limits{Requests: Limit{Rate: 1, Burst: 10}}})
+	reserve(t, l, 2, key)
+
+	// Keys keep their tokens up to the new burst
+	l.SetConfig(Config{AccessKey: Limits{Requests: Limit{Rate: 1, Burst: 3}}})
+	reserve(t, l, 3, key)
+	limited(t, l, key, time.Second, key)
+
+	// and are not limited once the limit is lifted
+	l.SetConfig(Config{})
+	reserve(t, l, 100, key)
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		AccessKey: Limits{Requests: Limit{Rate: 10, Burst: 20}, Bytes: Limit{Rate: 1 << 20}},
+		Overrides: map[string]Limits{Key(KindBucket, "busy"): {Requests: Limit{Rate: 100}}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"negative rate", Config{SourceIP: Limits{Requests: Limit{Rate: -1}}}},
+		{"negative burst", Config{Bucket: Limits{Bytes: Limit{Rate: 1, Burst: -1}}}},
+		{"NaN", Config{Bucket: Limits{Bytes: Limit{Rate: math.NaN()}}}},
+		{"infinite", Config{Bucket: Limits{Bytes: Limit{Rate: math.Inf(1)}}}},
+		{"burst without a rate", Config{AccessKey: Limits{Requests: Limit{Burst: 5}}}},
+		{"request burst below one", Config{AccessKey: Limits{Requests: Limit{Rate: 0.5}}}},
+		{"override of an unknown kind", Config{Overrides: map[string]Limits{"user:alice": {}}}},
+		{"override without a value", Config{Overrides: map[string]Limits{"bucket:": {}}}},
+		{"invalid override", Config{Overrides: map[string]Limits{Key(KindBucket, "bkt"): {Requests: Limit{Rate: -1}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("Validate: %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Package repair implements the background work that keeps replicas
+// durable: finding replicas that are missing or differ between nodes and
+// rebuilding them, and collecting replicas that nothing refers to.
+package repair
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/merkle"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+// Divergence is a replica that the nodes responsible for its ring range do
+// not agree on: some lack it or hold different data
+type Divergence struct {
+	Key      string
+	Token    uint64
+	Nodes    []string                        // nodes responsible for the token
+	Replicas map[string]datanode.ReplicaInfo // replica held by each node that has one
+}
+
+// Missing returns the responsible nodes that hold no replica
+func (d *Divergence) Missing() []string {
+	var missing []string
+	for _, nodeID := range d.Nodes {
+		if _, ok := d.Replicas[nodeID]; !ok {
+			missing = append(missing, nodeID)
+		}
+	}
+	return missing
+}
+
+// AntiEntropy compares the inventories of the nodes that share each ring
+// partition. Only ranges whose Merkle digests differ are listed, so a pass
+// over a healthy cluster costs a handful of digest calls per partition
+// regardless of how many replicas it holds.
+type AntiEntropy struct {
+	placement         placement.Controller
+	nodes             *datanode.Pool
+	replicationFactor int
+	diff              merkle.DiffConfig
+}
+
+// NewAntiEntropy creates an anti-entropy pass over the ring
+func NewAntiEntropy(p placement.Controller, nodes *datanode.Pool, replicationFactor int) *AntiEntropy {
+	return &AntiEntropy{
+		placement:         p,
+		nodes:             nodes,
+		replicationFactor: replicationFactor,
+		diff:              merkle.DefaultDiffConfig,
+	}
+}
+
+// Run compares every partition and returns the divergent replicas, sorted by
+// key. A partition that cannot be compared is logged and skipped so one
+// unreachable node does not stop the pass.
+func (a *AntiEntropy) Run(ctx context.Context) ([]Divergence, error) {
+	partitions, err := a.placement.Partitions(ctx, a.replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	var divergent []Divergence
+	for _, part := range partitions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		found, err := a.comparePartition(ctx, part)
+		if err != nil {
+			log.Printf("anti-entropy: partition %v: %v", merkle.Range{First: part.First, Last: part.Last}, err)
+			continue
+		}
+		divergent = append(divergent, found...)
+	}
+	sort.Slice(divergent, func(i, j int) bool { return divergent[i].Key < divergent[j].Key })
+	return divergent, nil
+}
+
+// comparePartition diffs the trees of the partition's nodes and lists the
+// ranges where they disagree
+func (a *AntiEntropy) comparePartition(ctx context.Context, part placement.Partition) ([]Divergence, error) {
+	if len(part.Nodes) < 2 {
+		return nil, nil
+	}
+	nodeIDs := make([]string, len(part.Nodes))
+	clients := make([]datanode.Client, len(part.Nodes))
+	sources := make([]merkle.Source, len(part.Nodes))
+	for i, node := range part.Nodes {
+		client, err := a.nodes.Get(node.ID)
+		if err != nil {
+			return nil, err
+		}
+		nodeIDs[i], clients[i], sources[i] = node.ID, client, client
+	}
+
+	ranges, err := merkle.Diff(ctx, merkle.Range{First: part.First, Last: part.Last}, sources, a.diff)
+	if err != nil {
+		return nil, err
+	}
+
+	var divergent []Divergence
+	for _, r := range ranges {
+		byKey := make(map[string]*Divergence)
+		for i, client := range clients {
+			replicas, err := client.List(ctx, r)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range replicas {
+				d, ok := byKey[info.Key]
+				if !ok {
+					d = &Divergence{Key: info.Key, Token: info.Token, Nodes: nodeIDs, Replicas: make(map[string]datanode.ReplicaInfo)}
+					byKey[info.Key] = d
+				}
+				d.Replicas[nodeIDs[i]] = info
+			}
+		}
+		for _, d := range byKey {
+			if !agree(d, len(nodeIDs)) {
+				divergent = append(divergent, *d)
+			}
+		}
+	}
+	return divergent, nil
+}
+
+// agree reports whether all n nodes hold identical replicas
+func agree(d *Divergence, n int) bool {
+	if len(d.Replicas) != n {
+		return false
+	}
+	var first *datanode.ReplicaInfo
+	for _, info := range d.Replicas {
+		info := info
+		if first == nil {
+			first = &info
+			continue
+		}
+		if info.Size != first.Size || !info.Checksum.Equal(first.Checksum) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// Defaults for lease and claim lifetimes
+const (
+	DefaultLeaseTTL = time.Minute
+	DefaultClaimTTL = 30 * time.Minute
+)
+
+// memberPrefix names the leases repair processes renew to announce
+// themselves to each other
+const memberPrefix = "member/"
+
+// Coordinator shares repair work between repair processes using one
+// metadata database. Work that only one process should do at a time, such
+// as scrubbing a given data node, is guarded by a named lease in the
+// leases table. A holder keeps its lease by renewing it; a process that
+// dies stops renewing, and once the lease expires another process takes
+// the work over.
+//
+// Sharded work is spread evenly: every process announces itself with a
+// member lease, and takes no more than its share of the shards.
+//
+// A nil *Coordinator acquires every lease, for a single repair process.
+type Coordinator struct {
+	metadata metadata.Service
+	holder   string
+}
+
+// NewCoordinator creates a coordinator acquiring leases as holder, which
+// must be unique among the repair processes
+func NewCoordinator(meta metadata.Service, holder string) *Coordinator {
+	return &Coordinator{metadata: meta, holder: holder}
+}
+
+// DefaultHolder names this process by host and pid
+func DefaultHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "repair"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Holder returns the name this process holds leases and claims under
+func (c *Coordinator) Holder() string {
+	if c == nil {
+		return ""
+	}
+	return c.holder
+}
+
+// Acquire takes or renews the named lease for ttl and reports whether this
+// process holds it
+func (c *Coordinator) Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	return c.metadata.AcquireLease(ctx, name, c.holder, ttl)
+}
+
+// Release gives up the named lease so another process can take it at once
+func (c *Coordinator) Release(name string) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.metadata.ReleaseLease(ctx, name, c.holder); err != nil {
+		log.Printf("release lease %s: %v", name, err)
+	}
+}
+
+// Heartbeat announces this process to the others until ctx is done, then
+// withdraws it
+func (c *Coordinator) Heartbeat(ctx context.Context, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	name := memberPrefix + c.holder
+	defer c.Release(name)
+	for ctx.Err() == nil {
+		if _, err := c.Acquire(ctx, name, ttl); err != nil && ctx.Err() == nil {
+			log.Printf("heartbeat: %v", err)
+		}
+		sleep(ctx, ttl/3)
+	}
+}
+
+// Share returns how many of n shards this process should hold: an equal
+// share among the live processes, rounded up
+func (c *Coordinator) Share(ctx context.Context, n int) (int, error) {
+	if c == nil {
+		return n, nil
+	}
+	leases, err := c.metadata.ListLeases(ctx)
+	if err != nil {
+		return 0, err
+	}
+	members, self := 0, false
+	for _, l := range leases {
+		if strings.HasPrefix(l.Name, memberPrefix) {
+			members++
+			self = self || l.Holder == c.holder
+		}
+	}
+	if !self {
+		members++
+	}
+	return (n + members - 1) / members, nil
+}
+
+// lease is a named lease held while a long piece of work runs. hold renews
+// it once a third of its lifetime has passed, so it can be called often.
+type lease struct {
+	coord   *Coordinator
+	name    string
+	ttl     time.Duration
+	renewed time.Time
+}
+
+func (l *lease) hold(ctx context.Context) (bool, error) {
+	if !l.renewed.IsZero() && time.Since(l.renewed) < l.ttl/3 {
+		return true, nil
+	}
+	held, err := l.coord.Acquire(ctx, l.name, l.ttl)
+	if err != nil || !held {
+		l.renewed = time.Time{}
+		return false, err
+	}
+	l.renewed = time.Now()
+	return true, nil
+}
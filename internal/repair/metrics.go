@@ -0,0 +1,78 @@
+package repair
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scrubBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_scrub_bytes_total",
+		Help: "Replica bytes verified by the scrubber.",
+	}, []string{"node"})
+
+	scrubReplicas = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_scrub_replicas_total",
+		Help: "Replicas verified by the scrubber.",
+	}, []string{"node"})
+
+	scrubCorrupt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_scrub_corrupt_replicas_total",
+		Help: "Corrupt replicas found and quarantined by the scrubber.",
+	}, []string{"node"})
+
+	scrubProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plinth_scrub_pass_progress_ratio",
+		Help: "Fraction of the ring covered by the current scrub pass.",
+	}, []string{"node"})
+
+	repairOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_repair_operations_total",
+		Help: "Repair actions by issue type and outcome.",
+	}, []string{"issue", "status"})
+
+	orphansFound = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_gc_orphans_found_total",
+		Help: "Orphan replicas found by the orphan collector, by reason.",
+	}, []string{"node", "reason"})
+
+	orphanBytesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_gc_orphan_bytes_deleted_total",
+		Help: "Bytes of orphan replicas deleted.",
+	}, []string{"node"})
+
+	tombstonesPurged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "plinth_gc_tombstones_purged_total",
+		Help: "Tombstoned versions whose replicas were deleted and records purged.",
+	})
+
+	tombstoneBytesReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "plinth_gc_tombstone_bytes_reclaimed_total",
+		Help: "Logical bytes of purged tombstoned versions.",
+	})
+
+	tombstoneDeleteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_gc_replica_delete_failures_total",
+		Help: "Replicas of tombstoned versions that could not be deleted after retries.",
+	}, []string{"node"})
+
+	pendingDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "plinth_gc_pending_objects_total",
+		Help: "Stale pending objects reaped, by decision.",
+	}, []string{"decision"})
+
+	uploadsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "plinth_gc_multipart_uploads_expired_total",
+		Help: "Multipart uploads aborted by AbortIncompleteMultipartUpload lifecycle rules.",
+	})
+
+	uploadBytesReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "plinth_gc_multipart_bytes_reclaimed_total",
+		Help: "Bytes of parts of expired multipart uploads.",
+	})
+
+	repairQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plinth_repair_queue_depth",
+		Help: "Pending repairs by the number of replicas the object has left.",
+	}, []string{"remaining_replicas"})
+)
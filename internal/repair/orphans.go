@@ -0,0 +1,252 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/merkle"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+// orphanWindowBits sets the width of the ring window listed at once while
+// reconciling a node: 2^56 tokens, 1/256 of the ring
+const orphanWindowBits = 56
+
+// orphanSampleSize caps the orphans an OrphanReport lists; the rest are
+// only counted
+const orphanSampleSize = 100
+
+// Defaults for OrphanConfig
+const (
+	DefaultOrphanGracePeriod = 24 * time.Hour
+	DefaultOrphanMaxDeletes  = 1000
+)
+
+// Reasons a replica is an orphan
+const (
+	OrphanUnowned   = "unowned"    // no object or multipart part has the key
+	OrphanNotPlaced = "not_placed" // the owner's placement does not include the node
+)
+
+// OrphanConfig holds the orphan collector's dependencies and limits
+type OrphanConfig struct {
+	Metadata  metadata.Service
+	Placement placement.Controller
+	Nodes     *datanode.Pool
+
+	// GracePeriod protects replicas written recently, which may belong to
+	// a write whose metadata is not recorded yet
+	GracePeriod time.Duration
+
+	// MaxDeletes caps the replicas deleted per run; orphans beyond it are
+	// reported and left for the next run
+	MaxDeletes int
+
+	// DryRun reports orphans without deleting anything
+	DryRun bool
+
+	Preemption *Preemption // at-risk repairs pause the collector; may be nil
+}
+
+// Orphan is a replica on a data node that no metadata accounts for
+type Orphan struct {
+	Node    string
+	Key     string
+	Size    int64
+	ModTime time.Time
+	Reason  string
+	Deleted bool
+}
+
+// OrphanReport summarises one run of the orphan collector
+type OrphanReport struct {
+	DryRun   bool
+	Scanned  int      // replicas old enough to be considered
+	Found    int      // orphans found, deleted or not
+	Orphans  []Orphan // the first orphans found, at most orphanSampleSize
+	Deleted  int
+	Bytes    int64 // bytes deleted
+	Capped   bool  // MaxDeletes was reached
+	Failed   int   // deletes that failed or were refused
+	Unlisted []string
+}
+
+// OrphanCollector finds replicas on data nodes that belong to no object or
+// multipart part, or to one whose placement no longer includes the node,
+// and deletes them. Such replicas are left behind by failed quorum writes,
+// aborted multipart parts, gateways that crashed between writing replicas
+// and committing, and replicas moved elsewhere by repair.
+//
+// Deletes are conditional on the replica not having been rewritten since
+// it was listed, so a replica that becomes live again while the collector
+// runs, for instance because repair copied a fresh replica to the node, is
+// kept.
+type OrphanCollector struct {
+	metadata   metadata.Service
+	placement  placement.Controller
+	nodes      *datanode.Pool
+	grace      time.Duration
+	maxDeletes int
+	dryRun     bool
+	preempt    *Preemption
+}
+
+// NewOrphanCollector creates an orphan collector
+func NewOrphanCollector(cfg OrphanConfig) *OrphanCollector {
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultOrphanGracePeriod
+	}
+	if cfg.MaxDeletes < 1 {
+		cfg.MaxDeletes = DefaultOrphanMaxDeletes
+	}
+	return &OrphanCollector{
+		metadata:   cfg.Metadata,
+		placement:  cfg.Placement,
+		nodes:      cfg.Nodes,
+		grace:      cfg.GracePeriod,
+		maxDeletes: cfg.MaxDeletes,
+		dryRun:     cfg.DryRun,
+		preempt:    cfg.Preemption,
+	}
+}
+
+// Run reconciles every node's inventory against the metadata. A node that
+// cannot be listed is skipped and named in the report's Unlisted.
+func (c *OrphanCollector) Run(ctx context.Context) (*OrphanReport, error) {
+	nodes, err := c.placement.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &OrphanReport{DryRun: c.dryRun}
+	cutoff := time.Now().Add(-c.grace)
+	for _, node := range nodes {
+		if node.Status == placement.StatusOffline {
+			report.Unlisted = append(report.Unlisted, node.ID)
+			continue
+		}
+		if err := c.reconcileNode(ctx, node.ID, cutoff, report); err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			log.Printf("orphan gc %s: %v", node.ID, err)
+			report.Unlisted = append(report.Unlisted, node.ID)
+		}
+	}
+	return report, nil
+}
+
+// reconcileNode walks one node's inventory a ring window at a time
+func (c *OrphanCollector) reconcileNode(ctx context.Context, nodeID string, cutoff time.Time, report *OrphanReport) error {
+	client, err := c.nodes.Get(nodeID)
+	if err != nil {
+		return err
+	}
+	for first := uint64(0); ; first += 1 << orphanWindowBits {
+		if err := c.preempt.Wait(ctx); err != nil {
+			return err
+		}
+		window := merkle.Range{First: first, Last: first | (1<<orphanWindowBits - 1)}
+		replicas, err := client.List(ctx, window)
+		if err != nil {
+			return err
+		}
+
+		var old []datanode.ReplicaInfo
+		keys := make([]string, 0, len(replicas))
+		for _, info := range replicas {
+			if info.ModTime.Before(cutoff) {
+				old = append(old, info)
+				keys = append(keys, info.Key)
+			}
+		}
+		report.Scanned += len(old)
+		if len(old) > 0 {
+			placements, err := c.metadata.ReplicaPlacements(ctx, keys)
+			if err != nil {
+				return err
+			}
+			for _, info := range old {
+				nodeIDs, owned := placements[info.Key]
+				switch {
+				case !owned:
+					c.collect(ctx, client, nodeID, info, OrphanUnowned, report)
+				case !contains(nodeIDs, nodeID):
+					c.collect(ctx, client, nodeID, info, OrphanNotPlaced, report)
+				}
+			}
+		}
+
+		if window.Last == math.MaxUint64 {
+			return nil
+		}
+	}
+}
+
+// collect records an orphan and deletes it unless this is a dry run or the
+// cap has been reached
+func (c *OrphanCollector) collect(ctx context.Context, client datanode.Client, nodeID string, info datanode.ReplicaInfo, reason string, report *OrphanReport) {
+	orphan := Orphan{Node: nodeID, Key: info.Key, Size: info.Size, ModTime: info.ModTime, Reason: reason}
+	orphansFound.WithLabelValues(nodeID, reason).Inc()
+	report.Found++
+	defer func() {
+		if len(report.Orphans) < orphanSampleSize {
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}()
+
+	if c.dryRun {
+		return
+	}
+	if report.Deleted >= c.maxDeletes {
+		report.Capped = true
+		return
+	}
+	err := client.DeleteIfUnmodified(ctx, info.Key, info.ModTime)
+	if err != nil {
+		report.Failed++
+		if !errors.Is(err, datanode.ErrModified) {
+			log.Printf("orphan gc %s: delete %s: %v", nodeID, info.Key, err)
+		}
+		return
+	}
+	orphan.Deleted = true
+	report.Deleted++
+	report.Bytes += info.Size
+	orphanBytesDeleted.WithLabelValues(nodeID).Add(float64(info.Size))
+}
+
+// Log writes the report: one line per orphan listed, then a summary
+func (r *OrphanReport) Log() {
+	action := "deleted"
+	if r.DryRun {
+		action = "would delete"
+	}
+	for _, o := range r.Orphans {
+		state := action
+		if !r.DryRun && !o.Deleted {
+			state = "kept"
+		}
+		log.Printf("orphan gc: %s %s on %s: %s, %d bytes, written %s",
+			state, o.Key, o.Node, o.Reason, o.Size, o.ModTime.Format(time.RFC3339))
+	}
+	summary := fmt.Sprintf("orphan gc: %d replicas checked, %d orphans", r.Scanned, r.Found)
+	if more := r.Found - len(r.Orphans); more > 0 {
+		summary += fmt.Sprintf(" (%d not listed)", more)
+	}
+	if !r.DryRun {
+		summary += fmt.Sprintf(", %d deleted (%d bytes), %d failed", r.Deleted, r.Bytes, r.Failed)
+	}
+	if r.Capped {
+		summary += ", deletion cap reached"
+	}
+	if len(r.Unlisted) > 0 {
+		summary += fmt.Sprintf(", nodes not checked: %v", r.Unlisted)
+	}
+	log.Println(summary)
+}
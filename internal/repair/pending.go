@@ -0,0 +1,295 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// Defaults for PendingConfig
+const (
+	DefaultPendingTimeout   = time.Hour
+	DefaultPendingBatchSize = 100
+)
+
+// Decisions the pending reaper makes about a stale pending object
+const (
+	PendingCommitted  = "committed"  // a write quorum of matching replicas landed
+	PendingDeleted    = "deleted"    // too few replicas landed
+	PendingSuperseded = "superseded" // the key was written or deleted since
+	PendingMultipart  = "multipart"  // an interrupted CompleteMultipartUpload
+	PendingEncrypted  = "encrypted"  // an encrypted write, whose ETag cannot be computed
+	PendingUndecided  = "undecided"  // a placement node did not answer
+)
+
+// PendingConfig holds the pending reaper's dependencies and limits
+type PendingConfig struct {
+	Metadata    metadata.Service
+	Nodes       *datanode.Pool
+	WriteQuorum int
+
+	// Timeout is how old a pending object must be before it is reaped. It
+	// must exceed the longest PUT, or the reaper races the gateway still
+	// writing it.
+	Timeout time.Duration
+
+	BatchSize int // pending objects examined per run
+}
+
+// PendingReport summarises one run of the pending reaper
+type PendingReport struct {
+	Examined  int
+	Decisions map[string]int // objects per decision
+	Deleted   int            // replica deletes, including of replicas already gone
+}
+
+// PendingReaper finishes two-phase writes that were interrupted: the
+// gateway created the pending record but never committed or aborted it,
+// because it crashed or lost its connection to the metadata store. Data
+// nodes store a replica only once it has been received in full, so each
+// replica found is complete. If a write quorum of them agree the object is
+// committed with their size and checksum and an ETag computed from the
+// data; otherwise every replica is deleted and the record removed.
+//
+// The client never got a response, so the reaper cannot check the digests
+// it sent, and it never resurrects a write that a later PUT or DELETE of
+// the same key has overtaken. Assembled multipart objects are deleted: the
+// upload is still active and CompleteMultipartUpload can be retried.
+// Encrypted objects are deleted too: their ETag is the MD5 of the
+// plaintext, which the reaper cannot read.
+type PendingReaper struct {
+	metadata    metadata.Service
+	nodes       *datanode.Pool
+	writeQuorum int
+	timeout     time.Duration
+	batchSize   int
+}
+
+// NewPendingReaper creates a pending reaper
+func NewPendingReaper(cfg PendingConfig) *PendingReaper {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultPendingTimeout
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = DefaultPendingBatchSize
+	}
+	return &PendingReaper{
+		metadata:    cfg.Metadata,
+		nodes:       cfg.Nodes,
+		writeQuorum: cfg.WriteQuorum,
+		timeout:     cfg.Timeout,
+		batchSize:   cfg.BatchSize,
+	}
+}
+
+// Run decides the fate of a batch of stale pending objects, oldest first.
+// Objects left undecided are examined again on the next run.
+func (r *PendingReaper) Run(ctx context.Context) (*PendingReport, error) {
+	report := &PendingReport{Decisions: make(map[string]int)}
+	objects, err := r.metadata.ListPendingObjects(ctx, time.Now().Add(-r.timeout), r.batchSize)
+	if err != nil {
+		return report, err
+	}
+	for _, obj := range objects {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Examined++
+		decision, err := r.reap(ctx, obj, report)
+		if err != nil {
+			log.Printf("pending reaper: %s/%s (%s): %s: %v", obj.BucketName, obj.ObjectKey, obj.ID, decision, err)
+			continue
+		}
+		report.Decisions[decision]++
+		pendingDecisions.WithLabelValues(decision).Inc()
+	}
+	return report, nil
+}
+
+// reap commits or deletes one pending object and returns the decision. An
+// error means the decision could not be carried out; the object stays
+// pending and is retried.
+func (r *PendingReaper) reap(ctx context.Context, obj *metadata.Object, report *PendingReport) (string, error) {
+	name := fmt.Sprintf("%s/%s (%s)", obj.BucketName, obj.ObjectKey, obj.ID)
+	if obj.PartsCount > 0 {
+		log.Printf("pending reaper: %s: interrupted multipart completion, deleting", name)
+		return PendingMultipart, r.discard(ctx, obj, report)
+	}
+	if obj.Encryption != nil {
+		log.Printf("pending reaper: %s: interrupted encrypted write, deleting", name)
+		return PendingEncrypted, r.discard(ctx, obj, report)
+	}
+
+	replicas, unreachable := r.stat(ctx, obj)
+	holders := agreeing(obj.Placement, replicas)
+	if len(holders) < r.writeQuorum {
+		if len(unreachable) > 0 {
+			// An unreachable node may hold the replica that makes a quorum
+			return PendingUndecided, fmt.Errorf("%d of %d replicas agree, nodes %v unreachable",
+				len(holders), len(obj.Placement), unreachable)
+		}
+		log.Printf("pending reaper: %s: %d of %d replicas landed, below write quorum %d, deleting",
+			name, len(holders), len(obj.Placement), r.writeQuorum)
+		return PendingDeleted, r.discard(ctx, obj, report)
+	}
+
+	info := replicas[holders[0]]
+	etag, err := r.etag(ctx, obj.ID, info, holders)
+	if err != nil {
+		return PendingUndecided, err
+	}
+	commit := *obj
+	commit.SizeBytes = info.Size
+	commit.Checksum = info.Checksum
+	commit.ETag = etag
+	commit.Placement = holders
+	err = r.metadata.CommitPendingObject(ctx, &commit)
+	switch {
+	case errors.Is(err, metadata.ErrObjectSuperseded):
+		log.Printf("pending reaper: %s: key written since, deleting", name)
+		return PendingSuperseded, r.discard(ctx, obj, report)
+	case errors.Is(err, metadata.ErrObjectNotFound):
+		return PendingUndecided, errors.New("no longer pending")
+	case err != nil:
+		return PendingUndecided, err
+	}
+	log.Printf("pending reaper: %s: %d of %d replicas landed, committed %d bytes on %v",
+		name, len(holders), len(obj.Placement), info.Size, holders)
+
+	// Replicas that disagree with the committed ones are left over from
+	// the failed write; orphan collection catches any missed here
+	for nodeID := range replicas {
+		if !contains(holders, nodeID) && deleteReplica(ctx, r.nodes, nodeID, obj.ID) == nil {
+			report.Deleted++
+		}
+	}
+	return PendingCommitted, nil
+}
+
+// stat asks every placement node for its replica of obj. Nodes that hold
+// none are left out; nodes that cannot be asked are returned separately.
+func (r *PendingReaper) stat(ctx context.Context, obj *metadata.Object) (map[string]*datanode.ReplicaInfo, []string) {
+	replicas := make(map[string]*datanode.ReplicaInfo)
+	var unreachable []string
+	for _, nodeID := range obj.Placement {
+		client, err := r.nodes.Get(nodeID)
+		if err != nil {
+			unreachable = append(unreachable, nodeID)
+			continue
+		}
+		info, err := client.Stat(ctx, obj.ID)
+		switch {
+		case errors.Is(err, datanode.ErrNotFound):
+		case err != nil:
+			unreachable = append(unreachable, nodeID)
+		default:
+			replicas[nodeID] = info
+		}
+	}
+	return replicas, unreachable
+}
+
+// agreeing returns the nodes holding the most common replica, by size and
+// checksum, in placement order
+func agreeing(placement []string, replicas map[string]*datanode.ReplicaInfo) []string {
+	groups := make(map[string][]string)
+	var best []string
+	for _, nodeID := range placement {
+		info, ok := replicas[nodeID]
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%d/%s", info.Size, info.Checksum)
+		groups[key] = append(groups[key], nodeID)
+		if len(groups[key]) > len(best) {
+			best = groups[key]
+		}
+	}
+	return best
+}
+
+// etag reads the replica from the first holder that can serve it and
+// returns the hex MD5 of its data, as PutObject would have. The data's
+// internal checksum must match the replica's.
+func (r *PendingReaper) etag(ctx context.Context, key string, info *datanode.ReplicaInfo, holders []string) (string, error) {
+	var lastErr error
+	for _, nodeID := range holders {
+		client, err := r.nodes.Get(nodeID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		hasher, err := checksum.NewMultiHasher(checksum.MD5, info.Checksum.Algorithm)
+		if err != nil {
+			return "", err
+		}
+		rc, err := client.Get(ctx, key, 0, -1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, err = io.Copy(hasher, rc)
+		rc.Close()
+		if err == nil {
+			err = hasher.Verify(info.Checksum)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("read replica from %s: %w", nodeID, err)
+			continue
+		}
+		sum, _ := hasher.Sum(checksum.MD5)
+		return sum.Hex(), nil
+	}
+	return "", lastErr
+}
+
+// discard deletes every replica of obj and then its record. If a replica
+// cannot be deleted the record is kept so the next run tries again.
+func (r *PendingReaper) discard(ctx context.Context, obj *metadata.Object, report *PendingReport) error {
+	for _, nodeID := range obj.Placement {
+		if err := deleteReplica(ctx, r.nodes, nodeID, obj.ID); err != nil {
+			return fmt.Errorf("delete replica from %s: %w", nodeID, err)
+		}
+		report.Deleted++
+	}
+	err := r.metadata.AbortObject(ctx, obj.ID)
+	if err != nil && !errors.Is(err, metadata.ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
+
+// deleteReplica deletes one replica; a missing replica counts as deleted
+func deleteReplica(ctx context.Context, nodes *datanode.Pool, nodeID, key string) error {
+	client, err := nodes.Get(nodeID)
+	if err != nil {
+		return err
+	}
+	if err := client.Delete(ctx, key); err != nil && !errors.Is(err, datanode.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Log writes the report's summary
+func (r *PendingReport) Log() {
+	log.Printf("pending reaper: %d stale pending objects, %d committed, %d deleted, %d superseded, %d multipart, %d undecided, %d replica deletes",
+		r.Examined, r.Decisions[PendingCommitted], r.Decisions[PendingDeleted], r.Decisions[PendingSuperseded],
+		r.Decisions[PendingMultipart], r.Examined-r.decided(), r.Deleted)
+}
+
+// decided counts the objects whose decision was carried out
+func (r *PendingReport) decided() int {
+	n := 0
+	for _, count := range r.Decisions {
+		n += count
+	}
+	return n
+}
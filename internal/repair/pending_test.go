@@ -0,0 +1,48 @@
+package repair
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+)
+
+func TestAgreeing(t *testing.T) {
+	replica := func(size int64, sum byte) *datanode.ReplicaInfo {
+		return &datanode.ReplicaInfo{Size: size, Checksum: checksum.Value{Algorithm: checksum.XXHash, Sum: []byte{sum}}}
+	}
+	placement := []string{"n1", "n2", "n3", "n4"}
+
+	tests := []struct {
+		name     string
+		replicas map[string]*datanode.ReplicaInfo
+		want     []string
+	}{
+		{"none landed", nil, nil},
+		{"one landed", map[string]*datanode.ReplicaInfo{"n3": replica(10, 1)}, []string{"n3"}},
+		{"all agree", map[string]*datanode.ReplicaInfo{
+			"n1": replica(10, 1), "n2": replica(10, 1), "n3": replica(10, 1), "n4": replica(10, 1),
+		}, placement},
+		{"majority by checksum", map[string]*datanode.ReplicaInfo{
+			"n1": replica(10, 2), "n2": replica(10, 1), "n4": replica(10, 1),
+		}, []string{"n2", "n4"}},
+		{"majority by size", map[string]*datanode.ReplicaInfo{
+			"n1": replica(10, 1), "n3": replica(5, 1), "n4": replica(5, 1),
+		}, []string{"n3", "n4"}},
+		// A tie goes to the group that first reached the winning count
+		{"tie", map[string]*datanode.ReplicaInfo{
+			"n1": replica(10, 1), "n2": replica(10, 2), "n3": replica(10, 2), "n4": replica(10, 1),
+		}, []string{"n2", "n3"}},
+		{"nodes outside the placement", map[string]*datanode.ReplicaInfo{
+			"n1": replica(10, 1), "n9": replica(10, 2), "n8": replica(10, 2),
+		}, []string{"n1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := agreeing(placement, tt.replicas); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("agreeing = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
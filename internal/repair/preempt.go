@@ -0,0 +1,64 @@
+package repair
+
+import (
+	"context"
+	"sync"
+)
+
+// Preemption lets repairs of at-risk objects hold off lower-priority
+// background traffic, such as scrubbing, within one repair process. Work
+// that can wait calls Wait before each unit of I/O.
+type Preemption struct {
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // closed while no at-risk repair is running
+}
+
+// NewPreemption creates a Preemption with no at-risk repair running
+func NewPreemption() *Preemption {
+	idle := make(chan struct{})
+	close(idle)
+	return &Preemption{idle: idle}
+}
+
+// begin marks an at-risk repair as running
+func (p *Preemption) begin() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.active++
+}
+
+// end marks an at-risk repair as finished
+func (p *Preemption) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.active == 0 {
+		close(p.idle)
+	}
+}
+
+// Wait blocks while an at-risk repair is running or until ctx is done
+func (p *Preemption) Wait(ctx context.Context) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	idle := p.idle
+	p.mu.Unlock()
+	select {
+	case <-idle:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
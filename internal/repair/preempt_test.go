@@ -0,0 +1,63 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// preempted reports whether Wait blocks on p
+func preempted(p *Preemption) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	return errors.Is(p.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestPreemption(t *testing.T) {
+	p := NewPreemption()
+	if preempted(p) {
+		t.Fatal("preempted with no at-risk repair running")
+	}
+
+	// Background work waits until the last of overlapping repairs ends
+	p.begin()
+	p.begin()
+	if !preempted(p) {
+		t.Fatal("not preempted by two repairs")
+	}
+	p.end()
+	if !preempted(p) {
+		t.Fatal("not preempted by the repair still running")
+	}
+
+	released := make(chan error)
+	go func() { released <- p.Wait(context.Background()) }()
+	p.end()
+	select {
+	case err := <-released:
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not released when the repairs ended")
+	}
+
+	// and again after the next one begins
+	p.begin()
+	if !preempted(p) {
+		t.Fatal("not preempted by a later repair")
+	}
+	p.end()
+	if preempted(p) {
+		t.Fatal("preempted after every repair ended")
+	}
+
+	// A nil Preemption never waits
+	var none *Preemption
+	none.begin()
+	if preempted(none) {
+		t.Error("nil Preemption waited")
+	}
+	none.end()
+}
@@ -0,0 +1,326 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/merkle"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+// scrubWindowBits sets the width of the ring window scrubbed between cursor
+// saves: 2^52 tokens, 1/4096 of the ring. A restart redoes at most one
+// window per node.
+const scrubWindowBits = 52
+
+// Defaults for ScrubConfig
+const (
+	DefaultScrubBytesPerSecond = 10 << 20
+	DefaultScrubRetryDelay     = time.Minute
+)
+
+// scrubLeasePrefix names the lease giving one process the scrubbing of a
+// data node
+const scrubLeasePrefix = "scrub/"
+
+// errLeaseLost stops a window whose node lease another process has taken
+var errLeaseLost = errors.New("scrub lease lost")
+
+// ScrubConfig holds the scrubber's dependencies and budget
+type ScrubConfig struct {
+	Metadata       metadata.Service
+	Placement      placement.Controller
+	Nodes          *datanode.Pool
+	BytesPerSecond int64         // read budget per data node; 0 means unthrottled
+	Interval       time.Duration // pause between passes over a node
+	Preemption     *Preemption   // at-risk repairs pause scrubbing; may be nil
+
+	// Coordinator shards the nodes among repair processes, one lease per
+	// node; nil scrubs every node
+	Coordinator *Coordinator
+	LeaseTTL    time.Duration
+}
+
+// Scrubber walks every replica on every node in ring token order, has the
+// node verify it against its stored checksums, and quarantines the ones
+// that fail. The position on each node is saved after every window, so a
+// restarted worker, or the worker that takes over the node's lease,
+// resumes the pass instead of starting over.
+type Scrubber struct {
+	metadata       metadata.Service
+	placement      placement.Controller
+	nodes          *datanode.Pool
+	bytesPerSecond int64
+	interval       time.Duration
+	preempt        *Preemption
+	coord          *Coordinator
+	leaseTTL       time.Duration
+
+	mu    sync.Mutex
+	owned int // node leases held
+}
+
+// NewScrubber creates a scrubber
+func NewScrubber(cfg ScrubConfig) *Scrubber {
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = DefaultLeaseTTL
+	}
+	return &Scrubber{
+		metadata:       cfg.Metadata,
+		placement:      cfg.Placement,
+		nodes:          cfg.Nodes,
+		bytesPerSecond: cfg.BytesPerSecond,
+		interval:       cfg.Interval,
+		preempt:        cfg.Preemption,
+		coord:          cfg.Coordinator,
+		leaseTTL:       cfg.LeaseTTL,
+	}
+}
+
+// Run scrubs every node whose lease this process holds, concurrently,
+// until ctx is cancelled
+func (s *Scrubber) Run(ctx context.Context) error {
+	nodes, err := s.placement.ListNodes(ctx)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+			s.scrubNode(ctx, nodeID, len(nodes))
+		}(node.ID)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// scrubNode runs passes over one node while holding its lease, pausing
+// s.interval between them
+func (s *Scrubber) scrubNode(ctx context.Context, nodeID string, nodes int) {
+	limit := newThrottle(s.bytesPerSecond)
+	l := &lease{coord: s.coord, name: scrubLeasePrefix + nodeID, ttl: s.leaseTTL}
+	defer s.release(l)
+	for ctx.Err() == nil {
+		held, err := s.claim(ctx, l, nodes)
+		if err != nil {
+			log.Printf("scrub %s: lease: %v", nodeID, err)
+			sleep(ctx, DefaultScrubRetryDelay)
+			continue
+		}
+		if !held {
+			sleep(ctx, s.leaseTTL/2)
+			continue
+		}
+
+		// Hand the node to a process with fewer nodes once others join
+		if share, err := s.coord.Share(ctx, nodes); err == nil && s.holding() > share {
+			log.Printf("scrub %s: handing off to another worker", nodeID)
+			s.release(l)
+			sleep(ctx, s.leaseTTL)
+			continue
+		}
+
+		prog, err := s.metadata.GetScrubProgress(ctx, nodeID)
+		if err != nil {
+			log.Printf("scrub %s: load progress: %v", nodeID, err)
+			sleep(ctx, DefaultScrubRetryDelay)
+			continue
+		}
+
+		if prog.PassStartedAt.IsZero() {
+			if wait := time.Until(prog.LastPassCompletedAt.Add(s.interval)); wait > 0 {
+				// Wake in time to renew the lease
+				sleep(ctx, min(wait, s.leaseTTL/3))
+				continue
+			}
+			*prog = metadata.ScrubProgress{
+				NodeID:              nodeID,
+				PassStartedAt:       time.Now().UTC(),
+				LastPassCompletedAt: prog.LastPassCompletedAt,
+			}
+			log.Printf("scrub %s: starting pass", nodeID)
+		}
+
+		err = s.scrubWindow(ctx, nodeID, prog, limit, l, nodes)
+		if errors.Is(err, errLeaseLost) {
+			log.Printf("scrub %s: lease taken over by another worker", nodeID)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("scrub %s: %v", nodeID, err)
+				sleep(ctx, DefaultScrubRetryDelay)
+			}
+			continue
+		}
+		if err := s.metadata.SaveScrubProgress(ctx, prog); err != nil && ctx.Err() == nil {
+			log.Printf("scrub %s: save progress: %v", nodeID, err)
+		}
+	}
+}
+
+// claim keeps the node's lease, or takes it if this process holds fewer
+// than its share of the nodes
+func (s *Scrubber) claim(ctx context.Context, l *lease, nodes int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wasHeld := !l.renewed.IsZero()
+	if !wasHeld {
+		share, err := s.coord.Share(ctx, nodes)
+		if err != nil {
+			return false, err
+		}
+		if s.owned >= share {
+			return false, nil
+		}
+	}
+	held, err := l.hold(ctx)
+	switch {
+	case held && !wasHeld:
+		s.owned++
+	case !held && wasHeld:
+		s.owned--
+	}
+	return held, err
+}
+
+// release gives up the node's lease if this process holds it
+func (s *Scrubber) release(l *lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.renewed.IsZero() {
+		return
+	}
+	s.coord.Release(l.name)
+	l.renewed = time.Time{}
+	s.owned--
+}
+
+// holding returns the number of node leases this process holds
+func (s *Scrubber) holding() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owned
+}
+
+// scrubWindow verifies the replicas in the window starting at the cursor
+// and advances the cursor past it, ending the pass after the last window.
+// It stops with errLeaseLost if the node's lease cannot be renewed.
+func (s *Scrubber) scrubWindow(ctx context.Context, nodeID string, prog *metadata.ScrubProgress, limit *throttle, l *lease, nodes int) error {
+	client, err := s.nodes.Get(nodeID)
+	if err != nil {
+		return err
+	}
+	window := merkle.Range{First: prog.Cursor, Last: prog.Cursor | (1<<scrubWindowBits - 1)}
+
+	replicas, err := client.List(ctx, window)
+	if err != nil {
+		return err
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].Token != replicas[j].Token {
+			return replicas[i].Token < replicas[j].Token
+		}
+		return replicas[i].Key < replicas[j].Key
+	})
+
+	for _, info := range replicas {
+		if err := s.preempt.Wait(ctx); err != nil {
+			return err
+		}
+		held, err := s.claim(ctx, l, nodes)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return errLeaseLost
+		}
+		if err := limit.wait(ctx, info.Size); err != nil {
+			return err
+		}
+		bad, err := client.Verify(ctx, info.Key)
+		if errors.Is(err, datanode.ErrNotFound) {
+			continue // deleted since the window was listed
+		}
+		if err != nil {
+			return err
+		}
+		scrubBytes.WithLabelValues(nodeID).Add(float64(info.Size))
+		scrubReplicas.WithLabelValues(nodeID).Inc()
+		prog.BytesScrubbed += info.Size
+		prog.ReplicasScrubbed++
+		if len(bad) > 0 {
+			prog.CorruptFound++
+			scrubCorrupt.WithLabelValues(nodeID).Inc()
+			s.quarantine(ctx, nodeID, client, info, bad)
+		}
+	}
+
+	if window.Last == math.MaxUint64 {
+		log.Printf("scrub %s: pass complete: %d replicas, %d bytes, %d corrupt",
+			nodeID, prog.ReplicasScrubbed, prog.BytesScrubbed, prog.CorruptFound)
+		prog.Cursor = 0
+		prog.PassStartedAt = time.Time{}
+		prog.LastPassCompletedAt = time.Now().UTC()
+		scrubProgress.WithLabelValues(nodeID).Set(1)
+		return nil
+	}
+	prog.Cursor = window.Last + 1
+	scrubProgress.WithLabelValues(nodeID).Set(float64(prog.Cursor) / math.MaxUint64)
+	return nil
+}
+
+// quarantine sets a corrupt replica aside on its node and queues a repair
+// that rewrites it from one of the object's other replicas. Replicas of
+// parts or of objects that no longer exist are only quarantined.
+func (s *Scrubber) quarantine(ctx context.Context, nodeID string, client datanode.Client, info datanode.ReplicaInfo, bad []datanode.BlockRange) {
+	log.Printf("scrub %s: replica %s corrupt in %d ranges, quarantining", nodeID, info.Key, len(bad))
+	if err := client.Quarantine(ctx, info.Key); err != nil {
+		log.Printf("scrub %s: quarantine %s: %v", nodeID, info.Key, err)
+		return
+	}
+
+	obj, err := s.metadata.GetObjectByID(ctx, info.Key)
+	if errors.Is(err, metadata.ErrObjectNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("scrub %s: look up %s: %v", nodeID, info.Key, err)
+		return
+	}
+	if !contains(obj.Placement, nodeID) {
+		return
+	}
+	rec := &metadata.RepairRecord{
+		ObjectID:          obj.ID,
+		IssueType:         metadata.IssueCorruptReplica,
+		TargetNodes:       []string{nodeID},
+		RemainingReplicas: len(obj.Placement) - 1,
+	}
+	if err := s.metadata.EnqueueRepair(ctx, rec); err != nil {
+		if !errors.Is(err, metadata.ErrObjectNotFound) {
+			log.Printf("scrub %s: queue repair of %s: %v", nodeID, info.Key, err)
+		}
+		return
+	}
+	repairOperations.WithLabelValues(rec.IssueType, string(rec.Status)).Inc()
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
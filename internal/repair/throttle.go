@@ -0,0 +1,44 @@
+package repair
+
+import (
+	"context"
+	"time"
+)
+
+// throttle paces reads to a bytes-per-second budget. Each read is allowed
+// once the time owed for the previous ones has passed, so the average rate
+// stays at the budget without bursts.
+type throttle struct {
+	bytesPerSecond int64
+	next           time.Time
+}
+
+// newThrottle creates a throttle; a budget of zero or less never waits
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until n more bytes may be read or ctx is done
+func (t *throttle) wait(ctx context.Context, n int64) error {
+	if t.bytesPerSecond <= 0 {
+		return ctx.Err()
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(float64(n) / float64(t.bytesPerSecond) * float64(time.Second)))
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
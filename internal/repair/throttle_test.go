@@ -0,0 +1,62 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+
+	// 500 bytes at 10 kB/s owe 50ms each; the first read does not wait
+	th := newThrottle(10_000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := th.wait(ctx, 500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("5 reads of 50ms took %v, want 200ms", elapsed)
+	}
+
+	// Idle time is not saved up for a burst
+	time.Sleep(200 * time.Millisecond)
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		if err := th.wait(ctx, 500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 reads of 50ms after idling took %v, want 100ms", elapsed)
+	}
+
+	// A wait ends with its context
+	slow := newThrottle(1)
+	if err := slow.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := slow.wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait: %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancelled wait took %v", elapsed)
+	}
+
+	// No budget never waits, but still reports a finished context
+	unlimited := newThrottle(0)
+	for i := 0; i < 1000; i++ {
+		if err := unlimited.wait(context.Background(), 1<<30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unlimited.wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait with no budget: %v, want the context's error", err)
+	}
+}
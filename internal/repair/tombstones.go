@@ -0,0 +1,233 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+// Defaults for TombstoneConfig
+const (
+	DefaultTombstoneGracePeriod = 15 * time.Minute
+	DefaultTombstoneBatchSize   = 500
+	DefaultDeleteAttempts       = 3
+	DefaultDeleteRetryDelay     = time.Second
+)
+
+// TombstoneConfig holds the tombstone collector's dependencies and limits
+type TombstoneConfig struct {
+	Metadata  metadata.Service
+	Placement placement.Controller
+	Nodes     *datanode.Pool
+
+	// GracePeriod keeps the replicas of a version for this long after it
+	// was deleted or replaced, so reads that looked it up just before can
+	// finish
+	GracePeriod time.Duration
+
+	// NoncurrentRetention is how long noncurrent versions in versioned
+	// buckets are kept before they are tombstoned; 0 keeps them forever
+	NoncurrentRetention time.Duration
+
+	BatchSize      int           // tombstones listed at a time
+	DeleteAttempts int           // tries per replica within a run
+	RetryDelay     time.Duration // first pause between tries, doubled after each
+}
+
+// TombstoneReport summarises one run of the tombstone collector
+type TombstoneReport struct {
+	Expired  int64 // noncurrent versions tombstoned
+	Examined int   // tombstones past the grace period
+	Purged   int   // records removed after every replica was deleted
+	Bytes    int64 // logical bytes of the purged versions
+	Replicas int   // replicas deleted
+	Kept     int   // tombstones with a replica that could not be deleted
+}
+
+// TombstoneCollector reclaims deleted and replaced versions. A version is
+// first tombstoned in the metadata, by DeleteObject, by an overwrite in a
+// bucket without versioning, or by the collector once a noncurrent version
+// outlives its retention. The collector then deletes its replica from every
+// node in its placement and only removes the record once all of them are
+// confirmed gone, taking the version off its bucket's cost counters in the
+// same transaction.
+//
+// Each step is idempotent: deleting a replica that is already gone
+// succeeds, and a tombstone whose replicas could not all be deleted is kept
+// and retried on the next run. A run interrupted at any point is completed
+// by the next one.
+type TombstoneCollector struct {
+	metadata   metadata.Service
+	placement  placement.Controller
+	nodes      *datanode.Pool
+	grace      time.Duration
+	retention  time.Duration
+	batchSize  int
+	attempts   int
+	retryDelay time.Duration
+}
+
+// NewTombstoneCollector creates a tombstone collector
+func NewTombstoneCollector(cfg TombstoneConfig) *TombstoneCollector {
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultTombstoneGracePeriod
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = DefaultTombstoneBatchSize
+	}
+	if cfg.DeleteAttempts < 1 {
+		cfg.DeleteAttempts = DefaultDeleteAttempts
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultDeleteRetryDelay
+	}
+	return &TombstoneCollector{
+		metadata:   cfg.Metadata,
+		placement:  cfg.Placement,
+		nodes:      cfg.Nodes,
+		grace:      cfg.GracePeriod,
+		retention:  cfg.NoncurrentRetention,
+		batchSize:  cfg.BatchSize,
+		attempts:   cfg.DeleteAttempts,
+		retryDelay: cfg.RetryDelay,
+	}
+}
+
+// Run expires noncurrent versions past retention, then collects every
+// tombstone past the grace period, a batch at a time
+func (c *TombstoneCollector) Run(ctx context.Context) (*TombstoneReport, error) {
+	report := &TombstoneReport{}
+	now := time.Now()
+
+	if c.retention > 0 {
+		for {
+			n, err := c.metadata.ExpireNoncurrentVersions(ctx, now.Add(-c.retention), c.batchSize)
+			if err != nil {
+				return report, err
+			}
+			report.Expired += n
+			if n < int64(c.batchSize) {
+				break
+			}
+		}
+	}
+
+	offline, err := c.offlineNodes(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	// Tombstones that cannot be collected stay listed, so page through
+	// them in order rather than starting over with every batch
+	cutoff := now.Add(-c.grace)
+	var (
+		afterTime time.Time
+		afterID   string
+	)
+	for {
+		tombstones, err := c.metadata.ListTombstones(ctx, cutoff, afterTime, afterID, c.batchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, obj := range tombstones {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			report.Examined++
+			c.collect(ctx, obj, offline, report)
+			afterTime, afterID = obj.NoncurrentAt, obj.ID
+		}
+		if len(tombstones) < c.batchSize {
+			return report, nil
+		}
+	}
+}
+
+// offlineNodes returns the nodes the placement controller reports offline
+func (c *TombstoneCollector) offlineNodes(ctx context.Context) (map[string]bool, error) {
+	nodes, err := c.placement.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offline := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Status == placement.StatusOffline {
+			offline[node.ID] = true
+		}
+	}
+	return offline, nil
+}
+
+// collect deletes every replica of a tombstoned version and then purges its
+// record
+func (c *TombstoneCollector) collect(ctx context.Context, obj *metadata.Object, offline map[string]bool, report *TombstoneReport) {
+	gone := true
+	for _, nodeID := range obj.Placement {
+		if offline[nodeID] {
+			gone = false
+			continue
+		}
+		if err := c.deleteReplica(ctx, nodeID, obj.ID); err != nil {
+			log.Printf("tombstone gc: delete %s from %s: %v", obj.ID, nodeID, err)
+			tombstoneDeleteFailures.WithLabelValues(nodeID).Inc()
+			gone = false
+			continue
+		}
+		report.Replicas++
+	}
+	if !gone {
+		report.Kept++
+		return
+	}
+
+	err := c.metadata.PurgeObject(ctx, obj.ID)
+	if errors.Is(err, metadata.ErrObjectNotFound) {
+		return // purged by another worker
+	}
+	if err != nil {
+		log.Printf("tombstone gc: purge %s: %v", obj.ID, err)
+		report.Kept++
+		return
+	}
+	report.Purged++
+	report.Bytes += obj.SizeBytes
+	tombstonesPurged.Inc()
+	tombstoneBytesReclaimed.Add(float64(obj.SizeBytes))
+}
+
+// deleteReplica deletes one replica, retrying with backoff. A replica that
+// is already gone counts as deleted.
+func (c *TombstoneCollector) deleteReplica(ctx context.Context, nodeID, key string) error {
+	client, err := c.nodes.Get(nodeID)
+	if err != nil {
+		return err
+	}
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = client.Delete(ctx, key)
+		if err == nil || errors.Is(err, datanode.ErrNotFound) {
+			return nil
+		}
+		if attempt == c.attempts || ctx.Err() != nil {
+			return err
+		}
+		sleep(ctx, delay)
+		delay *= 2
+	}
+}
+
+// Log writes the report's summary
+func (r *TombstoneReport) Log() {
+	summary := fmt.Sprintf("tombstone gc: %d noncurrent versions expired, %d tombstones examined, %d purged (%d bytes, %d replicas deleted)",
+		r.Expired, r.Examined, r.Purged, r.Bytes, r.Replicas)
+	if r.Kept > 0 {
+		summary += fmt.Sprintf(", %d kept for retry", r.Kept)
+	}
+	log.Println(summary)
+}
@@ -0,0 +1,149 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// DefaultUploadBatchSize is the number of stale uploads listed at a time
+const DefaultUploadBatchSize = 100
+
+// UploadConfig holds the upload sweeper's dependencies
+type UploadConfig struct {
+	Metadata  metadata.Service
+	Nodes     *datanode.Pool
+	BatchSize int
+}
+
+// UploadReport summarises one run of the upload sweeper
+type UploadReport struct {
+	Aborted  int   // uploads expired
+	Parts    int   // parts of the expired uploads
+	Bytes    int64 // bytes of those parts
+	Failed   int   // part replicas that could not be deleted
+	Buckets  int   // buckets with an AbortIncompleteMultipartUpload rule
+	Problems int   // rules that could not be applied
+}
+
+// UploadSweeper enforces the AbortIncompleteMultipartUpload lifecycle rule:
+// multipart uploads still active the given number of days after they were
+// initiated are aborted, and their part replicas deleted. The upload is
+// aborted in the metadata first, which stops new parts being accepted; a
+// part replica that cannot be deleted then belongs to nothing and is left
+// to orphan collection.
+type UploadSweeper struct {
+	metadata  metadata.Service
+	nodes     *datanode.Pool
+	batchSize int
+}
+
+// NewUploadSweeper creates an upload sweeper
+func NewUploadSweeper(cfg UploadConfig) *UploadSweeper {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = DefaultUploadBatchSize
+	}
+	return &UploadSweeper{
+		metadata:  cfg.Metadata,
+		nodes:     cfg.Nodes,
+		batchSize: cfg.BatchSize,
+	}
+}
+
+// Run applies every enabled rule of every bucket
+func (s *UploadSweeper) Run(ctx context.Context) (*UploadReport, error) {
+	report := &UploadReport{}
+	buckets, err := s.metadata.ListBuckets(ctx)
+	if err != nil {
+		return report, err
+	}
+	now := time.Now()
+	for _, bucket := range buckets {
+		swept := false
+		for _, rule := range bucket.Lifecycle {
+			if !rule.Enabled || rule.AbortIncompleteMultipartUploadDays < 1 {
+				continue
+			}
+			swept = true
+			cutoff := now.AddDate(0, 0, -rule.AbortIncompleteMultipartUploadDays)
+			if err := s.sweep(ctx, bucket.Name, rule, cutoff, report); err != nil {
+				if ctx.Err() != nil {
+					return report, ctx.Err()
+				}
+				log.Printf("upload sweeper %s: rule %q: %v", bucket.Name, rule.ID, err)
+				report.Problems++
+			}
+		}
+		if swept {
+			report.Buckets++
+		}
+	}
+	return report, nil
+}
+
+// sweep expires the uploads one rule matches, a batch at a time
+func (s *UploadSweeper) sweep(ctx context.Context, bucket string, rule metadata.LifecycleRule, cutoff time.Time, report *UploadReport) error {
+	for {
+		uploads, err := s.metadata.ListStaleMultipartUploads(ctx, bucket, rule.Prefix, cutoff, s.batchSize)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			if err := s.expire(ctx, upload, rule, report); err != nil {
+				return err
+			}
+		}
+		if len(uploads) < s.batchSize {
+			return nil
+		}
+	}
+}
+
+// expire aborts one upload and deletes its part replicas
+func (s *UploadSweeper) expire(ctx context.Context, upload *metadata.MultipartUpload, rule metadata.LifecycleRule, report *UploadReport) error {
+	parts, err := s.metadata.ExpireMultipartUpload(ctx, upload.UploadID)
+	if errors.Is(err, metadata.ErrUploadNotFound) {
+		return nil // completed or aborted since it was listed
+	}
+	if err != nil {
+		return fmt.Errorf("expire upload %s: %w", upload.UploadID, err)
+	}
+
+	var size int64
+	for _, part := range parts {
+		size += part.SizeBytes
+		for _, nodeID := range part.Placement {
+			if err := deleteReplica(ctx, s.nodes, nodeID, part.ID); err != nil {
+				log.Printf("upload sweeper: delete part %s from %s: %v", part.ID, nodeID, err)
+				report.Failed++
+			}
+		}
+	}
+	log.Printf("upload sweeper: aborted upload %s of %s/%s initiated %s (rule %q): %d parts, %d bytes",
+		upload.UploadID, upload.BucketName, upload.ObjectKey, upload.InitiatedAt.Format(time.RFC3339),
+		rule.ID, len(parts), size)
+	report.Aborted++
+	report.Parts += len(parts)
+	report.Bytes += size
+	uploadsExpired.Inc()
+	uploadBytesReclaimed.Add(float64(size))
+	return nil
+}
+
+// Log writes the report's summary
+func (r *UploadReport) Log() {
+	summary := fmt.Sprintf("upload sweeper: %d buckets with rules, %d uploads aborted, %d parts, %d bytes reclaimed",
+		r.Buckets, r.Aborted, r.Parts, r.Bytes)
+	if r.Failed > 0 {
+		summary += fmt.Sprintf(", %d part replicas left for orphan GC", r.Failed)
+	}
+	if r.Problems > 0 {
+		summary += fmt.Sprintf(", %d rules failed", r.Problems)
+	}
+	log.Println(summary)
+}
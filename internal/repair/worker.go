@@ -0,0 +1,615 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+	"github.com/mrmushfiq/plinth/internal/placement"
+)
+
+var (
+	// ErrNoHealthyReplica is returned when no node holds a replica matching
+	// the object's checksum, so there is nothing to copy from
+	ErrNoHealthyReplica = errors.New("no healthy replica")
+
+	// errReplicaMismatch marks a copy whose stored checksum is wrong
+	errReplicaMismatch = errors.New("copied replica does not match object checksum")
+)
+
+// Defaults for Config
+const (
+	DefaultBatchSize    = 1000
+	DefaultConcurrency  = 4
+	DefaultProbeTimeout = 5 * time.Second
+)
+
+// Config holds the worker's dependencies
+type Config struct {
+	Metadata          metadata.Service
+	Placement         placement.Controller
+	Nodes             *datanode.Pool
+	ReplicationFactor int
+	BatchSize         int // objects queued and repairs run per repair cycle
+	Concurrency       int // repairs run at once
+	Preemption        *Preemption
+
+	// Coordinator shares the work with other repair processes; nil for a
+	// single process. The process holding the scan lease queues
+	// under-replicated objects and keeps the lease for ScanLeaseTTL after
+	// each cycle, so ScanLeaseTTL should exceed the cycle interval. Every
+	// process runs the queue; a process renews its claim on a repair while
+	// the repair runs, and another process takes the repair over once the
+	// claim has gone ClaimTTL without renewal.
+	Coordinator  *Coordinator
+	ScanLeaseTTL time.Duration
+	ClaimTTL     time.Duration
+}
+
+// scanLease elects the process that looks for under-replicated objects
+const scanLease = "repair/scan"
+
+// Worker rebuilds missing replicas from healthy ones. Every issue found,
+// whether by the worker itself, anti-entropy or the scrubber, goes through
+// the persistent repair queue, so the objects closest to data loss are
+// repaired first.
+type Worker struct {
+	metadata          metadata.Service
+	placement         placement.Controller
+	nodes             *datanode.Pool
+	replicationFactor int
+	batchSize         int
+	concurrency       int
+	preempt           *Preemption
+	coord             *Coordinator
+	scanLeaseTTL      time.Duration
+	claimTTL          time.Duration
+}
+
+// NewWorker creates a repair worker
+func NewWorker(cfg Config) *Worker {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+	if cfg.ScanLeaseTTL <= 0 {
+		cfg.ScanLeaseTTL = DefaultLeaseTTL
+	}
+	if cfg.ClaimTTL <= 0 {
+		cfg.ClaimTTL = DefaultClaimTTL
+	}
+	return &Worker{
+		metadata:          cfg.Metadata,
+		placement:         cfg.Placement,
+		nodes:             cfg.Nodes,
+		replicationFactor: cfg.ReplicationFactor,
+		batchSize:         cfg.BatchSize,
+		concurrency:       cfg.Concurrency,
+		preempt:           cfg.Preemption,
+		coord:             cfg.Coordinator,
+		scanLeaseTTL:      cfg.ScanLeaseTTL,
+		claimTTL:          cfg.ClaimTTL,
+	}
+}
+
+// CycleStats summarises one repair cycle
+type CycleStats struct {
+	Offline  []string // nodes that did not answer the health probe
+	Scanned  bool     // this process held the scan lease and queued objects
+	Found    int      // repairs taken from the queue
+	Repaired int
+	Failed   int
+}
+
+// CheckNodes probes every node, records the result in the placement
+// controller and returns the nodes that are offline
+func (w *Worker) CheckNodes(ctx context.Context) ([]string, error) {
+	nodes, err := w.placement.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var offline []string
+	for _, node := range nodes {
+		status := placement.StatusHealthy
+		if err := w.probe(ctx, node.ID); err != nil {
+			status = placement.StatusOffline
+			offline = append(offline, node.ID)
+			if node.Status != status {
+				log.Printf("node %s is offline: %v", node.ID, err)
+			}
+		} else if node.Status != status {
+			log.Printf("node %s is back online", node.ID)
+		}
+		if node.Status != status {
+			if err := w.placement.UpdateNodeHealth(ctx, node.ID, status, node.Capacity, node.Used); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return offline, nil
+}
+
+// probe checks that a node answers as itself
+func (w *Worker) probe(ctx context.Context, nodeID string) error {
+	client, err := w.nodes.Get(nodeID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultProbeTimeout)
+	defer cancel()
+	_, err = client.Health(ctx, nodeID)
+	return err
+}
+
+// RunCycle probes the nodes, queues a batch of the objects with fewer than
+// RF live replicas if this process holds the scan lease, then runs the
+// repair queue. Replicas on offline nodes do not count.
+func (w *Worker) RunCycle(ctx context.Context) (*CycleStats, error) {
+	offline, err := w.CheckNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check nodes: %w", err)
+	}
+	stats := &CycleStats{Offline: offline}
+	isOffline := make(map[string]bool, len(offline))
+	for _, nodeID := range offline {
+		isOffline[nodeID] = true
+	}
+
+	stats.Scanned, err = w.coord.Acquire(ctx, scanLease, w.scanLeaseTTL)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Scanned {
+		if err := w.queueUnderReplicated(ctx, offline, isOffline); err != nil {
+			return stats, err
+		}
+	}
+
+	err = w.runQueue(ctx, isOffline, stats)
+	w.reportQueueDepth(ctx)
+	return stats, err
+}
+
+// queueUnderReplicated queues a batch of the objects with the fewest live
+// replicas
+func (w *Worker) queueUnderReplicated(ctx context.Context, offline []string, isOffline map[string]bool) error {
+	objects, err := w.metadata.FindUnderReplicatedObjects(ctx, w.replicationFactor, offline, w.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		rec := &metadata.RepairRecord{
+			ObjectID:          obj.ID,
+			IssueType:         metadata.IssueUnderReplicated,
+			RemainingReplicas: len(online(obj.Placement, isOffline)),
+		}
+		if err := w.metadata.EnqueueRepair(ctx, rec); err != nil && !errors.Is(err, metadata.ErrObjectNotFound) {
+			return fmt.Errorf("queue repair of %s: %w", obj.ID, err)
+		}
+	}
+	return nil
+}
+
+// runQueue claims repairs a round at a time, most urgent first, until the
+// queue is empty or a batch has been run. Claiming in small rounds lets an
+// at-risk repair queued meanwhile, for instance by the scrubber, go ahead of
+// the rest of the backlog, and spreads the queue over every repair process.
+func (w *Worker) runQueue(ctx context.Context, isOffline map[string]bool, stats *CycleStats) error {
+	var mu sync.Mutex
+	for stats.Found < w.batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		recs, err := w.metadata.ClaimRepairs(ctx, w.coord.Holder(), w.claimTTL, w.concurrency)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+		stats.Found += len(recs)
+
+		var wg sync.WaitGroup
+		for _, rec := range recs {
+			wg.Add(1)
+			go func(rec *metadata.RepairRecord) {
+				defer wg.Done()
+				err := w.runRepair(ctx, rec, isOffline)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					stats.Failed++
+					log.Printf("repair %s of %s (%d replicas left) failed: %v",
+						rec.IssueType, rec.ObjectID, rec.RemainingReplicas, err)
+					return
+				}
+				stats.Repaired++
+			}(rec)
+		}
+		wg.Wait()
+	}
+	return nil
+}
+
+// runRepair carries out one claimed repair, keeping the claim while it runs.
+// Repairs of at-risk objects hold off preemptible background work while they
+// run.
+func (w *Worker) runRepair(ctx context.Context, rec *metadata.RepairRecord, isOffline map[string]bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.keepClaim(ctx, rec, cancel)
+
+	if rec.RemainingReplicas <= metadata.AtRiskReplicas {
+		w.preempt.begin()
+		defer w.preempt.end()
+	}
+
+	obj, err := w.metadata.GetObjectByID(ctx, rec.ObjectID)
+	if err != nil {
+		return w.finish(ctx, rec, err)
+	}
+	if obj.State != metadata.ObjectStateCommitted || obj.IsDeleteMarker {
+		// Deleted or overwritten since it was queued; nothing to repair
+		return w.finish(ctx, rec, nil)
+	}
+	if rec.IssueType == metadata.IssueUnderReplicated {
+		return w.repairObject(ctx, rec, obj, isOffline)
+	}
+
+	// The other issues name the placement nodes whose replicas to rewrite
+	var sources []string
+	for _, nodeID := range online(obj.Placement, isOffline) {
+		if !contains(rec.TargetNodes, nodeID) {
+			sources = append(sources, nodeID)
+		}
+	}
+	return w.rewrite(ctx, rec, obj, w.verifiedHolders(ctx, obj, sources))
+}
+
+// keepClaim renews the claim on rec every third of the claim lifetime until
+// ctx is done, so a repair that outlasts ClaimTTL is not taken over while it
+// runs. If the claim has been lost to another process, stop is called to
+// abandon the repair.
+func (w *Worker) keepClaim(ctx context.Context, rec *metadata.RepairRecord, stop context.CancelFunc) {
+	ticker := time.NewTicker(w.claimTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.metadata.RenewRepairClaim(ctx, rec.ID, w.coord.Holder(), w.claimTTL)
+		if errors.Is(err, metadata.ErrObjectNotFound) {
+			log.Printf("repair %s of %s: claim lost, abandoning", rec.IssueType, rec.ObjectID)
+			stop()
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("repair %s of %s: renew claim: %v", rec.IssueType, rec.ObjectID, err)
+		}
+	}
+}
+
+// reportQueueDepth publishes the number of pending repairs per remaining
+// replica count
+func (w *Worker) reportQueueDepth(ctx context.Context) {
+	depths, err := w.metadata.RepairQueueDepth(ctx)
+	if err != nil {
+		log.Printf("repair queue depth: %v", err)
+		return
+	}
+	repairQueueDepth.Reset()
+	for _, d := range depths {
+		repairQueueDepth.WithLabelValues(strconv.Itoa(d.RemainingReplicas)).Set(float64(d.Pending))
+	}
+}
+
+// repairObject brings obj back to the replication factor: it keeps the
+// live placement nodes that still hold a matching replica, copies from one
+// of them to new nodes chosen by the placement controller, and records the
+// new placement
+func (w *Worker) repairObject(ctx context.Context, rec *metadata.RepairRecord, obj *metadata.Object, isOffline map[string]bool) error {
+	holders := w.verifiedHolders(ctx, obj, online(obj.Placement, isOffline))
+	if len(holders) == 0 {
+		return w.finish(ctx, rec, ErrNoHealthyReplica)
+	}
+
+	var targets []string
+	if needed := w.replicationFactor - len(holders); needed > 0 {
+		var err error
+		targets, err = w.chooseTargets(ctx, obj, holders, needed)
+		if err != nil {
+			return w.finish(ctx, rec, err)
+		}
+	}
+
+	rec.Status = metadata.RepairStatusInProgress
+	rec.SourceNode = holders[0]
+	rec.TargetNodes = targets
+	if err := w.metadata.UpdateRepair(ctx, rec); err != nil {
+		return err
+	}
+
+	placed := append([]string(nil), holders...)
+	var copyErr error
+	for _, target := range targets {
+		source, err := w.copyReplica(ctx, obj, holders, target)
+		if err != nil {
+			copyErr = fmt.Errorf("copy to %s: %w", target, err)
+			continue
+		}
+		rec.SourceNode = source
+		placed = append(placed, target)
+	}
+
+	// Record what was rebuilt even if some copies failed; the next cycle
+	// picks up the rest.
+	if !sameSet(placed, obj.Placement) {
+		if err := w.metadata.UpdateObjectPlacement(ctx, obj.ID, obj.Placement, placed); err != nil {
+			w.deleteReplicas(obj.ID, placed[len(holders):])
+			return w.finish(ctx, rec, fmt.Errorf("update placement: %w", err))
+		}
+	}
+	if copyErr == nil && len(placed) < w.replicationFactor {
+		copyErr = fmt.Errorf("only %d of %d replicas placed", len(placed), w.replicationFactor)
+	}
+	return w.finish(ctx, rec, copyErr)
+}
+
+// finish records the outcome of a repair and returns err
+func (w *Worker) finish(ctx context.Context, rec *metadata.RepairRecord, err error) error {
+	if err != nil {
+		rec.Status = metadata.RepairStatusFailed
+		rec.Error = err.Error()
+	} else {
+		rec.Status = metadata.RepairStatusCompleted
+		rec.RepairedAt = time.Now().UTC()
+	}
+	if updateErr := w.metadata.UpdateRepair(ctx, rec); updateErr != nil && !errors.Is(updateErr, metadata.ErrObjectNotFound) {
+		log.Printf("record repair %s: %v", rec.ID, updateErr)
+	}
+	repairOperations.WithLabelValues(rec.IssueType, string(rec.Status)).Inc()
+	return err
+}
+
+// verifiedHolders returns the nodes whose replica of obj matches its size
+// and checksum
+func (w *Worker) verifiedHolders(ctx context.Context, obj *metadata.Object, nodeIDs []string) []string {
+	var holders []string
+	for _, nodeID := range nodeIDs {
+		client, err := w.nodes.Get(nodeID)
+		if err != nil {
+			continue
+		}
+		info, err := client.Stat(ctx, obj.ID)
+		if err != nil {
+			if !errors.Is(err, datanode.ErrNotFound) {
+				log.Printf("stat %s on %s: %v", obj.ID, nodeID, err)
+			}
+			continue
+		}
+		if matches(obj, info) {
+			holders = append(holders, nodeID)
+		}
+	}
+	return holders
+}
+
+// matches reports whether a replica holds the object's data
+func matches(obj *metadata.Object, info *datanode.ReplicaInfo) bool {
+	if info.Size != obj.StoredSize() {
+		return false
+	}
+	return obj.Checksum.IsZero() || info.Checksum.Equal(obj.Checksum)
+}
+
+// chooseTargets picks needed nodes to receive new replicas, preferring the
+// object's own nodes on the ring and falling back to any other online node
+func (w *Worker) chooseTargets(ctx context.Context, obj *metadata.Object, holders []string, needed int) ([]string, error) {
+	used := make(map[string]bool, len(holders))
+	for _, nodeID := range holders {
+		used[nodeID] = true
+	}
+
+	preferred, err := w.placement.GetNodes(ctx, placement.RingKey(obj.BucketName, obj.ObjectKey), w.replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+	all, err := w.placement.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	for _, node := range append(preferred, all...) {
+		if len(targets) == needed {
+			break
+		}
+		if used[node.ID] || node.Status == placement.StatusOffline {
+			continue
+		}
+		used[node.ID] = true
+		targets = append(targets, node.ID)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no online node available for a new replica")
+	}
+	return targets, nil
+}
+
+// copyReplica streams obj from the first source that can serve it to
+// target and checks what target stored against the object's checksum. It
+// returns the source used.
+func (w *Worker) copyReplica(ctx context.Context, obj *metadata.Object, sources []string, target string) (string, error) {
+	dst, err := w.nodes.Get(target)
+	if err != nil {
+		return "", err
+	}
+	token := placement.KeyHash(placement.RingKey(obj.BucketName, obj.ObjectKey))
+
+	err = ErrNoHealthyReplica
+	for _, source := range sources {
+		src, srcErr := w.nodes.Get(source)
+		if srcErr != nil {
+			err = srcErr
+			continue
+		}
+		// The source verifies every block as it reads; a corrupt block
+		// ends the stream with an error and the target discards the copy.
+		r, srcErr := src.Get(ctx, obj.ID, 0, -1)
+		if srcErr != nil {
+			err = fmt.Errorf("read from %s: %w", source, srcErr)
+			continue
+		}
+		info, putErr := dst.Put(ctx, obj.ID, token, r)
+		r.Close()
+		if putErr != nil {
+			err = fmt.Errorf("copy from %s: %w", source, putErr)
+			continue
+		}
+		if !matches(obj, info) {
+			dst.Delete(ctx, obj.ID)
+			err = fmt.Errorf("copy from %s: %w", source, errReplicaMismatch)
+			continue
+		}
+		return source, nil
+	}
+	return "", err
+}
+
+// RepairDivergent queues repairs of replicas that anti-entropy found
+// missing or different on one of their object's placement nodes, then runs
+// the queue. Replicas that belong to no committed object are left for
+// garbage collection.
+func (w *Worker) RepairDivergent(ctx context.Context, divergent []Divergence) (*CycleStats, error) {
+	stats := &CycleStats{}
+	for _, d := range divergent {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		obj, err := w.metadata.GetObjectByID(ctx, d.Key)
+		if errors.Is(err, metadata.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("look up %s: %w", d.Key, err)
+		}
+		if obj.State != metadata.ObjectStateCommitted || obj.IsDeleteMarker {
+			continue
+		}
+
+		// Only nodes responsible for the range were listed, so a placement
+		// node outside it proves nothing either way.
+		var good int
+		issues := make(map[string][]string)
+		for _, nodeID := range obj.Placement {
+			info, ok := d.Replicas[nodeID]
+			switch {
+			case ok && matches(obj, &info):
+				good++
+			case ok:
+				issues[metadata.IssueChecksumMismatch] = append(issues[metadata.IssueChecksumMismatch], nodeID)
+			case contains(d.Nodes, nodeID):
+				issues[metadata.IssueMissingReplica] = append(issues[metadata.IssueMissingReplica], nodeID)
+			}
+		}
+		for issue, targets := range issues {
+			rec := &metadata.RepairRecord{
+				ObjectID:          obj.ID,
+				IssueType:         issue,
+				TargetNodes:       targets,
+				RemainingReplicas: good,
+			}
+			if err := w.metadata.EnqueueRepair(ctx, rec); err != nil && !errors.Is(err, metadata.ErrObjectNotFound) {
+				return stats, fmt.Errorf("queue repair of %s: %w", obj.ID, err)
+			}
+		}
+	}
+
+	err := w.runQueue(ctx, nil, stats)
+	w.reportQueueDepth(ctx)
+	return stats, err
+}
+
+// rewrite copies obj from one of the good holders to every target of rec,
+// replacing whatever the targets hold. Placement is unchanged: the targets
+// are already placement nodes.
+func (w *Worker) rewrite(ctx context.Context, rec *metadata.RepairRecord, obj *metadata.Object, good []string) error {
+	if len(good) == 0 {
+		return w.finish(ctx, rec, ErrNoHealthyReplica)
+	}
+	rec.Status = metadata.RepairStatusInProgress
+	rec.SourceNode = good[0]
+	if err := w.metadata.UpdateRepair(ctx, rec); err != nil {
+		return err
+	}
+	var copyErr error
+	for _, target := range rec.TargetNodes {
+		source, err := w.copyReplica(ctx, obj, good, target)
+		if err != nil {
+			copyErr = fmt.Errorf("copy to %s: %w", target, err)
+			continue
+		}
+		rec.SourceNode = source
+	}
+	return w.finish(ctx, rec, copyErr)
+}
+
+// deleteReplicas removes replicas copied for a repair that could not be
+// recorded
+func (w *Worker) deleteReplicas(key string, nodeIDs []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, nodeID := range nodeIDs {
+		client, err := w.nodes.Get(nodeID)
+		if err != nil {
+			continue
+		}
+		if err := client.Delete(ctx, key); err != nil {
+			log.Printf("delete replica %s on %s: %v", key, nodeID, err)
+		}
+	}
+}
+
+// online returns the nodes that are not offline
+func online(nodeIDs []string, isOffline map[string]bool) []string {
+	var live []string
+	for _, nodeID := range nodeIDs {
+		if !isOffline[nodeID] {
+			live = append(live, nodeID)
+		}
+	}
+	return live
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSet reports whether a and b hold the same strings in any order
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, s := range a {
+		if !contains(b, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrmushfiq/plinth/internal/checksum"
+	"github.com/mrmushfiq/plinth/internal/datanode"
+	"github.com/mrmushfiq/plinth/internal/metadata"
+)
+
+// claimStore records claim renewals, failing them once lost is set
+type claimStore struct {
+	metadata.Service
+
+	mu       sync.Mutex
+	renewals int
+	lost     bool
+}
+
+func (s *claimStore) RenewRepairClaim(ctx context.Context, id, holder string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return metadata.ErrObjectNotFound
+	}
+	s.renewals++
+	return nil
+}
+
+func TestKeepClaim(t *testing.T) {
+	store := &claimStore{}
+	w := &Worker{metadata: store, claimTTL: 30 * time.Millisecond}
+	rec := &metadata.RepairRecord{ID: "r1", ObjectID: "o1"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.keepClaim(ctx, rec, cancel)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	store.mu.Lock()
+	if store.renewals < 2 {
+		t.Errorf("claim renewed %d times in 100ms with a 30ms lifetime", store.renewals)
+	}
+	store.lost = true
+	store.mu.Unlock()
+
+	// Losing the claim abandons the repair
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keepClaim still running after the claim was lost")
+	}
+	if ctx.Err() == nil {
+		t.Error("repair not stopped after the claim was lost")
+	}
+}
+
+// queueStore holds objects and records the repairs queued for them. Its
+// queue is never claimed from.
+type queueStore struct {
+	metadata.Service
+
+	mu              sync.Mutex
+	objects         map[string]*metadata.Object
+	queued          []*metadata.RepairRecord
+	preempt         *Preemption
+	preempted       bool // an at-risk repair was running at the last lookup
+	underReplicated []*metadata.Object
+	replication     int
+}
+
+func (s *queueStore) GetObjectByID(ctx context.Context, id string) (*metadata.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preempt != nil {
+		s.preempt.mu.Lock()
+		s.preempted = s.preempt.active > 0
+		s.preempt.mu.Unlock()
+	}
+	obj, ok := s.objects[id]
+	if !ok {
+		return nil, metadata.ErrObjectNotFound
+	}
+	return obj, nil
+}
+
+func (s *queueStore) FindUnderReplicatedObjects(ctx context.Context, rf int, offline []string, limit int) ([]*metadata.Object, error) {
+	s.replication = rf
+	return s.underReplicated, nil
+}
+
+func (s *queueStore) EnqueueRepair(ctx context.Context, rec *metadata.RepairRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = append(s.queued, rec)
+	return nil
+}
+
+func (s *queueStore) ClaimRepairs(ctx context.Context, holder string, ttl time.Duration, limit int) ([]*metadata.RepairRecord, error) {
+	return nil, nil
+}
+
+func (s *queueStore) UpdateRepair(ctx context.Context, rec *metadata.RepairRecord) error {
+	return nil
+}
+
+func (s *queueStore) RepairQueueDepth(ctx context.Context) ([]metadata.RepairQueueDepth, error) {
+	return nil, nil
+}
+
+// queuedRepairs returns the repairs queued in store by object, issue and
+// target nodes
+func queuedRepairs(store *queueStore) map[string]*metadata.RepairRecord {
+	recs := make(map[string]*metadata.RepairRecord)
+	for _, rec := range store.queued {
+		recs[rec.ObjectID+" "+rec.IssueType+" "+strings.Join(rec.TargetNodes, ",")] = rec
+	}
+	return recs
+}
+
+// TestQueuePriority checks the remaining replicas repairs are queued with,
+// which order the queue
+func TestQueuePriority(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("under-replicated", func(t *testing.T) {
+		store := &queueStore{underReplicated: []*metadata.Object{
+			{ID: "o1", Placement: []string{"n1", "n2", "n3"}},
+			{ID: "o2", Placement: []string{"n2", "n3"}},
+			{ID: "o3", Placement: []string{"n1"}},
+		}}
+		w := NewWorker(Config{Metadata: store, ReplicationFactor: 3})
+		isOffline := map[string]bool{"n2": true, "n3": true}
+		if err := w.queueUnderReplicated(ctx, []string{"n2", "n3"}, isOffline); err != nil {
+			t.Fatal(err)
+		}
+		if store.replication != 3 {
+			t.Errorf("looked for objects under %d replicas, want 3", store.replication)
+		}
+		// Replicas on offline nodes do not count
+		want := map[string]int{"o1": 1, "o2": 0, "o3": 1}
+		if len(store.queued) != len(want) {
+			t.Fatalf("queued %d repairs, want %d", len(store.queued), len(want))
+		}
+		for _, rec := range store.queued {
+			if rec.IssueType != metadata.IssueUnderReplicated || rec.RemainingReplicas != want[rec.ObjectID] {
+				t.Errorf("%s queued as %s with %d replicas left, want %d",
+					rec.ObjectID, rec.IssueType, rec.RemainingReplicas, want[rec.ObjectID])
+			}
+		}
+	})
+
+	t.Run("divergent", func(t *testing.T) {
+		good := checksum.Value{Algorithm: checksum.XXHash, Sum: []byte{1}}
+		bad := checksum.Value{Algorithm: checksum.XXHash, Sum: []byte{2}}
+		store := &queueStore{objects: map[string]*metadata.Object{
+			"o1": {ID: "o1", SizeBytes: 10, Checksum: good, State: metadata.ObjectStateCommitted, Placement: []string{"n1", "n2", "n3", "n4"}},
+			"o2": {ID: "o2", SizeBytes: 10, Checksum: good, State: metadata.ObjectStateCommitted, Placement: []string{"n1", "n2"}},
+			"o3": {ID: "o3", IsDeleteMarker: true, State: metadata.ObjectStateCommitted, Placement: []string{"n1"}},
+		}}
+		w := NewWorker(Config{Metadata: store, ReplicationFactor: 3})
+		_, err := w.RepairDivergent(ctx, []Divergence{
+			// n4 is not responsible for the range listed: it may well hold
+			// its replica
+			{Key: "o1", Nodes: []string{"n1", "n2", "n3"}, Replicas: map[string]datanode.ReplicaInfo{
+				"n1": {Size: 10, Checksum: good},
+				"n2": {Size: 10, Checksum: bad},
+			}},
+			{Key: "o2", Nodes: []string{"n1", "n2"}, Replicas: map[string]datanode.ReplicaInfo{
+				"n1": {Size: 9, Checksum: good},
+			}},
+			{Key: "o3", Nodes: []string{"n1"}},
+			{Key: "gone", Nodes: []string{"n1"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{
+			"o1 " + metadata.IssueChecksumMismatch + " n2": 1,
+			"o1 " + metadata.IssueMissingReplica + " n3":   1,
+			"o2 " + metadata.IssueChecksumMismatch + " n1": 0,
+			"o2 " + metadata.IssueMissingReplica + " n2":   0,
+		}
+		got := queuedRepairs(store)
+		if len(got) != len(want) {
+			t.Errorf("queued %d repairs, want %d", len(got), len(want))
+		}
+		for key, remaining := range want {
+			if rec, ok := got[key]; !ok {
+				t.Errorf("%s not queued", key)
+			} else if rec.RemainingReplicas != remaining {
+				t.Errorf("%s queued with %d replicas left, want %d", key, rec.RemainingReplicas, remaining)
+			}
+		}
+	})
+}
+
+// TestRunRepairPreempts checks that repairs of at-risk objects, and only
+// those, hold off background work while they run
+func TestRunRepairPreempts(t *testing.T) {
+	p := NewPreemption()
+	store := &queueStore{preempt: p}
+	w := NewWorker(Config{Metadata: store, Preemption: p})
+
+	for remaining, want := range []bool{true, true, false, false} {
+		rec := &metadata.RepairRecord{ID: "r1", ObjectID: "gone", IssueType: metadata.IssueUnderReplicated, RemainingReplicas: remaining}
+		if err := w.runRepair(context.Background(), rec, nil); !errors.Is(err, metadata.ErrObjectNotFound) {
+			t.Fatalf("runRepair: %v", err)
+		}
+		if store.preempted != want {
+			t.Errorf("repair with %d replicas left preempted = %t, want %t", remaining, store.preempted, want)
+		}
+		if preempted(p) {
+			t.Fatalf("still preempted after a repair with %d replicas left", remaining)
+		}
+	}
+}
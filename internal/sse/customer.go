@@ -0,0 +1,39 @@
+package sse
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// CustomerKeySize is the size of a customer-provided key. Data is sealed
+// with such a key as with a data key.
+const CustomerKeySize = DataKeySize
+
+// fingerprintSaltSize is the size of the salt of a key fingerprint
+const fingerprintSaltSize = 16
+
+// NewKeyFingerprint returns a random salt and the fingerprint of a
+// customer-provided key with it, to store in place of the key
+func NewKeyFingerprint(key []byte) (salt, fingerprint []byte, err error) {
+	salt = make([]byte, fingerprintSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	return salt, keyFingerprint(key, salt), nil
+}
+
+// MatchKeyFingerprint reports whether key is the key fingerprint was taken
+// of with salt
+func MatchKeyFingerprint(key, salt, fingerprint []byte) bool {
+	return hmac.Equal(keyFingerprint(key, salt), fingerprint)
+}
+
+// keyFingerprint returns the HMAC-SHA256 of key under salt. The salt keeps
+// equal keys from having equal fingerprints; the key's own entropy keeps
+// the fingerprint from giving it away.
+func keyFingerprint(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
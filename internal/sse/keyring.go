@@ -0,0 +1,168 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MasterKeySize is the size of a master key
+const MasterKeySize = 32
+
+// wrapVersion is the first byte of a wrapped data key, so the format can
+// change. Version 1 keys authenticate only the master key ID; version 2
+// keys also authenticate what the data key belongs to.
+const (
+	wrapVersion      = 2
+	wrapVersionKeyID = 1
+)
+
+var (
+	// ErrUnknownKey marks a data key wrapped with a master key the keyring
+	// does not hold
+	ErrUnknownKey = errors.New("unknown master key")
+
+	// ErrUnwrap marks a wrapped data key that cannot be unwrapped with the
+	// master key it names, because it is corrupt
+	ErrUnwrap = errors.New("data key cannot be unwrapped")
+)
+
+// keyIDPattern is what a master key ID may look like
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Keyring holds the master keys data keys are wrapped with. New data keys
+// are wrapped with the current key; the others are kept to unwrap the data
+// keys wrapped with them until those are rewrapped.
+type Keyring struct {
+	ids  []string // current first
+	keys map[string]cipher.AEAD
+}
+
+// LoadKeyring reads a keyfile, as ParseKeyring parses it
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(data)
+}
+
+// ParseKeyring parses a keyfile: a master key per line, as an ID and the
+// base64 key, such as `openssl rand -base64 32` prints one, separated by
+// white space. The first key is the current one. Blank lines and lines
+// starting with # are ignored.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyfile line %d: want a key ID and a base64 key", line)
+		}
+		id := fields[0]
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("keyfile line %d: key ID %q is not 1 to 64 letters, digits, '.', '_' or '-'", line, id)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("keyfile line %d: duplicate key ID %q", line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("keyfile line %d: key is not base64: %w", line, err)
+		}
+		if len(key) != MasterKeySize {
+			return nil, fmt.Errorf("keyfile line %d: key must be %d bytes, got %d", line, MasterKeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.ids = append(k.ids, id)
+		k.keys[id] = aead
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("keyfile holds no keys")
+	}
+	return k, nil
+}
+
+// CurrentKeyID returns the ID of the key new data keys are wrapped with
+func (k *Keyring) CurrentKeyID() string {
+	return k.ids[0]
+}
+
+// KeyIDs returns the IDs of every key, the current one first
+func (k *Keyring) KeyIDs() []string {
+	return append([]string(nil), k.ids...)
+}
+
+// Wrap encrypts a data key with the current master key and returns the
+// key's ID with the wrapped data key. owner names what the data key
+// belongs to, such as an object; the wrapped key only unwraps for the same
+// owner.
+func (k *Keyring) Wrap(dataKey []byte, owner string) (keyID string, wrapped []byte, err error) {
+	keyID = k.CurrentKeyID()
+	aead := k.keys[keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	// The key ID and owner are authenticated, so a wrapped key cannot be
+	// passed off as wrapped with another master key, or be moved to
+	// another object and decrypt its data
+	wrapped = append([]byte{wrapVersion}, nonce...)
+	return keyID, aead.Seal(wrapped, nonce, dataKey, wrapData(keyID, owner)), nil
+}
+
+// Unwrap decrypts a data key wrapped with master key keyID for owner. Keys
+// wrapped before owners were authenticated unwrap for any owner until they
+// are rewrapped.
+func (k *Keyring) Unwrap(keyID string, wrapped []byte, owner string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < 1+aead.NonceSize() {
+		return nil, ErrUnwrap
+	}
+	var additional []byte
+	switch wrapped[0] {
+	case wrapVersion:
+		additional = wrapData(keyID, owner)
+	case wrapVersionKeyID:
+		additional = []byte(keyID)
+	default:
+		return nil, ErrUnwrap
+	}
+	nonce := wrapped[1 : 1+aead.NonceSize()]
+	dataKey, err := aead.Open(nil, nonce, wrapped[1+aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrUnwrap
+	}
+	return dataKey, nil
+}
+
+// wrapData is the additional data a wrapped key authenticates. Key IDs
+// cannot hold a slash, so the two parts cannot run into each other.
+func wrapData(keyID, owner string) []byte {
+	return []byte(keyID + "/" + owner)
+}
@@ -0,0 +1,161 @@
+package sse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// masterKey returns a keyfile line for key ID id, with a key of b bytes
+func masterKey(id string, b byte) string {
+	return id + " " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, MasterKeySize)) + "\n"
+}
+
+func mustKeyring(t *testing.T, keyfile string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring([]byte(keyfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestParseKeyring(t *testing.T) {
+	k := mustKeyring(t, "# master keys\n\n"+masterKey("2025-06", 1)+"  "+masterKey("2024.old_key-1", 2))
+	if got := k.CurrentKeyID(); got != "2025-06" {
+		t.Errorf("current key %q, want the first", got)
+	}
+	if got := k.KeyIDs(); len(got) != 2 || got[1] != "2024.old_key-1" {
+		t.Errorf("key IDs %q", got)
+	}
+
+	tests := []struct {
+		name    string
+		keyfile string
+	}{
+		{"empty", "# nothing\n"},
+		{"no key", "k1\n"},
+		{"extra field", strings.TrimSuffix(masterKey("k1", 1), "\n") + " extra\n"},
+		{"bad key ID", masterKey("k/1", 1)},
+		{"duplicate key ID", masterKey("k1", 1) + masterKey("k1", 2)},
+		{"not base64", "k1 not-base64!\n"},
+		{"short key", "k1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseKeyring([]byte(tt.keyfile)); err == nil {
+				t.Fatal("keyfile accepted")
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	k := mustKeyring(t, masterKey("k1", 1)+masterKey("k2", 1))
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err := k.Wrap(dataKey, "object/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "k1" {
+		t.Errorf("wrapped with %q, want the current key", keyID)
+	}
+	got, err := k.Unwrap(keyID, wrapped, "object/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Error("unwrapped another key")
+	}
+
+	tampered := bytes.Clone(wrapped)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name    string
+		keyID   string
+		wrapped []byte
+		owner   string
+		want    error
+	}{
+		{"another owner", "k1", wrapped, "object/2", ErrUnwrap},
+		{"an upload with the object's ID", "k1", wrapped, "upload/1", ErrUnwrap},
+		// k2 is the same key as k1, but the key ID is authenticated
+		{"another key ID", "k2", wrapped, "object/1", ErrUnwrap},
+		{"unknown key ID", "k3", wrapped, "object/1", ErrUnknownKey},
+		{"tampered", "k1", tampered, "object/1", ErrUnwrap},
+		{"unknown version", "k1", append([]byte{9}, wrapped[1:]...), "object/1", ErrUnwrap},
+		{"truncated", "k1", wrapped[:5], "object/1", ErrUnwrap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := k.Unwrap(tt.keyID, tt.wrapped, tt.owner); !errors.Is(err, tt.want) {
+				t.Fatalf("Unwrap: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestWrapKeyIDOnly unwraps a data key wrapped before owners were
+// authenticated
+func TestWrapKeyIDOnly(t *testing.T) {
+	k := mustKeyring(t, masterKey("k1", 1))
+	dataKey := testKey(7)
+	aead := k.keys["k1"]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := aead.Seal(append([]byte{wrapVersionKeyID}, nonce...), nonce, dataKey, []byte("k1"))
+
+	got, err := k.Unwrap("k1", wrapped, "object/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Error("unwrapped another key")
+	}
+}
+
+// TestRotate rewraps a data key with a new master key, as the rotation
+// endpoint does
+func TestRotate(t *testing.T) {
+	before := mustKeyring(t, masterKey("old", 1))
+	dataKey := testKey(8)
+	oldID, oldWrapped, err := before.Wrap(dataKey, "upload/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is added in front, the old one kept to unwrap
+	during := mustKeyring(t, masterKey("new", 2)+masterKey("old", 1))
+	unwrapped, err := during.Unwrap(oldID, oldWrapped, "upload/1")
+	if err != nil {
+		t.Fatalf("unwrap with the old key: %v", err)
+	}
+	newID, newWrapped, err := during.Wrap(unwrapped, "upload/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID != "new" {
+		t.Fatalf("rewrapped with %q, want the new key", newID)
+	}
+
+	// Once every key is rewrapped the old key can go
+	after := mustKeyring(t, masterKey("new", 2))
+	got, err := after.Unwrap(newID, newWrapped, "upload/1")
+	if err != nil {
+		t.Fatalf("unwrap with the new key: %v", err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Error("rewrapped another key")
+	}
+	if _, err := after.Unwrap(oldID, oldWrapped, "upload/1"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unwrap with a removed key: %v, want ErrUnknownKey", err)
+	}
+}
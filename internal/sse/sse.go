@@ -0,0 +1,296 @@
+// Package sse encrypts object data at rest. The data of an object, or of
+// each part of a multipart object, is sealed with a data key as a stream: a
+// random salt followed by segments of up to SegmentSize bytes of plaintext,
+// each encrypted and authenticated with AES-256-GCM. A segment's nonce is
+// its index, with the last segment marked, so segments cannot be swapped,
+// dropped or cut short unnoticed, and any range of the plaintext can be
+// read by decrypting only the segments it covers.
+//
+// Every stream is encrypted with its own key, derived from the data key and
+// the salt, so parts of a multipart upload can share the upload's data key
+// and a part can be uploaded again without reusing a nonce.
+//
+// Data keys are stored wrapped with a master key from a Keyring, for the
+// object or upload they belong to. Rotating the master key rewraps the data
+// keys; the data is never rewritten.
+//
+// A customer-provided key (SSE-C) is used as the data key of the data it
+// seals. It is never stored; a salted fingerprint checks the key given to
+// read the data.
+package sse
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// AlgorithmAES256 is the x-amz-server-side-encryption value for data
+// encrypted with keys the gateway manages
+const AlgorithmAES256 = "AES256"
+
+// DataKeySize is the size of a data key
+const DataKeySize = 32
+
+// SegmentSize is the most plaintext a segment holds. Every segment but the
+// last of a stream holds exactly this much.
+const SegmentSize = 64 << 10
+
+const (
+	saltSize = 32
+	tagSize  = 16
+)
+
+// ErrDecrypt marks sealed data that fails authentication: it was sealed
+// with another key, or is corrupt
+var ErrDecrypt = errors.New("encrypted data failed authentication")
+
+// NewDataKey returns a random data key
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SealedSize returns the size of the stream that size bytes of plaintext
+// are sealed into
+func SealedSize(size int64) int64 {
+	return saltSize + size + segments(size)*tagSize
+}
+
+// segments returns the number of segments size bytes of plaintext are
+// sealed in. Empty plaintext still takes one, so it is authenticated too.
+func segments(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + SegmentSize - 1) / SegmentSize
+}
+
+// streamCipher returns the cipher of the stream sealed with dataKey and
+// salt
+func streamCipher(dataKey, salt []byte) (cipher.AEAD, error) {
+	if len(dataKey) != DataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", DataKeySize, len(dataKey))
+	}
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of segment index, the last of its stream
+// or not
+func segmentNonce(nonce []byte, index int64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce[:8], uint64(index))
+	nonce[8], nonce[9], nonce[10], nonce[11] = 0, 0, 0, 0
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealer reads plaintext and returns the stream it is sealed into
+type sealer struct {
+	aead  cipher.AEAD
+	r     io.Reader
+	index int64
+	buf   []byte // a segment of plaintext and the first byte of the next
+	n     int    // bytes in buf
+	out   []byte // sealed bytes not yet returned
+	done  bool   // the last segment has been sealed
+}
+
+// NewSealer returns a reader over the stream the plaintext read from r is
+// sealed into with dataKey. Errors reading r are returned as they are.
+func NewSealer(dataKey []byte, r io.Reader) (io.Reader, error) {
+	salt := make([]byte, saltSize, saltSize+SegmentSize+tagSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamCipher(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, r: r, buf: make([]byte, SegmentSize+1), out: salt}, nil
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// seal seals the next segment into out. The buffer is filled to one byte
+// past a segment, so the segment is known to be the last when it is not
+// filled.
+func (s *sealer) seal() error {
+	m, err := io.ReadFull(s.r, s.buf[s.n:])
+	s.n += m
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	size := min(s.n, SegmentSize)
+	var nonce [12]byte
+	s.out = s.aead.Seal(s.out[:0], segmentNonce(nonce[:], s.index, last), s.buf[:size], nil)
+	s.n = copy(s.buf, s.buf[size:s.n])
+	s.index++
+	s.done = last
+	return nil
+}
+
+// rangeReader decrypts a range of the plaintext of a sealed stream
+type rangeReader struct {
+	dataKey  []byte
+	size     int64 // plaintext in the stream
+	pos, end int64 // plaintext range still to return
+	open     func(offset, end int64) io.ReadCloser
+
+	aead      cipher.AEAD
+	src       io.ReadCloser // the sealed segments the range covers
+	index     int64         // next segment to read from src
+	lastIndex int64         // last segment of the stream
+	skip      int64         // plaintext before the range in the first segment
+	sealed    []byte
+	buf       []byte
+	plain     []byte // decrypted plaintext not yet returned
+	err       error
+}
+
+// NewRangeReader returns a reader over bytes [start, end) of the plaintext
+// of a stream sealed with dataKey that holds size bytes of plaintext. open
+// returns a reader over bytes [offset, end) of the sealed stream. It is not
+// called until the reader is first read, and then at most twice: for the
+// salt, and for the segments the range covers.
+func NewRangeReader(dataKey []byte, size, start, end int64, open func(offset, end int64) io.ReadCloser) io.ReadCloser {
+	return &rangeReader{dataKey: dataKey, size: size, pos: start, end: end, open: open}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		if r.err = r.next(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next segment of the range into plain
+func (r *rangeReader) next() error {
+	if r.src == nil {
+		if err := r.start(); err != nil {
+			return err
+		}
+	}
+	length := SegmentSize
+	if r.index == r.lastIndex {
+		length = int(r.size - r.index*SegmentSize)
+	}
+	sealed := r.sealed[:length+tagSize]
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return unexpectedEOF(err)
+	}
+	var nonce [12]byte
+	plain, err := r.aead.Open(r.buf[:0], segmentNonce(nonce[:], r.index, r.index == r.lastIndex), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d", ErrDecrypt, r.index)
+	}
+	r.index++
+	plain = plain[r.skip:]
+	r.skip = 0
+	if remaining := r.end - r.pos; int64(len(plain)) > remaining {
+		plain = plain[:remaining]
+	}
+	r.pos += int64(len(plain))
+	r.plain = plain
+	return nil
+}
+
+// start reads the salt and opens the segments the range covers
+func (r *rangeReader) start() error {
+	if r.pos < 0 || r.end > r.size || r.pos > r.end {
+		return fmt.Errorf("range %d-%d outside %d bytes of plaintext", r.pos, r.end, r.size)
+	}
+	r.lastIndex = segments(r.size) - 1
+	r.index = r.pos / SegmentSize
+	r.skip = r.pos - r.index*SegmentSize
+	offset := saltSize + r.index*(SegmentSize+tagSize)
+	end := SealedSize(r.size)
+	if last := (r.end - 1) / SegmentSize; last < r.lastIndex {
+		end = saltSize + (last+1)*(SegmentSize+tagSize)
+	}
+
+	salt := make([]byte, saltSize)
+	if r.index == 0 {
+		// The salt is followed by the first segment: read them together
+		r.src = r.open(0, end)
+		if _, err := io.ReadFull(r.src, salt); err != nil {
+			return unexpectedEOF(err)
+		}
+	} else {
+		src := r.open(0, saltSize)
+		_, err := io.ReadFull(src, salt)
+		src.Close()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		r.src = r.open(offset, end)
+	}
+
+	aead, err := streamCipher(r.dataKey, salt)
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.sealed = make([]byte, SegmentSize+tagSize)
+	r.buf = make([]byte, 0, SegmentSize)
+	return nil
+}
+
+// unexpectedEOF reports a sealed stream that ends early as
+// io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *rangeReader) Close() error {
+	if r.src != nil {
+		return r.src.Close()
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// seal returns plain sealed with dataKey
+func seal(t *testing.T, dataKey, plain []byte) []byte {
+	t.Helper()
+	r, err := NewSealer(dataKey, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// openRange decrypts bytes [start, end) of size bytes of plaintext sealed
+// in sealed, and returns how many times the sealed stream was opened
+func openRange(dataKey, sealed []byte, size, start, end int64) ([]byte, int, error) {
+	opened := 0
+	open := func(offset, end int64) io.ReadCloser {
+		opened++
+		end = min(end, int64(len(sealed)))
+		offset = min(offset, end)
+		return io.NopCloser(bytes.NewReader(sealed[offset:end]))
+	}
+	r := NewRangeReader(dataKey, size, start, end, open)
+	defer r.Close()
+	plain, err := io.ReadAll(r)
+	return plain, opened, err
+}
+
+// plaintext returns size random bytes
+func plaintext(size int) []byte {
+	p := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(p)
+	return p
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, DataKeySize)
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	key := testKey(1)
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 5} {
+		plain := plaintext(size)
+		sealed := seal(t, key, plain)
+		if int64(len(sealed)) != SealedSize(int64(size)) {
+			t.Errorf("%d bytes sealed into %d, SealedSize says %d", size, len(sealed), SealedSize(int64(size)))
+		}
+		got, _, err := openRange(key, sealed, int64(size), 0, int64(size))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: round trip returned %d different bytes", size, len(got))
+		}
+	}
+
+	// Streams of the same plaintext differ by their salt
+	if bytes.Equal(seal(t, key, []byte("x")), seal(t, key, []byte("x"))) {
+		t.Error("two seals of the same plaintext are equal")
+	}
+}
+
+func TestRangeReader(t *testing.T) {
+	const s = SegmentSize
+	const size = 3*s + 5
+	key := testKey(2)
+	plain := plaintext(size)
+	sealed := seal(t, key, plain)
+
+	tests := []struct {
+		name       string
+		start, end int64
+	}{
+		{"whole", 0, size},
+		{"empty", 7, 7},
+		{"first byte", 0, 1},
+		{"within a segment", 100, 200},
+		{"to a segment boundary", s - 10, s},
+		{"from a segment boundary", s, s + 10},
+		{"one byte either side of a boundary", s - 1, s + 1},
+		{"exactly one segment", s, 2 * s},
+		{"across two boundaries", s - 3, 2*s + 3},
+		{"into the last segment", 2*s + 1, size},
+		{"last byte", size - 1, size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, opened, err := openRange(key, sealed, size, tt.start, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain[tt.start:tt.end]) {
+				t.Errorf("read %d bytes, not the %d of the range", len(got), tt.end-tt.start)
+			}
+			if opened > 2 {
+				t.Errorf("sealed stream opened %d times", opened)
+			}
+		})
+	}
+
+	if _, _, err := openRange(key, sealed, size, 10, size+1); err == nil {
+		t.Error("range past the end read")
+	}
+}
+
+func TestRangeReaderRejects(t *testing.T) {
+	const s = SegmentSize
+	const size = 2*s + 100
+	key := testKey(3)
+	sealed := seal(t, key, plaintext(size))
+	segment := func(i int) (int, int) {
+		start := saltSize + i*(s+tagSize)
+		return start, min(start+s+tagSize, len(sealed))
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[saltSize+s+tagSize+10] ^= 1
+
+	flippedSalt := bytes.Clone(sealed)
+	flippedSalt[0] ^= 1
+
+	// The first two segments swapped
+	a0, a1 := segment(0)
+	b0, b1 := segment(1)
+	reordered := append(append(append(append([]byte(nil), sealed[:a0]...), sealed[b0:b1]...), sealed[a0:a1]...), sealed[b1:]...)
+
+	// The stream cut after its second segment, passed off as one of 2s bytes
+	_, cut := segment(1)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		size   int64
+		key    []byte
+	}{
+		{"flipped ciphertext byte", flipped, size, key},
+		{"flipped salt byte", flippedSalt, size, key},
+		{"reordered segments", reordered, size, key},
+		{"truncated last segment", sealed[:len(sealed)-1], size, key},
+		{"missing last segment", sealed[:cut], size, key},
+		{"cut at a segment boundary", sealed[:cut], 2 * s, key},
+		{"wrong key", sealed, size, testKey(4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := openRange(tt.key, tt.sealed, tt.size, 0, tt.size)
+			if !errors.Is(err, ErrDecrypt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("read: %v, want ErrDecrypt or io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+
+	// A range that covers only intact segments still reads
+	if _, _, err := openRange(key, flipped, size, 0, s); err != nil {
+		t.Errorf("range before the flipped segment: %v", err)
+	}
+}
+
+func TestSealerReadError(t *testing.T) {
+	failure := errors.New("read failed")
+	r, err := NewSealer(testKey(1), io.MultiReader(bytes.NewReader(plaintext(10)), &failingReader{failure}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, failure) {
+		t.Fatalf("ReadAll: %v, want the read error", err)
+	}
+	if _, err := NewSealer(make([]byte, 16), bytes.NewReader(nil)); err == nil {
+		t.Error("sealer made with a 16-byte key")
+	}
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read(p []byte) (int, error) { return 0, r.err }
+
+func TestKeyFingerprint(t *testing.T) {
+	key := testKey(5)
+	salt, fingerprint, err := NewKeyFingerprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !MatchKeyFingerprint(key, salt, fingerprint) {
+		t.Error("key does not match its fingerprint")
+	}
+	if MatchKeyFingerprint(testKey(6), salt, fingerprint) {
+		t.Error("another key matches the fingerprint")
+	}
+	salt2, fingerprint2, err := NewKeyFingerprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(salt, salt2) || bytes.Equal(fingerprint, fingerprint2) {
+		t.Error("two fingerprints of one key are equal")
+	}
+}